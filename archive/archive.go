@@ -0,0 +1,50 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"net/mail"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// CRLF converts the line endings of a message to CRLF.
+func CRLF(body []byte) []byte {
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(body, []byte("\n"), []byte("\r\n"))
+}
+
+// HeaderDate returns the date from the Date header of a message, or zero if
+// there isn't a valid one.
+func HeaderDate(body []byte) time.Time {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return time.Time{}
+	}
+
+	date, err := mail.ParseDate(hdr.Get("Date"))
+	if err != nil {
+		return time.Time{}
+	}
+
+	return date
+}
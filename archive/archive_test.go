@@ -0,0 +1,338 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/internal/imaptest"
+)
+
+type sliceReader struct {
+	messages []*Message
+}
+
+func (r *sliceReader) Next() (*Message, error) {
+	if len(r.messages) == 0 {
+		return nil, io.EOF
+	}
+
+	msg := r.messages[0]
+	r.messages = r.messages[1:]
+	return msg, nil
+}
+
+func (r *sliceReader) Close() error {
+	return nil
+}
+
+// testSink records the subjects of delivered messages, failing those in errors.
+type testSink struct {
+	mu       sync.Mutex
+	errors   map[string]error
+	subjects []string
+}
+
+func (s *testSink) Deliver(_ string, _ []string, _ time.Time, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subject := strings.TrimPrefix(strings.SplitN(string(body), "\r\n", 2)[0], "Subject: ")
+	if err, ok := s.errors[subject]; ok {
+		return err
+	}
+
+	s.subjects = append(s.subjects, subject)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func newTestClient(t *testing.T, sink ingest.Sink) ingest.Client {
+	client, err := ingest.NewClient(&ingest.Config{Sink: sink})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func testMessages(n int) []*Message {
+	var msgs []*Message
+	for i := 0; i < n; i++ {
+		key := string(rune('a' + i))
+		msgs = append(msgs, &Message{Key: key, Body: []byte("Subject: " + key + "\r\n\r\nHello\r\n")})
+	}
+	return msgs
+}
+
+func TestEMLReader(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "2016"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "2016", "b.eml"), []byte("Subject: b\n\nHello\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "a.EML"), []byte("Date: Wed, 11 May 2016 14:31:59 +0000\nSubject: a\n\nHello\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("Not a message"), 0600))
+
+	mtime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filepath.Join(dir, "2016", "b.eml"), mtime, mtime))
+
+	r, err := NewEMLReader(dir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer r.Close()
+
+	msg, err := r.Next()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "2016/b.eml", msg.Key)
+		assert.True(t, mtime.Equal(msg.Date))
+		assert.Equal(t, "Subject: b\r\n\r\nHello\r\n", string(msg.Body))
+	}
+
+	msg, err = r.Next()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "a.EML", msg.Key)
+		assert.True(t, time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC).Equal(msg.Date))
+	}
+
+	_, err = r.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestImport(t *testing.T) {
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	sink := &testSink{errors: map[string]error{"c": errors.New("try again")}}
+
+	stats, err := Import(&ImportConfig{
+		Reader:     &sliceReader{messages: testMessages(5)},
+		Clients:    []ingest.Client{newTestClient(t, sink), newTestClient(t, sink)},
+		Checkpoint: checkpoint,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Read: 5, Imported: 4, Failed: 1}, stats)
+	assert.ElementsMatch(t, []string{"a", "b", "d", "e"}, sink.subjects)
+
+	// Resuming only retries the failure
+	sink.errors = nil
+	sink.subjects = nil
+
+	stats, err = Import(&ImportConfig{
+		Reader:     &sliceReader{messages: testMessages(5)},
+		Clients:    []ingest.Client{newTestClient(t, sink)},
+		Checkpoint: checkpoint,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Read: 5, Imported: 1, Skipped: 4}, stats)
+	assert.Equal(t, []string{"c"}, sink.subjects)
+}
+
+func TestImportStop(t *testing.T) {
+	stop := make(chan struct{})
+	close(stop)
+
+	stats, err := Import(&ImportConfig{
+		Reader:  &sliceReader{messages: testMessages(5)},
+		Clients: []ingest.Client{newTestClient(t, &testSink{})},
+		Stop:    stop,
+	})
+	assert.ErrorIs(t, err, ErrStopped)
+	assert.Equal(t, Stats{}, stats)
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	assert.NoError(t, os.WriteFile(path, []byte("\"a\"\n\"b\\nc\"\n\"d"), 0600))
+
+	cp, err := openCheckpoint(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, cp.Done("a"))
+	assert.True(t, cp.Done("b\nc"))
+	assert.False(t, cp.Done("d"))
+
+	assert.NoError(t, cp.Add("d"))
+	assert.NoError(t, cp.Close())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "\"a\"\n\"b\\nc\"\n\"d\"\n", string(data))
+
+	assert.NoError(t, os.WriteFile(path, []byte("garbage\n"), 0600))
+	_, err = openCheckpoint(path)
+	assert.Error(t, err)
+}
+
+func TestEMLSink(t *testing.T) {
+	dir := t.TempDir()
+	sink, err := NewEMLSink(dir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	date := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	body := []byte("Subject: one\r\n\r\nbody\r\n")
+
+	assert.NoError(t, sink.Deliver("", nil, date, body))
+	assert.NoError(t, sink.Deliver("", nil, date, body))
+	assert.NoError(t, sink.Deliver("Lists/Go", nil, date, []byte("Subject: two\r\n\r\n")))
+
+	for _, mailbox := range []string{"../escape", "Lists//Go", "a\\b"} {
+		err := sink.Deliver(mailbox, nil, date, body)
+		assert.True(t, delivery.IsPermanent(err), mailbox)
+	}
+
+	inbox, _ := filepath.Glob(filepath.Join(dir, "INBOX", "*.eml"))
+	if assert.Len(t, inbox, 1) {
+		assert.True(t, strings.HasPrefix(filepath.Base(inbox[0]), "20220102-030405-"))
+
+		data, err := os.ReadFile(inbox[0])
+		assert.NoError(t, err)
+		assert.Equal(t, body, data)
+
+		st, err := os.Stat(inbox[0])
+		assert.NoError(t, err)
+		assert.True(t, st.ModTime().Equal(date))
+	}
+
+	lists, _ := filepath.Glob(filepath.Join(dir, "Lists", "Go", "*.eml"))
+	assert.Len(t, lists, 1)
+}
+
+func TestExport(t *testing.T) {
+	_, addr, mailbox := internal.BuildTestIMAPServer(t)
+
+	addMessage := func(uid uint32, subject string) {
+		body := []byte("Subject: " + subject + "\r\n\r\nbody\r\n")
+		mailbox.Messages = append(mailbox.Messages, &memory.Message{
+			Uid:  uid,
+			Date: time.Now(),
+			Size: uint32(len(body)),
+			Body: body,
+		})
+	}
+
+	for i, subject := range []string{"one", "two", "three"} {
+		addMessage(uint32(i+1), subject)
+	}
+
+	c := imaptest.Connect(t, addr)
+
+	sink := &testSink{}
+	path := filepath.Join(t.TempDir(), "state.json")
+	state, err := OpenStateFile(path)
+	assert.NoError(t, err)
+
+	export := func() (ExportStats, error) {
+		return Export(&ExportConfig{
+			Client:    c,
+			Mailbox:   "INBOX",
+			Ingest:    newTestClient(t, sink),
+			Source:    "imap://username@test/INBOX",
+			State:     state,
+			BatchSize: 2,
+		})
+	}
+
+	stats, err := export()
+	assert.NoError(t, err)
+	assert.Equal(t, ExportStats{Exported: 3}, stats)
+	assert.Equal(t, []string{"one", "two", "three"}, sink.subjects)
+
+	// Nothing was changed on the server
+	if assert.Len(t, mailbox.Messages, 3) {
+		assert.Empty(t, mailbox.Messages[0].Flags)
+	}
+
+	// Only new messages are exported
+	addMessage(4, "four")
+	stats, err = export()
+	assert.NoError(t, err)
+	assert.Equal(t, ExportStats{Exported: 1, Skipped: 3}, stats)
+	assert.Equal(t, []string{"one", "two", "three", "four"}, sink.subjects)
+
+	state, err = OpenStateFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ExportState{UIDValidity: 1, LastUID: 4}, state.Get("imap://username@test/INBOX"))
+
+	// A new UIDVALIDITY starts again
+	assert.NoError(t, state.Set("imap://username@test/INBOX", ExportState{UIDValidity: 2, LastUID: 4}))
+	sink.subjects = nil
+	stats, err = export()
+	assert.NoError(t, err)
+	assert.Equal(t, ExportStats{Exported: 4}, stats)
+}
+
+func TestExportFailure(t *testing.T) {
+	_, addr, mailbox := internal.BuildTestIMAPServer(t)
+
+	for i, subject := range []string{"one", "two", "three", "four"} {
+		body := []byte("Subject: " + subject + "\r\n\r\n")
+		mailbox.Messages = append(mailbox.Messages, &memory.Message{
+			Uid:  uint32(i + 1),
+			Date: time.Now(),
+			Size: uint32(len(body)),
+			Body: body,
+		})
+	}
+
+	c := imaptest.Connect(t, addr)
+
+	sink := &testSink{errors: map[string]error{
+		"two":   &delivery.PermanentError{Err: errors.New("too big")},
+		"three": errors.New("disk full"),
+	}}
+	state, err := OpenStateFile(filepath.Join(t.TempDir(), "state.json"))
+	assert.NoError(t, err)
+
+	stats, err := Export(&ExportConfig{
+		Client:  c,
+		Mailbox: "INBOX",
+		Ingest:  newTestClient(t, sink),
+		Source:  "test",
+		State:   state,
+		Delete:  true,
+	})
+	assert.EqualError(t, err, "disk full")
+	assert.Equal(t, ExportStats{Exported: 1, Failed: 1}, stats)
+
+	// The rejected message is skipped, the failed one is tried again next time
+	assert.Equal(t, uint32(2), state.Get("test").LastUID)
+
+	// Only the exported message was deleted
+	var uids []uint32
+	for _, msg := range mailbox.Messages {
+		uids = append(uids, msg.Uid)
+	}
+	assert.Equal(t, []uint32{2, 3, 4}, uids)
+}
@@ -0,0 +1,108 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// checkpoint records the keys of imported messages, one quoted key per line.
+type checkpoint struct {
+	mu   sync.Mutex
+	file *os.File
+	w    *bufio.Writer
+	done map[string]bool
+}
+
+func openCheckpoint(path string) (*checkpoint, error) {
+	c := &checkpoint{done: map[string]bool{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// A crash may have left a partial line at the end. It's dropped, and the
+	// message is imported again.
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		key, err := strconv.Unquote(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: invalid checkpoint entry", path, i+1)
+		}
+		c.done[key] = true
+	}
+
+	if c.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		return nil, err
+	}
+
+	if err := c.file.Truncate(int64(len(data))); err != nil {
+		_ = c.file.Close()
+		return nil, err
+	}
+	c.w = bufio.NewWriter(c.file)
+
+	return c, nil
+}
+
+// Done checks if a message has already been imported.
+func (c *checkpoint) Done(key string) bool {
+	return c.done[key]
+}
+
+// Add records an imported message.
+func (c *checkpoint) Add(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.w.WriteString(strconv.Quote(key) + "\n")
+	return err
+}
+
+// Sync flushes the checkpoint to disk.
+func (c *checkpoint) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+func (c *checkpoint) Close() error {
+	err := c.Sync()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
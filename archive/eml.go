@@ -0,0 +1,184 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewEMLReader reads the .eml files in a directory and its subdirectories, in
+// order of their paths. Each file is a single message, dated by its Date
+// header, or its modification time if there isn't one.
+func NewEMLReader(root string) (Reader, error) {
+	r := &emlReader{root: root}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".eml") {
+			r.paths = append(r.paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(r.paths)
+	return r, nil
+}
+
+func (r *emlReader) Next() (*Message, error) {
+	if r.next >= len(r.paths) {
+		return nil, io.EOF
+	}
+
+	path := r.paths[r.next]
+	r.next++
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return nil, err
+	}
+
+	date := HeaderDate(body)
+	if date.IsZero() {
+		st, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		date = st.ModTime()
+	}
+
+	return &Message{
+		Key:  filepath.ToSlash(rel),
+		Date: date,
+		Body: CRLF(body),
+	}, nil
+}
+
+func (r *emlReader) Close() error {
+	return nil
+}
+
+// NewEMLSink creates an ingest.Sink that writes each message to its own .eml
+// file, in a directory per mailbox. Files are named by date and a hash of the
+// message, so delivering the same message twice writes it once.
+func NewEMLSink(path string) (ingest.Sink, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &emlSink{path: path}, nil
+}
+
+// EMLFolderPath returns the directory of a mailbox, relative to the root. An
+// empty name is INBOX.
+func EMLFolderPath(name string) (string, error) {
+	if name == "" {
+		name = "INBOX"
+	}
+
+	var parts []string
+	for _, p := range strings.Split(name, "/") {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, "\\\x00") {
+			return "", ErrInvalidMailbox
+		}
+		parts = append(parts, p)
+	}
+
+	return filepath.Join(parts...), nil
+}
+
+func (s *emlSink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	rel, err := EMLFolderPath(mailbox)
+	if err != nil {
+		return &delivery.PermanentError{Err: err}
+	}
+
+	dir := filepath.Join(s.path, rel)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(body)
+	name := date.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(sum[:8]) + ".eml"
+	path := filepath.Join(dir, name)
+
+	if _, err := os.Stat(path); err == nil {
+		log.WithField("path", path).Trace("eml_exists")
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && !date.IsZero() {
+		err = os.Chtimes(tmp.Name(), date, date)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"mailbox": mailbox,
+		"path":    path,
+	}).Trace("eml_delivered")
+	return nil
+}
+
+func (s *emlSink) Close() error {
+	return nil
+}
@@ -0,0 +1,268 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal/fsutil"
+)
+
+// peekSection fetches the whole message without setting \Seen, which would
+// otherwise happen on a read-write mailbox.
+var peekSection = &imap.BodySectionName{Peek: true}
+
+// OpenStateFile opens a file of export states, keyed by mailbox. It's
+// created when first saved.
+func OpenStateFile(path string) (*StateFile, error) {
+	f := &StateFile{path: path, states: map[string]ExportState{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &f.states); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Get returns the state of a mailbox, or the zero state if there isn't one.
+func (f *StateFile) Get(key string) ExportState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.states[key]
+}
+
+// Set records the state of a mailbox, and saves the file. The file is
+// replaced, so it's never left half-written.
+func (f *StateFile) Set(key string, state ExportState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.states[key] = state
+
+	data, err := json.MarshalIndent(f.states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsutil.WriteFileAtomic(f.path, append(data, '\n'))
+}
+
+// Export copies the messages in a mailbox that haven't been exported before.
+// Nothing on the server is changed, unless Delete is set. Messages the
+// destination permanently rejects are logged and skipped, but any other
+// failure stops the export there, so the message is tried again next time.
+func Export(cfg *ExportConfig) (ExportStats, error) {
+	var stats ExportStats
+
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = 100
+	}
+
+	key := cfg.Key
+	if key == "" {
+		key = cfg.Source
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+	logger = logger.WithField("mailbox", cfg.Mailbox)
+
+	status, err := cfg.Client.Select(cfg.Mailbox, !cfg.Delete)
+	if err != nil {
+		return stats, err
+	}
+
+	var state ExportState
+	if cfg.State != nil {
+		state = cfg.State.Get(key)
+	}
+
+	if state.UIDValidity != status.UidValidity {
+		if state.UIDValidity != 0 {
+			// The old UIDs mean nothing now, start again
+			logger.WithFields(log.Fields{
+				"old_uid_validity": state.UIDValidity,
+				"uid_validity":     status.UidValidity,
+			}).Warn("export_uid_validity_changed")
+		}
+		state = ExportState{UIDValidity: status.UidValidity}
+	}
+
+	saveState := func() error {
+		if cfg.State == nil {
+			return nil
+		}
+		return cfg.State.Set(key, state)
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Since = cfg.Since
+	criteria.Before = cfg.Before
+
+	uids, err := cfg.Client.UidSearch(criteria)
+	if err != nil {
+		return stats, err
+	}
+
+	var pending []uint32
+	for _, uid := range uids {
+		if uid > state.LastUID {
+			pending = append(pending, uid)
+		} else {
+			stats.Skipped++
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i] < pending[j] })
+
+	logger.WithFields(log.Fields{
+		"uid_validity": state.UIDValidity,
+		"last_uid":     state.LastUID,
+		"count":        len(pending),
+		"skipped":      stats.Skipped,
+	}).Info("export_started")
+
+	for len(pending) > 0 {
+		select {
+		case <-cfg.Stop:
+			return stats, ErrStopped
+		default:
+		}
+
+		batch := pending
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		pending = pending[len(batch):]
+
+		msgs, err := fetchBatch(cfg, batch)
+		if err != nil {
+			return stats, err
+		}
+
+		var exported []uint32
+		for _, msg := range msgs {
+			err := ingest.IngestCopySync(cfg.Source, cfg.TargetMailbox, cfg.Ingest, msg, 0)
+			if err != nil && !delivery.IsPermanent(err) {
+				logger.WithError(err).WithField("uid", msg.Uid).Error("export_message_failed")
+				if serr := saveState(); serr != nil {
+					return stats, serr
+				}
+				return stats, deleteExported(cfg, exported, err)
+			}
+
+			if err != nil {
+				logger.WithError(err).WithField("uid", msg.Uid).Warn("export_message_rejected")
+				stats.Failed++
+			} else {
+				exported = append(exported, msg.Uid)
+				stats.Exported++
+			}
+
+			state.LastUID = msg.Uid
+		}
+
+		// Save before deleting, so messages are never exported twice
+		if err := saveState(); err != nil {
+			return stats, err
+		}
+
+		if err := deleteExported(cfg, exported, nil); err != nil {
+			return stats, err
+		}
+
+		logger.WithFields(log.Fields{
+			"exported":  stats.Exported,
+			"failed":    stats.Failed,
+			"remaining": len(pending),
+			"last_uid":  state.LastUID,
+		}).Info("export_progress")
+	}
+
+	// Make sure a new UIDVALIDITY is recorded, even if there's nothing to export
+	return stats, saveState()
+}
+
+// deleteExported deletes and expunges messages if Delete is set, returning
+// err unless that fails.
+func deleteExported(cfg *ExportConfig, uids []uint32, err error) error {
+	if !cfg.Delete || len(uids) == 0 {
+		return err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	if derr := cfg.Client.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); derr != nil {
+		return derr
+	}
+
+	if derr := cfg.Client.Expunge(nil); derr != nil {
+		return derr
+	}
+
+	return err
+}
+
+// fetchBatch fetches a set of messages, ordered by UID.
+func fetchBatch(cfg *ExportConfig, uids []uint32) ([]*imap.Message, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, peekSection.FetchItem()}
+
+	ch := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.Client.UidFetch(seqset, items, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		// Expunged since the search
+		if msg.Uid == 0 || msg.GetBody(rfc822Section) == nil {
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+	return msgs, nil
+}
@@ -0,0 +1,256 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+type importer struct {
+	cfg        ImportConfig
+	checkpoint *checkpoint
+	uid        uint32
+
+	mu    sync.Mutex
+	stats Stats
+	err   error
+
+	// abort is closed if the import can't continue.
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+// Import reads every message from an archive and ingests it. Messages that
+// fail are logged and counted, and the import carries on.
+func Import(cfg *ImportConfig) (Stats, error) {
+	im := &importer{cfg: *cfg, abort: make(chan struct{})}
+
+	if len(im.cfg.Clients) == 0 {
+		return Stats{}, ErrNoClients
+	}
+
+	if im.cfg.ProgressInterval == 0 {
+		im.cfg.ProgressInterval = 10 * time.Second
+	}
+
+	if im.cfg.Logger == nil {
+		im.cfg.Logger = log.NewEntry(log.StandardLogger())
+	}
+
+	if im.cfg.Checkpoint != "" {
+		cp, err := openCheckpoint(im.cfg.Checkpoint)
+		if err != nil {
+			return Stats{}, err
+		}
+		im.checkpoint = cp
+
+		im.cfg.Logger.WithFields(log.Fields{
+			"checkpoint": im.cfg.Checkpoint,
+			"count":      len(cp.done),
+		}).Info("import_checkpoint_loaded")
+	}
+
+	start := time.Now()
+	jobs := make(chan *Message)
+
+	wg := sync.WaitGroup{}
+	for _, client := range im.cfg.Clients {
+		wg.Add(1)
+		go func(client ingest.Client) {
+			defer wg.Done()
+			im.worker(client, jobs)
+		}(client)
+	}
+
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	go func() {
+		defer close(progressStopped)
+		im.reportProgress(start, progressDone)
+	}()
+
+	err := im.feed(jobs)
+
+	close(jobs)
+	wg.Wait()
+	close(progressDone)
+	<-progressStopped
+
+	if im.checkpoint != nil {
+		if cerr := im.checkpoint.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	im.mu.Lock()
+	stats := im.stats
+	if err == nil {
+		err = im.err
+	}
+	im.mu.Unlock()
+
+	im.logProgress(start, stats).Info("import_finished")
+	return stats, err
+}
+
+// feed reads messages from the archive, and hands out the ones that haven't
+// already been imported.
+func (im *importer) feed(jobs chan<- *Message) error {
+	for {
+		select {
+		case <-im.cfg.Stop:
+			return ErrStopped
+		default:
+		}
+
+		msg, err := im.cfg.Reader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		im.mu.Lock()
+		im.stats.Read++
+		skip := im.checkpoint != nil && im.checkpoint.Done(msg.Key)
+		if skip {
+			im.stats.Skipped++
+		}
+		im.mu.Unlock()
+
+		if skip {
+			continue
+		}
+
+		select {
+		case jobs <- msg:
+		case <-im.cfg.Stop:
+			return ErrStopped
+		case <-im.abort:
+			return nil
+		}
+	}
+}
+
+func (im *importer) worker(client ingest.Client, jobs <-chan *Message) {
+	for msg := range jobs {
+		err := im.ingest(client, msg)
+
+		im.mu.Lock()
+		if err != nil {
+			im.stats.Failed++
+		} else {
+			im.stats.Imported++
+		}
+		im.mu.Unlock()
+
+		if err != nil {
+			im.cfg.Logger.WithError(err).WithField("key", msg.Key).Error("import_message_failed")
+			continue
+		}
+
+		im.cfg.Logger.WithField("key", msg.Key).Debug("import_message_imported")
+
+		if im.checkpoint == nil {
+			continue
+		}
+
+		// Without the checkpoint, resuming would duplicate messages
+		if err := im.checkpoint.Add(msg.Key); err != nil {
+			im.fail(err)
+		}
+	}
+}
+
+func (im *importer) fail(err error) {
+	im.abortOnce.Do(func() {
+		im.mu.Lock()
+		im.err = err
+		im.mu.Unlock()
+
+		im.cfg.Logger.WithError(err).Error("import_checkpoint_failed")
+		close(im.abort)
+	})
+}
+
+func (im *importer) ingest(client ingest.Client, msg *Message) error {
+	uid := atomic.AddUint32(&im.uid, 1)
+
+	imsg := imap.NewMessage(uid, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822})
+	imsg.Uid = uid
+	imsg.Flags = msg.Flags
+	imsg.InternalDate = msg.Date
+	imsg.Body[rfc822Section] = bytes.NewBuffer(msg.Body)
+
+	return ingest.IngestMessageSyncTimeout(im.cfg.Source, im.cfg.Mailbox, client, imsg, 0)
+}
+
+func (im *importer) reportProgress(start time.Time, done <-chan struct{}) {
+	ticker := time.NewTicker(im.cfg.ProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			im.mu.Lock()
+			stats := im.stats
+			im.mu.Unlock()
+
+			im.logProgress(start, stats).Info("import_progress")
+
+			if im.checkpoint != nil {
+				if err := im.checkpoint.Sync(); err != nil {
+					im.fail(err)
+				}
+			}
+		}
+	}
+}
+
+func (im *importer) logProgress(start time.Time, stats Stats) *log.Entry {
+	elapsed := time.Since(start)
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = math.Round(float64(stats.Imported)/elapsed.Seconds()*10) / 10
+	}
+
+	return im.cfg.Logger.WithFields(log.Fields{
+		"read":     stats.Read,
+		"imported": stats.Imported,
+		"skipped":  stats.Skipped,
+		"failed":   stats.Failed,
+		"elapsed":  elapsed.Round(time.Second).String(),
+		"rate":     rate,
+	})
+}
@@ -0,0 +1,182 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package archive
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrNoClients = errors.New("no ingest clients")
+	ErrStopped   = errors.New("stopped")
+
+	ErrInvalidMailbox = errors.New("invalid mailbox name")
+)
+
+// Message is a message read from an archive.
+type Message struct {
+	// Key identifies the message within the archive. It is recorded in the
+	// checkpoint file, so must be the same each time the archive is read.
+	Key string
+
+	Flags []string
+
+	// Date is the internal date of the message. If zero, the destination
+	// picks one.
+	Date time.Time
+
+	// Body is the raw message, with CRLF line endings.
+	Body []byte
+}
+
+// Reader reads the messages from an archive, in order.
+type Reader interface {
+	// Next returns the next message, or io.EOF when there are no more.
+	Next() (*Message, error)
+
+	Close() error
+}
+
+type ImportConfig struct {
+	Reader Reader
+
+	// Clients are the destinations to ingest into. Each is given one message
+	// at a time, so there are as many messages in flight as clients.
+	Clients []ingest.Client
+
+	// Mailbox is the mailbox to ingest into.
+	Mailbox string
+
+	// Source is passed to the destination as the source of each message.
+	Source string
+
+	// Checkpoint, if set, is a file that the keys of imported messages are
+	// appended to. Messages already in it are skipped, so an interrupted
+	// import can be resumed.
+	Checkpoint string
+
+	// ProgressInterval is how often progress is logged. Defaults to 10 seconds.
+	ProgressInterval time.Duration
+
+	// Stop, if closed, stops the import once the messages in flight are done.
+	Stop <-chan struct{}
+
+	Logger *log.Entry
+}
+
+// Stats are the results of an import.
+type Stats struct {
+	// Read is the number of messages read from the archive.
+	Read int
+
+	// Imported is the number of messages ingested.
+	Imported int
+
+	// Skipped is the number of messages skipped, as they were in the checkpoint.
+	Skipped int
+
+	// Failed is the number of messages that couldn't be ingested. They're
+	// retried if the import is resumed.
+	Failed int
+}
+
+type ExportConfig struct {
+	// Client is connected to the server to export from.
+	Client imap2.Client
+
+	// Mailbox is the mailbox to export. It is opened read-only, unless Delete
+	// is set.
+	Mailbox string
+
+	// Ingest is where messages are written to.
+	Ingest ingest.Client
+
+	// TargetMailbox is the mailbox to write to.
+	TargetMailbox string
+
+	// Source is passed to the destination as the source of each message.
+	Source string
+
+	// State, if set, records the UIDVALIDITY of the mailbox and the last UID
+	// exported. Later exports then only write new messages.
+	State *StateFile
+
+	// Key is the key of the mailbox in State. It should identify the server,
+	// user, and mailbox. Defaults to Source.
+	Key string
+
+	// Since and Before, if set, limit the export to messages received in
+	// that range, by their internal date.
+	Since  time.Time
+	Before time.Time
+
+	// Delete removes messages from the source once they've been written.
+	Delete bool
+
+	// BatchSize is the number of messages fetched at a time. Defaults to 100.
+	BatchSize int
+
+	// Stop, if closed, stops the export after the current batch.
+	Stop <-chan struct{}
+
+	Logger *log.Entry
+}
+
+// ExportStats are the results of an export.
+type ExportStats struct {
+	// Exported is the number of messages written.
+	Exported int
+
+	// Skipped is the number of messages skipped, as they were exported before.
+	Skipped int
+
+	// Failed is the number of messages the destination permanently rejected.
+	// They won't be tried again.
+	Failed int
+}
+
+// ExportState is the progress of an export of a single mailbox.
+type ExportState struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	LastUID     uint32 `json:"last_uid"`
+}
+
+// StateFile holds the ExportState of any number of mailboxes. It's safe for
+// concurrent use.
+type StateFile struct {
+	path   string
+	mu     sync.Mutex
+	states map[string]ExportState
+}
+
+type emlSink struct {
+	path string
+}
+
+type emlReader struct {
+	root  string
+	paths []string
+	next  int
+}
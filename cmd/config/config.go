@@ -24,11 +24,15 @@ import (
 	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"git.vs49688.net/zane/mailpump/imap"
 	"git.vs49688.net/zane/mailpump/pump"
 )
 
+var (
+	ErrOnceUnsupported = errors.New("--once is only supported for IMAP sources")
+)
+
 func makeFlagNames(name string, prefix string) (string, string, []string) {
 	name = strings.ToLower(name)
 	prefix = strings.ToLower(prefix)
@@ -46,6 +50,77 @@ func makeFlagNames(name string, prefix string) (string, string, []string) {
 	return prefix + "-" + name, desc, []string{env}
 }
 
+// makeLogParameters makes the --log-level and --log-format flags.
+func makeLogParameters(level *string, format *string, defLevel string, defFormat string) []cli.Flag {
+	var flags []cli.Flag
+
+	name, usage, envs := makeFlagNames("log-level", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       usage,
+		EnvVars:     envs,
+		Destination: level,
+		Value:       defLevel,
+	})
+
+	name, _, envs = makeFlagNames("log-format", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "log format (text/json)",
+		EnvVars:     envs,
+		Destination: format,
+		Value:       defFormat,
+	})
+
+	return flags
+}
+
+// makeIngestTuningParameters makes the flags tuning how the dest ingests
+// messages. The --quota-threshold flag is left out if quotaThreshold is nil.
+func makeIngestTuningParameters(checkDuplicates *bool, normalise *bool, quotaThreshold *float64) []cli.Flag {
+	var flags []cli.Flag
+
+	name, _, envs := makeFlagNames("check-duplicates", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "search the destination for an existing copy before appending",
+		EnvVars:     envs,
+		Destination: checkDuplicates,
+	})
+
+	name, _, envs = makeFlagNames("normalise", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "repair line endings, NULs, and over-long lines before appending",
+		EnvVars:     envs,
+		Destination: normalise,
+	})
+
+	if quotaThreshold != nil {
+		name, _, envs = makeFlagNames("quota-threshold", "")
+		flags = append(flags, &cli.Float64Flag{
+			Name:        name,
+			Usage:       "fraction of the dest storage quota at which to pause. 0 to disable",
+			EnvVars:     envs,
+			Destination: quotaThreshold,
+		})
+	}
+
+	return flags
+}
+
+// SetupLogger sets the level and format of a logger from the --log-level and
+// --log-format flags. An invalid level is ignored.
+func SetupLogger(logger *log.Logger, level string, format string) {
+	if logLevel, err := log.ParseLevel(level); err == nil {
+		logger.SetLevel(logLevel)
+	}
+
+	if format == "json" {
+		logger.SetFormatter(&log.JSONFormatter{})
+	}
+}
+
 func DefaultConfig() CliConfig {
 	return CliConfig{
 		Source:               DefaultIMAPConfig(),
@@ -57,6 +132,14 @@ func DefaultConfig() CliConfig {
 		DisableDeletions:     false,
 		FetchBufferSize:      20,
 		FetchMaxInterval:     5 * time.Minute,
+		CheckDuplicates:      false,
+		Normalise:            false,
+		QuotaThreshold:       0,
+		RejectMailbox:        "",
+		ShutdownTimeout:      30 * time.Second,
+		Once:                 false,
+		DryRun:               false,
+		DryRunFormat:         "table",
 	}
 }
 
@@ -70,23 +153,7 @@ func (cfg *CliConfig) Parameters() []cli.Flag {
 	flags = append(flags, cfg.Source.makeIMAPParameters("source")...)
 	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
 
-	name, usage, envs = makeFlagNames("log-level", "")
-	flags = append(flags, &cli.StringFlag{
-		Name:        name,
-		Usage:       usage,
-		EnvVars:     envs,
-		Destination: &cfg.LogLevel,
-		Value:       def.LogLevel,
-	})
-
-	name, _, envs = makeFlagNames("log-format", "")
-	flags = append(flags, &cli.StringFlag{
-		Name:        name,
-		Usage:       "log format (text/json)",
-		EnvVars:     envs,
-		Destination: &cfg.LogFormat,
-		Value:       def.LogFormat,
-	})
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
 
 	name, _, envs = makeFlagNames("idle-fallback-interval", "")
 	flags = append(flags, &cli.DurationFlag{
@@ -134,6 +201,53 @@ func (cfg *CliConfig) Parameters() []cli.Flag {
 		Value:       def.FetchMaxInterval,
 	})
 
+	flags = append(flags, makeIngestTuningParameters(&cfg.CheckDuplicates, &cfg.Normalise, &cfg.QuotaThreshold)...)
+
+	name, _, envs = makeFlagNames("reject-mailbox", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "source mailbox to move messages the dest permanently rejects to",
+		EnvVars:     envs,
+		Destination: &cfg.RejectMailbox,
+		Value:       def.RejectMailbox,
+	})
+
+	name, _, envs = makeFlagNames("shutdown-timeout", "")
+	flags = append(flags, &cli.DurationFlag{
+		Name:        name,
+		Usage:       "how long to wait on shutdown for fetched messages to be delivered and deleted. 0 to stop at once",
+		EnvVars:     envs,
+		Destination: &cfg.ShutdownTimeout,
+		Value:       def.ShutdownTimeout,
+	})
+
+	name, _, envs = makeFlagNames("once", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "drain the source once and exit, instead of waiting for new mail. IMAP sources only",
+		EnvVars:     envs,
+		Destination: &cfg.Once,
+		Value:       def.Once,
+	})
+
+	name, _, envs = makeFlagNames("dry-run", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "print what would be pumped, without appending or deleting anything. IMAP sources only",
+		EnvVars:     envs,
+		Destination: &cfg.DryRun,
+		Value:       def.DryRun,
+	})
+
+	name, _, envs = makeFlagNames("dry-run-format", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "dry run output format (table/json)",
+		EnvVars:     envs,
+		Destination: &cfg.DryRunFormat,
+		Value:       def.DryRunFormat,
+	})
+
 	return flags
 }
 
@@ -146,24 +260,53 @@ func prettifyError(err error, prefix string, authMethod string) error {
 	return err
 }
 
-func (cfg *CliConfig) BuildPumpConfig(pumpConfig *pump.Config) error {
-	var connConfig imap.ConnectionConfig
-	var factory imap.Factory
-	var err error
+func (cfg *CliConfig) buildSource(pumpConfig *pump.Config) error {
+	src, err := cfg.Source.ResolveSource()
+	if err != nil {
+		return prettifyError(err, "source", cfg.Source.AuthMethod)
+	}
+	pumpConfig.Source = src.ConnectionConfig
+	pumpConfig.SourceFactory = src.Factory
+	pumpConfig.SourceReceiver = src.Receiver
+	pumpConfig.SourceName = src.Name
+	pumpConfig.DisableDeletions = cfg.DisableDeletions
+	return nil
+}
 
+// BuildDryRunConfig is BuildPumpConfig for a dry run. Only the source, and the destination
+// mailbox are resolved, as resolving the destination may create it.
+func (cfg *CliConfig) BuildDryRunConfig(pumpConfig *pump.Config) error {
+	if err := cfg.buildSource(pumpConfig); err != nil {
+		return err
+	}
+
+	mailbox, err := cfg.Dest.DestinationMailbox()
+	if err != nil {
+		return prettifyError(err, "dest", cfg.Dest.AuthMethod)
+	}
+	pumpConfig.Dest.Mailbox = mailbox
+
+	return nil
+}
+
+func (cfg *CliConfig) BuildPumpConfig(pumpConfig *pump.Config) error {
 	def := DefaultConfig()
 
-	if connConfig, factory, err = cfg.Source.Resolve(); err != nil {
-		return prettifyError(err, "source", cfg.Source.AuthMethod)
+	if err := cfg.buildSource(pumpConfig); err != nil {
+		return err
+	}
+
+	if cfg.Once && pumpConfig.SourceReceiver != nil {
+		return ErrOnceUnsupported
 	}
-	pumpConfig.Source = connConfig
-	pumpConfig.SourceFactory = factory
 
-	if connConfig, factory, err = cfg.Dest.Resolve(); err != nil {
+	dest, err := cfg.Dest.ResolveDestination()
+	if err != nil {
 		return prettifyError(err, "dest", cfg.Dest.AuthMethod)
 	}
-	pumpConfig.Dest = connConfig
-	pumpConfig.DestFactory = factory
+	pumpConfig.Dest = dest.ConnectionConfig
+	pumpConfig.DestFactory = dest.Factory
+	pumpConfig.DestSink = dest.Sink
 
 	pumpConfig.IDLEFallbackInterval = cfg.IDLEFallbackInterval
 	if pumpConfig.IDLEFallbackInterval == 0 {
@@ -175,8 +318,6 @@ func (cfg *CliConfig) BuildPumpConfig(pumpConfig *pump.Config) error {
 		pumpConfig.BatchSize = def.BatchSize
 	}
 
-	pumpConfig.DisableDeletions = cfg.DisableDeletions
-
 	pumpConfig.FetchBufferSize = cfg.FetchBufferSize
 	if pumpConfig.FetchBufferSize == 0 {
 		pumpConfig.FetchBufferSize = def.FetchBufferSize
@@ -187,5 +328,12 @@ func (cfg *CliConfig) BuildPumpConfig(pumpConfig *pump.Config) error {
 		pumpConfig.FetchMaxInterval = def.FetchMaxInterval
 	}
 
+	pumpConfig.CheckDuplicates = cfg.CheckDuplicates
+	pumpConfig.Normalise = cfg.Normalise
+	pumpConfig.QuotaThreshold = cfg.QuotaThreshold
+	pumpConfig.RejectMailbox = cfg.RejectMailbox
+	pumpConfig.ShutdownTimeout = cfg.ShutdownTimeout
+	pumpConfig.Once = cfg.Once
+
 	return nil
 }
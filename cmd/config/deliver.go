@@ -0,0 +1,96 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+func DefaultDeliverConfig() DeliverConfig {
+	return DeliverConfig{
+		Dest:            DefaultIMAPConfig(),
+		Mailbox:         "",
+		Timeout:         time.Minute,
+		LogLevel:        "warning",
+		LogFormat:       "text",
+		CheckDuplicates: false,
+		Normalise:       false,
+	}
+}
+
+func (cfg *DeliverConfig) Parameters() []cli.Flag {
+	def := DefaultDeliverConfig()
+	var name string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("mailbox", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "mailbox to deliver to. defaults to the dest mailbox",
+		EnvVars:     envs,
+		Destination: &cfg.Mailbox,
+		Value:       def.Mailbox,
+	})
+
+	name, _, envs = makeFlagNames("flag", "")
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:        name,
+		Usage:       "flag to set on the message, e.g. \\Seen. may be repeated",
+		EnvVars:     envs,
+		Destination: &cfg.Flags,
+	})
+
+	name, _, envs = makeFlagNames("timeout", "")
+	flags = append(flags, &cli.DurationFlag{
+		Name:        name,
+		Usage:       "how long to wait for the dest before failing temporarily",
+		EnvVars:     envs,
+		Destination: &cfg.Timeout,
+		Value:       def.Timeout,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	flags = append(flags, makeIngestTuningParameters(&cfg.CheckDuplicates, &cfg.Normalise, nil)...)
+
+	return flags
+}
+
+// BuildIngestConfig resolves the destination. Its mailbox is replaced with
+// the one given, if any.
+func (cfg *DeliverConfig) BuildIngestConfig() (ingest.Config, error) {
+	dest, err := cfg.Dest.ResolveDestination()
+	if err != nil {
+		return ingest.Config{}, prettifyError(err, "dest", cfg.Dest.AuthMethod)
+	}
+
+	if cfg.Mailbox != "" {
+		dest.Mailbox = cfg.Mailbox
+	}
+
+	dest.CheckDuplicates = cfg.CheckDuplicates
+	dest.Normalise = cfg.Normalise
+	return dest, nil
+}
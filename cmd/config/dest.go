@@ -0,0 +1,409 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/oauth2"
+
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/jmap"
+	"git.vs49688.net/zane/mailpump/lmtp"
+	"git.vs49688.net/zane/mailpump/maildir"
+	"git.vs49688.net/zane/mailpump/mbox"
+	"git.vs49688.net/zane/mailpump/pipe"
+	"git.vs49688.net/zane/mailpump/smtp"
+	"git.vs49688.net/zane/mailpump/webhook"
+)
+
+// urlPath extracts a filesystem path from a URL, allowing for both
+// scheme:///absolute/path and scheme:relative/path forms.
+func urlPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+
+	return u.Host + u.Path
+}
+
+func queryBool(q url.Values, key string) (bool, error) {
+	v := q.Get(key)
+	if v == "" {
+		return false, nil
+	}
+
+	return strconv.ParseBool(v)
+}
+
+// parseSize parses a size in bytes, with an optional K, M, or G suffix.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1024
+	case "M":
+		mult = 1024 * 1024
+	case "G":
+		mult = 1024 * 1024 * 1024
+	}
+
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return n * mult, nil
+}
+
+func resolveMbox(u *url.URL) (ingest.Sink, error) {
+	q := u.Query()
+
+	rotateSize, err := parseSize(q.Get("rotate_size"))
+	if err != nil {
+		return nil, err
+	}
+
+	rotateMonthly, err := queryBool(q, "rotate_monthly")
+	if err != nil {
+		return nil, err
+	}
+
+	gzip, err := queryBool(q, "gzip")
+	if err != nil {
+		return nil, err
+	}
+
+	return mbox.NewSink(&mbox.Config{
+		Path:          urlPath(u),
+		Lock:          mbox.LockType(q.Get("lock")),
+		RotateSize:    rotateSize,
+		RotateMonthly: rotateMonthly,
+		Gzip:          gzip,
+	})
+}
+
+// lmtpConfig builds the configuration for an lmtp:// URL. If there's no host,
+// the path is a Unix socket.
+func lmtpConfig(u *url.URL) *lmtp.Config {
+	q := u.Query()
+
+	cfg := &lmtp.Config{
+		Recipients: q["rcpt"],
+		From:       q.Get("from"),
+	}
+
+	if u.Host == "" {
+		cfg.Network = "unix"
+		cfg.Address = urlPath(u)
+	} else {
+		cfg.Network = "tcp"
+		cfg.Address = u.Host
+		if u.Port() == "" {
+			cfg.Address = net.JoinHostPort(u.Hostname(), "24")
+		}
+	}
+
+	return cfg
+}
+
+// smtpConfig builds the configuration for an smtp:// or smtps:// URL. The
+// credentials, if any, are taken from the IMAP options.
+func (cfg *IMAPConfig) smtpConfig(u *url.URL) (*smtp.Config, error) {
+	cfg.fillDefaults()
+	q := u.Query()
+
+	c := &smtp.Config{
+		Recipients: q["rcpt"],
+		From:       q.Get("from"),
+		Mode:       smtp.Mode(q.Get("mode")),
+		ResentFrom: q.Get("resent_from"),
+	}
+
+	port := "587"
+	if strings.ToLower(u.Scheme) == "smtps" {
+		port = "465"
+		c.Security = smtp.SecurityTLS
+	} else {
+		c.Security = smtp.SecurityStartTLS
+
+		if q.Get("starttls") != "" {
+			starttls, err := queryBool(q, "starttls")
+			if err != nil {
+				return nil, err
+			}
+
+			if !starttls {
+				c.Security = smtp.SecurityNone
+			}
+		}
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	c.Address = net.JoinHostPort(u.Hostname(), port)
+
+	if cfg.TLSSkipVerify {
+		// #nosec G402
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	if cfg.Username == "" {
+		return c, nil
+	}
+
+	user, pass, err := cfg.validateUserPass()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(cfg.AuthMethod) {
+	case sasl.Login:
+		c.Auth = sasl.NewLoginClient(user, pass)
+	case sasl.Plain:
+		c.Auth = sasl.NewPlainClient("", user, pass)
+	default:
+		return nil, fmt.Errorf("unsupported auth method: %v", cfg.AuthMethod)
+	}
+
+	return c, nil
+}
+
+// webhookConfig builds the configuration for a webhook+http:// or webhook+https://
+// URL. Our options are removed from the query, anything else is passed through.
+// The password, if any, is used as the signing secret.
+func (cfg *IMAPConfig) webhookConfig(u *url.URL) (*webhook.Config, error) {
+	q := u.Query()
+
+	c := &webhook.Config{
+		Format:  webhook.Format(q.Get("format")),
+		Headers: http.Header{},
+	}
+
+	for _, h := range q["header"] {
+		k, v, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid webhook header: %v", h)
+		}
+		c.Headers.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+
+	if t := q.Get("timeout"); t != "" {
+		timeout, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, err
+		}
+		c.Timeout = timeout
+	}
+
+	if cfg.Password != "" || cfg.PasswordFile != "" || cfg.SystemdCredential != "" {
+		secret, err := cfg.readPassword()
+		if err != nil {
+			return nil, err
+		}
+		c.Secret = []byte(secret)
+	}
+
+	for _, k := range []string{"folder", "format", "header", "timeout"} {
+		q.Del(k)
+	}
+
+	target := *u
+	target.Scheme = strings.TrimPrefix(strings.ToLower(u.Scheme), "webhook+")
+	target.RawQuery = q.Encode()
+	c.URL = target.String()
+
+	return c, nil
+}
+
+// pipeConfig builds the configuration for a pipe:// URL.
+func pipeConfig(u *url.URL) (*pipe.Config, error) {
+	q := u.Query()
+
+	crlf, err := queryBool(q, "crlf")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &pipe.Config{
+		Command: urlPath(u),
+		Args:    q["arg"],
+		CRLF:    crlf,
+	}
+
+	if t := q.Get("timeout"); t != "" {
+		if c.Timeout, err = time.ParseDuration(t); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// jmapConfig builds the configuration for a jmap:// URL. The session resource is
+// fetched over HTTPS, from /.well-known/jmap unless a path is given.
+func (cfg *IMAPConfig) jmapConfig(u *url.URL) (*jmap.Config, error) {
+	cfg.fillDefaults()
+
+	useTLS := true
+	if u.Query().Get("tls") != "" {
+		var err error
+		if useTLS, err = queryBool(u.Query(), "tls"); err != nil {
+			return nil, err
+		}
+	}
+
+	session := url.URL{Scheme: "https", Host: u.Host, Path: u.Path}
+	if !useTLS {
+		session.Scheme = "http"
+	}
+
+	if session.Path == "" || session.Path == "/" {
+		session.Path = "/.well-known/jmap"
+	}
+
+	c := &jmap.Config{SessionURL: session.String()}
+
+	user, pass, err := cfg.validateUserPass()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(cfg.AuthMethod) {
+	case "LOGIN", sasl.Plain:
+		c.Username = user
+		c.Password = pass
+	case "BEARER":
+		c.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: pass})
+	case sasl.OAuthBearer:
+		if c.TokenSource, err = cfg.OAuth2.tokenSource(pass); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth method: %v", cfg.AuthMethod)
+	}
+
+	return c, nil
+}
+
+func resolveMaildir(u *url.URL) (ingest.Sink, error) {
+	crlf, err := queryBool(u.Query(), "crlf")
+	if err != nil {
+		return nil, err
+	}
+
+	return maildir.NewSink(&maildir.Config{
+		Path: urlPath(u),
+		CRLF: crlf,
+	})
+}
+
+// DestinationMailbox returns the mailbox ResolveDestination would deliver to, without creating
+// or connecting to the destination.
+func (cfg *IMAPConfig) DestinationMailbox() (string, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "maildir", "mbox", "eml", "lmtp", "jmap", "pipe", "webhook+http", "webhook+https", "smtp", "smtps":
+		return u.Query().Get("folder"), nil
+	default:
+		_, mailbox, _, err := extractUrl(u)
+		return mailbox, err
+	}
+}
+
+// ResolveDestination will validate and resolve the configuration into an ingest.Config.
+// Unlike Resolve, this also accepts the URLs of non-IMAP destinations, such as maildir://.
+// Their options are given as URL query parameters, with the target mailbox in "folder".
+func (cfg *IMAPConfig) ResolveDestination() (ingest.Config, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return ingest.Config{}, err
+	}
+
+	var sink ingest.Sink
+	switch strings.ToLower(u.Scheme) {
+	case "maildir":
+		sink, err = resolveMaildir(u)
+	case "mbox":
+		sink, err = resolveMbox(u)
+	case "eml":
+		sink, err = archive.NewEMLSink(urlPath(u))
+	case "lmtp":
+		sink, err = lmtp.NewSink(lmtpConfig(u))
+	case "jmap":
+		var jmapCfg *jmap.Config
+		if jmapCfg, err = cfg.jmapConfig(u); err == nil {
+			sink, err = jmap.NewSink(jmapCfg)
+		}
+	case "pipe":
+		var pipeCfg *pipe.Config
+		if pipeCfg, err = pipeConfig(u); err == nil {
+			sink, err = pipe.NewSink(pipeCfg)
+		}
+	case "webhook+http", "webhook+https":
+		var webhookCfg *webhook.Config
+		if webhookCfg, err = cfg.webhookConfig(u); err == nil {
+			sink, err = webhook.NewSink(webhookCfg)
+		}
+	case "smtp", "smtps":
+		var smtpCfg *smtp.Config
+		if smtpCfg, err = cfg.smtpConfig(u); err == nil {
+			sink, err = smtp.NewSink(smtpCfg)
+		}
+	default:
+		connConfig, factory, err := cfg.Resolve()
+		if err != nil {
+			return ingest.Config{}, err
+		}
+
+		return ingest.Config{ConnectionConfig: connConfig, Factory: factory}, nil
+	}
+
+	if err != nil {
+		return ingest.Config{}, err
+	}
+
+	return ingest.Config{
+		ConnectionConfig: imap.ConnectionConfig{Mailbox: u.Query().Get("folder")},
+		Sink:             sink,
+	}, nil
+}
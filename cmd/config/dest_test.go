@@ -0,0 +1,255 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/imap/persistentclient"
+	"git.vs49688.net/zane/mailpump/jmap"
+	"git.vs49688.net/zane/mailpump/lmtp"
+	"git.vs49688.net/zane/mailpump/pipe"
+	"git.vs49688.net/zane/mailpump/smtp"
+	"git.vs49688.net/zane/mailpump/webhook"
+)
+
+func TestIMAPConfig_ResolveDestination(t *testing.T) {
+	t.Run("imap", func(t *testing.T) {
+		cfg := getTestIMAPConfig()
+
+		dest, err := cfg.ResolveDestination()
+		assert.NoError(t, err)
+		assert.Nil(t, dest.Sink)
+		assert.Equal(t, persistentclient.Factory{MaxDelay: 0}, dest.Factory)
+		assert.Equal(t, "imap.hostname.com:1234", dest.HostPort)
+	})
+
+	t.Run("maildir", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "Maildir")
+
+		cfg := DefaultIMAPConfig()
+		cfg.URL = "maildir://" + filepath.ToSlash(path) + "?folder=Archive"
+
+		dest, err := cfg.ResolveDestination()
+		assert.NoError(t, err)
+		assert.NotNil(t, dest.Sink)
+		assert.Equal(t, "Archive", dest.Mailbox)
+
+		_, err = os.Stat(filepath.Join(path, "new"))
+		assert.NoError(t, err)
+	})
+
+	t.Run("mbox", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "archive")
+
+		cfg := DefaultIMAPConfig()
+		cfg.URL = "mbox://" + filepath.ToSlash(path) + "?lock=dotlock&rotate_size=10M&gzip=true"
+
+		dest, err := cfg.ResolveDestination()
+		assert.NoError(t, err)
+		assert.NotNil(t, dest.Sink)
+
+		_, err = os.Stat(path)
+		assert.NoError(t, err)
+	})
+
+	t.Run("lmtp", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		cfg.URL = "lmtp://localhost?rcpt=user@example.com"
+
+		dest, err := cfg.ResolveDestination()
+		assert.NoError(t, err)
+		assert.NotNil(t, dest.Sink)
+	})
+
+	t.Run("maildir_invalid_option", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		cfg.URL = "maildir://" + filepath.ToSlash(t.TempDir()) + "?crlf=maybe"
+
+		_, err := cfg.ResolveDestination()
+		assert.Error(t, err)
+	})
+}
+
+func TestLMTPConfig(t *testing.T) {
+	tests := map[string]lmtp.Config{
+		"lmtp://localhost": {
+			Network: "tcp",
+			Address: "localhost:24",
+		},
+		"lmtp://[::1]:2424?from=sender@example.com": {
+			Network: "tcp",
+			Address: "[::1]:2424",
+			From:    "sender@example.com",
+		},
+		"lmtp:///var/run/dovecot/lmtp?rcpt=a@example.com&rcpt=b@example.com": {
+			Network:    "unix",
+			Address:    "/var/run/dovecot/lmtp",
+			Recipients: []string{"a@example.com", "b@example.com"},
+		},
+	}
+
+	for s, expected := range tests {
+		u, err := url.Parse(s)
+		assert.NoError(t, err)
+		assert.Equal(t, &expected, lmtpConfig(u), s)
+	}
+}
+
+func TestIMAPConfig_smtpConfig(t *testing.T) {
+	t.Run("starttls", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		u, _ := url.Parse("smtp://smtp.example.com?rcpt=forward@example.com&mode=resend")
+
+		c, err := cfg.smtpConfig(u)
+		assert.NoError(t, err)
+		assert.Equal(t, &smtp.Config{
+			Address:    "smtp.example.com:587",
+			Security:   smtp.SecurityStartTLS,
+			Recipients: []string{"forward@example.com"},
+			Mode:       smtp.ModeResend,
+		}, c)
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		u, _ := url.Parse("smtp://localhost:25?starttls=false")
+
+		c, err := cfg.smtpConfig(u)
+		assert.NoError(t, err)
+		assert.Equal(t, "localhost:25", c.Address)
+		assert.Equal(t, smtp.SecurityNone, c.Security)
+	})
+
+	t.Run("implicit_auth", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		cfg.Username = "user"
+		cfg.Password = "pass"
+		cfg.AuthMethod = "PLAIN"
+		cfg.TLSSkipVerify = true
+		u, _ := url.Parse("smtps://smtp.example.com")
+
+		c, err := cfg.smtpConfig(u)
+		assert.NoError(t, err)
+		assert.Equal(t, "smtp.example.com:465", c.Address)
+		assert.Equal(t, smtp.SecurityTLS, c.Security)
+		assert.True(t, c.TLSConfig.InsecureSkipVerify)
+
+		mech, _, err := c.Auth.Start()
+		assert.NoError(t, err)
+		assert.Equal(t, "PLAIN", mech)
+	})
+
+	t.Run("missing_password", func(t *testing.T) {
+		cfg := DefaultIMAPConfig()
+		cfg.Username = "user"
+		u, _ := url.Parse("smtps://smtp.example.com")
+
+		_, err := cfg.smtpConfig(u)
+		assert.ErrorIs(t, err, ErrIMAPMissingPassword)
+	})
+}
+
+func TestIMAPConfig_webhookConfig(t *testing.T) {
+	cfg := DefaultIMAPConfig()
+	cfg.Password = "secret"
+
+	u, _ := url.Parse("webhook+https://hooks.example.com/mail?token=abc&format=json&header=X-Team:%20mail&timeout=10s&folder=INBOX")
+
+	c, err := cfg.webhookConfig(u)
+	assert.NoError(t, err)
+	assert.Equal(t, &webhook.Config{
+		URL:     "https://hooks.example.com/mail?token=abc",
+		Format:  webhook.FormatJSON,
+		Secret:  []byte("secret"),
+		Headers: http.Header{"X-Team": {"mail"}},
+		Timeout: 10 * time.Second,
+	}, c)
+
+	u, _ = url.Parse("webhook+http://localhost?header=invalid")
+	_, err = cfg.webhookConfig(u)
+	assert.Error(t, err)
+}
+
+func TestPipeConfig(t *testing.T) {
+	u, _ := url.Parse("pipe:///usr/lib/dovecot/dovecot-lda?arg=-d&arg=user@example.com&timeout=1m")
+
+	c, err := pipeConfig(u)
+	assert.NoError(t, err)
+	assert.Equal(t, &pipe.Config{
+		Command: "/usr/lib/dovecot/dovecot-lda",
+		Args:    []string{"-d", "user@example.com"},
+		Timeout: time.Minute,
+	}, c)
+
+	u, _ = url.Parse("pipe:///usr/bin/procmail?crlf=maybe")
+	_, err = pipeConfig(u)
+	assert.Error(t, err)
+}
+
+func TestIMAPConfig_jmapConfig(t *testing.T) {
+	cfg := DefaultIMAPConfig()
+	cfg.Username = "user"
+	cfg.Password = "pass"
+
+	u, _ := url.Parse("jmap://api.example.com")
+	c, err := cfg.jmapConfig(u)
+	assert.NoError(t, err)
+	assert.Equal(t, &jmap.Config{
+		SessionURL: "https://api.example.com/.well-known/jmap",
+		Username:   "user",
+		Password:   "pass",
+	}, c)
+
+	cfg.AuthMethod = "BEARER"
+	u, _ = url.Parse("jmap://localhost:8080/jmap/session?tls=false")
+	c, err = cfg.jmapConfig(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/jmap/session", c.SessionURL)
+	assert.Empty(t, c.Username)
+
+	tok, err := c.TokenSource.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "pass", tok.AccessToken)
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"":     0,
+		"1024": 1024,
+		"10k":  10 * 1024,
+		"10M":  10 * 1024 * 1024,
+		"2G":   2 * 1024 * 1024 * 1024,
+	}
+
+	for s, expected := range tests {
+		n, err := parseSize(s)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	_, err := parseSize("M")
+	assert.Error(t, err)
+}
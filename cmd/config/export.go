@@ -0,0 +1,118 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrInvalidExportTarget = errors.New("invalid export target, expected a maildir:, mbox:, or eml: url")
+)
+
+// exportStateName is the name of the state file kept in the target directory.
+const exportStateName = ".mailpump-export.json"
+
+func DefaultExportConfig() ExportConfig {
+	return ExportConfig{
+		Source:    DefaultIMAPConfig(),
+		BatchSize: 100,
+		LogLevel:  "info",
+		LogFormat: "text",
+	}
+}
+
+func (cfg *ExportConfig) Parameters() []cli.Flag {
+	def := DefaultExportConfig()
+	var name string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Source.makeIMAPParameters("source")...)
+
+	name, _, envs = makeFlagNames("to", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "where to export to, e.g. maildir:/backup, mbox:/backup, or eml:/backup",
+		EnvVars:     envs,
+		Destination: &cfg.To,
+		Required:    true,
+		Value:       def.To,
+	})
+
+	name, _, envs = makeFlagNames("state", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "file to record the last exported uid in. defaults to " + exportStateName + " in the target directory",
+		EnvVars:     envs,
+		Destination: &cfg.State,
+		Value:       def.State,
+	})
+
+	name, _, envs = makeFlagNames("batch-size", "")
+	flags = append(flags, &cli.UintFlag{
+		Name:        name,
+		Usage:       "number of messages to fetch at a time",
+		EnvVars:     envs,
+		Destination: &cfg.BatchSize,
+		Value:       def.BatchSize,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	return flags
+}
+
+// ResolveTarget resolves the local copy to export to. If no state file was
+// given, it's kept in the target directory.
+func (cfg *ExportConfig) ResolveTarget() (ingest.Config, error) {
+	u, err := url.Parse(cfg.To)
+	if err != nil {
+		return ingest.Config{}, err
+	}
+
+	path := urlPath(u)
+	switch strings.ToLower(u.Scheme) {
+	case "maildir", "mbox", "eml":
+	default:
+		return ingest.Config{}, ErrInvalidExportTarget
+	}
+
+	if path == "" {
+		return ingest.Config{}, ErrInvalidExportTarget
+	}
+
+	to := IMAPConfig{URL: cfg.To}
+	dest, err := to.ResolveDestination()
+	if err != nil {
+		return ingest.Config{}, err
+	}
+
+	if cfg.State == "" {
+		cfg.State = filepath.Join(path, exportStateName)
+	}
+
+	return dest, nil
+}
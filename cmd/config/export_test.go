@@ -0,0 +1,53 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportConfig_ResolveTarget(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+
+	cfg := DefaultExportConfig()
+	cfg.To = "eml:" + dir + "?folder=Backup"
+	dest, err := cfg.ResolveTarget()
+	if assert.NoError(t, err) {
+		assert.NotNil(t, dest.Sink)
+		assert.Equal(t, "Backup", dest.Mailbox)
+		assert.Equal(t, filepath.Join(dir, exportStateName), cfg.State)
+	}
+
+	cfg = DefaultExportConfig()
+	cfg.To = "maildir:" + dir
+	cfg.State = "state.json"
+	_, err = cfg.ResolveTarget()
+	assert.NoError(t, err)
+	assert.Equal(t, "state.json", cfg.State)
+
+	for _, to := range []string{"imaps://imap.example.com/INBOX", "pipe:/bin/cat", "eml:", dir} {
+		cfg = DefaultExportConfig()
+		cfg.To = to
+		_, err = cfg.ResolveTarget()
+		assert.ErrorIs(t, err, ErrInvalidExportTarget, to)
+	}
+}
@@ -19,7 +19,6 @@
 package config
 
 import (
-	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -37,7 +36,6 @@ import (
 	"git.vs49688.net/zane/mailpump/imap"
 	"git.vs49688.net/zane/mailpump/imap/client"
 	"git.vs49688.net/zane/mailpump/imap/persistentclient"
-	"golang.org/x/oauth2"
 )
 
 var (
@@ -103,7 +101,7 @@ func (cfg *IMAPConfig) makeIMAPParameters(prefix string) []cli.Flag {
 		Usage:       fmt.Sprintf("%v imap username", prefix),
 		EnvVars:     envs,
 		Destination: &cfg.Username,
-		Required:    true,
+		Required:    false,
 		Value:       def.Username,
 	})
 
@@ -188,41 +186,67 @@ func (cfg *IMAPConfig) validateUserPass() (string, string, error) {
 		return "", "", ErrIMAPMissingUsername
 	}
 
+	password, err := cfg.readPassword()
+	if err != nil {
+		return "", "", err
+	}
+
+	return cfg.Username, password, nil
+}
+
+// readPassword reads the password from wherever it was configured.
+func (cfg *IMAPConfig) readPassword() (string, error) {
 	var password string
-	username := cfg.Username
 
 	if cfg.Password != "" {
 		password = cfg.Password
 	} else if cfg.PasswordFile != "" {
 		pass, err := ioutil.ReadFile(cfg.PasswordFile)
 		if err != nil {
-			return "", "", err
+			return "", err
 		}
 
 		password = strings.TrimSpace(string(pass))
 	} else if cfg.SystemdCredential != "" {
 		credsDir := os.Getenv("CREDENTIALS_DIRECTORY")
 		if credsDir == "" {
-			return "", "", ErrSystemdCredentialsNotSet
+			return "", ErrSystemdCredentialsNotSet
 		}
 
 		credsDir = filepath.Clean(credsDir)
 		credPath := filepath.Clean(path.Join(credsDir, cfg.SystemdCredential))
 		if !strings.HasPrefix(credPath, credsDir) {
-			return "", "", fmt.Errorf("resolved credential path outside $CREDENTIALS_DIRECTORY: %v", credPath)
+			return "", fmt.Errorf("resolved credential path outside $CREDENTIALS_DIRECTORY: %v", credPath)
 		}
 
 		pass, err := ioutil.ReadFile(credPath)
 		if err != nil {
-			return "", "", err
+			return "", err
 		}
 
 		password = strings.TrimSpace(string(pass))
 	} else {
-		return "", "", ErrIMAPMissingPassword
+		return "", ErrIMAPMissingPassword
+	}
+
+	return password, nil
+}
+
+// MakeSourceName builds a printable name for a connection, without the password.
+func MakeSourceName(username string, cfg *imap.ConnectionConfig) string {
+	u := url.URL{
+		User: url.User(username),
+		Host: cfg.HostPort,
+		Path: cfg.Mailbox,
+	}
+
+	if cfg.TLS {
+		u.Scheme = "imaps"
+	} else {
+		u.Scheme = "imap"
 	}
 
-	return username, password, nil
+	return u.String()
 }
 
 // Resolve will validate and resolve the configuration into an imap.ConnectionConfig, and
@@ -261,19 +285,17 @@ func (cfg *IMAPConfig) Resolve() (imap.ConnectionConfig, imap.Factory, error) {
 		}
 		connConfig.Auth = imap.NewSASLAuthenticator(sasl.NewPlainClient("", user, pass))
 	case sasl.OAuthBearer:
-		if err := cfg.OAuth2.Resolve(); err != nil {
+		user, pass, err := cfg.validateUserPass()
+		if err != nil {
 			return imap.ConnectionConfig{}, nil, err
 		}
 
-		user, pass, err := cfg.validateUserPass()
+		ts, err := cfg.OAuth2.tokenSource(pass)
 		if err != nil {
 			return imap.ConnectionConfig{}, nil, err
 		}
 
-		tok := &oauth2.Token{RefreshToken: pass}
-
-		ctx := context.Background() // FIXME: use parent context
-		connConfig.Auth = imap.NewOAuthBearerAuthenticator(user, cfg.OAuth2.Config.TokenSource(ctx, tok))
+		connConfig.Auth = imap.NewOAuthBearerAuthenticator(user, ts)
 	default:
 		return imap.ConnectionConfig{}, nil, fmt.Errorf("unsupported auth method: %v", cfg.AuthMethod)
 
@@ -0,0 +1,154 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/maildir"
+	"git.vs49688.net/zane/mailpump/mbox"
+)
+
+var (
+	ErrInvalidArchive = errors.New("invalid archive, expected an mbox:, maildir:, or eml: url")
+)
+
+func DefaultImportConfig() ImportConfig {
+	return ImportConfig{
+		Dest:             DefaultIMAPConfig(),
+		Mailbox:          "",
+		Concurrency:      4,
+		ProgressInterval: 10 * time.Second,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		CheckDuplicates:  false,
+		Normalise:        false,
+		QuotaThreshold:   0,
+	}
+}
+
+func (cfg *ImportConfig) Parameters() []cli.Flag {
+	def := DefaultImportConfig()
+	var name string
+	var usage string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("from", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "archive to import, e.g. mbox:/path/archive.mbox, maildir:/path/Maildir, or eml:/path/dir",
+		EnvVars:     envs,
+		Destination: &cfg.From,
+		Required:    true,
+		Value:       def.From,
+	})
+
+	name, _, envs = makeFlagNames("mailbox", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "mailbox to import into. defaults to the dest mailbox",
+		EnvVars:     envs,
+		Destination: &cfg.Mailbox,
+		Value:       def.Mailbox,
+	})
+
+	name, _, envs = makeFlagNames("concurrency", "")
+	flags = append(flags, &cli.UintFlag{
+		Name:        name,
+		Usage:       "number of dest connections to import over. imap dests only",
+		EnvVars:     envs,
+		Destination: &cfg.Concurrency,
+		Value:       def.Concurrency,
+	})
+
+	name, _, envs = makeFlagNames("checkpoint", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "file to record imported messages in, so the import can be resumed",
+		EnvVars:     envs,
+		Destination: &cfg.Checkpoint,
+		Value:       def.Checkpoint,
+	})
+
+	name, usage, envs = makeFlagNames("progress-interval", "")
+	flags = append(flags, &cli.DurationFlag{
+		Name:        name,
+		Usage:       usage,
+		EnvVars:     envs,
+		Destination: &cfg.ProgressInterval,
+		Value:       def.ProgressInterval,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	flags = append(flags, makeIngestTuningParameters(&cfg.CheckDuplicates, &cfg.Normalise, &cfg.QuotaThreshold)...)
+
+	return flags
+}
+
+// ResolveReader opens the archive to import.
+func (cfg *ImportConfig) ResolveReader() (archive.Reader, error) {
+	u, err := url.Parse(cfg.From)
+	if err != nil {
+		return nil, err
+	}
+
+	path := urlPath(u)
+	if path == "" {
+		return nil, ErrInvalidArchive
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "mbox":
+		return mbox.NewReader(path)
+	case "maildir":
+		return maildir.NewReader(path, u.Query().Get("folder"))
+	case "eml":
+		return archive.NewEMLReader(path)
+	default:
+		return nil, ErrInvalidArchive
+	}
+}
+
+// BuildIngestConfig resolves the destination. Its mailbox is replaced with
+// the one given, if any.
+func (cfg *ImportConfig) BuildIngestConfig() (ingest.Config, error) {
+	dest, err := cfg.Dest.ResolveDestination()
+	if err != nil {
+		return ingest.Config{}, prettifyError(err, "dest", cfg.Dest.AuthMethod)
+	}
+
+	if cfg.Mailbox != "" {
+		dest.Mailbox = cfg.Mailbox
+	}
+
+	dest.CheckDuplicates = cfg.CheckDuplicates
+	dest.Normalise = cfg.Normalise
+	dest.QuotaThreshold = cfg.QuotaThreshold
+	return dest, nil
+}
@@ -0,0 +1,53 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportConfig_ResolveReader(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "archive.mbox"), nil, 0600))
+
+	cfg := DefaultImportConfig()
+	for _, from := range []string{
+		"mbox:" + filepath.ToSlash(filepath.Join(dir, "archive.mbox")),
+		"mbox://" + filepath.ToSlash(filepath.Join(dir, "archive.mbox")),
+		"eml:" + filepath.ToSlash(dir),
+	} {
+		cfg.From = from
+		r, err := cfg.ResolveReader()
+		if assert.NoError(t, err, from) {
+			_ = r.Close()
+		}
+	}
+
+	cfg.From = "maildir:" + filepath.ToSlash(dir) + "?folder=Archive"
+	_, err := cfg.ResolveReader()
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	cfg.From = filepath.Join(dir, "archive.mbox")
+	_, err = cfg.ResolveReader()
+	assert.ErrorIs(t, err, ErrInvalidArchive)
+}
@@ -0,0 +1,245 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/smtpd"
+)
+
+var (
+	ErrListenMissingPassword = errors.New("listen password required")
+	ErrListenTLSKeyPair      = errors.New("both a tls certificate and key are required")
+)
+
+func DefaultListenConfig() ListenConfig {
+	return ListenConfig{
+		Dest:            DefaultIMAPConfig(),
+		Address:         "localhost:2525",
+		Protocol:        string(smtpd.ProtocolSMTP),
+		LogLevel:        "info",
+		LogFormat:       "text",
+		CheckDuplicates: false,
+		Normalise:       false,
+		QuotaThreshold:  0,
+		MaxMessageSize:  "50M",
+	}
+}
+
+func (cfg *ListenConfig) Parameters() []cli.Flag {
+	def := DefaultListenConfig()
+	var name string
+	var usage string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("address", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "HOST:PORT, or unix socket path, to listen on",
+		EnvVars:     envs,
+		Destination: &cfg.Address,
+		Value:       def.Address,
+	})
+
+	name, _, envs = makeFlagNames("protocol", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "protocol to accept mail with (smtp, lmtp)",
+		EnvVars:     envs,
+		Destination: &cfg.Protocol,
+		Value:       def.Protocol,
+	})
+
+	name, _, envs = makeFlagNames("hostname", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "name to greet clients with. defaults to the hostname",
+		EnvVars:     envs,
+		Destination: &cfg.Hostname,
+		Value:       def.Hostname,
+	})
+
+	name, usage, envs = makeFlagNames("tls-cert", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       usage + " file. enables STARTTLS",
+		EnvVars:     envs,
+		Destination: &cfg.TLSCert,
+		Value:       def.TLSCert,
+	})
+
+	name, usage, envs = makeFlagNames("tls-key", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       usage + " file",
+		EnvVars:     envs,
+		Destination: &cfg.TLSKey,
+		Value:       def.TLSKey,
+	})
+
+	name, _, envs = makeFlagNames("username", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "username clients must AUTH with. if unset, AUTH is disabled",
+		EnvVars:     envs,
+		Destination: &cfg.Username,
+		Value:       def.Username,
+	})
+
+	name, usage, envs = makeFlagNames("password", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       usage,
+		EnvVars:     envs,
+		Destination: &cfg.Password,
+		Value:       def.Password,
+	})
+
+	name, usage, envs = makeFlagNames("password-file", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       usage,
+		EnvVars:     envs,
+		Destination: &cfg.PasswordFile,
+		Value:       def.PasswordFile,
+	})
+
+	name, _, envs = makeFlagNames("route", "listen")
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:        name,
+		Usage:       "route a recipient to a mailbox, as RECIPIENT=MAILBOX. may be repeated",
+		EnvVars:     envs,
+		Destination: &cfg.Routes,
+	})
+
+	name, _, envs = makeFlagNames("reject-unknown", "listen")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "reject recipients without a route, instead of using the dest mailbox",
+		EnvVars:     envs,
+		Destination: &cfg.RejectUnknown,
+		Value:       def.RejectUnknown,
+	})
+
+	name, _, envs = makeFlagNames("max-message-size", "listen")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "largest message to accept, with an optional K, M, or G suffix. 0 for no limit",
+		EnvVars:     envs,
+		Destination: &cfg.MaxMessageSize,
+		Value:       def.MaxMessageSize,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	flags = append(flags, makeIngestTuningParameters(&cfg.CheckDuplicates, &cfg.Normalise, &cfg.QuotaThreshold)...)
+
+	return flags
+}
+
+// Network returns the network to listen on, "unix" if the address is a path.
+func (cfg *ListenConfig) Network() string {
+	if strings.ContainsRune(cfg.Address, '/') {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (cfg *ListenConfig) readPassword() (string, error) {
+	if cfg.Password != "" {
+		return cfg.Password, nil
+	} else if cfg.PasswordFile != "" {
+		pass, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimSpace(string(pass)), nil
+	}
+
+	return "", ErrListenMissingPassword
+}
+
+// BuildServerConfig fills in the server config, returning the config for the
+// destination it should ingest into.
+func (cfg *ListenConfig) BuildServerConfig(serverConfig *smtpd.Config) (ingest.Config, error) {
+	dest, err := cfg.Dest.ResolveDestination()
+	if err != nil {
+		return ingest.Config{}, prettifyError(err, "dest", cfg.Dest.AuthMethod)
+	}
+	dest.CheckDuplicates = cfg.CheckDuplicates
+	dest.Normalise = cfg.Normalise
+	dest.QuotaThreshold = cfg.QuotaThreshold
+
+	serverConfig.Protocol = smtpd.Protocol(strings.ToLower(cfg.Protocol))
+	serverConfig.Hostname = cfg.Hostname
+	serverConfig.DefaultMailbox = dest.Mailbox
+	serverConfig.RejectUnknown = cfg.RejectUnknown
+
+	serverConfig.Routes = map[string]string{}
+	for _, route := range cfg.Routes.Value() {
+		rcpt, mailbox, ok := strings.Cut(route, "=")
+		if !ok || rcpt == "" {
+			return ingest.Config{}, fmt.Errorf("invalid route \"%v\", expected RECIPIENT=MAILBOX", route)
+		}
+		serverConfig.Routes[rcpt] = mailbox
+	}
+
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return ingest.Config{}, ErrListenTLSKeyPair
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return ingest.Config{}, err
+		}
+
+		serverConfig.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	if cfg.Username != "" {
+		password, err := cfg.readPassword()
+		if errors.Is(err, ErrListenMissingPassword) {
+			return ingest.Config{}, errors.New("at least one of the \"listen-password\" or \"listen-password-file\" flags is required")
+		} else if err != nil {
+			return ingest.Config{}, err
+		}
+		serverConfig.Users = map[string]string{cfg.Username: password}
+	}
+
+	if serverConfig.MaxMessageSize, err = parseSize(cfg.MaxMessageSize); err != nil {
+		return ingest.Config{}, fmt.Errorf("invalid max message size: %w", err)
+	}
+
+	return dest, nil
+}
@@ -0,0 +1,63 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/smtpd"
+)
+
+func TestListenConfig_BuildServerConfig(t *testing.T) {
+	cfg := DefaultListenConfig()
+	cfg.Dest.URL = "maildir://" + filepath.ToSlash(t.TempDir()) + "?folder=Archive"
+	cfg.Protocol = "LMTP"
+	cfg.Username = "user"
+	cfg.PasswordFile = "testdata/testpass.txt"
+	cfg.MaxMessageSize = "10M"
+	_ = cfg.Routes.Set("alice@example.com=Alice")
+	_ = cfg.Routes.Set("@example.org=Org")
+
+	serverConfig := smtpd.Config{}
+	dest, err := cfg.BuildServerConfig(&serverConfig)
+	assert.NoError(t, err)
+	assert.NotNil(t, dest.Sink)
+	assert.Equal(t, smtpd.ProtocolLMTP, serverConfig.Protocol)
+	assert.Equal(t, "Archive", serverConfig.DefaultMailbox)
+	assert.Equal(t, map[string]string{"alice@example.com": "Alice", "@example.org": "Org"}, serverConfig.Routes)
+	assert.Equal(t, map[string]string{"user": "password"}, serverConfig.Users)
+	assert.Equal(t, int64(10*1024*1024), serverConfig.MaxMessageSize)
+	assert.Nil(t, serverConfig.TLSConfig)
+	assert.Equal(t, "tcp", cfg.Network())
+
+	_ = cfg.Routes.Set("nobody")
+	_, err = cfg.BuildServerConfig(&serverConfig)
+	assert.EqualError(t, err, "invalid route \"nobody\", expected RECIPIENT=MAILBOX")
+
+	cfg = DefaultListenConfig()
+	cfg.Dest.URL = "maildir://" + filepath.ToSlash(t.TempDir())
+	cfg.TLSCert = "cert.pem"
+	_, err = cfg.BuildServerConfig(&serverConfig)
+	assert.ErrorIs(t, err, ErrListenTLSKeyPair)
+
+	cfg.Address = "/run/mailpump/lmtp.sock"
+	assert.Equal(t, "unix", cfg.Network())
+}
@@ -0,0 +1,189 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrMigrateDateRange = errors.New("--since must be before --before")
+)
+
+// migrateDateLayout is the format of --since and --before.
+const migrateDateLayout = "2006-01-02"
+
+func DefaultMigrateConfig() MigrateConfig {
+	return MigrateConfig{
+		Source:          DefaultIMAPConfig(),
+		Dest:            DefaultIMAPConfig(),
+		Workers:         4,
+		Checkpoint:      "mailpump-migrate.json",
+		Delete:          false,
+		BatchSize:       100,
+		LogLevel:        "info",
+		LogFormat:       "text",
+		CheckDuplicates: false,
+		Normalise:       false,
+		QuotaThreshold:  0,
+	}
+}
+
+func (cfg *MigrateConfig) Parameters() []cli.Flag {
+	def := DefaultMigrateConfig()
+	var name string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Source.makeIMAPParameters("source")...)
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("folder", "")
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:        name,
+		Usage:       "folder to migrate, e.g. INBOX or Lists/*. may be repeated. defaults to all folders",
+		EnvVars:     envs,
+		Destination: &cfg.Folders,
+	})
+
+	name, _, envs = makeFlagNames("map", "")
+	flags = append(flags, &cli.StringSliceFlag{
+		Name:        name,
+		Usage:       "migrate a folder and its subfolders to another name, as SOURCE=DEST. may be repeated",
+		EnvVars:     envs,
+		Destination: &cfg.Mappings,
+	})
+
+	name, _, envs = makeFlagNames("since", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "only migrate messages received on or after this date, as YYYY-MM-DD",
+		EnvVars:     envs,
+		Destination: &cfg.Since,
+		Value:       def.Since,
+	})
+
+	name, _, envs = makeFlagNames("before", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "only migrate messages received before this date, as YYYY-MM-DD",
+		EnvVars:     envs,
+		Destination: &cfg.Before,
+		Value:       def.Before,
+	})
+
+	name, _, envs = makeFlagNames("workers", "")
+	flags = append(flags, &cli.UintFlag{
+		Name:        name,
+		Usage:       "number of folders to migrate at once. imap dests only",
+		EnvVars:     envs,
+		Destination: &cfg.Workers,
+		Value:       def.Workers,
+	})
+
+	name, _, envs = makeFlagNames("checkpoint", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "file to record the progress of each folder in, so the migration can be resumed",
+		EnvVars:     envs,
+		Destination: &cfg.Checkpoint,
+		Value:       def.Checkpoint,
+	})
+
+	name, _, envs = makeFlagNames("delete", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "delete messages from the source once they've been copied",
+		EnvVars:     envs,
+		Destination: &cfg.Delete,
+		Value:       def.Delete,
+	})
+
+	name, _, envs = makeFlagNames("batch-size", "")
+	flags = append(flags, &cli.UintFlag{
+		Name:        name,
+		Usage:       "number of messages to fetch at a time",
+		EnvVars:     envs,
+		Destination: &cfg.BatchSize,
+		Value:       def.BatchSize,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	flags = append(flags, makeIngestTuningParameters(&cfg.CheckDuplicates, &cfg.Normalise, &cfg.QuotaThreshold)...)
+
+	return flags
+}
+
+// ParseMappings parses the folder mappings.
+func (cfg *MigrateConfig) ParseMappings() (map[string]string, error) {
+	mappings := map[string]string{}
+	for _, mapping := range cfg.Mappings.Value() {
+		from, to, ok := strings.Cut(mapping, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid mapping \"%v\", expected SOURCE=DEST", mapping)
+		}
+		mappings[from] = to
+	}
+
+	return mappings, nil
+}
+
+// ParseDateRange parses the dates to migrate between. Either may be zero.
+func (cfg *MigrateConfig) ParseDateRange() (time.Time, time.Time, error) {
+	var since, before time.Time
+	var err error
+
+	if cfg.Since != "" {
+		if since, err = time.Parse(migrateDateLayout, cfg.Since); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --since date \"%v\", expected YYYY-MM-DD", cfg.Since)
+		}
+	}
+
+	if cfg.Before != "" {
+		if before, err = time.Parse(migrateDateLayout, cfg.Before); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --before date \"%v\", expected YYYY-MM-DD", cfg.Before)
+		}
+	}
+
+	if !since.IsZero() && !before.IsZero() && !since.Before(before) {
+		return time.Time{}, time.Time{}, ErrMigrateDateRange
+	}
+
+	return since, before, nil
+}
+
+// BuildIngestConfig resolves the destination.
+func (cfg *MigrateConfig) BuildIngestConfig() (ingest.Config, error) {
+	dest, err := cfg.Dest.ResolveDestination()
+	if err != nil {
+		return ingest.Config{}, prettifyError(err, "dest", cfg.Dest.AuthMethod)
+	}
+
+	dest.CheckDuplicates = cfg.CheckDuplicates
+	dest.Normalise = cfg.Normalise
+	dest.QuotaThreshold = cfg.QuotaThreshold
+	return dest, nil
+}
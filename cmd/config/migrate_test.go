@@ -0,0 +1,68 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+func TestMigrateConfig_ParseMappings(t *testing.T) {
+	cfg := DefaultMigrateConfig()
+	cfg.Mappings = *cli.NewStringSlice("[Gmail]/Sent Mail=Sent", "Lists=Archive/Lists")
+
+	mappings, err := cfg.ParseMappings()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"[Gmail]/Sent Mail": "Sent",
+		"Lists":             "Archive/Lists",
+	}, mappings)
+
+	for _, mapping := range []string{"Sent", "=Sent", "Sent="} {
+		cfg.Mappings = *cli.NewStringSlice(mapping)
+		_, err = cfg.ParseMappings()
+		assert.Error(t, err, mapping)
+	}
+}
+
+func TestMigrateConfig_ParseDateRange(t *testing.T) {
+	cfg := DefaultMigrateConfig()
+	since, before, err := cfg.ParseDateRange()
+	assert.NoError(t, err)
+	assert.True(t, since.IsZero())
+	assert.True(t, before.IsZero())
+
+	cfg.Since = "2020-01-02"
+	cfg.Before = "2021-03-04"
+	since, before, err = cfg.ParseDateRange()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), since)
+	assert.Equal(t, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC), before)
+
+	cfg.Before = "2020-01-02"
+	_, _, err = cfg.ParseDateRange()
+	assert.ErrorIs(t, err, ErrMigrateDateRange)
+
+	cfg.Since = "02/01/2020"
+	_, _, err = cfg.ParseDateRange()
+	assert.Error(t, err)
+}
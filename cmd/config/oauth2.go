@@ -19,10 +19,12 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
 	"github.com/urfave/cli/v2"
+	"golang.org/x/oauth2"
 )
 
 func DefaultOAuth2Config() OAuth2Config {
@@ -124,3 +126,14 @@ func (cfg *OAuth2Config) Resolve() error {
 
 	return nil
 }
+
+// tokenSource resolves the configuration and returns a token source that refreshes
+// access tokens using refreshToken.
+func (cfg *OAuth2Config) tokenSource(refreshToken string) (oauth2.TokenSource, error) {
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background() // FIXME: use parent context
+	return cfg.Config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}), nil
+}
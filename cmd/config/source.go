@@ -0,0 +1,173 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/jmap"
+	"git.vs49688.net/zane/mailpump/maildir"
+	"git.vs49688.net/zane/mailpump/pop3"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+// Source is a resolved source.
+type Source struct {
+	imap.ConnectionConfig
+	Factory imap.Factory
+
+	// Receiver, if set, creates the receiver for a non-IMAP source.
+	Receiver receiver.Factory
+
+	// Name is a printable name for the source, without the password.
+	Name string
+}
+
+// pop3Config builds the configuration for a pop3:// or pop3s:// URL.
+func (cfg *IMAPConfig) pop3Config(u *url.URL) (*pop3.Config, error) {
+	cfg.fillDefaults()
+	q := u.Query()
+
+	c := &pop3.Config{}
+
+	port := "110"
+	if strings.ToLower(u.Scheme) == "pop3s" {
+		port = "995"
+		c.Security = pop3.SecurityTLS
+	} else {
+		c.Security = pop3.SecurityStartTLS
+
+		if q.Get("starttls") != "" {
+			starttls, err := queryBool(q, "starttls")
+			if err != nil {
+				return nil, err
+			}
+
+			if !starttls {
+				c.Security = pop3.SecurityNone
+			}
+		}
+	}
+
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	c.Address = net.JoinHostPort(u.Hostname(), port)
+
+	if cfg.TLSSkipVerify {
+		// #nosec G402
+		c.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	user, pass, err := cfg.validateUserPass()
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToUpper(cfg.AuthMethod) {
+	case "LOGIN":
+		c.Username = user
+		c.Password = pass
+	case "APOP":
+		c.Username = user
+		c.Password = pass
+		c.APOP = true
+	case sasl.Plain:
+		c.Auth = sasl.NewPlainClient("", user, pass)
+	default:
+		return nil, fmt.Errorf("unsupported auth method: %v", cfg.AuthMethod)
+	}
+
+	return c, nil
+}
+
+// ResolveSource will validate and resolve the configuration into a Source. Unlike Resolve,
+// this also accepts the URLs of non-IMAP sources, such as jmap://, pop3://, and maildir://. As with ResolveDestination,
+// their options are given as URL query parameters, with the source mailbox in "folder".
+func (cfg *IMAPConfig) ResolveSource() (Source, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return Source{}, err
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "jmap":
+		jmapCfg, err := cfg.jmapConfig(u)
+		if err != nil {
+			return Source{}, err
+		}
+
+		mailbox := u.Query().Get("folder")
+		if mailbox == "" {
+			mailbox = "INBOX"
+		}
+
+		name := url.URL{Scheme: "jmap", User: url.User(cfg.Username), Host: u.Host, Path: mailbox}
+
+		return Source{
+			ConnectionConfig: imap.ConnectionConfig{Mailbox: mailbox},
+			Receiver:         &jmap.ReceiverFactory{Config: *jmapCfg, MoveTo: u.Query().Get("move_to")},
+			Name:             name.String(),
+		}, nil
+	case "maildir":
+		mailbox := u.Query().Get("folder")
+		if mailbox == "" {
+			mailbox = "INBOX"
+		}
+
+		name := url.URL{Scheme: "maildir", Path: urlPath(u), RawQuery: url.Values{"folder": {mailbox}}.Encode()}
+
+		return Source{
+			ConnectionConfig: imap.ConnectionConfig{Mailbox: mailbox},
+			Receiver:         &maildir.ReceiverFactory{Path: urlPath(u), MoveTo: u.Query().Get("move_to")},
+			Name:             name.String(),
+		}, nil
+	case "pop3", "pop3s":
+		pop3Cfg, err := cfg.pop3Config(u)
+		if err != nil {
+			return Source{}, err
+		}
+
+		name := url.URL{Scheme: strings.ToLower(u.Scheme), User: url.User(cfg.Username), Host: u.Host}
+
+		return Source{
+			ConnectionConfig: imap.ConnectionConfig{Mailbox: "INBOX"},
+			Receiver:         &pop3.ReceiverFactory{Config: *pop3Cfg},
+			Name:             name.String(),
+		}, nil
+	default:
+		connConfig, factory, err := cfg.Resolve()
+		if err != nil {
+			return Source{}, err
+		}
+
+		return Source{
+			ConnectionConfig: connConfig,
+			Factory:          factory,
+			Name:             MakeSourceName(cfg.Username, &connConfig),
+		}, nil
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/imap/persistentclient"
+	"git.vs49688.net/zane/mailpump/jmap"
+	"git.vs49688.net/zane/mailpump/maildir"
+	"git.vs49688.net/zane/mailpump/pop3"
+	"git.vs49688.net/zane/mailpump/pump"
+)
+
+func TestIMAPConfig_ResolveSource(t *testing.T) {
+	cfg := getTestIMAPConfig()
+
+	src, err := cfg.ResolveSource()
+	assert.NoError(t, err)
+	assert.Equal(t, "INBOX", src.Mailbox)
+	assert.Equal(t, persistentclient.Factory{MaxDelay: 0}, src.Factory)
+	assert.Nil(t, src.Receiver)
+	assert.Equal(t, "imaps://username@imap.hostname.com:1234/INBOX", src.Name)
+
+	cfg.URL = "jmap://api.example.com?folder=Lists/Go&move_to=Archive"
+	src, err = cfg.ResolveSource()
+	assert.NoError(t, err)
+	assert.Equal(t, "Lists/Go", src.Mailbox)
+	assert.Nil(t, src.Factory)
+	assert.Equal(t, "jmap://username@api.example.com/Lists/Go", src.Name)
+	assert.Equal(t, &jmap.ReceiverFactory{
+		Config: jmap.Config{
+			SessionURL: "https://api.example.com/.well-known/jmap",
+			Username:   "username",
+			Password:   "password",
+		},
+		MoveTo: "Archive",
+	}, src.Receiver)
+
+	cfg.URL = "jmap://api.example.com"
+	src, err = cfg.ResolveSource()
+	assert.NoError(t, err)
+	assert.Equal(t, "INBOX", src.Mailbox)
+
+	cfg.URL = "maildir:///var/mail/user?folder=Lists/Go&move_to=Archive"
+	src, err = cfg.ResolveSource()
+	assert.NoError(t, err)
+	assert.Equal(t, "Lists/Go", src.Mailbox)
+	assert.Equal(t, "maildir:///var/mail/user?folder=Lists%2FGo", src.Name)
+	assert.Equal(t, &maildir.ReceiverFactory{Path: "/var/mail/user", MoveTo: "Archive"}, src.Receiver)
+}
+
+func TestIMAPConfig_pop3Config(t *testing.T) {
+	cfg := getTestIMAPConfig()
+
+	u, _ := url.Parse("pop3s://pop.example.com")
+	c, err := cfg.pop3Config(u)
+	assert.NoError(t, err)
+	assert.Equal(t, &pop3.Config{
+		Address:  "pop.example.com:995",
+		Security: pop3.SecurityTLS,
+		Username: "username",
+		Password: "password",
+	}, c)
+
+	cfg.AuthMethod = "APOP"
+	u, _ = url.Parse("pop3://pop.example.com:1110?starttls=false")
+	c, err = cfg.pop3Config(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "pop.example.com:1110", c.Address)
+	assert.Equal(t, pop3.SecurityNone, c.Security)
+	assert.True(t, c.APOP)
+
+	cfg.AuthMethod = "PLAIN"
+	u, _ = url.Parse("pop3://pop.example.com")
+	c, err = cfg.pop3Config(u)
+	assert.NoError(t, err)
+	assert.Equal(t, "pop.example.com:110", c.Address)
+	assert.Equal(t, pop3.SecurityStartTLS, c.Security)
+	assert.NotNil(t, c.Auth)
+
+	cfg.URL = "pop3s://pop.example.com"
+	src, err := cfg.ResolveSource()
+	assert.NoError(t, err)
+	assert.Equal(t, "pop3s://username@pop.example.com", src.Name)
+	assert.IsType(t, &pop3.ReceiverFactory{}, src.Receiver)
+}
+
+func TestCliConfig_BuildPumpConfigOnce(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Source = getTestIMAPConfig()
+	cfg.Dest = getTestIMAPConfig()
+	cfg.Once = true
+
+	pumpConfig := pump.Config{}
+	assert.NoError(t, cfg.BuildPumpConfig(&pumpConfig))
+	assert.True(t, pumpConfig.Once)
+
+	cfg.Source.URL = "maildir:///var/mail/user"
+	assert.ErrorIs(t, cfg.BuildPumpConfig(&pumpConfig), ErrOnceUnsupported)
+}
+
+func TestCliConfig_BuildDryRunConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Maildir")
+
+	cfg := DefaultConfig()
+	cfg.Source = getTestIMAPConfig()
+	cfg.Dest = DefaultIMAPConfig()
+	cfg.Dest.URL = "maildir://" + filepath.ToSlash(path) + "?folder=Archive"
+	cfg.DisableDeletions = true
+
+	pumpConfig := pump.Config{}
+	assert.NoError(t, cfg.BuildDryRunConfig(&pumpConfig))
+	assert.Equal(t, "imap.hostname.com:1234", pumpConfig.Source.HostPort)
+	assert.Equal(t, "Archive", pumpConfig.Dest.Mailbox)
+	assert.True(t, pumpConfig.DisableDeletions)
+	assert.Nil(t, pumpConfig.DestSink)
+
+	_, err := os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	cfg.Dest = getTestIMAPConfig()
+	assert.NoError(t, cfg.BuildDryRunConfig(&pumpConfig))
+	assert.Equal(t, "INBOX", pumpConfig.Dest.Mailbox)
+}
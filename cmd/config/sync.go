@@ -0,0 +1,96 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"errors"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/mailsync"
+)
+
+var (
+	ErrInvalidSyncInterval = errors.New("sync interval must be positive")
+)
+
+func DefaultSyncConfig() SyncConfig {
+	return SyncConfig{
+		Source:    DefaultIMAPConfig(),
+		Dest:      DefaultIMAPConfig(),
+		State:     "mailpump-sync.json",
+		Conflict:  string(mailsync.ConflictKeep),
+		Interval:  time.Minute,
+		LogLevel:  "info",
+		LogFormat: "text",
+	}
+}
+
+func (cfg *SyncConfig) Parameters() []cli.Flag {
+	def := DefaultSyncConfig()
+	var name string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Source.makeIMAPParameters("source")...)
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("state", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "file to keep the sync state in",
+		EnvVars:     envs,
+		Destination: &cfg.State,
+		Value:       def.State,
+	})
+
+	name, _, envs = makeFlagNames("conflict", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "what to do with a message deleted on one side and changed on the other (keep/source/dest)",
+		EnvVars:     envs,
+		Destination: &cfg.Conflict,
+		Value:       def.Conflict,
+	})
+
+	name, _, envs = makeFlagNames("interval", "")
+	flags = append(flags, &cli.DurationFlag{
+		Name:        name,
+		Usage:       "time between syncs",
+		EnvVars:     envs,
+		Destination: &cfg.Interval,
+		Value:       def.Interval,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	return flags
+}
+
+func (cfg *SyncConfig) Validate() error {
+	if _, err := mailsync.ParseConflictPolicy(cfg.Conflict); err != nil {
+		return err
+	}
+
+	if cfg.Interval <= 0 {
+		return ErrInvalidSyncInterval
+	}
+
+	return nil
+}
@@ -60,4 +60,103 @@ type CliConfig struct {
 	DisableDeletions     bool          `json:"disable_deletions"`
 	FetchBufferSize      uint          `json:"fetch_buffer_size"`
 	FetchMaxInterval     time.Duration `json:"fetch_max_interval"`
+	CheckDuplicates      bool          `json:"check_duplicates"`
+	Normalise            bool          `json:"normalise"`
+	QuotaThreshold       float64       `json:"quota_threshold"`
+	RejectMailbox        string        `json:"reject_mailbox"`
+	ShutdownTimeout      time.Duration `json:"shutdown_timeout"`
+	Once                 bool          `json:"once"`
+	DryRun               bool          `json:"dry_run"`
+	DryRunFormat         string        `json:"dry_run_format"`
+}
+
+type ListenConfig struct {
+	Dest            IMAPConfig      `json:"dest"`
+	Address         string          `json:"address"`
+	Protocol        string          `json:"protocol"`
+	Hostname        string          `json:"hostname"`
+	TLSCert         string          `json:"tls_cert"`
+	TLSKey          string          `json:"tls_key"`
+	Username        string          `json:"username"`
+	Password        string          `json:"password,omitempty"`
+	PasswordFile    string          `json:"password_file"`
+	Routes          cli.StringSlice `json:"-"`
+	RejectUnknown   bool            `json:"reject_unknown"`
+	MaxMessageSize  string          `json:"max_message_size"`
+	LogLevel        string          `json:"log_level"`
+	LogFormat       string          `json:"log_format"`
+	CheckDuplicates bool            `json:"check_duplicates"`
+	Normalise       bool            `json:"normalise"`
+	QuotaThreshold  float64         `json:"quota_threshold"`
+}
+
+type DeliverConfig struct {
+	Dest            IMAPConfig      `json:"dest"`
+	Mailbox         string          `json:"mailbox"`
+	Flags           cli.StringSlice `json:"-"`
+	Timeout         time.Duration   `json:"timeout"`
+	LogLevel        string          `json:"log_level"`
+	LogFormat       string          `json:"log_format"`
+	CheckDuplicates bool            `json:"check_duplicates"`
+	Normalise       bool            `json:"normalise"`
+}
+
+type ImportConfig struct {
+	Dest             IMAPConfig    `json:"dest"`
+	From             string        `json:"from"`
+	Mailbox          string        `json:"mailbox"`
+	Concurrency      uint          `json:"concurrency"`
+	Checkpoint       string        `json:"checkpoint"`
+	ProgressInterval time.Duration `json:"progress_interval"`
+	LogLevel         string        `json:"log_level"`
+	LogFormat        string        `json:"log_format"`
+	CheckDuplicates  bool          `json:"check_duplicates"`
+	Normalise        bool          `json:"normalise"`
+	QuotaThreshold   float64       `json:"quota_threshold"`
+}
+
+type MigrateConfig struct {
+	Source          IMAPConfig      `json:"source"`
+	Dest            IMAPConfig      `json:"dest"`
+	Folders         cli.StringSlice `json:"-"`
+	Mappings        cli.StringSlice `json:"-"`
+	Since           string          `json:"since"`
+	Before          string          `json:"before"`
+	Workers         uint            `json:"workers"`
+	Checkpoint      string          `json:"checkpoint"`
+	Delete          bool            `json:"delete"`
+	BatchSize       uint            `json:"batch_size"`
+	LogLevel        string          `json:"log_level"`
+	LogFormat       string          `json:"log_format"`
+	CheckDuplicates bool            `json:"check_duplicates"`
+	Normalise       bool            `json:"normalise"`
+	QuotaThreshold  float64         `json:"quota_threshold"`
+}
+
+type VerifyConfig struct {
+	Source    IMAPConfig `json:"source"`
+	Dest      IMAPConfig `json:"dest"`
+	Format    string     `json:"format"`
+	Repump    bool       `json:"repump"`
+	LogLevel  string     `json:"log_level"`
+	LogFormat string     `json:"log_format"`
+}
+
+type SyncConfig struct {
+	Source    IMAPConfig    `json:"source"`
+	Dest      IMAPConfig    `json:"dest"`
+	State     string        `json:"state"`
+	Conflict  string        `json:"conflict"`
+	Interval  time.Duration `json:"interval"`
+	LogLevel  string        `json:"log_level"`
+	LogFormat string        `json:"log_format"`
+}
+
+type ExportConfig struct {
+	Source    IMAPConfig `json:"source"`
+	To        string     `json:"to"`
+	State     string     `json:"state"`
+	BatchSize uint       `json:"batch_size"`
+	LogLevel  string     `json:"log_level"`
+	LogFormat string     `json:"log_format"`
 }
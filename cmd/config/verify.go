@@ -0,0 +1,83 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package config
+
+import (
+	"errors"
+
+	"github.com/urfave/cli/v2"
+)
+
+var (
+	ErrInvalidVerifyFormat = errors.New("invalid format, expected text or json")
+)
+
+func DefaultVerifyConfig() VerifyConfig {
+	return VerifyConfig{
+		Source:    DefaultIMAPConfig(),
+		Dest:      DefaultIMAPConfig(),
+		Format:    "text",
+		Repump:    false,
+		LogLevel:  "warning",
+		LogFormat: "text",
+	}
+}
+
+func (cfg *VerifyConfig) Parameters() []cli.Flag {
+	def := DefaultVerifyConfig()
+	var name string
+	var envs []string
+	var flags []cli.Flag
+
+	flags = append(flags, cfg.Source.makeIMAPParameters("source")...)
+	flags = append(flags, cfg.Dest.makeIMAPParameters("dest")...)
+
+	name, _, envs = makeFlagNames("format", "")
+	flags = append(flags, &cli.StringFlag{
+		Name:        name,
+		Usage:       "report format (text/json)",
+		EnvVars:     envs,
+		Destination: &cfg.Format,
+		Value:       def.Format,
+	})
+
+	name, _, envs = makeFlagNames("repump", "")
+	flags = append(flags, &cli.BoolFlag{
+		Name:        name,
+		Usage:       "copy messages missing from the dest again",
+		EnvVars:     envs,
+		Destination: &cfg.Repump,
+		Value:       def.Repump,
+	})
+
+	flags = append(flags, makeLogParameters(&cfg.LogLevel, &cfg.LogFormat, def.LogLevel, def.LogFormat)...)
+
+	return flags
+}
+
+// Validate checks the options that can't be checked by resolving the
+// source or dest.
+func (cfg *VerifyConfig) Validate() error {
+	switch cfg.Format {
+	case "text", "json":
+		return nil
+	default:
+		return ErrInvalidVerifyFormat
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package deliver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// Exit codes, from sysexits.h. MTAs bounce or retry based on these.
+const (
+	exOK          = 0
+	exUsage       = 64
+	exDataErr     = 65
+	exUnavailable = 69
+	exIOErr       = 74
+	exTempFail    = 75
+	exConfig      = 78
+)
+
+var (
+	errEmptyMessage = errors.New("message is empty")
+)
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+// readMessage reads a message, dropping the mbox "From " line some MTAs
+// prepend, and converting line endings to CRLF.
+func readMessage(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(body, []byte("From ")) {
+		if i := bytes.IndexByte(body, '\n'); i >= 0 {
+			body = body[i+1:]
+		} else {
+			body = nil
+		}
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil, errEmptyMessage
+	}
+
+	return archive.CRLF(body), nil
+}
+
+// deliver ingests a message, giving up after the timeout.
+func deliver(ing ingest.Client, mailbox string, flags []string, body []byte, timeout time.Duration) error {
+	msg := imap.NewMessage(1, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822})
+	msg.Uid = 1
+	msg.Flags = flags
+	msg.InternalDate = time.Now()
+	msg.Body[rfc822Section] = bytes.NewBuffer(body)
+
+	return ingest.IngestMessageSyncTimeout("stdin", mailbox, ing, msg, timeout)
+}
+
+// exitCode maps the result of a delivery to an exit code. Anything not known
+// to be permanent is retried.
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exOK
+	case errors.Is(err, errEmptyMessage):
+		return exDataErr
+	case delivery.IsPermanent(err):
+		return exUnavailable
+	default:
+		return exTempFail
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package deliver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+type testSink struct {
+	err     error
+	mailbox string
+	flags   []string
+	body    string
+}
+
+func (s *testSink) Deliver(mailbox string, flags []string, _ time.Time, body []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.mailbox, s.flags, s.body = mailbox, flags, string(body)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func TestReadMessage(t *testing.T) {
+	body, err := readMessage(strings.NewReader("From sender@example.com Sat Oct 18 10:00:00 2026\nSubject: Test\n\nHello\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Subject: Test\r\n\r\nHello\r\n", string(body))
+
+	_, err = readMessage(strings.NewReader("From sender@example.com Sat Oct 18 10:00:00 2026\n\n"))
+	assert.ErrorIs(t, err, errEmptyMessage)
+}
+
+func TestDeliver(t *testing.T) {
+	sink := &testSink{}
+	ing, err := ingest.NewClient(&ingest.Config{Sink: sink})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ing.Close()
+
+	err = deliver(ing, "Archive", []string{"\\Seen"}, []byte("Subject: Test\r\n\r\nHello\r\n"), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, exOK, exitCode(err))
+	assert.Equal(t, "Archive", sink.mailbox)
+	assert.Equal(t, []string{"\\Seen"}, sink.flags)
+	assert.Equal(t, "Subject: Test\r\n\r\nHello\r\n", sink.body)
+
+	sink.err = errors.New("try again")
+	err = deliver(ing, "Archive", nil, []byte("Subject: Test\r\n\r\nHello\r\n"), time.Second)
+	assert.Equal(t, exTempFail, exitCode(err))
+
+	sink.err = &delivery.PermanentError{Err: ingest.ErrMessageTooLarge}
+	err = deliver(ing, "Archive", nil, []byte("Subject: Test\r\n\r\nHello\r\n"), time.Second)
+	assert.Equal(t, exUnavailable, exitCode(err))
+}
@@ -0,0 +1,80 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package deliver
+
+import (
+	"errors"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.DeliverConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "deliver",
+		Usage:  "Deliver a single message from stdin, for use as an MDA",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+		OnUsageError: func(_ *cli.Context, err error, _ bool) error {
+			return cli.Exit(err, exUsage)
+		},
+	})
+	return app
+}
+
+func run(_ *cli.Context, cfg *config.DeliverConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	ingestConfig, err := cfg.BuildIngestConfig()
+	if err != nil {
+		return cli.Exit(err, exConfig)
+	}
+
+	body, err := readMessage(os.Stdin)
+	if errors.Is(err, errEmptyMessage) {
+		return cli.Exit(err, exDataErr)
+	} else if err != nil {
+		return cli.Exit(err, exIOErr)
+	}
+
+	ing, err := ingest.NewClient(&ingestConfig)
+	if err != nil {
+		return cli.Exit(err, exTempFail)
+	}
+
+	err = deliver(ing, ingestConfig.Mailbox, cfg.Flags.Value(), body, cfg.Timeout)
+	if errors.Is(err, ingest.ErrTimeout) {
+		// The destination is stuck, don't wait for it to shut down. An APPEND
+		// in flight may still land, see --check-duplicates.
+		return cli.Exit(err, exTempFail)
+	}
+	ing.Close()
+
+	if err != nil {
+		log.WithError(err).WithField("mailbox", ingestConfig.Mailbox).Error("deliver_failed")
+		return cli.Exit(err, exitCode(err))
+	}
+
+	log.WithFields(log.Fields{"mailbox": ingestConfig.Mailbox, "size": len(body)}).Info("deliver_succeeded")
+	return nil
+}
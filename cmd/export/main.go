@@ -0,0 +1,155 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package export
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.ExportConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "export",
+		Usage:  "Copy new messages from an IMAP mailbox to a local Maildir, mbox, or directory of .eml files",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+func run(_ *cli.Context, cfg *config.ExportConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"source_url":             cfg.Source.URL,
+		"source_username":        cfg.Source.Username,
+		"source_auth_method":     cfg.Source.AuthMethod,
+		"source_password_file":   cfg.Source.PasswordFile,
+		"source_tls_skip_verify": cfg.Source.TLSSkipVerify,
+		"source_transport":       cfg.Source.Transport,
+		"to":                     cfg.To,
+		"state":                  cfg.State,
+		"batch_size":             cfg.BatchSize,
+		"log_level":              cfg.LogLevel,
+		"log_format":             cfg.LogFormat,
+	}).Info("starting")
+
+	connConfig, factory, err := cfg.Source.Resolve()
+	if err != nil {
+		return err
+	}
+
+	if connConfig.Mailbox == "" {
+		connConfig.Mailbox = "INBOX"
+	}
+
+	ingestConfig, err := cfg.ResolveTarget()
+	if err != nil {
+		return err
+	}
+
+	state, err := archive.OpenStateFile(cfg.State)
+	if err != nil {
+		return err
+	}
+
+	target := ingestConfig.Mailbox
+	if target == "" {
+		target = connConfig.Mailbox
+	}
+
+	ing, err := ingest.NewClient(&ingestConfig)
+	if err != nil {
+		return err
+	}
+	defer ing.Close()
+
+	client, err := factory.NewClient(&imap.ClientConfig{ConnectionConfig: connConfig})
+	if err != nil {
+		return err
+	}
+	defer client.Logout()
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	go func() {
+		sigcount := 0
+		for {
+			select {
+			case sig := <-sigchan:
+				sigcount += 1
+				if sigcount > 1 {
+					log.WithFields(log.Fields{"signal": sig}).Warn("received_interrupt_force_exit")
+					os.Exit(1)
+				}
+				log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
+
+				close(stopChan)
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	stats, err := archive.Export(&archive.ExportConfig{
+		Client:        client,
+		Mailbox:       connConfig.Mailbox,
+		Ingest:        ing,
+		TargetMailbox: target,
+		Source:        config.MakeSourceName(cfg.Source.Username, &connConfig),
+		State:         state,
+		BatchSize:     int(cfg.BatchSize),
+		Stop:          stopChan,
+		Logger:        log.NewEntry(log.StandardLogger()),
+	})
+	if errors.Is(err, archive.ErrStopped) {
+		return fmt.Errorf("%w after %d message(s), run again to continue", err, stats.Exported)
+	} else if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"exported": stats.Exported,
+		"skipped":  stats.Skipped,
+		"failed":   stats.Failed,
+	}).Info("export_finished")
+
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d message(s) were rejected by the destination", stats.Failed)
+	}
+
+	return nil
+}
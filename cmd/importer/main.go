@@ -0,0 +1,148 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.ImportConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "import",
+		Usage:  "Import an mbox file, Maildir, or directory of .eml files",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+func run(_ *cli.Context, cfg *config.ImportConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"dest_url":             cfg.Dest.URL,
+		"dest_username":        cfg.Dest.Username,
+		"dest_auth_method":     cfg.Dest.AuthMethod,
+		"dest_password_file":   cfg.Dest.PasswordFile,
+		"dest_tls_skip_verify": cfg.Dest.TLSSkipVerify,
+		"dest_transport":       cfg.Dest.Transport,
+		"from":                 cfg.From,
+		"mailbox":              cfg.Mailbox,
+		"concurrency":          cfg.Concurrency,
+		"checkpoint":           cfg.Checkpoint,
+		"progress_interval":    cfg.ProgressInterval,
+		"log_level":            cfg.LogLevel,
+		"log_format":           cfg.LogFormat,
+		"check_duplicates":     cfg.CheckDuplicates,
+		"normalise":            cfg.Normalise,
+		"quota_threshold":      cfg.QuotaThreshold,
+	}).Info("starting")
+
+	reader, err := cfg.ResolveReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	ingestConfig, err := cfg.BuildIngestConfig()
+	if err != nil {
+		return err
+	}
+
+	// Sinks can't be used concurrently, only IMAP servers get more connections
+	count := 1
+	if ingestConfig.Sink == nil && cfg.Concurrency > 1 {
+		count = int(cfg.Concurrency)
+	}
+
+	clients := make([]ingest.Client, 0, count)
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		client, err := ingest.NewClient(&ingestConfig)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, client)
+	}
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	go func() {
+		sigcount := 0
+		for {
+			select {
+			case sig := <-sigchan:
+				sigcount += 1
+				if sigcount > 1 {
+					log.WithFields(log.Fields{"signal": sig}).Warn("received_interrupt_force_exit")
+					os.Exit(1)
+				}
+				log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
+
+				close(stopChan)
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	stats, err := archive.Import(&archive.ImportConfig{
+		Reader:           reader,
+		Clients:          clients,
+		Mailbox:          ingestConfig.Mailbox,
+		Source:           cfg.From,
+		Checkpoint:       cfg.Checkpoint,
+		ProgressInterval: cfg.ProgressInterval,
+		Stop:             stopChan,
+		Logger:           log.NewEntry(log.StandardLogger()),
+	})
+	if errors.Is(err, archive.ErrStopped) && cfg.Checkpoint != "" {
+		return fmt.Errorf("%w, run again with the same checkpoint to resume", err)
+	} else if err != nil {
+		return err
+	}
+
+	if stats.Failed > 0 {
+		return fmt.Errorf("%d message(s) failed to import", stats.Failed)
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package listen
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/smtpd"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.ListenConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "listen",
+		Usage:  "Accept mail over SMTP or LMTP and ingest it",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+func run(_ *cli.Context, cfg *config.ListenConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"dest_url":                cfg.Dest.URL,
+		"dest_username":           cfg.Dest.Username,
+		"dest_auth_method":        cfg.Dest.AuthMethod,
+		"dest_password_file":      cfg.Dest.PasswordFile,
+		"dest_tls_skip_verify":    cfg.Dest.TLSSkipVerify,
+		"dest_transport":          cfg.Dest.Transport,
+		"listen_address":          cfg.Address,
+		"listen_protocol":         cfg.Protocol,
+		"listen_hostname":         cfg.Hostname,
+		"listen_tls_cert":         cfg.TLSCert,
+		"listen_username":         cfg.Username,
+		"listen_routes":           cfg.Routes.Value(),
+		"listen_reject_unknown":   cfg.RejectUnknown,
+		"listen_max_message_size": cfg.MaxMessageSize,
+		"log_level":               cfg.LogLevel,
+		"log_format":              cfg.LogFormat,
+		"check_duplicates":        cfg.CheckDuplicates,
+		"normalise":               cfg.Normalise,
+		"quota_threshold":         cfg.QuotaThreshold,
+	}).Info("starting")
+
+	serverConfig := smtpd.Config{Logger: log.NewEntry(log.StandardLogger())}
+	ingestConfig, err := cfg.BuildServerConfig(&serverConfig)
+	if err != nil {
+		return err
+	}
+
+	ing, err := ingest.NewClient(&ingestConfig)
+	if err != nil {
+		return err
+	}
+	defer ing.Close()
+
+	serverConfig.Ingest = ing
+	server, err := smtpd.NewServer(&serverConfig)
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen(cfg.Network(), cfg.Address)
+	if err != nil {
+		return err
+	}
+
+	doneChan := make(chan error, 1)
+	go func() { doneChan <- server.Serve(l) }()
+
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	sigcount := 0
+	for {
+		select {
+		case sig := <-sigchan:
+			log.WithFields(log.Fields{"signal": sig, "count": sigcount}).Trace("caught_signal")
+
+			sigcount += 1
+			if sigcount > 1 {
+				log.WithFields(log.Fields{"signal": sig}).Warn("received_interrupt_force_exit")
+				os.Exit(1)
+			}
+			log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
+
+			go func() { _ = server.Close() }()
+		case err := <-doneChan:
+			_ = server.Close()
+			if errors.Is(err, smtpd.ErrServerClosed) {
+				log.Info("listener_terminated")
+				return nil
+			}
+			return err
+		}
+	}
+}
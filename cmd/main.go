@@ -23,9 +23,16 @@ import (
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/deliver"
+	"git.vs49688.net/zane/mailpump/cmd/export"
+	"git.vs49688.net/zane/mailpump/cmd/importer"
+	"git.vs49688.net/zane/mailpump/cmd/listen"
+	"git.vs49688.net/zane/mailpump/cmd/migrate"
 	"git.vs49688.net/zane/mailpump/cmd/oauthlogin"
 	"git.vs49688.net/zane/mailpump/cmd/run"
 	run_multi "git.vs49688.net/zane/mailpump/cmd/run-multi"
+	"git.vs49688.net/zane/mailpump/cmd/sync"
+	"git.vs49688.net/zane/mailpump/cmd/verify"
 )
 
 func Main() {
@@ -39,6 +46,13 @@ to another mailbox on a different server, deleting the originals.
 
 	run.RegisterCommand(&app)
 	run_multi.RegisterCommand(&app)
+	listen.RegisterCommand(&app)
+	deliver.RegisterCommand(&app)
+	importer.RegisterCommand(&app)
+	export.RegisterCommand(&app)
+	migrate.RegisterCommand(&app)
+	verify.RegisterCommand(&app)
+	sync.RegisterCommand(&app)
 	oauthlogin.RegisterCommand(&app)
 
 	err := app.Run(os.Args)
@@ -0,0 +1,233 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/migrate"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.MigrateConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "migrate",
+		Usage:  "Copy every folder from one account to another",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+func run(_ *cli.Context, cfg *config.MigrateConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"source_url":             cfg.Source.URL,
+		"source_username":        cfg.Source.Username,
+		"source_auth_method":     cfg.Source.AuthMethod,
+		"source_password_file":   cfg.Source.PasswordFile,
+		"source_tls_skip_verify": cfg.Source.TLSSkipVerify,
+		"dest_url":               cfg.Dest.URL,
+		"dest_username":          cfg.Dest.Username,
+		"dest_auth_method":       cfg.Dest.AuthMethod,
+		"dest_password_file":     cfg.Dest.PasswordFile,
+		"dest_tls_skip_verify":   cfg.Dest.TLSSkipVerify,
+		"dest_transport":         cfg.Dest.Transport,
+		"folders":                cfg.Folders.Value(),
+		"mappings":               cfg.Mappings.Value(),
+		"since":                  cfg.Since,
+		"before":                 cfg.Before,
+		"workers":                cfg.Workers,
+		"checkpoint":             cfg.Checkpoint,
+		"delete":                 cfg.Delete,
+		"batch_size":             cfg.BatchSize,
+		"log_level":              cfg.LogLevel,
+		"log_format":             cfg.LogFormat,
+		"check_duplicates":       cfg.CheckDuplicates,
+		"normalise":              cfg.Normalise,
+		"quota_threshold":        cfg.QuotaThreshold,
+	}).Info("starting")
+
+	mappings, err := cfg.ParseMappings()
+	if err != nil {
+		return err
+	}
+
+	since, before, err := cfg.ParseDateRange()
+	if err != nil {
+		return err
+	}
+
+	// The source mailbox changes for each folder, which a persistent client
+	// wouldn't restore after reconnecting, so always use a standard one.
+	connConfig, _, err := cfg.Source.Resolve()
+	if err != nil {
+		return err
+	}
+	connConfig.Mailbox = ""
+
+	ingestConfig, err := cfg.BuildIngestConfig()
+	if err != nil {
+		return err
+	}
+
+	var state *archive.StateFile
+	if cfg.Checkpoint != "" {
+		if state, err = archive.OpenStateFile(cfg.Checkpoint); err != nil {
+			return err
+		}
+	}
+
+	// Sinks can't be used concurrently, only IMAP servers get more workers
+	count := 1
+	var dest imap.Client
+	if ingestConfig.Sink == nil {
+		if cfg.Workers > 1 {
+			count = int(cfg.Workers)
+		}
+
+		destConfig := ingestConfig.ConnectionConfig
+		destConfig.Mailbox = ""
+		if dest, err = ingestConfig.Factory.NewClient(&imap.ClientConfig{ConnectionConfig: destConfig}); err != nil {
+			return err
+		}
+		defer dest.Logout()
+	}
+
+	clients := make([]ingest.Client, 0, count)
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		c, err := ingest.NewClient(&ingestConfig)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, c)
+	}
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	go func() {
+		sigcount := 0
+		for {
+			select {
+			case sig := <-sigchan:
+				sigcount += 1
+				if sigcount > 1 {
+					log.WithFields(log.Fields{"signal": sig}).Warn("received_interrupt_force_exit")
+					os.Exit(1)
+				}
+				log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
+
+				close(stopChan)
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	results, err := migrate.Migrate(&migrate.Config{
+		Source:     connConfig,
+		Factory:    client.Factory{},
+		SourceName: config.MakeSourceName(cfg.Source.Username, &connConfig),
+		Clients:    clients,
+		Dest:       dest,
+		Folders:    cfg.Folders.Value(),
+		Mapping:    mappings,
+		Since:      since,
+		Before:     before,
+		Delete:     cfg.Delete,
+		State:      state,
+		BatchSize:  int(cfg.BatchSize),
+		Stop:       stopChan,
+		Logger:     log.NewEntry(log.StandardLogger()),
+	})
+	if err != nil && !errors.Is(err, archive.ErrStopped) {
+		return err
+	}
+
+	var total archive.ExportStats
+	var unfinished int
+	for _, r := range results {
+		fields := log.Fields{
+			"folder":  r.Name,
+			"target":  r.Target,
+			"copied":  r.Exported,
+			"skipped": r.Skipped,
+			"failed":  r.Failed,
+		}
+
+		if r.Err != nil {
+			unfinished++
+			log.WithFields(fields).WithError(r.Err).Warn("migrate_summary")
+		} else {
+			log.WithFields(fields).Info("migrate_summary")
+		}
+
+		total.Exported += r.Exported
+		total.Skipped += r.Skipped
+		total.Failed += r.Failed
+	}
+
+	log.WithFields(log.Fields{
+		"folders":    len(results),
+		"unfinished": unfinished,
+		"copied":     total.Exported,
+		"skipped":    total.Skipped,
+		"failed":     total.Failed,
+	}).Info("migrate_finished")
+
+	if errors.Is(err, archive.ErrStopped) && cfg.Checkpoint != "" {
+		return fmt.Errorf("%w, run again with the same checkpoint to resume", err)
+	} else if err != nil {
+		return err
+	}
+
+	if unfinished > 0 {
+		return fmt.Errorf("%d folder(s) weren't finished, run again with the same checkpoint to resume", unfinished)
+	}
+
+	if total.Failed > 0 {
+		return fmt.Errorf("%d message(s) were rejected by the destination", total.Failed)
+	}
+
+	return nil
+}
@@ -21,7 +21,6 @@ package run_multi
 import (
 	"encoding/json"
 	"io/ioutil"
-	"net/url"
 	"os"
 	"time"
 
@@ -29,7 +28,7 @@ import (
 
 	"github.com/urfave/cli/v2"
 	"git.vs49688.net/zane/mailpump/cmd/config"
-	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/dedupe"
 	"git.vs49688.net/zane/mailpump/ingest"
 	"git.vs49688.net/zane/mailpump/receiver"
 )
@@ -42,6 +41,9 @@ const (
 	DefaultBatchSize            = 10
 	DefaultFetchBufferSize      = 20
 	DefaultFetchMaxInterval     = 5 * time.Minute
+
+	DefaultDedupeKey    = dedupe.KeyContent
+	DefaultDedupeWindow = 7 * 24 * time.Hour
 )
 
 type Source struct {
@@ -52,33 +54,19 @@ type Source struct {
 	DisableDeletions     bool              `json:"disable_deletions"`
 	FetchBufferSize      uint              `json:"fetch_buffer_size"`
 	FetchMaxInterval     time.Duration     `json:"fetch_max_interval"`
-}
-
-func makeSourceName(username string, cfg *imap.ConnectionConfig) string {
-	u := url.URL{
-		User: url.User(username),
-		Host: cfg.HostPort,
-		Path: cfg.Mailbox,
-	}
-
-	if cfg.TLS {
-		u.Scheme = "imaps"
-	} else {
-		u.Scheme = "imap"
-	}
-
-	return u.String()
+	RejectMailbox        string            `json:"reject_mailbox,omitempty"`
 }
 
 func (src *Source) Resolve(logger *log.Entry) (receiver.Config, error) {
-	connConfig, factory, err := src.Connection.Resolve()
+	rs, err := src.Connection.ResolveSource()
 	if err != nil {
 		return receiver.Config{}, err
 	}
 
 	cfg := receiver.Config{
-		ConnectionConfig:     connConfig,
-		Factory:              factory,
+		ConnectionConfig:     rs.ConnectionConfig,
+		Factory:              rs.Factory,
+		Receiver:             rs.Receiver,
 		Logger:               logger,
 		IDLEFallbackInterval: src.IDLEFallbackInterval,
 		BatchSize:            src.BatchSize,
@@ -86,6 +74,7 @@ func (src *Source) Resolve(logger *log.Entry) (receiver.Config, error) {
 		FetchMaxInterval:     src.FetchMaxInterval,
 		Channel:              nil, // Not our problem yet
 		DisableDeletions:     src.DisableDeletions,
+		RejectMailbox:        src.RejectMailbox,
 	}
 
 	if cfg.IDLEFallbackInterval == 0 {
@@ -107,26 +96,60 @@ func (src *Source) Resolve(logger *log.Entry) (receiver.Config, error) {
 	return cfg, nil
 }
 
-type Configuration struct {
-	ConfigPath string `json:"-"`
+type Dedupe struct {
+	Path   string        `json:"path"`
+	Key    string        `json:"key"`
+	Window time.Duration `json:"window"`
+}
+
+func (d *Dedupe) Resolve() *dedupe.Config {
+	cfg := &dedupe.Config{
+		Path:   d.Path,
+		Key:    dedupe.KeyType(d.Key),
+		Window: d.Window,
+	}
+
+	if cfg.Key == "" {
+		cfg.Key = DefaultDedupeKey
+	}
 
-	Destination config.IMAPConfig  `json:"destination,omitempty"`
-	Sources     map[string]*Source `json:"sources,omitempty"`
-	LogLevel    string             `json:"log_level,omitempty"`
-	LogFormat   string             `json:"log_format,omitempty"`
+	if cfg.Window == 0 {
+		cfg.Window = DefaultDedupeWindow
+	}
+
+	return cfg
+}
+
+type Configuration struct {
+	ConfigPath   string `json:"-"`
+	DryRun       bool   `json:"-"`
+	DryRunFormat string `json:"-"`
+
+	Destination     config.IMAPConfig  `json:"destination,omitempty"`
+	Sources         map[string]*Source `json:"sources,omitempty"`
+	LogLevel        string             `json:"log_level,omitempty"`
+	LogFormat       string             `json:"log_format,omitempty"`
+	CheckDuplicates bool               `json:"check_duplicates,omitempty"`
+	Normalise       bool               `json:"normalise,omitempty"`
+	QuotaThreshold  float64            `json:"quota_threshold,omitempty"`
+	Dedupe          *Dedupe            `json:"dedupe,omitempty"`
 
 	ResolvedDestination ingest.Config     `json:"-"`
 	ResolvedSources     []receiver.Config `json:"-"`
+	ResolvedSourceNames []string          `json:"-"`
+	ResolvedTargets     []string          `json:"-"`
+	ResolvedDedupe      *dedupe.Config    `json:"-"`
 	Logger              *log.Logger       `json:"-"`
 }
 
 func DefaultConfig() Configuration {
 	return Configuration{
-		Destination: config.DefaultIMAPConfig(),
-		ConfigPath:  "config.json",
-		LogLevel:    DefaultLogLevel,
-		LogFormat:   DefaultLogFormat,
-		Logger:      log.StandardLogger(),
+		Destination:  config.DefaultIMAPConfig(),
+		ConfigPath:   "config.json",
+		DryRunFormat: "table",
+		LogLevel:     DefaultLogLevel,
+		LogFormat:    DefaultLogFormat,
+		Logger:       log.StandardLogger(),
 	}
 }
 
@@ -140,6 +163,18 @@ func (cfg *Configuration) Parameters() []cli.Flag {
 			Value:       def.ConfigPath,
 			Destination: &cfg.ConfigPath,
 		},
+		&cli.BoolFlag{
+			Name:        "dry-run",
+			Usage:       "print what would be pumped, without appending or deleting anything. IMAP sources only",
+			Value:       def.DryRun,
+			Destination: &cfg.DryRun,
+		},
+		&cli.StringFlag{
+			Name:        "dry-run-format",
+			Usage:       "dry run output format (table/json)",
+			Value:       def.DryRunFormat,
+			Destination: &cfg.DryRunFormat,
+		},
 	}
 }
 
@@ -161,16 +196,25 @@ func (cfg *Configuration) Resolve() error {
 		return err
 	}
 
-	destConfig, factory, err := cfg.Destination.Resolve()
-	if err != nil {
-		return err
+	// A dry run doesn't need the destination, and resolving it may create it
+	if !cfg.DryRun {
+		dest, err := cfg.Destination.ResolveDestination()
+		if err != nil {
+			return err
+		}
+		cfg.ResolvedDestination = dest
+		cfg.ResolvedDestination.CheckDuplicates = cfg.CheckDuplicates
+		cfg.ResolvedDestination.Normalise = cfg.Normalise
+		cfg.ResolvedDestination.QuotaThreshold = cfg.QuotaThreshold
 	}
-	cfg.ResolvedDestination = ingest.Config{
-		ConnectionConfig: destConfig,
-		Factory:          factory,
+
+	if cfg.Dedupe != nil {
+		cfg.ResolvedDedupe = cfg.Dedupe.Resolve()
 	}
 
 	cfg.ResolvedSources = make([]receiver.Config, 0, len(cfg.Sources))
+	cfg.ResolvedSourceNames = make([]string, 0, len(cfg.Sources))
+	cfg.ResolvedTargets = make([]string, 0, len(cfg.Sources))
 	for name, src := range cfg.Sources {
 		rs, err := src.Resolve(cfg.Logger.WithField("source", name))
 		if err != nil {
@@ -178,6 +222,8 @@ func (cfg *Configuration) Resolve() error {
 		}
 
 		cfg.ResolvedSources = append(cfg.ResolvedSources, rs)
+		cfg.ResolvedSourceNames = append(cfg.ResolvedSourceNames, name)
+		cfg.ResolvedTargets = append(cfg.ResolvedTargets, src.TargetMailbox)
 	}
 
 	return nil
@@ -1,6 +1,10 @@
 package run_multi
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -20,8 +24,13 @@ func TestConfigParse(t *testing.T) {
 	cfg.ResolvedDestination = ingest.Config{}
 	cfg.ResolvedSources = nil
 
+	assert.ElementsMatch(t, []string{"yahoo-user-inbox", "yahoo-user-inbox-spam"}, cfg.ResolvedSourceNames)
+	cfg.ResolvedSourceNames = nil
+	cfg.ResolvedTargets = nil
+
 	assert.Equal(t, Configuration{
-		ConfigPath: "testdata/config.json",
+		ConfigPath:   "testdata/config.json",
+		DryRunFormat: "table",
 		Destination: config.IMAPConfig{
 			URL:          "imaps://imap.example.com",
 			Username:     "user1@example.com",
@@ -59,3 +68,74 @@ func TestConfigParse(t *testing.T) {
 		Logger:    logrus.StandardLogger(),
 	}, cfg)
 }
+
+func TestResolvedTargets(t *testing.T) {
+	dir := t.TempDir()
+
+	// Enough sources that map order is unlikely to match by chance
+	sources := map[string]interface{}{}
+	for i := 0; i < 16; i++ {
+		name := fmt.Sprintf("source%d", i)
+		sources[name] = map[string]interface{}{
+			"connection": map[string]interface{}{
+				"url":      "imaps://imap.example.com/" + name,
+				"username": "username",
+				"password": "password",
+			},
+			"target_mailbox": "Target-" + name,
+		}
+	}
+
+	raw, err := json.Marshal(map[string]interface{}{
+		"destination": map[string]interface{}{"url": "maildir://" + filepath.ToSlash(filepath.Join(dir, "Maildir"))},
+		"sources":     sources,
+	})
+	assert.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.ConfigPath = filepath.Join(dir, "config.json")
+	assert.NoError(t, os.WriteFile(cfg.ConfigPath, raw, 0600))
+	assert.NoError(t, cfg.Resolve())
+
+	if !assert.Len(t, cfg.ResolvedTargets, len(sources)) {
+		t.FailNow()
+	}
+
+	for i, rs := range cfg.ResolvedSources {
+		name := cfg.ResolvedSourceNames[i]
+		assert.Equal(t, name, rs.ConnectionConfig.Mailbox)
+		assert.Equal(t, "Target-"+name, cfg.ResolvedTargets[i])
+	}
+}
+
+func TestDryRunSkipsDestination(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Maildir")
+
+	raw, err := json.Marshal(map[string]interface{}{
+		"destination": map[string]interface{}{"url": "maildir://" + filepath.ToSlash(path)},
+		"sources": map[string]interface{}{
+			"work": map[string]interface{}{
+				"connection": map[string]interface{}{
+					"url":      "imaps://imap.example.com/INBOX",
+					"username": "username",
+					"password": "password",
+				},
+				"target_mailbox": "Work",
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	cfg := DefaultConfig()
+	cfg.ConfigPath = filepath.Join(dir, "config.json")
+	cfg.DryRun = true
+	assert.NoError(t, os.WriteFile(cfg.ConfigPath, raw, 0600))
+
+	assert.NoError(t, cfg.Resolve())
+	assert.Equal(t, []string{"work"}, cfg.ResolvedSourceNames)
+	assert.Nil(t, cfg.ResolvedDestination.Sink)
+
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -19,12 +19,16 @@
 package run_multi
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/dryrun"
 	"git.vs49688.net/zane/mailpump/multipump"
 )
 
@@ -45,28 +49,62 @@ func RegisterCommand(app *cli.App) *cli.App {
 	return app
 }
 
-func run(_ *cli.Context, cfg *Configuration) error {
-	logLevel, err := log.ParseLevel(cfg.LogLevel)
-	if err == nil {
-		cfg.Logger.SetLevel(logLevel)
+// dryRun prints what the pump would do. Only the sources are connected to.
+func dryRun(cfg *Configuration) error {
+	format, err := dryrun.ParseFormat(cfg.DryRunFormat)
+	if err != nil {
+		return err
 	}
 
-	if cfg.LogFormat == "json" {
-		cfg.Logger.SetFormatter(&log.JSONFormatter{})
+	// Go by name, map order isn't stable
+	order := make([]int, len(cfg.ResolvedSourceNames))
+	for i := range order {
+		order[i] = i
 	}
+	sort.Slice(order, func(i, j int) bool {
+		return cfg.ResolvedSourceNames[order[i]] < cfg.ResolvedSourceNames[order[j]]
+	})
 
-	doneChan := make(chan error)
-	stopChan := make(chan struct{})
+	sources := make([]dryrun.Source, 0, len(order))
+	for _, i := range order {
+		name := cfg.ResolvedSourceNames[i]
+		rs := &cfg.ResolvedSources[i]
+		if rs.Receiver != nil {
+			return fmt.Errorf("%v: %w", name, dryrun.ErrUnsupportedSource)
+		}
+
+		sources = append(sources, dryrun.Source{
+			Name:             name,
+			ConnectionConfig: rs.ConnectionConfig,
+			Target:           cfg.Sources[name].TargetMailbox,
+			Delete:           !rs.DisableDeletions,
+		})
+	}
+
+	entries, err := dryrun.Plan(sources)
+	if err != nil {
+		return err
+	}
 
-	targetMailboxes := make([]string, 0, len(cfg.Sources))
-	for _, src := range cfg.Sources {
-		targetMailboxes = append(targetMailboxes, src.TargetMailbox)
+	return dryrun.Write(os.Stdout, format, entries)
+}
+
+func run(_ *cli.Context, cfg *Configuration) error {
+	config.SetupLogger(cfg.Logger, cfg.LogLevel, cfg.LogFormat)
+
+	if cfg.DryRun {
+		return dryRun(cfg)
 	}
 
+	doneChan := make(chan error)
+	stopChan := make(chan struct{})
+
 	pumpConfig := multipump.Config{
 		Destination:     cfg.ResolvedDestination,
 		Sources:         cfg.ResolvedSources,
-		TargetMailboxes: targetMailboxes,
+		SourceNames:     cfg.ResolvedSourceNames,
+		TargetMailboxes: cfg.ResolvedTargets,
+		Dedupe:          cfg.ResolvedDedupe,
 		DoneChan:        doneChan,
 		StopChan:        stopChan,
 	}
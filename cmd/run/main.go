@@ -26,6 +26,7 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/dryrun"
 	"git.vs49688.net/zane/mailpump/pump"
 )
 
@@ -40,16 +41,33 @@ func RegisterCommand(app *cli.App) *cli.App {
 	return app
 }
 
-func run(_ *cli.Context, cfg *config.CliConfig) error {
-	logLevel, err := log.ParseLevel(cfg.LogLevel)
-	if err == nil {
-		log.SetLevel(logLevel)
+// dryRun prints what the pump would do. Only the source is connected to.
+func dryRun(pumpConfig *pump.Config, format string) error {
+	f, err := dryrun.ParseFormat(format)
+	if err != nil {
+		return err
+	}
+
+	if pumpConfig.SourceReceiver != nil {
+		return dryrun.ErrUnsupportedSource
 	}
 
-	if cfg.LogFormat == "json" {
-		log.SetFormatter(&log.JSONFormatter{})
+	entries, err := dryrun.Plan([]dryrun.Source{{
+		Name:             pumpConfig.SourceName,
+		ConnectionConfig: pumpConfig.Source,
+		Target:           pumpConfig.Dest.Mailbox,
+		Delete:           !pumpConfig.DisableDeletions,
+	}})
+	if err != nil {
+		return err
 	}
 
+	return dryrun.Write(os.Stdout, f, entries)
+}
+
+func run(_ *cli.Context, cfg *config.CliConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
 	log.WithFields(log.Fields{
 		"source_url":             cfg.Source.URL,
 		"source_auth_method":     cfg.Source.AuthMethod,
@@ -70,9 +88,25 @@ func run(_ *cli.Context, cfg *config.CliConfig) error {
 		"idle_fallback_interval": cfg.IDLEFallbackInterval,
 		"batch_size":             cfg.BatchSize,
 		"fetch_buffer_size":      cfg.FetchBufferSize,
+		"check_duplicates":       cfg.CheckDuplicates,
+		"normalise":              cfg.Normalise,
+		"quota_threshold":        cfg.QuotaThreshold,
+		"reject_mailbox":         cfg.RejectMailbox,
+		"shutdown_timeout":       cfg.ShutdownTimeout,
+		"once":                   cfg.Once,
+		"dry_run":                cfg.DryRun,
+		"dry_run_format":         cfg.DryRunFormat,
 	}).Info("starting")
 
 	pumpConfig := pump.Config{}
+	if cfg.DryRun {
+		if err := cfg.BuildDryRunConfig(&pumpConfig); err != nil {
+			return err
+		}
+
+		return dryRun(&pumpConfig, cfg.DryRunFormat)
+	}
+
 	if err := cfg.BuildPumpConfig(&pumpConfig); err != nil {
 		return err
 	}
@@ -106,9 +140,9 @@ func run(_ *cli.Context, cfg *config.CliConfig) error {
 			log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
 
 			close(stopChan)
-		case <-doneChan:
+		case err := <-doneChan:
 			log.Info("pump_terminated")
-			return nil
+			return err
 		}
 	}
 }
@@ -0,0 +1,152 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package sync
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/mailsync"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.SyncConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "sync",
+		Usage:  "Keep two IMAP mailboxes in sync, in both directions",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+// resolveSide connects to one side. The caller must close its client and
+// ingest client, even on error.
+func resolveSide(cfg *config.IMAPConfig, defaultMailbox string, side *mailsync.Side) error {
+	connConfig, factory, err := cfg.Resolve()
+	if err != nil {
+		return err
+	}
+
+	if connConfig.Mailbox == "" {
+		connConfig.Mailbox = defaultMailbox
+	}
+
+	side.Mailbox = connConfig.Mailbox
+	side.Name = config.MakeSourceName(cfg.Username, &connConfig)
+
+	if side.Client, err = factory.NewClient(&imap.ClientConfig{ConnectionConfig: connConfig}); err != nil {
+		return err
+	}
+
+	side.Ingest, err = ingest.NewClient(&ingest.Config{ConnectionConfig: connConfig, Factory: factory})
+	return err
+}
+
+func run(_ *cli.Context, cfg *config.SyncConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"source_url":             cfg.Source.URL,
+		"source_username":        cfg.Source.Username,
+		"source_auth_method":     cfg.Source.AuthMethod,
+		"source_password_file":   cfg.Source.PasswordFile,
+		"source_tls_skip_verify": cfg.Source.TLSSkipVerify,
+		"dest_url":               cfg.Dest.URL,
+		"dest_username":          cfg.Dest.Username,
+		"dest_auth_method":       cfg.Dest.AuthMethod,
+		"dest_password_file":     cfg.Dest.PasswordFile,
+		"dest_tls_skip_verify":   cfg.Dest.TLSSkipVerify,
+		"state":                  cfg.State,
+		"conflict":               cfg.Conflict,
+		"interval":               cfg.Interval,
+		"log_level":              cfg.LogLevel,
+		"log_format":             cfg.LogFormat,
+	}).Info("starting")
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	// Already validated
+	conflict, _ := mailsync.ParseConflictPolicy(cfg.Conflict)
+
+	syncConfig := mailsync.Config{
+		State:    cfg.State,
+		Conflict: conflict,
+		Interval: cfg.Interval,
+		Logger:   log.NewEntry(log.StandardLogger()),
+	}
+
+	defer func() {
+		for _, side := range []*mailsync.Side{&syncConfig.Source, &syncConfig.Dest} {
+			if side.Ingest != nil {
+				side.Ingest.Close()
+			}
+			if side.Client != nil {
+				_ = side.Client.Logout()
+			}
+		}
+	}()
+
+	if err := resolveSide(&cfg.Source, "INBOX", &syncConfig.Source); err != nil {
+		return err
+	}
+
+	// The dest mailbox defaults to the same name as the source
+	if err := resolveSide(&cfg.Dest, syncConfig.Source.Mailbox, &syncConfig.Dest); err != nil {
+		return err
+	}
+
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+	defer close(doneChan)
+
+	sigchan := make(chan os.Signal, 10)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigchan)
+
+	go func() {
+		sigcount := 0
+		for {
+			select {
+			case sig := <-sigchan:
+				sigcount += 1
+				if sigcount > 1 {
+					log.WithFields(log.Fields{"signal": sig}).Warn("received_interrupt_force_exit")
+					os.Exit(1)
+				}
+				log.WithFields(log.Fields{"signal": sig}).Info("received_interrupt")
+
+				close(stopChan)
+			case <-doneChan:
+				return
+			}
+		}
+	}()
+
+	syncConfig.Stop = stopChan
+	return mailsync.Run(&syncConfig)
+}
@@ -0,0 +1,185 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"git.vs49688.net/zane/mailpump/cmd/config"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/verify"
+)
+
+func RegisterCommand(app *cli.App) *cli.App {
+	cfg := &config.VerifyConfig{}
+	app.Commands = append(app.Commands, &cli.Command{
+		Name:   "verify",
+		Usage:  "Compare a source mailbox with its dest, by Message-ID",
+		Flags:  cfg.Parameters(),
+		Action: func(context *cli.Context) error { return run(context, cfg) },
+	})
+	return app
+}
+
+func connect(cfg *config.IMAPConfig, defaultMailbox string) (imap.Client, imap.ConnectionConfig, imap.Factory, error) {
+	connConfig, factory, err := cfg.Resolve()
+	if err != nil {
+		return nil, imap.ConnectionConfig{}, nil, err
+	}
+
+	if connConfig.Mailbox == "" {
+		connConfig.Mailbox = defaultMailbox
+	}
+
+	client, err := factory.NewClient(&imap.ClientConfig{ConnectionConfig: connConfig})
+	if err != nil {
+		return nil, imap.ConnectionConfig{}, nil, err
+	}
+
+	return client, connConfig, factory, nil
+}
+
+func writeEntries(w io.Writer, title string, entries []verify.Entry) {
+	_, _ = fmt.Fprintf(w, "%v: %v\n", title, len(entries))
+	for _, e := range entries {
+		id := e.MessageID
+		if id == "" {
+			id = "(no message-id)"
+		}
+		_, _ = fmt.Fprintf(w, "  uid %v: %v, %v bytes, %v, %q\n", e.UID, id, e.Size, e.Date.Format(time.RFC3339), e.Subject)
+	}
+}
+
+func writeText(w io.Writer, report *verify.Report) {
+	_, _ = fmt.Fprintf(w, "source: %v (%v messages)\n", report.Source, report.SourceCount)
+	_, _ = fmt.Fprintf(w, "dest:   %v (%v messages)\n", report.Dest, report.DestCount)
+
+	writeEntries(w, "missing from dest", report.MissingFromDest)
+	writeEntries(w, "missing from source", report.MissingFromSource)
+
+	_, _ = fmt.Fprintf(w, "size mismatches: %v\n", len(report.SizeMismatches))
+	for _, m := range report.SizeMismatches {
+		_, _ = fmt.Fprintf(w, "  %v: source uid %v, %v bytes, dest uid %v, %v bytes\n", m.MessageID, m.SourceUID, m.SourceSize, m.DestUID, m.DestSize)
+	}
+
+	if report.Repumped > 0 {
+		_, _ = fmt.Fprintf(w, "repumped: %v\n", report.Repumped)
+	}
+}
+
+func run(_ *cli.Context, cfg *config.VerifyConfig) error {
+	config.SetupLogger(log.StandardLogger(), cfg.LogLevel, cfg.LogFormat)
+
+	log.WithFields(log.Fields{
+		"source_url":             cfg.Source.URL,
+		"source_username":        cfg.Source.Username,
+		"source_auth_method":     cfg.Source.AuthMethod,
+		"source_password_file":   cfg.Source.PasswordFile,
+		"source_tls_skip_verify": cfg.Source.TLSSkipVerify,
+		"dest_url":               cfg.Dest.URL,
+		"dest_username":          cfg.Dest.Username,
+		"dest_auth_method":       cfg.Dest.AuthMethod,
+		"dest_password_file":     cfg.Dest.PasswordFile,
+		"dest_tls_skip_verify":   cfg.Dest.TLSSkipVerify,
+		"format":                 cfg.Format,
+		"repump":                 cfg.Repump,
+		"log_level":              cfg.LogLevel,
+		"log_format":             cfg.LogFormat,
+	}).Info("starting")
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	src, srcConfig, _, err := connect(&cfg.Source, "INBOX")
+	if err != nil {
+		return err
+	}
+	defer src.Logout()
+
+	// The dest mailbox defaults to the same name as the source
+	dst, dstConfig, dstFactory, err := connect(&cfg.Dest, srcConfig.Mailbox)
+	if err != nil {
+		return err
+	}
+	defer dst.Logout()
+
+	source, err := verify.List(src, srcConfig.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	dest, err := verify.List(dst, dstConfig.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	report := verify.Compare(source, dest)
+	report.Source = config.MakeSourceName(cfg.Source.Username, &srcConfig)
+	report.Dest = config.MakeSourceName(cfg.Dest.Username, &dstConfig)
+
+	if cfg.Repump && len(report.MissingFromDest) > 0 {
+		ing, err := ingest.NewClient(&ingest.Config{ConnectionConfig: dstConfig, Factory: dstFactory})
+		if err != nil {
+			return err
+		}
+		defer ing.Close()
+
+		uids := make([]uint32, 0, len(report.MissingFromDest))
+		for _, e := range report.MissingFromDest {
+			uids = append(uids, e.UID)
+		}
+
+		report.Repumped, err = verify.Repump(&verify.RepumpConfig{
+			Client:        src,
+			Mailbox:       srcConfig.Mailbox,
+			UIDs:          uids,
+			Ingest:        ing,
+			TargetMailbox: dstConfig.Mailbox,
+			Source:        report.Source,
+			Logger:        log.NewEntry(log.StandardLogger()),
+		})
+		if err != nil {
+			log.WithError(err).WithField("repumped", report.Repumped).Error("repump_failed")
+		}
+	}
+
+	if cfg.Format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		writeText(os.Stdout, report)
+	}
+
+	if n := report.Differences(); n > 0 {
+		return fmt.Errorf("%d difference(s) found", n)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dedupe
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var errInvalidKeyType = errors.New("invalid dedupe key type")
+
+// NewStore opens the index at cfg.Path, creating it if needed. Expired
+// entries are discarded and the file compacted.
+func NewStore(cfg *Config) (Store, error) {
+	keyType := cfg.Key
+	if keyType == "" {
+		keyType = KeyContent
+	}
+
+	if keyType != KeyContent && keyType != KeyMessageID {
+		return nil, errInvalidKeyType
+	}
+
+	s := &store{
+		keyType: keyType,
+		window:  cfg.Window,
+		entries: map[string]time.Time{},
+	}
+
+	if cfg.Path == "" {
+		return s, nil
+	}
+
+	if err := s.load(cfg.Path); err != nil {
+		return nil, err
+	}
+
+	if err := s.compact(cfg.Path); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+
+	log.WithFields(log.Fields{
+		"path":    cfg.Path,
+		"key":     keyType,
+		"window":  cfg.Window,
+		"entries": len(s.entries),
+	}).Info("dedupe_store_opened")
+
+	return s, nil
+}
+
+func (s *store) expired(t time.Time, now time.Time) bool {
+	return s.window > 0 && now.Sub(t) > s.window
+}
+
+func (s *store) load(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		ts, key, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		t := time.Unix(0, nanos)
+		if s.expired(t, now) {
+			continue
+		}
+
+		if old, ok := s.entries[key]; !ok || t.After(old) {
+			s.entries[key] = t
+		}
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the index with only the live entries.
+func (s *store) compact(path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for key, t := range s.entries {
+		_, _ = fmt.Fprintf(w, "%d %s\n", t.UnixNano(), key)
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (s *store) Key(body []byte) string {
+	return MessageKey(s.keyType, body)
+}
+
+func (s *store) Contains(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+
+	if s.expired(t, time.Now()) {
+		delete(s.entries, key)
+		return false
+	}
+
+	return true
+}
+
+func (s *store) Add(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.entries[key] = now
+
+	if s.file == nil {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(s.file, "%d %s\n", now.UnixNano(), key)
+	return err
+}
+
+func (s *store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
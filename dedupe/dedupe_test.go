@@ -0,0 +1,99 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dedupe
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMessage1 = "Received: from a.example.com\r\n" +
+	"Delivered-To: alias1@example.com\r\n" +
+	"From: from@example.com\r\n" +
+	"To: list@example.com\r\n" +
+	"Subject: Test Email\r\n" +
+	"Message-ID: <01@example.com>\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+const testMessage2 = "Received: from b.example.com\n" +
+	"Delivered-To: alias2@example.com\n" +
+	"From: from@example.com\n" +
+	"To: list@example.com\n" +
+	"Subject: Test  Email\n" +
+	"Message-ID: <01@example.com>\n" +
+	"\n" +
+	"Hello  \n"
+
+func TestMessageKey(t *testing.T) {
+	t.Run("content", func(t *testing.T) {
+		k1 := MessageKey(KeyContent, []byte(testMessage1))
+		k2 := MessageKey(KeyContent, []byte(testMessage2))
+		assert.Equal(t, k1, k2)
+
+		k3 := MessageKey(KeyContent, []byte(testMessage1+"Goodbye\r\n"))
+		assert.NotEqual(t, k1, k3)
+	})
+
+	t.Run("message-id", func(t *testing.T) {
+		assert.Equal(t, "mid:01@example.com", MessageKey(KeyMessageID, []byte(testMessage1)))
+	})
+
+	t.Run("message-id_fallback", func(t *testing.T) {
+		msg := "From: from@example.com\r\n\r\nHello\r\n"
+		assert.Equal(t, MessageKey(KeyContent, []byte(msg)), MessageKey(KeyMessageID, []byte(msg)))
+	})
+}
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedupe")
+
+	s, err := NewStore(&Config{Path: path, Key: KeyContent, Window: time.Hour})
+	assert.NoError(t, err)
+
+	key := s.Key([]byte(testMessage1))
+	assert.False(t, s.Contains(key))
+	assert.NoError(t, s.Add(key))
+	assert.True(t, s.Contains(key))
+	assert.NoError(t, s.Close())
+
+	t.Run("reload", func(t *testing.T) {
+		s, err := NewStore(&Config{Path: path, Key: KeyContent, Window: time.Hour})
+		assert.NoError(t, err)
+		defer s.Close()
+
+		assert.True(t, s.Contains(key))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		s, err := NewStore(&Config{Path: path, Key: KeyContent, Window: time.Nanosecond})
+		assert.NoError(t, err)
+		defer s.Close()
+
+		assert.False(t, s.Contains(key))
+	})
+}
+
+func TestInvalidKeyType(t *testing.T) {
+	_, err := NewStore(&Config{Key: "invalid"})
+	assert.ErrorIs(t, err, errInvalidKeyType)
+}
@@ -0,0 +1,100 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dedupe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// contentHeaders are the only header fields considered when hashing content.
+// Anything else tends to be added in transit (Received, Delivered-To, etc.),
+// and differs between copies of the same message.
+var contentHeaders = []string{
+	"From",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"In-Reply-To",
+	"References",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+func normaliseMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// normaliseBody strips carriage returns and trailing whitespace from each line,
+// as well as any trailing blank lines.
+func normaliseBody(body []byte) []byte {
+	out := new(bytes.Buffer)
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		out.Write(bytes.TrimRight(line, " \t\r"))
+		out.WriteByte('\n')
+	}
+
+	return bytes.TrimRight(out.Bytes(), "\n")
+}
+
+// contentKey hashes the normalised content of a message.
+func contentKey(hdr textproto.Header, body []byte) string {
+	h := sha256.New()
+	for _, k := range contentHeaders {
+		for _, v := range hdr.Values(k) {
+			h.Write([]byte(strings.ToLower(k)))
+			h.Write([]byte{':'})
+			h.Write([]byte(strings.Join(strings.Fields(v), " ")))
+			h.Write([]byte{'\n'})
+		}
+	}
+	h.Write([]byte{'\n'})
+	h.Write(normaliseBody(body))
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// MessageKey calculates the key of a raw RFC822 message.
+func MessageKey(keyType KeyType, raw []byte) string {
+	br := bufio.NewReader(bytes.NewReader(raw))
+	hdr, err := textproto.ReadHeader(br)
+	if err != nil {
+		// Not a valid message, just hash the whole thing.
+		sum := sha256.Sum256(raw)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	if keyType == KeyMessageID {
+		if id := normaliseMessageID(hdr.Get("Message-Id")); id != "" {
+			return "mid:" + id
+		}
+	}
+
+	body := new(bytes.Buffer)
+	_, _ = body.ReadFrom(br)
+
+	return contentKey(hdr, body.Bytes())
+}
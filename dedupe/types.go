@@ -0,0 +1,71 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dedupe
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+type KeyType string
+
+const (
+	// KeyContent keys messages by a hash of their normalised content.
+	KeyContent KeyType = "content"
+
+	// KeyMessageID keys messages by their Message-ID, falling back
+	// to KeyContent if there isn't one.
+	KeyMessageID KeyType = "message-id"
+)
+
+type Config struct {
+	// Path is the path of the index file. If empty, the index
+	// is kept in memory only.
+	Path string
+
+	// Key selects how messages are identified.
+	Key KeyType
+
+	// Window is how long a key is remembered for. If zero, keys
+	// are kept forever.
+	Window time.Duration
+}
+
+type Store interface {
+	// Key calculates the key of a raw RFC822 message.
+	Key(body []byte) string
+
+	// Contains checks if a key has been seen within the window.
+	Contains(key string) bool
+
+	// Add records a key as seen.
+	Add(key string) error
+
+	Close() error
+}
+
+type store struct {
+	keyType KeyType
+	window  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+	file    *os.File
+}
@@ -0,0 +1,66 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+// Package delivery holds what sources and destinations both need to know
+// about delivering messages, so neither depends on the other.
+package delivery
+
+// Health is the state of the destination.
+type Health int
+
+const (
+	// HealthConnected indicates the destination is accepting messages.
+	HealthConnected Health = 0
+
+	// HealthDegraded indicates the destination is reachable, but not
+	// currently accepting messages, e.g. it is over quota.
+	HealthDegraded Health = 1
+
+	// HealthDown indicates the destination is unreachable.
+	HealthDown Health = 2
+)
+
+func (h Health) String() string {
+	switch h {
+	case HealthConnected:
+		return "connected"
+	case HealthDegraded:
+		return "degraded"
+	case HealthDown:
+		return "down"
+	default:
+		panic("invalid health")
+	}
+}
+
+// SendHealth sends a health update on ch, replacing any update that has not
+// yet been received. ch must be buffered, and this must be its only sender.
+func SendHealth(ch chan Health, h Health) {
+	for {
+		select {
+		case ch <- h:
+			return
+		default:
+		}
+
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dryrun
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/verify"
+)
+
+// cellReplacer keeps a field on one line of its table cell.
+var cellReplacer = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+// ParseFormat parses a plan format. An empty string is FormatTable.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "":
+		return FormatTable, nil
+	case FormatTable, FormatJSON:
+		return f, nil
+	default:
+		return "", ErrInvalidFormat
+	}
+}
+
+// Plan connects to each source in turn, and lists what would be done with
+// each of its messages. Only SELECT (read-only) and FETCH are used, and the
+// dest is never connected to.
+//
+// A standard client is always used, as a persistent one re-selects the
+// mailbox read-write when it reconnects.
+func Plan(sources []Source) ([]Entry, error) {
+	entries := []Entry{}
+	for i := range sources {
+		src := &sources[i]
+
+		c, err := client.NewClient(&imap2.ClientConfig{ConnectionConfig: src.ConnectionConfig})
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", src.Name, err)
+		}
+
+		planned, err := planSource(c, src)
+		_ = c.Logout()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", src.Name, err)
+		}
+
+		entries = append(entries, planned...)
+	}
+
+	return entries, nil
+}
+
+func planSource(c imap2.Client, src *Source) ([]Entry, error) {
+	msgs, err := verify.Messages(c, src.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, msg := range msgs {
+		entry := Entry{
+			Source: src.Name,
+			Entry:  verify.NewEntry(msg),
+			Target: src.Target,
+			Delete: src.Delete,
+		}
+
+		if msg.Envelope != nil && len(msg.Envelope.From) > 0 {
+			entry.From = msg.Envelope.From[0].Address()
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Write writes a plan in the given format.
+func Write(w io.Writer, format Format, entries []Entry) error {
+	if format == FormatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	var size uint64
+	deletes := 0
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "SOURCE\tUID\tDATE\tSIZE\tFROM\tSUBJECT\tTARGET\tDELETE")
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", e.Source, e.UID, e.Date.Format("2006-01-02 15:04"), e.Size, cellReplacer.Replace(e.From), cellReplacer.Replace(e.Subject), e.Target, e.Delete)
+
+		size += uint64(e.Size)
+		if e.Delete {
+			deletes++
+		}
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%v message(s), %v bytes, would be appended. %v would be deleted.\n", len(entries), size, deletes)
+	return err
+}
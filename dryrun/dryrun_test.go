@@ -0,0 +1,123 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dryrun
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/verify"
+)
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatTable, f)
+
+	f, err = ParseFormat("JSON")
+	assert.NoError(t, err)
+	assert.Equal(t, FormatJSON, f)
+
+	_, err = ParseFormat("yaml")
+	assert.ErrorIs(t, err, ErrInvalidFormat)
+}
+
+func TestPlan(t *testing.T) {
+	_, addr, inbox := internal.BuildTestIMAPServer(t)
+
+	connConfig := imap2.ConnectionConfig{
+		HostPort: addr,
+		Auth:     imap2.NewNormalAuthenticator("username", "password"),
+	}
+
+	c, err := client.NewClient(&imap2.ClientConfig{ConnectionConfig: connConfig})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer c.Logout()
+
+	date := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, c.Create("Lists"))
+	for _, mailbox := range []string{"INBOX", "INBOX", "Lists"} {
+		body := "From: a@example.com\r\nSubject: to " + mailbox + "\r\n\r\nbody\r\n"
+		assert.NoError(t, c.Append(mailbox, nil, date, bytes.NewBufferString(body)))
+	}
+
+	inboxConfig := connConfig
+	inboxConfig.Mailbox = "INBOX"
+	listsConfig := connConfig
+	listsConfig.Mailbox = "Lists"
+
+	entries, err := Plan([]Source{
+		{Name: "inbox", ConnectionConfig: inboxConfig, Target: "Archive", Delete: true},
+		{Name: "lists", ConnectionConfig: listsConfig, Target: "INBOX"},
+	})
+	assert.NoError(t, err)
+	if !assert.Len(t, entries, 3) {
+		t.FailNow()
+	}
+
+	assert.Equal(t, Entry{
+		Source: "inbox",
+		Entry: verify.Entry{
+			UID:     1,
+			Size:    entries[0].Size,
+			Date:    entries[0].Date,
+			Subject: "to INBOX",
+		},
+		From:   "a@example.com",
+		Target: "Archive",
+		Delete: true,
+	}, entries[0])
+	assert.Equal(t, uint32(2), entries[1].UID)
+	assert.Equal(t, "lists", entries[2].Source)
+	assert.Equal(t, "INBOX", entries[2].Target)
+	assert.False(t, entries[2].Delete)
+
+	// Nothing was changed
+	if assert.Len(t, inbox.Messages, 2) {
+		assert.Empty(t, inbox.Messages[0].Flags)
+		assert.Empty(t, inbox.Messages[1].Flags)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	entries := []Entry{
+		{Source: "a", Entry: verify.Entry{UID: 1, Size: 100, Subject: "one\ttwo"}, Target: "INBOX", Delete: true},
+		{Source: "a", Entry: verify.Entry{UID: 2, Size: 50, Subject: "three"}, Target: "INBOX"},
+	}
+
+	buf := new(bytes.Buffer)
+	assert.NoError(t, Write(buf, FormatTable, entries))
+	assert.Contains(t, buf.String(), "one two")
+	assert.Contains(t, buf.String(), "2 message(s), 150 bytes, would be appended. 1 would be deleted.\n")
+
+	buf.Reset()
+	assert.NoError(t, Write(buf, FormatJSON, entries))
+
+	var decoded []Entry
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, entries, decoded)
+}
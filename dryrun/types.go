@@ -0,0 +1,65 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package dryrun
+
+import (
+	"errors"
+
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/verify"
+)
+
+var (
+	ErrInvalidFormat     = errors.New("invalid dry-run format, expected table or json")
+	ErrUnsupportedSource = errors.New("dry runs are only supported for IMAP sources")
+)
+
+// Format is how a plan is written.
+type Format string
+
+const (
+	FormatTable Format = "table"
+	FormatJSON  Format = "json"
+)
+
+// Source is a mailbox that would be pumped.
+type Source struct {
+	// Name identifies the source in the plan.
+	Name string
+
+	// ConnectionConfig is the source. Its Mailbox is only ever opened
+	// read-only.
+	imap2.ConnectionConfig
+
+	// Target is the dest mailbox messages would be appended to.
+	Target string
+
+	// Delete is set if messages would be deleted from the source once
+	// they've been appended.
+	Delete bool
+}
+
+// Entry is what would be done with a single message.
+type Entry struct {
+	Source string `json:"source"`
+	verify.Entry
+	From   string `json:"from"`
+	Target string `json:"target"`
+	Delete bool   `json:"delete"`
+}
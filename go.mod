@@ -30,5 +30,5 @@ require (
 	github.com/golang/mock v1.6.0
 	github.com/skratchdot/open-golang v0.0.0-20200116055534-eef842397966 // indirect
 	golang.org/x/oauth2 v0.30.0
-	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/sys v0.35.0
 )
@@ -23,6 +23,8 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
 	"git.vs49688.net/zane/mailpump/imap"
 )
 
@@ -82,6 +84,30 @@ func (c *standardClient) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch c
 	return c.c.Fetch(seqset, items, ch)
 }
 
+func (c *standardClient) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	return c.c.UidFetch(seqset, items, ch)
+}
+
+func (c *standardClient) UidFetchChangedSince(seqset *imap.SeqSet, items []imap.FetchItem, modSeq uint64, ch chan *imap.Message) error {
+	defer close(ch)
+
+	cmd := &commands.Uid{Cmd: &fetchChangedSince{
+		Fetch:  commands.Fetch{SeqSet: seqset, Items: items},
+		ModSeq: modSeq,
+	}}
+
+	status, err := c.c.Execute(cmd, &responses.Fetch{Messages: ch, SeqSet: seqset, Uid: true})
+	if err != nil {
+		return err
+	}
+
+	return statusError(status)
+}
+
+func (c *standardClient) UidSearch(criteria *imap.SearchCriteria) ([]uint32, error) {
+	return c.c.UidSearch(criteria)
+}
+
 func (c *standardClient) Expunge(ch chan uint32) error {
 	return c.c.Expunge(ch)
 }
@@ -91,7 +117,52 @@ func (c *standardClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, valu
 }
 
 func (c *standardClient) Append(mbox string, flags []string, date time.Time, msg imap.Literal) error {
-	return c.c.Append(mbox, flags, date, msg)
+	// Not using c.c.Append() as it discards the response code.
+	status, err := c.c.Execute(&commands.Append{
+		Mailbox: mbox,
+		Flags:   flags,
+		Date:    date,
+		Message: msg,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	return statusError(status)
+}
+
+func (c *standardClient) UidCopy(seqset *imap.SeqSet, dest string) error {
+	return c.c.UidCopy(seqset, dest)
+}
+
+func (c *standardClient) List(ref string, name string, ch chan *imap.MailboxInfo) error {
+	return c.c.List(ref, name, ch)
+}
+
+func (c *standardClient) Create(name string) error {
+	return c.c.Create(name)
+}
+
+func (c *standardClient) Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	return c.c.Status(name, items)
+}
+
+func (c *standardClient) Capability() (map[string]bool, error) {
+	return c.c.Capability()
+}
+
+func (c *standardClient) GetQuotaRoot(mailbox string) ([]imap.Quota, error) {
+	h := &quotaHandler{}
+	status, err := c.c.Execute(&getQuotaRoot{Mailbox: mailbox}, h)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := statusError(status); err != nil {
+		return nil, err
+	}
+
+	return h.Quotas, nil
 }
 
 func (c *standardClient) Mailbox() *imap.MailboxStatus {
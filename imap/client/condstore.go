@@ -0,0 +1,42 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package client
+
+import (
+	"strconv"
+
+	imap2 "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+)
+
+// fetchChangedSince is a FETCH command with the CHANGEDSINCE modifier, as
+// defined in RFC 7162.
+type fetchChangedSince struct {
+	commands.Fetch
+	ModSeq uint64
+}
+
+func (cmd *fetchChangedSince) Command() *imap2.Command {
+	c := cmd.Fetch.Command()
+	c.Arguments = append(c.Arguments, []interface{}{
+		imap2.RawString("CHANGEDSINCE"),
+		imap2.RawString(strconv.FormatUint(cmd.ModSeq, 10)),
+	})
+	return c
+}
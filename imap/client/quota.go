@@ -0,0 +1,130 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	imap2 "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/utf7"
+	"git.vs49688.net/zane/mailpump/imap"
+)
+
+var errInvalidQuotaResponse = errors.New("invalid QUOTA response")
+
+// getQuotaRoot is a GETQUOTAROOT command, as defined in RFC 9208.
+type getQuotaRoot struct {
+	Mailbox string
+}
+
+func (cmd *getQuotaRoot) Command() *imap2.Command {
+	mailbox, _ := utf7.Encoding.NewEncoder().String(cmd.Mailbox)
+
+	return &imap2.Command{
+		Name:      "GETQUOTAROOT",
+		Arguments: []interface{}{imap2.FormatMailboxName(mailbox)},
+	}
+}
+
+// quotaHandler collects the QUOTA responses to a GETQUOTAROOT command.
+// QUOTAROOT responses are ignored, as every root is followed by a QUOTA
+// response anyway.
+type quotaHandler struct {
+	Quotas []imap.Quota
+}
+
+func parseQuotaNumber(f interface{}) (uint64, error) {
+	s, err := imap2.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func (h *quotaHandler) Handle(resp imap2.Resp) error {
+	name, fields, ok := imap2.ParseNamedResp(resp)
+	if !ok {
+		return responses.ErrUnhandled
+	}
+
+	switch name {
+	case "QUOTAROOT":
+		return nil
+	case "QUOTA":
+		break
+	default:
+		return responses.ErrUnhandled
+	}
+
+	if len(fields) < 2 {
+		return errInvalidQuotaResponse
+	}
+
+	root, err := imap2.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+
+	list, ok := fields[1].([]interface{})
+	if !ok || len(list)%3 != 0 {
+		return errInvalidQuotaResponse
+	}
+
+	quota := imap.Quota{Root: root}
+	for i := 0; i < len(list); i += 3 {
+		name, err := imap2.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+
+		usage, err := parseQuotaNumber(list[i+1])
+		if err != nil {
+			return err
+		}
+
+		limit, err := parseQuotaNumber(list[i+2])
+		if err != nil {
+			return err
+		}
+
+		quota.Resources = append(quota.Resources, imap.QuotaResource{
+			Name:  strings.ToUpper(name),
+			Usage: usage,
+			Limit: limit,
+		})
+	}
+
+	h.Quotas = append(h.Quotas, quota)
+	return nil
+}
+
+// statusError converts a tagged status response into an error,
+// retaining the response code.
+func statusError(status *imap2.StatusResp) error {
+	err := status.Err()
+	if err == nil || status == nil {
+		return err
+	}
+
+	return &imap.StatusError{Code: string(status.Code), Info: status.Info}
+}
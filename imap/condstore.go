@@ -0,0 +1,53 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package imap
+
+import (
+	"strconv"
+
+	"github.com/emersion/go-imap"
+)
+
+// StatusHighestModSeq is the HIGHESTMODSEQ status item, as defined in RFC 7162.
+const StatusHighestModSeq StatusItem = "HIGHESTMODSEQ"
+
+// HighestModSeq returns the HIGHESTMODSEQ of a STATUS response. It's not
+// present if the server doesn't support CONDSTORE, or the mailbox doesn't
+// support mod-sequences.
+func HighestModSeq(status *MailboxStatus) (uint64, bool) {
+	status.ItemsLocker.Lock()
+	v, ok := status.Items[StatusHighestModSeq]
+	status.ItemsLocker.Unlock()
+
+	if !ok {
+		return 0, false
+	}
+
+	s, err := imap.ParseString(v)
+	if err != nil {
+		return 0, false
+	}
+
+	modSeq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || modSeq == 0 {
+		return 0, false
+	}
+
+	return modSeq, true
+}
@@ -52,6 +52,35 @@ func (mr *MockClientMockRecorder) Append(mbox, flags, date, msg interface{}) *go
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Append", reflect.TypeOf((*MockClient)(nil).Append), mbox, flags, date, msg)
 }
 
+// Capability mocks base method.
+func (m *MockClient) Capability() (map[string]bool, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Capability")
+	ret0, _ := ret[0].(map[string]bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Capability indicates an expected call of Capability.
+func (mr *MockClientMockRecorder) Capability() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Capability", reflect.TypeOf((*MockClient)(nil).Capability))
+}
+
+// Create mocks base method.
+func (m *MockClient) Create(name string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Create", name)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Create indicates an expected call of Create.
+func (mr *MockClientMockRecorder) Create(name interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Create", reflect.TypeOf((*MockClient)(nil).Create), name)
+}
+
 // Expunge mocks base method.
 func (m *MockClient) Expunge(ch chan uint32) error {
 	m.ctrl.T.Helper()
@@ -92,6 +121,21 @@ func (mr *MockClientMockRecorder) FlagQuit() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FlagQuit", reflect.TypeOf((*MockClient)(nil).FlagQuit))
 }
 
+// GetQuotaRoot mocks base method.
+func (m *MockClient) GetQuotaRoot(mailbox string) ([]imap0.Quota, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetQuotaRoot", mailbox)
+	ret0, _ := ret[0].([]imap0.Quota)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetQuotaRoot indicates an expected call of GetQuotaRoot.
+func (mr *MockClientMockRecorder) GetQuotaRoot(mailbox interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetQuotaRoot", reflect.TypeOf((*MockClient)(nil).GetQuotaRoot), mailbox)
+}
+
 // Idle mocks base method.
 func (m *MockClient) Idle(stop <-chan struct{}, opts *client.IdleOptions) error {
 	m.ctrl.T.Helper()
@@ -106,6 +150,20 @@ func (mr *MockClientMockRecorder) Idle(stop, opts interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Idle", reflect.TypeOf((*MockClient)(nil).Idle), stop, opts)
 }
 
+// List mocks base method.
+func (m *MockClient) List(ref, name string, ch chan *imap.MailboxInfo) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", ref, name, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// List indicates an expected call of List.
+func (mr *MockClientMockRecorder) List(ref, name, ch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockClient)(nil).List), ref, name, ch)
+}
+
 // LoggedOut mocks base method.
 func (m *MockClient) LoggedOut() <-chan struct{} {
 	m.ctrl.T.Helper()
@@ -163,6 +221,78 @@ func (mr *MockClientMockRecorder) Select(name, readOnly interface{}) *gomock.Cal
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Select", reflect.TypeOf((*MockClient)(nil).Select), name, readOnly)
 }
 
+// Status mocks base method.
+func (m *MockClient) Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Status", name, items)
+	ret0, _ := ret[0].(*imap.MailboxStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Status indicates an expected call of Status.
+func (mr *MockClientMockRecorder) Status(name, items interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockClient)(nil).Status), name, items)
+}
+
+// UidCopy mocks base method.
+func (m *MockClient) UidCopy(seqset *imap.SeqSet, dest string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidCopy", seqset, dest)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UidCopy indicates an expected call of UidCopy.
+func (mr *MockClientMockRecorder) UidCopy(seqset, dest interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidCopy", reflect.TypeOf((*MockClient)(nil).UidCopy), seqset, dest)
+}
+
+// UidFetch mocks base method.
+func (m *MockClient) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidFetch", seqset, items, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UidFetch indicates an expected call of UidFetch.
+func (mr *MockClientMockRecorder) UidFetch(seqset, items, ch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidFetch", reflect.TypeOf((*MockClient)(nil).UidFetch), seqset, items, ch)
+}
+
+// UidFetchChangedSince mocks base method.
+func (m *MockClient) UidFetchChangedSince(seqset *imap.SeqSet, items []imap.FetchItem, modSeq uint64, ch chan *imap.Message) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidFetchChangedSince", seqset, items, modSeq, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// UidFetchChangedSince indicates an expected call of UidFetchChangedSince.
+func (mr *MockClientMockRecorder) UidFetchChangedSince(seqset, items, modSeq, ch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidFetchChangedSince", reflect.TypeOf((*MockClient)(nil).UidFetchChangedSince), seqset, items, modSeq, ch)
+}
+
+// UidSearch mocks base method.
+func (m *MockClient) UidSearch(criteria *imap.SearchCriteria) ([]uint32, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UidSearch", criteria)
+	ret0, _ := ret[0].([]uint32)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UidSearch indicates an expected call of UidSearch.
+func (mr *MockClientMockRecorder) UidSearch(criteria interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UidSearch", reflect.TypeOf((*MockClient)(nil).UidSearch), criteria)
+}
+
 // UidStore mocks base method.
 func (m *MockClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
 	m.ctrl.T.Helper()
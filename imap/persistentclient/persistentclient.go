@@ -90,6 +90,63 @@ func (c *PersistentIMAPClient) Fetch(seqset *imap.SeqSet, items []imap.FetchItem
 	return <-r
 }
 
+func (c *PersistentIMAPClient) UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_uidfetch_invoked")
+	if shutdown {
+		if ch != nil {
+			close(ch)
+		}
+		return errConnectionClosed
+	}
+
+	r := make(chan error)
+	c.ch <- uidFetchRequest{
+		r:      r,
+		seqset: seqset,
+		items:  items,
+		ch:     ch,
+	}
+	return <-r
+}
+
+func (c *PersistentIMAPClient) UidFetchChangedSince(seqset *imap.SeqSet, items []imap.FetchItem, modSeq uint64, ch chan *imap.Message) error {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_uidfetchchangedsince_invoked")
+	if shutdown {
+		if ch != nil {
+			close(ch)
+		}
+		return errConnectionClosed
+	}
+
+	r := make(chan error)
+	c.ch <- uidFetchChangedSinceRequest{
+		r:      r,
+		seqset: seqset,
+		items:  items,
+		modSeq: modSeq,
+		ch:     ch,
+	}
+	return <-r
+}
+
+func (c *PersistentIMAPClient) UidSearch(criteria *imap.SearchCriteria) ([]uint32, error) {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_uidsearch_invoked")
+	if shutdown {
+		return nil, errConnectionClosed
+	}
+
+	r := make(chan uidSearchResponse)
+	c.ch <- uidSearchRequest{
+		r:        r,
+		criteria: criteria,
+	}
+	sr := <-r
+	return sr.uids, sr.err
+}
+
 func (c *PersistentIMAPClient) Expunge(ch chan uint32) error {
 	shutdown := c.isShutdown()
 	c.log().WithField("shutdown", shutdown).Trace("pimap_expunge_invoked")
@@ -147,6 +204,103 @@ func (c *PersistentIMAPClient) Append(mbox string, flags []string, date time.Tim
 	return <-r
 }
 
+func (c *PersistentIMAPClient) UidCopy(seqset *imap.SeqSet, dest string) error {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_uidcopy_invoked")
+	if shutdown {
+		return errConnectionClosed
+	}
+
+	r := make(chan error)
+	c.ch <- uidCopyRequest{
+		r:      r,
+		seqset: seqset,
+		dest:   dest,
+	}
+	return <-r
+}
+
+func (c *PersistentIMAPClient) List(ref string, name string, ch chan *imap.MailboxInfo) error {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_list_invoked")
+	if shutdown {
+		if ch != nil {
+			close(ch)
+		}
+		return errConnectionClosed
+	}
+
+	r := make(chan error)
+	c.ch <- listRequest{
+		r:    r,
+		ref:  ref,
+		name: name,
+		ch:   ch,
+	}
+	return <-r
+}
+
+func (c *PersistentIMAPClient) Create(name string) error {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_create_invoked")
+	if shutdown {
+		return errConnectionClosed
+	}
+
+	r := make(chan error)
+	c.ch <- createRequest{
+		r:    r,
+		name: name,
+	}
+	return <-r
+}
+
+func (c *PersistentIMAPClient) Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_status_invoked")
+	if shutdown {
+		return nil, errConnectionClosed
+	}
+
+	r := make(chan statusResponse)
+	c.ch <- statusRequest{
+		r:     r,
+		name:  name,
+		items: items,
+	}
+	sr := <-r
+	return sr.status, sr.err
+}
+
+func (c *PersistentIMAPClient) Capability() (map[string]bool, error) {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_capability_invoked")
+	if shutdown {
+		return nil, errConnectionClosed
+	}
+
+	r := make(chan capabilityResponse)
+	c.ch <- capabilityRequest{r: r}
+	cr := <-r
+	return cr.caps, cr.err
+}
+
+func (c *PersistentIMAPClient) GetQuotaRoot(mailbox string) ([]imap.Quota, error) {
+	shutdown := c.isShutdown()
+	c.log().WithField("shutdown", shutdown).Trace("pimap_getquotaroot_invoked")
+	if shutdown {
+		return nil, errConnectionClosed
+	}
+
+	r := make(chan getQuotaRootResponse)
+	c.ch <- getQuotaRootRequest{
+		r:       r,
+		mailbox: mailbox,
+	}
+	qr := <-r
+	return qr.quotas, qr.err
+}
+
 func (c *PersistentIMAPClient) Mailbox() *imap.MailboxStatus {
 	shutdown := c.isShutdown()
 	c.log().WithField("shutdown", shutdown).Trace("pimap_mailbox_invoked")
@@ -220,6 +374,12 @@ func makeAndInitClient(cfg *Config, readOnly bool) (imap.Client, error) {
 	return c, err
 }
 
+func (c *PersistentIMAPClient) publishState(state imap.ConnectionState) {
+	if c.cfg.StateUpdates != nil {
+		c.cfg.StateUpdates <- state
+	}
+}
+
 func (c *PersistentIMAPClient) run() {
 	var nextDelay time.Duration = 0
 	var logout logoutRequest
@@ -280,12 +440,14 @@ func (c *PersistentIMAPClient) run() {
 				c.log().WithError(err).WithFields(log.Fields{
 					"new_delay": nextDelay,
 				}).Error("pimap_connection_failed")
+				c.publishState(imap.ConnectionDown)
 				continue
 			}
 
 			c.c = cli
 			state = ClientStateConnected
 			nextDelay = time.Second
+			c.publishState(imap.ConnectionUp)
 		}
 
 		if state == ClientStateConnected {
@@ -308,6 +470,7 @@ func (c *PersistentIMAPClient) run() {
 				c.log().Trace("pimap_disconnected")
 				c.c = nil
 				state = ClientStateDisconnected
+				c.publishState(imap.ConnectionDown)
 			case req := <-c.logoutChannel:
 				c.log().Trace("pimap_logout_request")
 				logout = req
@@ -326,6 +489,16 @@ func (c *PersistentIMAPClient) run() {
 				case fetchRequest:
 					c.log().Trace("pimap_fetch_request")
 					req.r <- c.c.Fetch(req.seqset, req.items, req.ch)
+				case uidFetchRequest:
+					c.log().Trace("pimap_uidfetch_request")
+					req.r <- c.c.UidFetch(req.seqset, req.items, req.ch)
+				case uidFetchChangedSinceRequest:
+					c.log().Trace("pimap_uidfetchchangedsince_request")
+					req.r <- c.c.UidFetchChangedSince(req.seqset, req.items, req.modSeq, req.ch)
+				case uidSearchRequest:
+					c.log().Trace("pimap_uidsearch_request")
+					uids, err := c.c.UidSearch(req.criteria)
+					req.r <- uidSearchResponse{uids: uids, err: err}
 				case expungeRequest:
 					c.log().Trace("pimap_expunge_request")
 					req.r <- c.c.Expunge(req.ch)
@@ -335,6 +508,27 @@ func (c *PersistentIMAPClient) run() {
 				case appendRequest:
 					c.log().Trace("pimap_append_request")
 					req.r <- c.c.Append(req.mbox, req.flags, req.date, req.msg)
+				case uidCopyRequest:
+					c.log().Trace("pimap_uidcopy_request")
+					req.r <- c.c.UidCopy(req.seqset, req.dest)
+				case listRequest:
+					c.log().Trace("pimap_list_request")
+					req.r <- c.c.List(req.ref, req.name, req.ch)
+				case createRequest:
+					c.log().Trace("pimap_create_request")
+					req.r <- c.c.Create(req.name)
+				case statusRequest:
+					c.log().Trace("pimap_status_request")
+					s, err := c.c.Status(req.name, req.items)
+					req.r <- statusResponse{status: s, err: err}
+				case capabilityRequest:
+					c.log().Trace("pimap_capability_request")
+					caps, err := c.c.Capability()
+					req.r <- capabilityResponse{caps: caps, err: err}
+				case getQuotaRootRequest:
+					c.log().Trace("pimap_getquotaroot_request")
+					quotas, err := c.c.GetQuotaRoot(req.mailbox)
+					req.r <- getQuotaRootResponse{quotas: quotas, err: err}
 				case mailboxRequest:
 					c.log().Trace("pimap_mailbox_request")
 					req.r <- c.c.Mailbox()
@@ -383,12 +577,30 @@ func (c *PersistentIMAPClient) drainRequests() {
 				req.r <- errConnectionClosed
 			case fetchRequest:
 				req.r <- errConnectionClosed
+			case uidFetchRequest:
+				req.r <- errConnectionClosed
+			case uidFetchChangedSinceRequest:
+				req.r <- errConnectionClosed
+			case uidSearchRequest:
+				req.r <- uidSearchResponse{err: errConnectionClosed}
 			case expungeRequest:
 				req.r <- errConnectionClosed
 			case uidStoreRequest:
 				req.r <- errConnectionClosed
 			case appendRequest:
 				req.r <- errConnectionClosed
+			case uidCopyRequest:
+				req.r <- errConnectionClosed
+			case listRequest:
+				req.r <- errConnectionClosed
+			case createRequest:
+				req.r <- errConnectionClosed
+			case statusRequest:
+				req.r <- statusResponse{err: errConnectionClosed}
+			case capabilityRequest:
+				req.r <- capabilityResponse{err: errConnectionClosed}
+			case getQuotaRootRequest:
+				req.r <- getQuotaRootResponse{err: errConnectionClosed}
 			case mailboxRequest:
 				req.r <- &imap.MailboxStatus{Name: c.cfg.Mailbox}
 			}
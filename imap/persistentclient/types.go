@@ -58,6 +58,34 @@ type fetchRequest struct {
 	ch     chan *imap.Message
 }
 
+type uidFetchRequest struct {
+	r chan error
+
+	seqset *imap.SeqSet
+	items  []imap.FetchItem
+	ch     chan *imap.Message
+}
+
+type uidFetchChangedSinceRequest struct {
+	r chan error
+
+	seqset *imap.SeqSet
+	items  []imap.FetchItem
+	modSeq uint64
+	ch     chan *imap.Message
+}
+
+type uidSearchResponse struct {
+	uids []uint32
+	err  error
+}
+
+type uidSearchRequest struct {
+	r chan uidSearchResponse
+
+	criteria *imap.SearchCriteria
+}
+
 type expungeRequest struct {
 	r chan error
 
@@ -82,6 +110,59 @@ type appendRequest struct {
 	msg   imap.Literal
 }
 
+type uidCopyRequest struct {
+	r chan error
+
+	seqset *imap.SeqSet
+	dest   string
+}
+
+type listRequest struct {
+	r chan error
+
+	ref  string
+	name string
+	ch   chan *imap.MailboxInfo
+}
+
+type createRequest struct {
+	r chan error
+
+	name string
+}
+
+type statusResponse struct {
+	status *imap.MailboxStatus
+	err    error
+}
+
+type statusRequest struct {
+	r chan statusResponse
+
+	name  string
+	items []imap.StatusItem
+}
+
+type capabilityResponse struct {
+	caps map[string]bool
+	err  error
+}
+
+type capabilityRequest struct {
+	r chan capabilityResponse
+}
+
+type getQuotaRootResponse struct {
+	quotas []imap2.Quota
+	err    error
+}
+
+type getQuotaRootRequest struct {
+	r chan getQuotaRootResponse
+
+	mailbox string
+}
+
 type mailboxRequest struct {
 	r chan *imap.MailboxStatus
 }
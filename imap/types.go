@@ -35,12 +35,32 @@ type Client interface {
 
 	Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error
 
+	UidFetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error
+
+	// UidFetchChangedSince is UidFetch with the CHANGEDSINCE modifier, as defined in RFC 7162.
+	// Only messages whose mod-sequence is above modSeq are fetched. The server must support CONDSTORE.
+	UidFetchChangedSince(seqset *imap.SeqSet, items []imap.FetchItem, modSeq uint64, ch chan *imap.Message) error
+
+	UidSearch(criteria *imap.SearchCriteria) ([]uint32, error)
+
 	Expunge(ch chan uint32) error
 
 	UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error
 
 	Append(mbox string, flags []string, date time.Time, msg imap.Literal) error
 
+	UidCopy(seqset *imap.SeqSet, dest string) error
+
+	List(ref string, name string, ch chan *imap.MailboxInfo) error
+
+	Create(name string) error
+
+	Status(name string, items []imap.StatusItem) (*imap.MailboxStatus, error)
+
+	Capability() (map[string]bool, error)
+
+	GetQuotaRoot(mailbox string) ([]Quota, error)
+
 	Mailbox() *imap.MailboxStatus
 
 	Logout() error
@@ -50,6 +70,35 @@ type Client interface {
 	FlagQuit()
 }
 
+// QuotaResource is a single resource in a QUOTA response, as defined in RFC 9208.
+// For the STORAGE resource, Usage and Limit are in units of 1024 octets.
+type QuotaResource struct {
+	Name  string
+	Usage uint64
+	Limit uint64
+}
+
+// Quota is the set of resource limits of a quota root.
+type Quota struct {
+	Root      string
+	Resources []QuotaResource
+}
+
+// StatusError is returned when the server rejects a command. Unlike the errors
+// returned by go-imap, it retains the response code, e.g. OVERQUOTA.
+type StatusError struct {
+	Code string
+	Info string
+}
+
+func (e *StatusError) Error() string {
+	if e.Code == "" {
+		return e.Info
+	}
+
+	return "[" + e.Code + "] " + e.Info
+}
+
 // Authenticatable is the minimal set of functions that are
 // used by an Authenticator. This is mainly to assist with mocking.
 type Authenticatable interface {
@@ -89,9 +138,32 @@ type ConnectionConfig struct {
 	Debug bool
 }
 
+// ConnectionState is the state of a client's connection to the server.
+type ConnectionState int
+
+const (
+	ConnectionDown ConnectionState = 0
+	ConnectionUp   ConnectionState = 1
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionDown:
+		return "down"
+	case ConnectionUp:
+		return "up"
+	default:
+		panic("invalid connection state")
+	}
+}
+
 type ClientConfig struct {
 	ConnectionConfig
 	Updates chan<- client.Update
+
+	// StateUpdates, if set, receives the connection state whenever it may
+	// have changed. Only clients that manage their own connection send these.
+	StateUpdates chan<- ConnectionState
 }
 
 type Factory interface {
@@ -104,3 +176,6 @@ type StoreItem = imap.StoreItem
 type MailboxStatus = imap.MailboxStatus
 type FetchItem = imap.FetchItem
 type Literal = imap.Literal
+type SearchCriteria = imap.SearchCriteria
+type StatusItem = imap.StatusItem
+type MailboxInfo = imap.MailboxInfo
@@ -0,0 +1,152 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+)
+
+var errMissingResult = errors.New("sink returned no result for message")
+
+// maxBatchSize is the most messages given to a BatchSink at once.
+const maxBatchSize = 20
+
+type pendingResponse struct {
+	ch       chan<- Response
+	response Response
+}
+
+// runBatch is run() for a BatchSink. Requests are accepted while the responses
+// to the previous batch are sent, and delivered together once they're done.
+//
+// Requests are always accepted, even once there's more than a batch waiting.
+// Callers may send requests and read responses on the same goroutine, so
+// refusing them until the responses are read would deadlock.
+func (ingest *ingestClient) runBatch(sink BatchSink) {
+	var pending []request
+	var responses []pendingResponse
+
+	for {
+		if len(pending) > 0 && len(responses) == 0 {
+			pending = ingest.collect(pending)
+			n := min(len(pending), maxBatchSize)
+			responses = ingest.deliverBatch(sink, pending[:n])
+			pending = pending[n:]
+			continue
+		}
+
+		var out chan<- Response
+		var resp Response
+		if len(responses) > 0 {
+			out, resp = responses[0].ch, responses[0].response
+		}
+
+		select {
+		case <-ingest.wantQuit:
+			for _, r := range responses {
+				r.ch <- r.response
+			}
+
+			for _, req := range pending {
+				req.ch <- Response{UID: req.UID, Error: errConnectionClosed}
+			}
+			return
+		case req := <-ingest.incoming:
+			pending = append(pending, req)
+		case out <- resp:
+			responses = responses[1:]
+		}
+	}
+}
+
+// collect adds any requests that are already waiting to a batch.
+func (ingest *ingestClient) collect(pending []request) []request {
+	for len(pending) < maxBatchSize {
+		select {
+		case req := <-ingest.incoming:
+			pending = append(pending, req)
+		default:
+			return pending
+		}
+	}
+
+	return pending
+}
+
+func (ingest *ingestClient) deliverBatch(sink BatchSink, reqs []request) []pendingResponse {
+	errs := make([]error, len(reqs))
+	deliveries := make([]Delivery, 0, len(reqs))
+	indices := make([]int, 0, len(reqs))
+
+	for i := range reqs {
+		req := &reqs[i]
+		log.WithFields(log.Fields{
+			"uid": req.UID,
+			"seq": req.Message.SeqNum,
+		}).Trace("ingest_start")
+
+		lit := req.Message.GetBody(ingest.rfc822Section)
+		if lit == nil {
+			errs[i] = &delivery.PermanentError{Err: errNoBody}
+			continue
+		}
+
+		fields := log.Fields{"mailbox": req.Mailbox, "uid": req.UID, "seq": req.Message.SeqNum}
+		body, err := ingest.readBody(lit, fields)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		deliveries = append(deliveries, Delivery{
+			Metadata: Metadata{Source: req.Source, UID: req.UID},
+			Mailbox:  req.Mailbox,
+			Flags:    req.Message.Flags,
+			Date:     req.Message.InternalDate,
+			Body:     body.Bytes(),
+		})
+		indices = append(indices, i)
+	}
+
+	if len(deliveries) > 0 {
+		log.WithField("count", len(deliveries)).Trace("ingest_batch_start")
+		results := sink.DeliverBatch(deliveries)
+		for j, i := range indices {
+			if j < len(results) {
+				errs[i] = results[j]
+			} else {
+				errs[i] = errMissingResult
+			}
+		}
+	}
+
+	responses := make([]pendingResponse, 0, len(reqs))
+	for i := range reqs {
+		logResult(&reqs[i], errs[i])
+		responses = append(responses, pendingResponse{
+			ch:       reqs[i].ch,
+			response: Response{UID: reqs[i].UID, Error: errs[i]},
+		})
+	}
+
+	return responses
+}
@@ -0,0 +1,147 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	log "github.com/sirupsen/logrus"
+)
+
+// splitHeader returns the raw header block of a message, including
+// the terminating blank line.
+func splitHeader(body []byte) []byte {
+	if i := bytes.Index(body, []byte("\r\n\r\n")); i >= 0 {
+		return body[:i+4]
+	}
+
+	if i := bytes.Index(body, []byte("\n\n")); i >= 0 {
+		return body[:i+2]
+	}
+
+	return body
+}
+
+// buildDuplicateCriteria builds the search criteria used to find candidate
+// duplicates of a message. If the message has a Message-ID, it is used directly,
+// otherwise the search is narrowed by size and Date.
+func buildDuplicateCriteria(hdr textproto.Header, size uint32) (*imap.SearchCriteria, bool) {
+	criteria := imap.NewSearchCriteria()
+
+	if messageID := hdr.Get("Message-Id"); messageID != "" {
+		criteria.Header.Add("Message-Id", messageID)
+		return criteria, true
+	}
+
+	if size > 0 {
+		criteria.Larger = size - 1
+	}
+	criteria.Smaller = size + 1
+
+	if date := hdr.Get("Date"); date != "" {
+		criteria.Header.Add("Date", date)
+	}
+
+	return criteria, false
+}
+
+// isDuplicate checks if a copy of body already exists in the destination mailbox.
+// Candidates are found by Message-ID and must match in size. Messages without a
+// Message-ID fall back to comparing a hash of the header block.
+func (ingest *ingestClient) isDuplicate(mailbox string, body []byte) (bool, error) {
+	rawHeader := splitHeader(body)
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(rawHeader)))
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := ingest.client.Select(mailbox, true); err != nil {
+		return false, err
+	}
+
+	criteria, byMessageID := buildDuplicateCriteria(hdr, uint32(len(body)))
+
+	uids, err := ingest.client.UidSearch(criteria)
+	if err != nil {
+		return false, err
+	}
+
+	log.WithFields(log.Fields{
+		"mailbox":       mailbox,
+		"by_message_id": byMessageID,
+		"candidates":    uids,
+	}).Trace("ingest_duplicate_candidates")
+
+	if len(uids) == 0 {
+		return false, nil
+	}
+
+	headerSection := &imap.BodySectionName{
+		BodyPartName: imap.BodyPartName{Specifier: imap.HeaderSpecifier},
+		Peek:         true,
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size}
+	if !byMessageID {
+		items = append(items, headerSection.FetchItem())
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() { done <- ingest.client.UidFetch(seqset, items, ch) }()
+
+	wantHash := sha256.Sum256(rawHeader)
+	found := false
+	for msg := range ch {
+		if found || msg.Size != uint32(len(body)) {
+			continue
+		}
+
+		if byMessageID {
+			found = true
+			continue
+		}
+
+		lit := msg.GetBody(headerSection)
+		if lit == nil {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(lit); err != nil {
+			continue
+		}
+
+		found = sha256.Sum256(buf.Bytes()) == wantHash
+	}
+
+	if err := <-done; err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
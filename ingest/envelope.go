@@ -0,0 +1,44 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// ReturnPath extracts the envelope sender from a message's Return-Path header,
+// for sinks that deliver over SMTP or LMTP. It's empty if there isn't one, or
+// it isn't a plain address.
+func ReturnPath(body []byte) string {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return ""
+	}
+
+	sender := strings.Trim(strings.TrimSpace(hdr.Get("Return-Path")), "<>")
+	if strings.ContainsAny(sender, " \t") {
+		return ""
+	}
+
+	return sender
+}
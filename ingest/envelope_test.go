@@ -0,0 +1,32 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReturnPath(t *testing.T) {
+	assert.Equal(t, "sender@example.com", ReturnPath([]byte("Return-Path: <sender@example.com>\r\nSubject: test\r\n\r\nbody\r\n")))
+	assert.Equal(t, "", ReturnPath([]byte("Return-Path: <>\r\n\r\nbody\r\n")))
+	assert.Equal(t, "", ReturnPath([]byte("Return-Path: not an address\r\n\r\nbody\r\n")))
+	assert.Equal(t, "", ReturnPath([]byte("Subject: test\r\n\r\nbody\r\n")))
+}
@@ -0,0 +1,29 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import "errors"
+
+// ErrMessageTooLarge is returned when a message exceeds the destination's
+// APPENDLIMIT, or is otherwise rejected for its size.
+var ErrMessageTooLarge = errors.New("message too large for destination")
+
+// ErrTimeout is returned by IngestMessageSyncTimeout when there's no response
+// in time.
+var ErrTimeout = errors.New("timed out waiting for the destination")
@@ -0,0 +1,67 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+)
+
+func (ingest *ingestClient) watchState() {
+	for state := range ingest.stateUpdates {
+		ingest.healthMu.Lock()
+		ingest.connected = state == imap2.ConnectionUp
+		ingest.updateHealth()
+		ingest.healthMu.Unlock()
+	}
+}
+
+func (ingest *ingestClient) setQuotaPaused(paused bool) {
+	ingest.healthMu.Lock()
+	defer ingest.healthMu.Unlock()
+
+	ingest.quotaPaused = paused
+	ingest.updateHealth()
+}
+
+// updateHealth recalculates the health, publishing it if it has changed.
+// healthMu must be held.
+func (ingest *ingestClient) updateHealth() {
+	health := delivery.HealthConnected
+	if !ingest.connected {
+		health = delivery.HealthDown
+	} else if ingest.quotaPaused {
+		health = delivery.HealthDegraded
+	}
+
+	if health == ingest.health {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"old": ingest.health,
+		"new": health,
+	}).Info("ingest_health_changed")
+	ingest.health = health
+
+	if ingest.healthUpdates != nil {
+		delivery.SendHealth(ingest.healthUpdates, health)
+	}
+}
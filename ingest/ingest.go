@@ -19,11 +19,14 @@
 package ingest
 
 import (
+	"bytes"
 	"errors"
 	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-imap"
 	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 )
 
@@ -33,24 +36,45 @@ func NewClient(cfg *Config) (Client, error) {
 		panic(err)
 	}
 
-	imapClient, err := cfg.Factory.NewClient(&imap2.ClientConfig{
-		ConnectionConfig: cfg.ConnectionConfig,
-		Updates:          nil,
-	})
+	quotaPollInterval := cfg.QuotaPollInterval
+	if quotaPollInterval == 0 {
+		quotaPollInterval = time.Minute
+	}
 
-	if err != nil {
-		return nil, err
+	stateUpdates := make(chan imap2.ConnectionState)
+
+	var imapClient imap2.Client
+	if cfg.Sink == nil {
+		imapClient, err = cfg.Factory.NewClient(&imap2.ClientConfig{
+			ConnectionConfig: cfg.ConnectionConfig,
+			Updates:          nil,
+			StateUpdates:     stateUpdates,
+		})
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	ingest := &ingestClient{
-		client:        imapClient,
-		rfc822Section: rfc822Section,
-		incoming:      make(chan request),
-		hasQuit:       make(chan struct{}),
-		wantQuit:      make(chan struct{}),
-		shutdown:      0,
+		client:            imapClient,
+		sink:              cfg.Sink,
+		rfc822Section:     rfc822Section,
+		checkDuplicates:   cfg.CheckDuplicates,
+		normalise:         cfg.Normalise,
+		quotaThreshold:    cfg.QuotaThreshold,
+		quotaPollInterval: quotaPollInterval,
+		connected:         true,
+		health:            delivery.HealthConnected,
+		healthUpdates:     cfg.HealthUpdates,
+		stateUpdates:      stateUpdates,
+		incoming:          make(chan request),
+		hasQuit:           make(chan struct{}),
+		wantQuit:          make(chan struct{}),
+		shutdown:          0,
 	}
 
+	go ingest.watchState()
 	go ingest.run()
 	return ingest, nil
 }
@@ -58,6 +82,7 @@ func NewClient(cfg *Config) (Client, error) {
 var (
 	errInvalidUID       = errors.New("invalid uid")
 	errConnectionClosed = errors.New("connection closed")
+	errNoBody           = errors.New("message has no body")
 )
 
 func (ingest *ingestClient) isShutdown() bool {
@@ -65,7 +90,11 @@ func (ingest *ingestClient) isShutdown() bool {
 }
 
 func (ingest *ingestClient) IngestMessage(mailbox string, msg *imap.Message, ch chan<- Response) error {
-	log.WithFields(log.Fields{"mailbox": mailbox, "uid": msg.Uid, "seq": msg.SeqNum}).Trace("ingest_message")
+	return ingest.IngestMessageFrom("", mailbox, msg, ch)
+}
+
+func (ingest *ingestClient) IngestMessageFrom(source string, mailbox string, msg *imap.Message, ch chan<- Response) error {
+	log.WithFields(log.Fields{"source": source, "mailbox": mailbox, "uid": msg.Uid, "seq": msg.SeqNum}).Trace("ingest_message")
 	if msg.Uid == 0 {
 		return errInvalidUID
 	}
@@ -74,25 +103,73 @@ func (ingest *ingestClient) IngestMessage(mailbox string, msg *imap.Message, ch
 		return errConnectionClosed
 	}
 
-	ingest.incoming <- request{Mailbox: mailbox, UID: msg.Uid, Message: msg, ch: ch}
+	ingest.incoming <- request{Source: source, Mailbox: mailbox, UID: msg.Uid, Message: msg, ch: ch}
 	return nil
 }
 
 func IngestMessageSync(mailbox string, ingestClient Client, msg *imap.Message) error {
-	ch := make(chan Response)
-	if err := ingestClient.IngestMessage(mailbox, msg, ch); err != nil {
+	return IngestMessageSyncTimeout("", mailbox, ingestClient, msg, 0)
+}
+
+// IngestMessageSyncTimeout is IngestMessageSync, but gives up with ErrTimeout
+// if there's no response within the timeout. A zero timeout waits forever.
+func IngestMessageSyncTimeout(source string, mailbox string, ingestClient Client, msg *imap.Message, timeout time.Duration) error {
+	// Buffered, so a late response doesn't block the ingest client
+	ch := make(chan Response, 1)
+	if err := ingestClient.IngestMessageFrom(source, mailbox, msg, ch); err != nil {
 		return err
 	}
 
-	res := <-ch
-	if res.Error != nil {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case res := <-ch:
 		return res.Error
+	case <-timer:
+		return ErrTimeout
 	}
+}
 
-	return nil
+// IngestCopySync is IngestMessageSyncTimeout for a message fetched from
+// another mailbox. \Recent is dropped from its flags, as a client can't set
+// it, and it means nothing in a copy.
+func IngestCopySync(source string, mailbox string, ingestClient Client, msg *imap.Message, timeout time.Duration) error {
+	var flags []string
+	for _, flag := range msg.Flags {
+		if flag != imap.RecentFlag {
+			flags = append(flags, flag)
+		}
+	}
+	msg.Flags = flags
+
+	return IngestMessageSyncTimeout(source, mailbox, ingestClient, msg, timeout)
+}
+
+func logResult(req *request, err error) {
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"uid": req.UID,
+			"seq": req.Message.SeqNum,
+		}).Error("ingest_failed")
+	} else {
+		log.WithFields(log.Fields{
+			"uid": req.UID,
+			"seq": req.Message.SeqNum,
+		}).Info("ingest_success")
+	}
 }
 
 func (ingest *ingestClient) run() {
+	if sink, ok := ingest.sink.(BatchSink); ok {
+		ingest.runBatch(sink)
+		goto done
+	}
+
 	for {
 		select {
 		case <-ingest.wantQuit:
@@ -102,31 +179,132 @@ func (ingest *ingestClient) run() {
 				"uid": req.UID,
 				"seq": req.Message.SeqNum,
 			}).Trace("ingest_start")
-			err := ingest.client.Append(req.Mailbox, req.Message.Flags, req.Message.InternalDate, req.Message.GetBody(ingest.rfc822Section))
-			if err != nil {
-				log.WithError(err).WithFields(log.Fields{
-					"uid": req.UID,
-					"seq": req.Message.SeqNum,
-				}).Error("ingest_failed")
-			} else {
-				log.WithFields(log.Fields{
-					"uid": req.UID,
-					"seq": req.Message.SeqNum,
-				}).Info("ingest_success")
-			}
+			err := ingest.append(&req)
+			logResult(&req, err)
 			req.ch <- Response{UID: req.UID, Error: err}
 		}
 	}
 done:
 	atomic.StoreInt32(&ingest.shutdown, 1)
 	drain(ingest.incoming)
-	if err := ingest.client.Logout(); err != nil {
+	if ingest.sink != nil {
+		if err := ingest.sink.Close(); err != nil {
+			log.WithError(err).Error("ingest_sink_close_failed")
+		}
+	} else if err := ingest.client.Logout(); err != nil {
 		log.WithError(err).Error("ingest_client_close_failed")
 	}
+	close(ingest.stateUpdates)
 
 	close(ingest.hasQuit)
 }
 
+// readBody buffers the body of a message, normalising it if needed.
+func (ingest *ingestClient) readBody(lit imap.Literal, fields log.Fields) (*bytes.Buffer, error) {
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(lit); err != nil {
+		return nil, err
+	}
+
+	if !ingest.normalise {
+		return body, nil
+	}
+
+	normalised, changes := normaliseMessage(body.Bytes())
+	for _, c := range changes {
+		log.WithFields(fields).WithFields(log.Fields{
+			"change": c.Kind,
+			"part":   c.Part,
+			"count":  c.Count,
+		}).Info("ingest_normalised")
+	}
+	return bytes.NewBuffer(normalised), nil
+}
+
+func (ingest *ingestClient) deliver(req *request) error {
+	lit := req.Message.GetBody(ingest.rfc822Section)
+	if lit == nil {
+		return &delivery.PermanentError{Err: errNoBody}
+	}
+
+	fields := log.Fields{"mailbox": req.Mailbox, "uid": req.UID, "seq": req.Message.SeqNum}
+
+	body, err := ingest.readBody(lit, fields)
+	if err != nil {
+		return err
+	}
+
+	if sink, ok := ingest.sink.(MetadataSink); ok {
+		meta := Metadata{Source: req.Source, UID: req.UID}
+		return sink.DeliverMetadata(meta, req.Mailbox, req.Message.Flags, req.Message.InternalDate, body.Bytes())
+	}
+
+	return ingest.sink.Deliver(req.Mailbox, req.Message.Flags, req.Message.InternalDate, body.Bytes())
+}
+
+func (ingest *ingestClient) append(req *request) error {
+	if ingest.sink != nil {
+		return ingest.deliver(req)
+	}
+
+	lit := req.Message.GetBody(ingest.rfc822Section)
+	if lit == nil {
+		return ingest.client.Append(req.Mailbox, req.Message.Flags, req.Message.InternalDate, lit)
+	}
+
+	fields := log.Fields{"mailbox": req.Mailbox, "uid": req.UID, "seq": req.Message.SeqNum}
+
+	ingest.loadCapabilities()
+
+	// The body may be needed more than once, so buffer it.
+	body, err := ingest.readBody(lit, fields)
+	if err != nil {
+		return err
+	}
+
+	size := uint64(body.Len())
+	if ingest.appendLimit > 0 && size > ingest.appendLimit {
+		log.WithFields(fields).WithFields(log.Fields{
+			"size":         size,
+			"append_limit": ingest.appendLimit,
+		}).Warn("ingest_append_limit_exceeded")
+		return &delivery.PermanentError{Err: ErrMessageTooLarge}
+	}
+
+	if ingest.checkDuplicates {
+		if dup, err := ingest.isDuplicate(req.Mailbox, body.Bytes()); err != nil {
+			log.WithError(err).WithFields(fields).Warn("ingest_duplicate_check_failed")
+		} else if dup {
+			log.WithFields(fields).Info("ingest_duplicate_skipped")
+			return nil
+		}
+	}
+
+	overQuota := false
+	for {
+		if !ingest.waitForQuota(req.Mailbox, size, overQuota) {
+			return errConnectionClosed
+		}
+
+		err := ingest.client.Append(req.Mailbox, req.Message.Flags, req.Message.InternalDate, bytes.NewReader(body.Bytes()))
+		if err == nil {
+			ingest.quotaUsage += size
+			return nil
+		}
+
+		if isTooBig(err) {
+			return &delivery.PermanentError{Err: err}
+		}
+
+		if !isOverQuota(err) {
+			return err
+		}
+
+		log.WithError(err).WithFields(fields).Warn("ingest_over_quota")
+		overQuota = true
+	}
+}
+
 func drain(ch chan request) {
 	count := 0
 	for {
@@ -20,14 +20,18 @@ package ingest
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"testing"
+	"time"
 
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/internal"
 
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 
 	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
 	"github.com/emersion/go-message"
 	"github.com/stretchr/testify/assert"
 	"git.vs49688.net/zane/mailpump/imap/client"
@@ -43,7 +47,9 @@ func makeTestMessage(t *testing.T, messageID string) (*imap.Message, []byte, int
 	hdr.Add("Subject", "Test Email")
 	hdr.Add("Date", "Wed, 11 May 2016 14:31:59 +0000")
 	hdr.Add("Content-Type", "text/plain")
-	hdr.Add("Message-ID", messageID)
+	if messageID != "" {
+		hdr.Add("Message-ID", messageID)
+	}
 
 	msg, err := message.New(hdr, strings.NewReader("Привет!"))
 	assert.NoError(t, err)
@@ -110,3 +116,329 @@ func TestIngestPersistent(t *testing.T) {
 		})
 	})
 }
+
+func TestIngestCheckDuplicates(t *testing.T) {
+	for _, messageID := range []string{"<dup@example.com>", ""} {
+		t.Run(fmt.Sprintf("message_id=%q", messageID), func(t *testing.T) {
+			_, addr, mailbox := internal.BuildTestIMAPServer(t)
+
+			ingest, err := NewClient(&Config{
+				ConnectionConfig: imap2.ConnectionConfig{
+					HostPort: addr,
+					Auth:     imap2.NewNormalAuthenticator("username", "password"),
+				},
+				Factory:         client.Factory{},
+				CheckDuplicates: true,
+			})
+			assert.NoError(t, err)
+			defer ingest.Close()
+
+			for i := uint32(1); i <= 2; i++ {
+				msg, _, _ := makeTestMessage(t, messageID)
+				msg.Uid = i
+				err = IngestMessageSync("INBOX", ingest, msg)
+				assert.NoError(t, err)
+			}
+
+			assert.Len(t, mailbox.Messages, 1)
+		})
+	}
+}
+
+// testExtension adds capabilities, and a fixed GETQUOTAROOT response
+// to the test server.
+type testExtension struct {
+	caps         []string
+	usage, limit uint32
+}
+
+func (ext *testExtension) Capabilities(_ server.Conn) []string {
+	return ext.caps
+}
+
+func (ext *testExtension) Command(name string) server.HandlerFactory {
+	if name != "GETQUOTAROOT" {
+		return nil
+	}
+
+	return func() server.Handler { return &testQuotaHandler{ext: ext} }
+}
+
+type testQuotaHandler struct {
+	ext *testExtension
+}
+
+func (h *testQuotaHandler) Parse(_ []interface{}) error {
+	return nil
+}
+
+func (h *testQuotaHandler) Handle(conn server.Conn) error {
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("QUOTA"),
+		"",
+		[]interface{}{imap.RawString("STORAGE"), h.ext.usage, h.ext.limit},
+	}))
+}
+
+func TestIngestAppendLimit(t *testing.T) {
+	_, addr, mailbox := internal.BuildTestIMAPServer(t, &testExtension{caps: []string{"APPENDLIMIT=10"}})
+
+	ingest, err := NewClient(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory: client.Factory{},
+	})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	msg, _, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 1
+	err = IngestMessageSync("INBOX", ingest, msg)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+	assert.True(t, delivery.IsPermanent(err))
+	assert.Len(t, mailbox.Messages, 0)
+}
+
+func TestIngestQuotaPause(t *testing.T) {
+	_, addr, mailbox := internal.BuildTestIMAPServer(t, &testExtension{caps: []string{"QUOTA"}, usage: 99, limit: 100})
+
+	healthCh := make(chan delivery.Health, 1)
+	ingest, err := NewClient(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory:           client.Factory{},
+		QuotaThreshold:    0.95,
+		QuotaPollInterval: 100 * time.Millisecond,
+		HealthUpdates:     healthCh,
+	})
+	assert.NoError(t, err)
+
+	msg, _, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 1
+
+	ch := make(chan Response, 1)
+	err = ingest.IngestMessage("INBOX", msg, ch)
+	assert.NoError(t, err)
+
+	select {
+	case <-ch:
+		assert.Fail(t, "ingest wasn't paused")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	select {
+	case h := <-healthCh:
+		assert.Equal(t, delivery.HealthDegraded, h)
+	default:
+		assert.Fail(t, "health wasn't updated")
+	}
+
+	ingest.Close()
+
+	r := <-ch
+	assert.ErrorIs(t, r.Error, errConnectionClosed)
+	assert.Len(t, mailbox.Messages, 0)
+}
+
+func TestIngestHealthDown(t *testing.T) {
+	s, addr, _ := internal.BuildTestIMAPServer(t)
+
+	healthCh := make(chan delivery.Health, 1)
+	ingest, err := NewClient(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory:       persistentclient.Factory{MaxDelay: time.Second},
+		HealthUpdates: healthCh,
+	})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	// Make sure we're connected first
+	msg, _, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 1
+	assert.NoError(t, IngestMessageSync("INBOX", ingest, msg))
+
+	assert.NoError(t, s.Close())
+
+	select {
+	case h := <-healthCh:
+		assert.Equal(t, delivery.HealthDown, h)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "health wasn't updated")
+	}
+}
+
+type testMetadataSink struct {
+	meta    Metadata
+	mailbox string
+	flags   []string
+	body    []byte
+}
+
+func (s *testMetadataSink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	return s.DeliverMetadata(Metadata{}, mailbox, flags, date, body)
+}
+
+func (s *testMetadataSink) DeliverMetadata(meta Metadata, mailbox string, flags []string, _ time.Time, body []byte) error {
+	s.meta = meta
+	s.mailbox = mailbox
+	s.flags = flags
+	s.body = body
+	return nil
+}
+
+func (s *testMetadataSink) Close() error {
+	return nil
+}
+
+func TestIngestMetadataSink(t *testing.T) {
+	sink := &testMetadataSink{}
+
+	ingest, err := NewClient(&Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	msg, data, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 42
+
+	ch := make(chan Response, 1)
+	assert.NoError(t, ingest.IngestMessageFrom("work", "Archive", msg, ch))
+	assert.Equal(t, Response{UID: 42}, <-ch)
+
+	assert.Equal(t, Metadata{Source: "work", UID: 42}, sink.meta)
+	assert.Equal(t, "Archive", sink.mailbox)
+	assert.Equal(t, data, sink.body)
+}
+
+type testBatchSink struct {
+	testMetadataSink
+	gate    chan struct{}
+	batches []int
+}
+
+func (s *testBatchSink) DeliverBatch(deliveries []Delivery) []error {
+	<-s.gate
+	s.batches = append(s.batches, len(deliveries))
+	return make([]error, len(deliveries))
+}
+
+func TestIngestBatchSink(t *testing.T) {
+	sink := &testBatchSink{gate: make(chan struct{})}
+
+	ingest, err := NewClient(&Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	ch := make(chan Response, 5)
+	for i := 1; i <= 5; i++ {
+		msg, _, _ := makeTestMessage(t, "test@example.com")
+		msg.Uid = uint32(i)
+		go func() {
+			assert.NoError(t, ingest.IngestMessage("INBOX", msg, ch))
+		}()
+
+		// Let the first one start before queueing the rest
+		if i == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	// Give the rest time to queue
+	time.Sleep(50 * time.Millisecond)
+	close(sink.gate)
+
+	uids := []uint32{}
+	for i := 0; i < 5; i++ {
+		r := <-ch
+		assert.NoError(t, r.Error)
+		uids = append(uids, r.UID)
+	}
+
+	assert.ElementsMatch(t, []uint32{1, 2, 3, 4, 5}, uids)
+	assert.Equal(t, []int{1, 4}, sink.batches)
+}
+
+func TestIngestBatchSinkBacklog(t *testing.T) {
+	sink := &testBatchSink{gate: make(chan struct{})}
+	close(sink.gate)
+
+	ingest, err := NewClient(&Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	// Like the pump, queue everything before reading any responses
+	count := 2*maxBatchSize + 1
+	ch := make(chan Response)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= count; i++ {
+			msg, _, _ := makeTestMessage(t, "test@example.com")
+			msg.Uid = uint32(i)
+			assert.NoError(t, ingest.IngestMessage("INBOX", msg, ch))
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		// Unblock it so Close() can finish
+		go func() {
+			for range ch {
+			}
+		}()
+		t.Fatal("ingest stopped accepting messages")
+	}
+
+	for i := 0; i < count; i++ {
+		assert.NoError(t, (<-ch).Error)
+	}
+
+	total := 0
+	for _, n := range sink.batches {
+		assert.LessOrEqual(t, n, maxBatchSize)
+		total += n
+	}
+	assert.Equal(t, count, total)
+}
+
+func TestIngestSyncTimeout(t *testing.T) {
+	sink := &testBatchSink{gate: make(chan struct{})}
+
+	ingest, err := NewClient(&Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	msg, _, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 1
+
+	err = IngestMessageSyncTimeout("stdin", "INBOX", ingest, msg, 100*time.Millisecond)
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// The late response mustn't block the ingest client
+	close(sink.gate)
+	msg.Uid = 2
+	assert.NoError(t, IngestMessageSyncTimeout("stdin", "INBOX", ingest, msg, 5*time.Second))
+}
+
+func TestIngestCopySync(t *testing.T) {
+	sink := &testMetadataSink{}
+
+	ingest, err := NewClient(&Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ingest.Close()
+
+	msg, _, _ := makeTestMessage(t, "test@example.com")
+	msg.Uid = 1
+	msg.Flags = []string{imap.SeenFlag, imap.RecentFlag}
+
+	assert.NoError(t, IngestCopySync("export", "Archive", ingest, msg, 0))
+	assert.Equal(t, Metadata{Source: "export", UID: 1}, sink.meta)
+	assert.Equal(t, []string{imap.SeenFlag}, sink.flags)
+}
@@ -60,3 +60,17 @@ func (mr *MockClientMockRecorder) IngestMessage(mailbox, msg, ch interface{}) *g
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IngestMessage", reflect.TypeOf((*MockClient)(nil).IngestMessage), mailbox, msg, ch)
 }
+
+// IngestMessageFrom mocks base method.
+func (m *MockClient) IngestMessageFrom(source string, mailbox string, msg *imap.Message, ch chan<- ingest.Response) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IngestMessageFrom", source, mailbox, msg, ch)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// IngestMessageFrom indicates an expected call of IngestMessageFrom.
+func (mr *MockClientMockRecorder) IngestMessageFrom(source, mailbox, msg, ch interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IngestMessageFrom", reflect.TypeOf((*MockClient)(nil).IngestMessageFrom), source, mailbox, msg, ch)
+}
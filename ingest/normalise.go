@@ -0,0 +1,442 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"mime/quotedprintable"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+const (
+	// maxLineLength is the maximum length of a line, excluding the CRLF,
+	// as per RFC 5322 Section 2.1.1.
+	maxLineLength = 998
+
+	// base64LineLength is the line length used when splitting base64.
+	base64LineLength = 76
+)
+
+var crlf = []byte("\r\n")
+
+// normaliseChange is a single kind of change made to a part of a message.
+type normaliseChange struct {
+	Kind  string
+	Part  string
+	Count int
+}
+
+type normaliser struct {
+	changes []normaliseChange
+}
+
+func (n *normaliser) record(kind string, part string, count int) {
+	if count == 0 {
+		return
+	}
+
+	for i := range n.changes {
+		if n.changes[i].Kind == kind && n.changes[i].Part == part {
+			n.changes[i].Count += count
+			return
+		}
+	}
+
+	n.changes = append(n.changes, normaliseChange{Kind: kind, Part: part, Count: count})
+}
+
+// normaliseMessage repairs a raw message so strict servers will accept it.
+// Line endings are converted to CRLF, NULs are removed, and lines longer than
+// maxLineLength are broken in a way appropriate to the part they're in.
+func normaliseMessage(raw []byte) ([]byte, []normaliseChange) {
+	n := &normaliser{}
+	out := n.fixLineEndings(raw)
+	out = n.entity("", out)
+	return out, n.changes
+}
+
+// fixLineEndings converts bare CRs and LFs to CRLF, and strips NULs.
+func (n *normaliser) fixLineEndings(raw []byte) []byte {
+	var bareCR, bareLF, nul int
+
+	out := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		switch c := raw[i]; c {
+		case 0:
+			nul++
+		case '\r':
+			if i+1 < len(raw) && raw[i+1] == '\n' {
+				i++
+			} else {
+				bareCR++
+			}
+			out = append(out, crlf...)
+		case '\n':
+			bareLF++
+			out = append(out, crlf...)
+		default:
+			out = append(out, c)
+		}
+	}
+
+	n.record("bare_cr", "", bareCR)
+	n.record("bare_lf", "", bareLF)
+	n.record("nul", "", nul)
+
+	if bareCR == 0 && bareLF == 0 && nul == 0 {
+		return raw
+	}
+
+	return out
+}
+
+// splitLines splits data after each CRLF. The last line may not have one.
+func splitLines(data []byte) [][]byte {
+	lines := bytes.SplitAfter(data, crlf)
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func lineLength(line []byte) int {
+	return len(bytes.TrimSuffix(line, crlf))
+}
+
+func hasLongLines(data []byte) bool {
+	for _, line := range splitLines(data) {
+		if lineLength(line) > maxLineLength {
+			return true
+		}
+	}
+	return false
+}
+
+func childPart(parent string, i int) string {
+	if parent == "" {
+		return strconv.Itoa(i)
+	}
+	return parent + "." + strconv.Itoa(i)
+}
+
+// splitEntity splits an entity into its header (including the trailing CRLF
+// of the last field) and body.
+func splitEntity(data []byte) ([]byte, []byte, bool) {
+	if bytes.HasPrefix(data, crlf) {
+		return nil, data[2:], true
+	}
+
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx >= 0 {
+		return data[:idx+2], data[idx+4:], true
+	}
+
+	return data, nil, false
+}
+
+func (n *normaliser) entity(part string, data []byte) []byte {
+	header, body, hasBody := splitEntity(data)
+	header = n.foldHeader(part, header)
+
+	if !hasBody {
+		return header
+	}
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(append(header[:len(header):len(header)], crlf...))))
+	if err != nil {
+		hdr = textproto.Header{}
+	}
+
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	cte := strings.ToLower(strings.TrimSpace(hdr.Get("Content-Transfer-Encoding")))
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		body = n.multipart(part, body, params["boundary"])
+	case mediaType == "message/rfc822" && cte != "base64" && cte != "quoted-printable":
+		body = n.entity(part, body)
+	default:
+		header, body = n.leaf(part, header, body, cte)
+	}
+
+	out := make([]byte, 0, len(header)+len(body)+2)
+	out = append(out, header...)
+	out = append(out, crlf...)
+	return append(out, body...)
+}
+
+// foldHeader folds over-long header lines at whitespace.
+func (n *normaliser) foldHeader(part string, header []byte) []byte {
+	if !hasLongLines(header) {
+		return header
+	}
+
+	var folded, unfoldable int
+	out := make([]byte, 0, len(header))
+	for _, line := range splitLines(header) {
+		if lineLength(line) > maxLineLength {
+			folded++
+		}
+
+		for lineLength(line) > maxLineLength {
+			idx := foldPoint(line)
+			if idx < 0 {
+				folded--
+				unfoldable++
+				break
+			}
+
+			out = append(out, line[:idx]...)
+			out = append(out, crlf...)
+			line = line[idx:]
+		}
+		out = append(out, line...)
+	}
+
+	n.record("header_folded", part, folded)
+	n.record("header_unfoldable", part, unfoldable)
+	return out
+}
+
+// foldPoint finds where a header line can be folded, preferring the last
+// whitespace before the limit. Returns -1 if there's nowhere to fold.
+func foldPoint(line []byte) int {
+	isWSP := func(c byte) bool { return c == ' ' || c == '\t' }
+
+	// Never fold at the start of a line, that would leave it empty.
+	for i := maxLineLength; i > 0; i-- {
+		if isWSP(line[i]) && !isWSP(line[i-1]) {
+			return i
+		}
+	}
+
+	length := lineLength(line)
+	for i := maxLineLength + 1; i < length; i++ {
+		if isWSP(line[i]) && !isWSP(line[i-1]) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func isDelimiter(line []byte, delim []byte) (bool, bool) {
+	line = bytes.TrimRight(bytes.TrimSuffix(line, crlf), " \t")
+	if !bytes.HasPrefix(line, delim) {
+		return false, false
+	}
+
+	rest := line[len(delim):]
+	if len(rest) == 0 {
+		return true, false
+	}
+
+	if bytes.Equal(rest, []byte("--")) {
+		return true, true
+	}
+
+	return false, false
+}
+
+// multipart normalises each part of a multipart body. The CRLF before
+// a delimiter belongs to it, so it is kept out of the parts.
+func (n *normaliser) multipart(part string, body []byte, boundary string) []byte {
+	delim := []byte("--" + boundary)
+
+	var out []byte
+	var current [][]byte
+	inPart, closed := false, false
+	index := 0
+
+	flush := func() {
+		data := bytes.Join(current, nil)
+		current = nil
+
+		if !inPart {
+			out = append(out, n.hardWrap(part, data)...)
+			return
+		}
+
+		data, hadCRLF := bytes.CutSuffix(data, crlf)
+		index++
+		out = append(out, n.entity(childPart(part, index), data)...)
+		if hadCRLF {
+			out = append(out, crlf...)
+		}
+	}
+
+	for _, line := range splitLines(body) {
+		if closed {
+			current = append(current, line)
+			continue
+		}
+
+		if ok, last := isDelimiter(line, delim); ok {
+			flush()
+			out = append(out, line...)
+			inPart = !last
+			closed = last
+			continue
+		}
+
+		current = append(current, line)
+	}
+
+	// Whatever's left is either the epilogue, or an unterminated part.
+	flush()
+	return out
+}
+
+// hardWrap breaks long lines in text that isn't part of any entity,
+// such as a multipart preamble or epilogue.
+func (n *normaliser) hardWrap(part string, data []byte) []byte {
+	if !hasLongLines(data) {
+		return data
+	}
+
+	count := 0
+	out := make([]byte, 0, len(data))
+	for _, line := range splitLines(data) {
+		if lineLength(line) > maxLineLength {
+			count++
+		}
+
+		for lineLength(line) > maxLineLength {
+			out = append(out, line[:maxLineLength]...)
+			out = append(out, crlf...)
+			line = line[maxLineLength:]
+		}
+		out = append(out, line...)
+	}
+
+	n.record("line_wrapped", part, count)
+	return out
+}
+
+func (n *normaliser) leaf(part string, header []byte, body []byte, cte string) ([]byte, []byte) {
+	if !hasLongLines(body) {
+		return header, body
+	}
+
+	switch cte {
+	case "base64":
+		return header, n.splitBase64(part, body)
+	case "quoted-printable":
+		return header, n.softBreak(part, body)
+	default:
+		return n.reencode(part, header, body)
+	}
+}
+
+// splitBase64 splits long base64 lines. Decoders ignore line breaks, so
+// this can be done anywhere.
+func (n *normaliser) splitBase64(part string, body []byte) []byte {
+	count := 0
+	out := make([]byte, 0, len(body))
+	for _, line := range splitLines(body) {
+		if lineLength(line) > maxLineLength {
+			count++
+		}
+
+		for lineLength(line) > maxLineLength {
+			out = append(out, line[:base64LineLength]...)
+			out = append(out, crlf...)
+			line = line[base64LineLength:]
+		}
+		out = append(out, line...)
+	}
+
+	n.record("base64_split", part, count)
+	return out
+}
+
+// softBreak inserts quoted-printable soft line breaks into long lines,
+// taking care not to split an escape sequence.
+func (n *normaliser) softBreak(part string, body []byte) []byte {
+	count := 0
+	out := make([]byte, 0, len(body))
+	for _, line := range splitLines(body) {
+		if lineLength(line) > maxLineLength {
+			count++
+		}
+
+		for lineLength(line) > maxLineLength {
+			// Leave room for the '='
+			idx := maxLineLength - 1
+			if line[idx-1] == '=' {
+				idx--
+			} else if line[idx-2] == '=' {
+				idx -= 2
+			}
+
+			out = append(out, line[:idx]...)
+			out = append(out, "=\r\n"...)
+			line = line[idx:]
+		}
+		out = append(out, line...)
+	}
+
+	n.record("qp_soft_break", part, count)
+	return out
+}
+
+// reencode converts an unencoded part with long lines to quoted-printable.
+func (n *normaliser) reencode(part string, header []byte, body []byte) ([]byte, []byte) {
+	encoded := new(bytes.Buffer)
+	w := quotedprintable.NewWriter(encoded)
+	_, _ = w.Write(body)
+	_ = w.Close()
+
+	header = removeHeaderField(header, "Content-Transfer-Encoding")
+	header = append(header, "Content-Transfer-Encoding: quoted-printable\r\n"...)
+
+	n.record("reencoded_qp", part, 1)
+	return header, encoded.Bytes()
+}
+
+// removeHeaderField removes every instance of a field, including any
+// continuation lines.
+func removeHeaderField(header []byte, name string) []byte {
+	out := make([]byte, 0, len(header))
+	skipping := false
+	for _, line := range splitLines(header) {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			if !skipping {
+				out = append(out, line...)
+			}
+			continue
+		}
+
+		k, _, ok := bytes.Cut(line, []byte(":"))
+		skipping = ok && strings.EqualFold(strings.TrimSpace(string(k)), name)
+		if !skipping {
+			out = append(out, line...)
+		}
+	}
+
+	return out
+}
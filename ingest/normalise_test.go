@@ -0,0 +1,178 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertNoLongLines(t *testing.T, data []byte) {
+	for _, line := range splitLines(data) {
+		assert.LessOrEqual(t, lineLength(line), maxLineLength)
+	}
+}
+
+// readParts decodes the body of every leaf part of a message.
+func readParts(t *testing.T, raw []byte) []string {
+	e, err := message.Read(bytes.NewReader(raw))
+	assert.NoError(t, err)
+
+	var parts []string
+	assert.NoError(t, e.Walk(func(path []int, entity *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entity.MultipartReader() != nil {
+			return nil
+		}
+
+		b, err := io.ReadAll(entity.Body)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, string(b))
+		return nil
+	}))
+
+	return parts
+}
+
+func longWords(n int) string {
+	return strings.TrimSpace(strings.Repeat("word ", n))
+}
+
+func TestNormaliseLineEndings(t *testing.T) {
+	raw := "From: from@example.com\nSubject: Test\r\n\nHello\x00\rWorld\r\n"
+
+	out, changes := normaliseMessage([]byte(raw))
+	assert.Equal(t, "From: from@example.com\r\nSubject: Test\r\n\r\nHello\r\nWorld\r\n", string(out))
+	assert.ElementsMatch(t, []normaliseChange{
+		{Kind: "bare_cr", Count: 1},
+		{Kind: "bare_lf", Count: 2},
+		{Kind: "nul", Count: 1},
+	}, changes)
+}
+
+func TestNormaliseUnchanged(t *testing.T) {
+	raw := []byte("From: from@example.com\r\nSubject: Test\r\n\r\nHello\r\n")
+
+	out, changes := normaliseMessage(raw)
+	assert.Equal(t, raw, out)
+	assert.Empty(t, changes)
+}
+
+func TestNormaliseHeader(t *testing.T) {
+	subject := longWords(300)
+	raw := "Subject: " + subject + "\r\n\r\nHello\r\n"
+
+	out, changes := normaliseMessage([]byte(raw))
+	assertNoLongLines(t, out)
+	assert.Equal(t, []normaliseChange{{Kind: "header_folded", Count: 1}}, changes)
+
+	e, err := message.Read(bytes.NewReader(out))
+	assert.NoError(t, err)
+	assert.Equal(t, subject, e.Header.Get("Subject"))
+}
+
+func TestNormaliseBody(t *testing.T) {
+	text := longWords(500) + "\r\n" + strings.Repeat("é", 600) + "\r\n"
+
+	qp := new(bytes.Buffer)
+	w := quotedprintable.NewWriter(qp)
+	_, _ = w.Write([]byte(text))
+	_ = w.Close()
+	// Join the soft line breaks, making the lines too long
+	qpLong := strings.ReplaceAll(qp.String(), "=\r\n", "")
+
+	b64 := base64.StdEncoding.EncodeToString([]byte(text))
+
+	tests := []struct {
+		name string
+		cte  string
+		body string
+		kind string
+	}{
+		{name: "7bit", cte: "7bit", body: text, kind: "reencoded_qp"},
+		{name: "none", cte: "", body: text, kind: "reencoded_qp"},
+		{name: "quoted-printable", cte: "quoted-printable", body: qpLong, kind: "qp_soft_break"},
+		{name: "base64", cte: "base64", body: b64, kind: "base64_split"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := "Content-Type: text/plain; charset=utf-8\r\n"
+			if tt.cte != "" {
+				raw += "Content-Transfer-Encoding: " + tt.cte + "\r\n"
+			}
+			raw += "\r\n" + tt.body
+
+			out, changes := normaliseMessage([]byte(raw))
+			assertNoLongLines(t, out)
+			assert.Len(t, changes, 1)
+			assert.Equal(t, tt.kind, changes[0].Kind)
+			assert.Equal(t, []string{text}, readParts(t, out))
+		})
+	}
+}
+
+func TestNormaliseMultipart(t *testing.T) {
+	text := longWords(500) + "\r\n"
+	b64 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 1000)))
+
+	raw := "Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"This is the preamble.\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Short\r\n" +
+		"--outer\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		text +
+		"--inner\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		b64 + "\r\n" +
+		"--inner--\r\n" +
+		"--outer--\r\n"
+
+	out, changes := normaliseMessage([]byte(raw))
+	assertNoLongLines(t, out)
+	assert.ElementsMatch(t, []normaliseChange{
+		{Kind: "reencoded_qp", Part: "2.1", Count: 1},
+		{Kind: "base64_split", Part: "2.2", Count: 1},
+	}, changes)
+
+	// The final CRLF of a part belongs to the delimiter
+	assert.Equal(t, []string{"Short", longWords(500), strings.Repeat("x", 1000)}, readParts(t, out))
+}
@@ -0,0 +1,176 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package ingest
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+)
+
+// loadCapabilities fetches and caches the capabilities of the destination.
+func (ingest *ingestClient) loadCapabilities() {
+	if ingest.caps != nil {
+		return
+	}
+
+	caps, err := ingest.client.Capability()
+	if err != nil {
+		log.WithError(err).Warn("ingest_capability_failed")
+		return
+	}
+
+	ingest.caps = caps
+	for c := range caps {
+		v, ok := strings.CutPrefix(strings.ToUpper(c), "APPENDLIMIT=")
+		if !ok {
+			continue
+		}
+
+		if limit, err := strconv.ParseUint(v, 10, 64); err == nil {
+			ingest.appendLimit = limit
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"append_limit": ingest.appendLimit,
+		"quota":        caps["QUOTA"],
+	}).Info("ingest_capabilities")
+}
+
+func (ingest *ingestClient) quotaEnabled() bool {
+	return ingest.quotaThreshold > 0 && ingest.caps["QUOTA"]
+}
+
+// refreshQuota fetches the STORAGE quota of mailbox. If there are multiple
+// quota roots, the one with the least space remaining is used.
+func (ingest *ingestClient) refreshQuota(mailbox string) error {
+	quotas, err := ingest.client.GetQuotaRoot(mailbox)
+	if err != nil {
+		return err
+	}
+
+	var usage, limit uint64
+	for _, q := range quotas {
+		for _, r := range q.Resources {
+			if r.Name != "STORAGE" || r.Limit == 0 {
+				continue
+			}
+
+			if limit == 0 || r.Limit-min(r.Usage, r.Limit) < limit-min(usage, limit) {
+				usage, limit = r.Usage, r.Limit
+			}
+		}
+	}
+
+	// STORAGE is in units of 1024 octets
+	ingest.quotaUsage = usage * 1024
+	ingest.quotaLimit = limit * 1024
+	ingest.quotaCheckedAt = time.Now()
+
+	log.WithFields(log.Fields{
+		"mailbox": mailbox,
+		"usage":   ingest.quotaUsage,
+		"limit":   ingest.quotaLimit,
+	}).Trace("ingest_quota")
+	return nil
+}
+
+// quotaAllows checks if a message of the given size can be appended
+// without exceeding the quota threshold.
+func (ingest *ingestClient) quotaAllows(mailbox string, size uint64) bool {
+	if !ingest.quotaEnabled() {
+		return true
+	}
+
+	if time.Since(ingest.quotaCheckedAt) >= ingest.quotaPollInterval {
+		if err := ingest.refreshQuota(mailbox); err != nil {
+			log.WithError(err).WithField("mailbox", mailbox).Warn("ingest_quota_failed")
+			return true
+		}
+	}
+
+	if ingest.quotaLimit == 0 {
+		return true
+	}
+
+	return float64(ingest.quotaUsage+size) <= ingest.quotaThreshold*float64(ingest.quotaLimit)
+}
+
+// waitForQuota blocks until there is room for a message of the given size.
+// If overQuota is set, the server has already rejected the message, so wait
+// at least one interval. Returns false if the client is shutting down.
+func (ingest *ingestClient) waitForQuota(mailbox string, size uint64, overQuota bool) bool {
+	for {
+		if overQuota {
+			// Force a refresh, our usage is stale
+			ingest.quotaCheckedAt = time.Time{}
+		} else if ingest.quotaAllows(mailbox, size) {
+			ingest.setQuotaPaused(false)
+			return true
+		}
+
+		ingest.setQuotaPaused(true)
+
+		log.WithFields(log.Fields{
+			"mailbox":  mailbox,
+			"size":     size,
+			"usage":    ingest.quotaUsage,
+			"limit":    ingest.quotaLimit,
+			"interval": ingest.quotaPollInterval,
+		}).Warn("ingest_quota_paused")
+
+		select {
+		case <-ingest.wantQuit:
+			return false
+		case <-time.After(ingest.quotaPollInterval):
+		}
+
+		overQuota = false
+	}
+}
+
+func statusCode(err error) string {
+	var se *imap2.StatusError
+	if !errors.As(err, &se) {
+		return ""
+	}
+
+	return strings.ToUpper(se.Code)
+}
+
+// isOverQuota checks if an APPEND failed due to the quota being exceeded.
+func isOverQuota(err error) bool {
+	if statusCode(err) == "OVERQUOTA" {
+		return true
+	}
+
+	// Older servers don't send a response code
+	var se *imap2.StatusError
+	return errors.As(err, &se) && strings.Contains(strings.ToLower(se.Info), "quota")
+}
+
+// isTooBig checks if an APPEND failed due to the message size, as in RFC 4469.
+func isTooBig(err error) bool {
+	return statusCode(err) == "TOOBIG"
+}
@@ -19,13 +19,45 @@
 package ingest
 
 import (
+	"sync"
+	"time"
+
 	"github.com/emersion/go-imap"
+	"git.vs49688.net/zane/mailpump/delivery"
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 )
 
 type Config struct {
 	imap2.ConnectionConfig
 	Factory imap2.Factory
+
+	// Sink, if set, is used as the destination instead of an IMAP server.
+	// The ConnectionConfig and Factory are ignored, as are any IMAP-specific
+	// options.
+	Sink Sink
+
+	// CheckDuplicates, if set, searches the destination mailbox for an
+	// existing copy of each message before appending it. This guards against
+	// duplicates after a crash or a lost APPEND response.
+	CheckDuplicates bool
+
+	// Normalise, if set, repairs messages before they are appended. Line endings
+	// are converted to CRLF, NULs are removed, and over-long lines are broken in
+	// a way that keeps the MIME structure intact.
+	Normalise bool
+
+	// QuotaThreshold is the fraction of the destination's STORAGE quota at which
+	// ingestion is paused until space is freed. If zero, the quota is only
+	// considered once an APPEND fails with OVERQUOTA.
+	QuotaThreshold float64
+
+	// QuotaPollInterval is how often the quota is checked.
+	QuotaPollInterval time.Duration
+
+	// HealthUpdates, if set, receives the health of the destination whenever
+	// it changes. It must be buffered. If updates aren't received in time,
+	// only the latest is kept.
+	HealthUpdates chan delivery.Health
 }
 
 type Response struct {
@@ -33,13 +65,60 @@ type Response struct {
 	Error error
 }
 
+// Sink is a destination that isn't an IMAP server. Calls are never
+// made concurrently.
+type Sink interface {
+	// Deliver writes a raw message to a mailbox. If the mailbox is empty,
+	// the sink's default is used.
+	Deliver(mailbox string, flags []string, date time.Time, body []byte) error
+
+	Close() error
+}
+
+// Metadata describes where a message came from.
+type Metadata struct {
+	// Source is the name of the source, if known.
+	Source string
+	UID    uint32
+}
+
+// MetadataSink is a Sink that also wants to know where each message came from.
+type MetadataSink interface {
+	Sink
+
+	DeliverMetadata(meta Metadata, mailbox string, flags []string, date time.Time, body []byte) error
+}
+
+// Delivery is a single message given to a BatchSink.
+type Delivery struct {
+	Metadata Metadata
+	Mailbox  string
+	Flags    []string
+	Date     time.Time
+	Body     []byte
+}
+
+// BatchSink is a Sink that can deliver several messages at once. Messages that
+// arrive while a batch is being delivered are collected into the next one.
+type BatchSink interface {
+	Sink
+
+	// DeliverBatch delivers several messages, returning an error for each, in order.
+	DeliverBatch(deliveries []Delivery) []error
+}
+
 type Client interface {
 	IngestMessage(mailbox string, msg *imap.Message, ch chan<- Response) error
 
+	// IngestMessageFrom is the same as IngestMessage, but records the name of
+	// the source the message came from.
+	IngestMessageFrom(source string, mailbox string, msg *imap.Message, ch chan<- Response) error
+
 	Close()
 }
 
 type request struct {
+	Source  string
 	Mailbox string
 	UID     uint32
 	Message *imap.Message
@@ -47,10 +126,29 @@ type request struct {
 }
 
 type ingestClient struct {
-	client        imap2.Client
-	rfc822Section *imap.BodySectionName
-	incoming      chan request
-	hasQuit       chan struct{}
-	wantQuit      chan struct{}
-	shutdown      int32
+	client          imap2.Client
+	sink            Sink
+	rfc822Section   *imap.BodySectionName
+	checkDuplicates bool
+	normalise       bool
+	incoming        chan request
+
+	quotaThreshold    float64
+	quotaPollInterval time.Duration
+	caps              map[string]bool
+	appendLimit       uint64
+	quotaUsage        uint64
+	quotaLimit        uint64
+	quotaCheckedAt    time.Time
+
+	healthMu      sync.Mutex
+	connected     bool
+	quotaPaused   bool
+	health        delivery.Health
+	healthUpdates chan delivery.Health
+	stateUpdates  chan imap2.ConnectionState
+
+	hasQuit  chan struct{}
+	wantQuit chan struct{}
+	shutdown int32
 }
@@ -0,0 +1,47 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+// Package imaptest connects to the servers started by internal.BuildTestIMAPServer.
+// It's separate from internal, as the imap package's tests use that.
+package imaptest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+)
+
+// ConnectionConfig returns the config to connect to a test server.
+func ConnectionConfig(addr string) imap.ConnectionConfig {
+	return imap.ConnectionConfig{
+		HostPort: addr,
+		Auth:     imap.NewNormalAuthenticator("username", "password"),
+	}
+}
+
+// Connect connects to a test server, logging out when the test finishes.
+func Connect(t *testing.T, addr string) imap.Client {
+	c, err := client.Factory{}.NewClient(&imap.ClientConfig{ConnectionConfig: ConnectionConfig(addr)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = c.Logout() })
+	return c
+}
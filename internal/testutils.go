@@ -19,16 +19,29 @@
 package internal
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
 	"testing"
+	"time"
 
 	"golang.org/x/net/nettest"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend/memory"
 	"github.com/emersion/go-imap/server"
 	"github.com/stretchr/testify/assert"
 )
 
-func BuildTestIMAPServer(t *testing.T) (*server.Server, string, *memory.Mailbox) {
+// BuildTestIMAPServer starts an IMAP server with an empty INBOX. Any extensions
+// are enabled before it starts serving.
+func BuildTestIMAPServer(t *testing.T, exts ...server.Extension) (*server.Server, string, *memory.Mailbox) {
 	be := memory.New()
 	user, err := be.Login(nil, "username", "password")
 	assert.NoError(t, err)
@@ -49,6 +62,7 @@ func BuildTestIMAPServer(t *testing.T) (*server.Server, string, *memory.Mailbox)
 	t.Cleanup(func() { _ = s.Close() })
 
 	s.AllowInsecureAuth = true
+	s.Enable(exts...)
 
 	l, err := nettest.NewLocalListener("tcp")
 	if err != nil {
@@ -60,3 +74,58 @@ func BuildTestIMAPServer(t *testing.T) (*server.Server, string, *memory.Mailbox)
 
 	return s, l.Addr().String(), mailbox
 }
+
+// ReceiveMessage waits for a message from a receiver, failing the test if one
+// doesn't arrive in time.
+func ReceiveMessage(t *testing.T, ch <-chan *imap.Message) *imap.Message {
+	t.Helper()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return nil
+	}
+}
+
+// MessageBody reads the whole body of a message, as given by a receiver.
+func MessageBody(t *testing.T, msg *imap.Message) string {
+	t.Helper()
+
+	section, _ := imap.ParseBodySectionName(imap.FetchRFC822)
+	lit := msg.GetBody(section)
+	if !assert.NotNil(t, lit) {
+		return ""
+	}
+
+	body, err := io.ReadAll(lit)
+	assert.NoError(t, err)
+	return string(body)
+}
+
+// BuildTestTLSConfig makes a TLS config with a self-signed certificate for
+// 127.0.0.1.
+func BuildTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func newClient(cfg *Config) *client {
+	c := &client{cfg: *cfg}
+	if c.cfg.Timeout == 0 {
+		c.cfg.Timeout = time.Minute
+	}
+
+	c.http = &http.Client{Timeout: c.cfg.Timeout}
+	// Event streams stay open indefinitely, so can't have a timeout.
+	c.push = &http.Client{}
+	return c
+}
+
+// authorize adds the credentials to a request.
+func (c *client) authorize(req *http.Request) error {
+	if c.cfg.TokenSource != nil {
+		tok, err := c.cfg.TokenSource.Token()
+		if err != nil {
+			return err
+		}
+		tok.SetAuthHeader(req)
+	} else if c.cfg.Username != "" {
+		req.SetBasicAuth(c.cfg.Username, c.cfg.Password)
+	}
+
+	return nil
+}
+
+func (c *client) do(method string, url string, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return data, nil
+}
+
+// getSession fetches the session resource, if it hasn't been already.
+func (c *client) getSession() (*session, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session != nil {
+		return c.session, c.accountID, nil
+	}
+
+	data, err := c.do(http.MethodGet, c.cfg.SessionURL, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := &session{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, "", err
+	}
+
+	accountID, ok := s.PrimaryAccounts[CapabilityMail]
+	if !ok {
+		return nil, "", ErrNoMailAccount
+	}
+
+	c.session = s
+	c.accountID = accountID
+	return s, accountID, nil
+}
+
+// resetSession forces the session to be fetched again, e.g. if it has changed.
+func (c *client) resetSession() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.session = nil
+	c.accountID = ""
+}
+
+// call makes a single method call, unmarshalling the response into resp.
+func (c *client) call(name string, args interface{}, resp interface{}) error {
+	s, _, err := c.getSession()
+	if err != nil {
+		return err
+	}
+
+	rawArgs, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	req, err := json.Marshal(&apiRequest{
+		Using:       []string{CapabilityCore, CapabilityMail},
+		MethodCalls: []invocation{{Name: name, Args: rawArgs, CallID: "0"}},
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := c.do(http.MethodPost, s.APIURL, "application/json", req)
+	if err != nil {
+		return err
+	}
+
+	apiResp := apiResponse{}
+	if err := json.Unmarshal(data, &apiResp); err != nil {
+		return err
+	}
+
+	if apiResp.SessionState != "" && apiResp.SessionState != s.State {
+		c.resetSession()
+	}
+
+	if len(apiResp.MethodResponses) != 1 {
+		return ErrUnexpectedResponse
+	}
+
+	inv := apiResp.MethodResponses[0]
+	if inv.Name == "error" {
+		merr := &MethodError{}
+		if err := json.Unmarshal(inv.Args, merr); err != nil {
+			return err
+		}
+		return merr
+	}
+
+	if inv.Name != name {
+		return ErrUnexpectedResponse
+	}
+
+	return json.Unmarshal(inv.Args, resp)
+}
+
+// expandTemplate fills in the variables of a URL template, as used by the
+// session's downloadUrl, uploadUrl, and eventSourceUrl.
+func expandTemplate(template string, vars map[string]string) string {
+	for k, v := range vars {
+		template = strings.ReplaceAll(template, "{"+k+"}", url.PathEscape(v))
+	}
+	return template
+}
+
+func expandAccount(template string, accountID string) string {
+	return expandTemplate(template, map[string]string{"accountId": accountID})
+}
+
+// upload uploads a blob, returning its ID.
+func (c *client) upload(contentType string, body []byte) (string, error) {
+	s, accountID, err := c.getSession()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := c.do(http.MethodPost, expandAccount(s.UploadURL, accountID), contentType, body)
+	if err != nil {
+		return "", err
+	}
+
+	resp := struct {
+		BlobID string `json:"blobId"`
+	}{}
+
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+
+	return resp.BlobID, nil
+}
+
+// download fetches the contents of a blob.
+func (c *client) download(blobID string, contentType string, name string) ([]byte, error) {
+	s, accountID, err := c.getSession()
+	if err != nil {
+		return nil, err
+	}
+
+	u := expandTemplate(s.DownloadURL, map[string]string{
+		"accountId": accountID,
+		"blobId":    blobID,
+		"type":      contentType,
+		"name":      name,
+	})
+
+	return c.do(http.MethodGet, u, "", nil)
+}
+
+// stream opens an event stream, as defined in RFC 8620 7.3. The caller
+// must close the returned body.
+func (c *client) stream(ctx context.Context, url string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	if err := c.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.push.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		_ = resp.Body.Close()
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,236 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+const testMessage = "From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+func TestKeywords(t *testing.T) {
+	assert.Equal(t, map[string]bool{
+		"$seen":      true,
+		"$flagged":   true,
+		"$forwarded": true,
+		"label":      true,
+	}, Keywords([]string{"\\Seen", "\\Flagged", "\\Deleted", "\\Recent", "$Forwarded", "Label"}))
+}
+
+func TestDeliver(t *testing.T) {
+	s := newStubServer(t)
+
+	sink, err := NewSink(s.Config())
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	date := time.Date(2022, 5, 11, 14, 31, 59, 0, time.FixedZone("AEST", 10*60*60))
+	assert.NoError(t, sink.Deliver("INBOX", []string{"\\Seen"}, date, []byte(testMessage)))
+	assert.NoError(t, sink.Deliver("Lists/Go", nil, time.Time{}, []byte(testMessage)))
+	assert.NoError(t, sink.Deliver("Junk", nil, time.Time{}, []byte(testMessage)))
+
+	imports := s.Imports()
+	if assert.Len(t, imports, 3) {
+		assert.Equal(t, stubImport{
+			Body:       testMessage,
+			MailboxIDs: map[string]bool{"mb-inbox": true},
+			Keywords:   map[string]bool{"$seen": true},
+			ReceivedAt: "2022-05-11T04:31:59Z",
+		}, imports[0])
+		assert.Equal(t, map[string]bool{"mb-go": true}, imports[1].MailboxIDs)
+		assert.Equal(t, map[string]bool{"mb-junk": true}, imports[2].MailboxIDs)
+	}
+
+	// The mailboxes should only be fetched once
+	assert.Equal(t, 1, s.calls["Mailbox/get"])
+
+	err = sink.Deliver("Missing", nil, time.Time{}, []byte(testMessage))
+	assert.ErrorIs(t, err, ErrMailboxNotFound)
+	assert.False(t, delivery.IsPermanent(err))
+}
+
+func TestDeliverBatch(t *testing.T) {
+	s := newStubServer(t)
+
+	sink, err := NewSink(s.Config())
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	errs := sink.(ingest.BatchSink).DeliverBatch([]ingest.Delivery{
+		{Mailbox: "INBOX", Body: []byte(testMessage)},
+		{Mailbox: "INBOX", Body: []byte(testMessage + "REJECT\r\n")},
+		{Mailbox: "Missing", Body: []byte(testMessage)},
+		{Mailbox: "Lists/Go", Body: []byte(testMessage)},
+	})
+
+	if assert.Len(t, errs, 4) {
+		assert.NoError(t, errs[0])
+		assert.True(t, delivery.IsPermanent(errs[1]))
+		assert.ErrorIs(t, errs[2], ErrMailboxNotFound)
+		assert.NoError(t, errs[3])
+	}
+
+	assert.Equal(t, []int{3}, s.batches)
+	assert.Len(t, s.Imports(), 2)
+}
+
+func TestUnauthorized(t *testing.T) {
+	s := newStubServer(t)
+
+	cfg := s.Config()
+	cfg.Password = "wrong"
+
+	sink, err := NewSink(cfg)
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	err = sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+
+	var serr *StatusError
+	if assert.ErrorAs(t, err, &serr) {
+		assert.Equal(t, http.StatusUnauthorized, serr.StatusCode)
+	}
+	assert.False(t, delivery.IsPermanent(err))
+}
+
+func TestFlags(t *testing.T) {
+	assert.Equal(t, []string{"$Forwarded", "\\Flagged", "\\Seen", "label"}, Flags(map[string]bool{
+		"$seen":      true,
+		"$Flagged":   true,
+		"$draft":     false,
+		"$Forwarded": true,
+		"label":      true,
+	}))
+}
+
+func TestReceiver(t *testing.T) {
+	s := newStubServer(t)
+	s.push = true
+
+	date := time.Date(2022, 5, 11, 4, 31, 59, 0, time.UTC)
+	id1 := s.AddEmail("first", "mb-inbox", map[string]bool{"$seen": true}, date)
+	id2 := s.AddEmail("second", "mb-inbox", nil, date.Add(time.Minute))
+	s.AddEmail("elsewhere", "mb-go", nil, date)
+
+	ch := make(chan *imap.Message, 10)
+	recv, err := receiver.NewReceiver(&receiver.Config{
+		ConnectionConfig: imap2.ConnectionConfig{Mailbox: "INBOX"},
+		Receiver:         &ReceiverFactory{Config: *s.Config()},
+		Channel:          ch,
+		RejectMailbox:    "Junk",
+	})
+	assert.NoError(t, err)
+
+	msg1 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "first", internal.MessageBody(t, msg1))
+	assert.Equal(t, []string{imap.SeenFlag}, msg1.Flags)
+	assert.True(t, date.Equal(msg1.InternalDate))
+
+	msg2 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "second", internal.MessageBody(t, msg2))
+	assert.NotEqual(t, msg1.Uid, msg2.Uid)
+
+	// Should be pushed to us
+	id3 := s.AddEmail("third", "mb-inbox", nil, date.Add(2*time.Minute))
+	msg3 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "third", internal.MessageBody(t, msg3))
+
+	recv.Ack(msg1.Uid, nil)
+	recv.Ack(msg2.Uid, &delivery.PermanentError{Err: errors.New("rejected")})
+	recv.Ack(msg3.Uid, errors.New("try again later"))
+	recv.Close()
+
+	emails := s.Emails()
+	assert.NotContains(t, emails, id1)
+	assert.Equal(t, map[string]bool{"mb-junk": true}, emails[id2])
+	assert.Equal(t, map[string]bool{"mb-inbox": true}, emails[id3])
+}
+
+func TestReceiverPolling(t *testing.T) {
+	s := newStubServer(t)
+
+	ch := make(chan *imap.Message, 10)
+	recv, err := receiver.NewReceiver(&receiver.Config{
+		ConnectionConfig:     imap2.ConnectionConfig{Mailbox: "Lists/Go"},
+		Receiver:             &ReceiverFactory{Config: *s.Config(), MoveTo: "Lists"},
+		Channel:              ch,
+		IDLEFallbackInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	id := s.AddEmail("polled", "mb-go", nil, time.Now())
+
+	msg := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "polled", internal.MessageBody(t, msg))
+
+	recv.Ack(msg.Uid, nil)
+	recv.Close()
+
+	assert.Equal(t, map[string]bool{"mb-lists": true}, s.Emails()[id])
+}
+
+func TestReceiverDisableDeletions(t *testing.T) {
+	s := newStubServer(t)
+
+	date := time.Date(2022, 5, 11, 4, 31, 59, 0, time.UTC)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, s.AddEmail(fmt.Sprintf("message %v", i), "mb-inbox", nil, date.Add(time.Duration(i)*time.Minute)))
+	}
+
+	ch := make(chan *imap.Message, 10)
+	recv, err := receiver.NewReceiver(&receiver.Config{
+		ConnectionConfig:     imap2.ConnectionConfig{Mailbox: "INBOX"},
+		Receiver:             &ReceiverFactory{Config: *s.Config()},
+		Channel:              ch,
+		IDLEFallbackInterval: 10 * time.Millisecond,
+		FetchBufferSize:      2,
+		DisableDeletions:     true,
+	})
+	assert.NoError(t, err)
+
+	// Acked messages stay in the mailbox, but mustn't stop the rest
+	// being fetched.
+	for i := 0; i < 5; i++ {
+		msg := internal.ReceiveMessage(t, ch)
+		assert.Equal(t, fmt.Sprintf("message %v", i), internal.MessageBody(t, msg))
+		recv.Ack(msg.Uid, nil)
+	}
+	recv.Close()
+
+	emails := s.Emails()
+	for _, id := range ids {
+		assert.Equal(t, map[string]bool{"mb-inbox": true}, emails[id])
+	}
+}
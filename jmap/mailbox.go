@@ -0,0 +1,107 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"fmt"
+	"strings"
+)
+
+func newMailboxCache(c *client) *mailboxCache {
+	return &mailboxCache{client: c}
+}
+
+// load fetches the account's mailboxes, building their paths.
+func (m *mailboxCache) load() error {
+	_, accountID, err := m.client.getSession()
+	if err != nil {
+		return err
+	}
+
+	resp := struct {
+		List []mailbox `json:"list"`
+	}{}
+
+	args := map[string]interface{}{
+		"accountId":  accountID,
+		"ids":        nil,
+		"properties": []string{"id", "name", "parentId", "role"},
+	}
+
+	if err := m.client.call("Mailbox/get", args, &resp); err != nil {
+		return err
+	}
+
+	byID := map[string]*mailbox{}
+	for i := range resp.List {
+		byID[resp.List[i].ID] = &resp.List[i]
+	}
+
+	m.mailboxes = map[string]string{}
+	m.roles = map[string]string{}
+	for _, mb := range resp.List {
+		path := mb.Name
+		seen := map[string]bool{mb.ID: true}
+		for parent := byID[mb.ParentID]; parent != nil && !seen[parent.ID]; parent = byID[parent.ParentID] {
+			path = parent.Name + "/" + path
+			seen[parent.ID] = true
+		}
+
+		m.mailboxes[path] = mb.ID
+		if mb.Role != "" {
+			m.roles[mb.Role] = mb.ID
+		}
+	}
+
+	return nil
+}
+
+func (m *mailboxCache) lookup(name string) (string, bool) {
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		id, ok := m.roles["inbox"]
+		return id, ok
+	}
+
+	if id, ok := m.mailboxes[name]; ok {
+		return id, true
+	}
+
+	// Fall back to the role, so "Junk" or "Trash" work everywhere
+	id, ok := m.roles[strings.ToLower(name)]
+	return id, ok
+}
+
+// id finds the ID of a mailbox, reloading them if it isn't found.
+func (m *mailboxCache) id(name string) (string, error) {
+	if m.mailboxes != nil {
+		if id, ok := m.lookup(name); ok {
+			return id, nil
+		}
+	}
+
+	if err := m.load(); err != nil {
+		return "", err
+	}
+
+	if id, ok := m.lookup(name); ok {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("%w: %v", ErrMailboxNotFound, name)
+}
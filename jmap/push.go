@@ -0,0 +1,130 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// pushPingInterval is how often the server is asked to ping. The connection
+	// is considered dead if a few are missed.
+	pushPingInterval = 30 * time.Second
+	pushRetryDelay   = 30 * time.Second
+)
+
+var errNoEventSource = errors.New("server has no event source")
+
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// watch listens on the session's event source for state changes, notifying
+// events of them. Without one, the receiver falls back to polling.
+func (r *mailReceiver) watch(ctx context.Context, events chan<- struct{}) {
+	for {
+		err := r.listen(ctx, events)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errNoEventSource) {
+			r.logger.Info("jmap_receiver_push_unsupported")
+			return
+		}
+
+		r.logger.WithError(err).Warn("jmap_receiver_push_failed")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(pushRetryDelay):
+		}
+	}
+}
+
+// listen reads the event source until it fails, as per RFC 8620 7.3.
+func (r *mailReceiver) listen(ctx context.Context, events chan<- struct{}) error {
+	s, _, err := r.client.getSession()
+	if err != nil {
+		return err
+	}
+
+	if s.EventSourceURL == "" {
+		return errNoEventSource
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u := expandTemplate(s.EventSourceURL, map[string]string{
+		"types":      "Email",
+		"closeafter": "no",
+		"ping":       strconv.Itoa(int(pushPingInterval / time.Second)),
+	})
+
+	body, err := r.client.stream(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	watchdog := time.AfterFunc(3*pushPingInterval, cancel)
+	defer watchdog.Stop()
+
+	r.pushing.Store(true)
+	defer r.pushing.Store(false)
+	r.logger.Info("jmap_receiver_push_connected")
+
+	// Check for anything missed while disconnected
+	notify(events)
+
+	event := ""
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		watchdog.Reset(3 * pushPingInterval)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line dispatches the event
+			if event == "state" {
+				notify(events)
+			}
+			event = ""
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
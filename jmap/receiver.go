@@ -0,0 +1,541 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+// systemFlags maps JMAP keywords back to IMAP system flags.
+var systemFlags = map[string]string{
+	"$seen":     imap.SeenFlag,
+	"$flagged":  imap.FlaggedFlag,
+	"$answered": imap.AnsweredFlag,
+	"$draft":    imap.DraftFlag,
+}
+
+// Flags converts JMAP keywords to IMAP flags.
+func Flags(keywords map[string]bool) []string {
+	flags := make([]string, 0, len(keywords))
+	for kw, set := range keywords {
+		if !set {
+			continue
+		}
+
+		if f, ok := systemFlags[strings.ToLower(kw)]; ok {
+			flags = append(flags, f)
+		} else {
+			flags = append(flags, kw)
+		}
+	}
+
+	sort.Strings(flags)
+	return flags
+}
+
+// NewReceiver creates a receiver.Client for the mailbox in cfg.ConnectionConfig.
+// Only the receiver options of cfg are used, the connection comes from the factory.
+func (f *ReceiverFactory) NewReceiver(cfg *receiver.Config) (receiver.Client, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize == 0 {
+		batchSize = 15
+	}
+
+	idleFallbackInterval := cfg.IDLEFallbackInterval
+	if idleFallbackInterval == 0 {
+		idleFallbackInterval = 1 * time.Minute
+	}
+
+	fetchBufferSize := cfg.FetchBufferSize
+	if fetchBufferSize == 0 {
+		fetchBufferSize = 20
+	}
+
+	fetchMaxInterval := cfg.FetchMaxInterval
+	if fetchMaxInterval == 0 {
+		fetchMaxInterval = 5 * time.Minute
+	}
+
+	c := newClient(&f.Config)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &mailReceiver{
+		client:        c,
+		mailboxes:     newMailboxCache(c),
+		logger:        logger,
+		ackChannel:    make(chan ackRequest, fetchBufferSize),
+		healthChannel: make(chan delivery.Health, 1),
+		outChannel:    cfg.Channel,
+
+		mailbox:              cfg.Mailbox,
+		moveTo:               f.MoveTo,
+		rejectMailbox:        cfg.RejectMailbox,
+		batchSize:            batchSize,
+		idleFallbackInterval: idleFallbackInterval,
+		fetchBufferSize:      fetchBufferSize,
+		fetchMaxInterval:     fetchMaxInterval,
+		disableDeletions:     cfg.DisableDeletions,
+
+		messages: map[uint32]*email{},
+		ids:      map[string]uint32{},
+
+		cancel:   cancel,
+		hasQuit:  make(chan struct{}, 1),
+		wantQuit: make(chan struct{}, 1),
+	}
+
+	events := make(chan struct{}, 1)
+	go r.watch(ctx, events)
+	go r.run(events)
+	return r, nil
+}
+
+func (r *mailReceiver) Ack(UID uint32, error error) {
+	if UID == 0 {
+		return
+	}
+
+	r.ackChannel <- ackRequest{UID: UID, Error: error}
+}
+
+func (r *mailReceiver) SetDestinationHealth(health delivery.Health) {
+	delivery.SendHealth(r.healthChannel, health)
+}
+
+func (r *mailReceiver) handleAck(req *ackRequest) {
+	e := r.logger.WithField("uid", req.UID)
+	if req.Error != nil {
+		e.WithError(req.Error).Warn("jmap_receiver_ack")
+	} else {
+		e.Info("jmap_receiver_ack")
+	}
+
+	msg, ok := r.messages[req.UID]
+	if !ok || msg.Acked || msg.Failed {
+		return
+	}
+
+	if req.Error != nil && (r.rejectMailbox == "" || !delivery.IsPermanent(req.Error)) {
+		msg.Failed = true
+		return
+	}
+
+	if req.Error != nil {
+		e.WithField("reject_mailbox", r.rejectMailbox).Info("jmap_receiver_message_rejected")
+		msg.Rejected = true
+	}
+	msg.Acked = true
+}
+
+// pollInterval is how long to wait between fetches if nothing
+// else triggers one.
+func (r *mailReceiver) pollInterval() time.Duration {
+	if r.pushing.Load() {
+		return r.fetchMaxInterval
+	}
+	return r.idleFallbackInterval
+}
+
+type emailProperties struct {
+	ID         string          `json:"id"`
+	BlobID     string          `json:"blobId"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+}
+
+func (r *mailReceiver) getEmails(accountID string, ids []string) ([]emailProperties, string, error) {
+	resp := struct {
+		State string            `json:"state"`
+		List  []emailProperties `json:"list"`
+	}{}
+
+	args := map[string]interface{}{
+		"accountId":  accountID,
+		"ids":        ids,
+		"properties": []string{"id", "blobId", "keywords", "receivedAt"},
+	}
+
+	if err := r.client.call("Email/get", args, &resp); err != nil {
+		return nil, "", err
+	}
+
+	return resp.List, resp.State, nil
+}
+
+// fetch passes on the oldest messages in the mailbox that haven't been
+// already, up to the fetch buffer size.
+func (r *mailReceiver) fetch() error {
+	pending := 0
+	for _, msg := range r.messages {
+		if !msg.Acked && !msg.Failed {
+			pending++
+		}
+	}
+
+	room := int(r.fetchBufferSize) - pending
+	if room <= 0 {
+		r.more = true
+		return nil
+	}
+
+	_, accountID, err := r.client.getSession()
+	if err != nil {
+		return err
+	}
+
+	mailboxID, err := r.mailboxes.id(r.mailbox)
+	if err != nil {
+		return err
+	}
+
+	// Take the state first, so anything arriving during the
+	// fetch is seen as a change.
+	_, state, err := r.getEmails(accountID, []string{})
+	if err != nil {
+		return err
+	}
+
+	query := struct {
+		IDs []string `json:"ids"`
+	}{}
+
+	// Messages already passed on may still be in the mailbox, e.g. if
+	// they failed, so look past them.
+	limit := uint(room + len(r.messages))
+
+	args := map[string]interface{}{
+		"accountId": accountID,
+		"filter":    map[string]interface{}{"inMailbox": mailboxID},
+		"sort":      []map[string]interface{}{{"property": "receivedAt", "isAscending": true}},
+		"limit":     limit,
+	}
+
+	if err := r.client.call("Email/query", args, &query); err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, room)
+	for _, id := range query.IDs {
+		if _, ok := r.ids[id]; !ok && len(ids) < room {
+			ids = append(ids, id)
+		}
+	}
+
+	r.state = state
+	r.more = uint(len(query.IDs)) >= limit
+	if len(ids) == 0 {
+		return nil
+	}
+
+	list, _, err := r.getEmails(accountID, ids)
+	if err != nil {
+		return err
+	}
+
+	// Keep the order of the query
+	byID := make(map[string]*emailProperties, len(list))
+	for i := range list {
+		byID[list[i].ID] = &list[i]
+	}
+
+	for _, id := range ids {
+		props, ok := byID[id]
+		if !ok {
+			// Gone since the query
+			continue
+		}
+
+		body, err := r.client.download(props.BlobID, "message/rfc822", "message.eml")
+		if err != nil {
+			// Pick up the rest next time
+			r.more = true
+			return err
+		}
+
+		r.nextUID++
+		uid := r.nextUID
+
+		msg := imap.NewMessage(uid, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822})
+		msg.Uid = uid
+		msg.Flags = Flags(props.Keywords)
+		msg.InternalDate = props.ReceivedAt
+		msg.Body[rfc822Section] = bytes.NewBuffer(body)
+
+		r.messages[uid] = &email{UID: uid, ID: id}
+		r.ids[id] = uid
+
+		r.logger.WithFields(log.Fields{"uid": uid, "id": id}).Info("jmap_receiver_message_fetched")
+		r.outChannel <- msg
+	}
+
+	return nil
+}
+
+// changed checks whether any messages have been created or updated since
+// the last fetch.
+func (r *mailReceiver) changed() (bool, error) {
+	if r.state == "" {
+		return true, nil
+	}
+
+	_, accountID, err := r.client.getSession()
+	if err != nil {
+		return false, err
+	}
+
+	changed := false
+	for {
+		resp := struct {
+			NewState       string   `json:"newState"`
+			HasMoreChanges bool     `json:"hasMoreChanges"`
+			Created        []string `json:"created"`
+			Updated        []string `json:"updated"`
+		}{}
+
+		args := map[string]interface{}{
+			"accountId":  accountID,
+			"sinceState": r.state,
+			"maxChanges": 256,
+		}
+
+		err := r.client.call("Email/changes", args, &resp)
+
+		var merr *MethodError
+		if errors.As(err, &merr) && merr.Type == "cannotCalculateChanges" {
+			r.state = ""
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		r.state = resp.NewState
+		changed = changed || len(resp.Created) > 0 || len(resp.Updated) > 0
+
+		if !resp.HasMoreChanges {
+			return changed, nil
+		}
+	}
+}
+
+// flush destroys or moves acknowledged messages, returning how many were
+// done. Unless force is set, it waits for a full batch, or for everything
+// outstanding to be acknowledged.
+func (r *mailReceiver) flush(force bool) int {
+	if r.disableDeletions {
+		return 0
+	}
+
+	var acked []*email
+	outstanding := 0
+	for _, msg := range r.messages {
+		if msg.Acked {
+			acked = append(acked, msg)
+		} else if !msg.Failed {
+			outstanding++
+		}
+	}
+
+	if len(acked) == 0 {
+		return 0
+	}
+
+	if !force && uint(len(acked)) < r.batchSize && outstanding > 0 {
+		return 0
+	}
+
+	n, err := r.process(acked)
+	if err != nil {
+		r.logger.WithError(err).Warn("jmap_receiver_delete_failed")
+	}
+
+	return n
+}
+
+func (r *mailReceiver) process(acked []*email) (int, error) {
+	_, accountID, err := r.client.getSession()
+	if err != nil {
+		return 0, err
+	}
+
+	sourceID, err := r.mailboxes.id(r.mailbox)
+	if err != nil {
+		return 0, err
+	}
+
+	update := map[string]interface{}{}
+	destroy := []string{}
+	for _, msg := range acked {
+		target := r.moveTo
+		if msg.Rejected {
+			target = r.rejectMailbox
+		}
+
+		if target == "" {
+			destroy = append(destroy, msg.ID)
+			continue
+		}
+
+		targetID, err := r.mailboxes.id(target)
+		if err != nil {
+			return 0, err
+		}
+
+		// Patch, rather than replace, in case it's in other mailboxes too
+		update[msg.ID] = map[string]interface{}{
+			"mailboxIds/" + sourceID: nil,
+			"mailboxIds/" + targetID: true,
+		}
+	}
+
+	resp := struct {
+		NotUpdated   map[string]*SetError `json:"notUpdated"`
+		NotDestroyed map[string]*SetError `json:"notDestroyed"`
+	}{}
+
+	args := map[string]interface{}{
+		"accountId": accountID,
+		"update":    update,
+		"destroy":   destroy,
+	}
+
+	if err := r.client.call("Email/set", args, &resp); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, msg := range acked {
+		e := r.logger.WithFields(log.Fields{"uid": msg.UID, "id": msg.ID})
+
+		serr, failed := resp.NotUpdated[msg.ID]
+		if !failed {
+			serr, failed = resp.NotDestroyed[msg.ID]
+		}
+
+		if failed && serr.Type != "notFound" {
+			if msg.Rejected {
+				// Couldn't reject the message, leave it be
+				e.WithError(serr).Warn("jmap_receiver_message_rejection_failed")
+				msg.Acked = false
+				msg.Rejected = false
+				msg.Failed = true
+			} else {
+				// Try again next time
+				e.WithError(serr).Info("jmap_receiver_message_deletion_failed")
+			}
+			continue
+		}
+
+		e.Info("jmap_receiver_message_deleted")
+		delete(r.messages, msg.UID)
+		delete(r.ids, msg.ID)
+		n++
+	}
+
+	return n, nil
+}
+
+func (r *mailReceiver) run(events <-chan struct{}) {
+	fetchPaused := false
+	wantFetch := true
+	nextPoll := time.Now().Add(r.pollInterval())
+
+	for {
+		if wantFetch && !fetchPaused {
+			if err := r.fetch(); err != nil {
+				r.logger.WithError(err).Warn("jmap_receiver_fetch_failed")
+			} else {
+				wantFetch = false
+			}
+		}
+
+		if r.flush(false) > 0 && r.more {
+			wantFetch = true
+			continue
+		}
+
+		select {
+		case <-r.wantQuit:
+			goto done
+		case <-events:
+			changed, err := r.changed()
+			if err != nil {
+				r.logger.WithError(err).Warn("jmap_receiver_changes_failed")
+				changed = true
+			}
+			wantFetch = wantFetch || changed
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+
+			// There may be room for more now
+			wantFetch = wantFetch || r.more
+		case health := <-r.healthChannel:
+			paused := health != delivery.HealthConnected
+			if paused != fetchPaused {
+				r.logger.WithField("health", health).Info("jmap_receiver_destination_health_changed")
+			}
+
+			// Catch up on anything we missed
+			wantFetch = wantFetch || (fetchPaused && !paused)
+			fetchPaused = paused
+		case <-time.After(time.Until(nextPoll)):
+			nextPoll = time.Now().Add(r.pollInterval())
+			wantFetch = true
+			r.flush(true)
+		}
+	}
+
+done:
+	// Process any outstanding acks before leaving
+	for {
+		select {
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+			continue
+		default:
+		}
+		break
+	}
+
+	r.flush(true)
+	r.hasQuit <- struct{}{}
+}
+
+func (r *mailReceiver) Close() {
+	r.wantQuit <- struct{}{}
+	<-r.hasQuit
+	r.cancel()
+	r.client.http.CloseIdleConnections()
+}
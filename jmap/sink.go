@@ -0,0 +1,188 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// systemKeywords maps IMAP system flags to JMAP keywords, as per RFC 8621 4.1.1.
+// Anything not here is dropped.
+var systemKeywords = map[string]string{
+	"\\seen":     "$seen",
+	"\\flagged":  "$flagged",
+	"\\answered": "$answered",
+	"\\draft":    "$draft",
+}
+
+// Keywords converts IMAP flags to JMAP keywords.
+func Keywords(flags []string) map[string]bool {
+	keywords := map[string]bool{}
+	for _, f := range flags {
+		lf := strings.ToLower(f)
+		if strings.HasPrefix(lf, "\\") {
+			if kw, ok := systemKeywords[lf]; ok {
+				keywords[kw] = true
+			}
+			continue
+		}
+
+		keywords[lf] = true
+	}
+
+	return keywords
+}
+
+// NewSink creates an ingest.Sink that imports messages into a JMAP account.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	c := newClient(cfg)
+	return &sink{client: c, mailboxes: newMailboxCache(c)}, nil
+}
+
+func uploadError(err error) error {
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.StatusCode == http.StatusRequestEntityTooLarge {
+		return &delivery.PermanentError{Err: ingest.ErrMessageTooLarge}
+	}
+
+	return err
+}
+
+func importError(serr *SetError) error {
+	if serr.Type == "tooLarge" {
+		return &delivery.PermanentError{Err: fmt.Errorf("%w: %v", ingest.ErrMessageTooLarge, serr)}
+	}
+
+	if !serr.Temporary() {
+		return &delivery.PermanentError{Err: serr}
+	}
+
+	return serr
+}
+
+type emailImport struct {
+	BlobID     string          `json:"blobId"`
+	MailboxIDs map[string]bool `json:"mailboxIds"`
+	Keywords   map[string]bool `json:"keywords"`
+	ReceivedAt *time.Time      `json:"receivedAt,omitempty"`
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	return s.DeliverBatch([]ingest.Delivery{{
+		Mailbox: mailbox,
+		Flags:   flags,
+		Date:    date,
+		Body:    body,
+	}})[0]
+}
+
+func (s *sink) DeliverBatch(deliveries []ingest.Delivery) []error {
+	errs := make([]error, len(deliveries))
+
+	_, accountID, err := s.client.getSession()
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	emails := map[string]*emailImport{}
+	for i, d := range deliveries {
+		mailboxID, err := s.mailboxes.id(d.Mailbox)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+
+		blobID, err := s.client.upload("message/rfc822", d.Body)
+		if err != nil {
+			errs[i] = uploadError(err)
+			continue
+		}
+
+		email := &emailImport{
+			BlobID:     blobID,
+			MailboxIDs: map[string]bool{mailboxID: true},
+			Keywords:   Keywords(d.Flags),
+		}
+
+		if !d.Date.IsZero() {
+			receivedAt := d.Date.UTC()
+			email.ReceivedAt = &receivedAt
+		}
+
+		emails[fmt.Sprintf("m%d", i)] = email
+	}
+
+	if len(emails) == 0 {
+		return errs
+	}
+
+	resp := struct {
+		Created map[string]struct {
+			ID string `json:"id"`
+		} `json:"created"`
+		NotCreated map[string]*SetError `json:"notCreated"`
+	}{}
+
+	args := map[string]interface{}{
+		"accountId": accountID,
+		"emails":    emails,
+	}
+
+	err = s.client.call("Email/import", args, &resp)
+	for i := range deliveries {
+		key := fmt.Sprintf("m%d", i)
+		if _, ok := emails[key]; !ok {
+			continue
+		}
+
+		if err != nil {
+			errs[i] = err
+		} else if serr, ok := resp.NotCreated[key]; ok && serr.Type == "alreadyExists" {
+			// Already there from a previous attempt
+			log.WithField("mailbox", deliveries[i].Mailbox).Info("jmap_already_exists")
+		} else if ok {
+			errs[i] = importError(serr)
+		} else if created, ok := resp.Created[key]; ok {
+			log.WithFields(log.Fields{
+				"mailbox": deliveries[i].Mailbox,
+				"id":      created.ID,
+			}).Trace("jmap_imported")
+		} else {
+			errs[i] = ErrUnexpectedResponse
+		}
+	}
+
+	return errs
+}
+
+func (s *sink) Close() error {
+	s.client.http.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,439 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubImport struct {
+	Body       string
+	MailboxIDs map[string]bool
+	Keywords   map[string]bool
+	ReceivedAt string
+}
+
+type stubEmail struct {
+	ID         string
+	BlobID     string
+	MailboxIDs map[string]bool
+	Keywords   map[string]bool
+	ReceivedAt time.Time
+
+	// created is the state the email was created in.
+	created int
+}
+
+// stubServer is a minimal JMAP server. Messages containing "REJECT" are
+// refused as invalidEmail.
+type stubServer struct {
+	*httptest.Server
+	mailboxes []mailbox
+
+	// push enables the event source.
+	push bool
+
+	mu        sync.Mutex
+	blobs     map[string]string
+	imports   []stubImport
+	calls     map[string]int
+	batches   []int
+	emails    []*stubEmail
+	state     int
+	listeners []chan struct{}
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	s := &stubServer{
+		mailboxes: []mailbox{
+			{ID: "mb-inbox", Name: "Inbox", Role: "inbox"},
+			{ID: "mb-junk", Name: "Spam", Role: "junk"},
+			{ID: "mb-lists", Name: "Lists"},
+			{ID: "mb-go", Name: "Go", ParentID: "mb-lists"},
+		},
+		blobs: map[string]string{},
+		calls: map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jmap", s.handleSession)
+	mux.HandleFunc("/api", s.handleAPI)
+	mux.HandleFunc("/upload/acc1", s.handleUpload)
+	mux.HandleFunc("/download/acc1/", s.handleDownload)
+	mux.HandleFunc("/events", s.handleEvents)
+
+	s.Server = httptest.NewServer(s.checkAuth(mux))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubServer) checkAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *stubServer) handleSession(w http.ResponseWriter, _ *http.Request) {
+	resp := map[string]interface{}{
+		"apiUrl":          s.URL + "/api",
+		"uploadUrl":       s.URL + "/upload/{accountId}",
+		"downloadUrl":     s.URL + "/download/{accountId}/{blobId}/{name}?accept={type}",
+		"primaryAccounts": map[string]string{CapabilityMail: "acc1"},
+		"state":           "s1",
+	}
+
+	if s.push {
+		resp["eventSourceUrl"] = s.URL + "/events?types={types}&closeafter={closeafter}&ping={ping}"
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *stubServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/download/acc1/"), "/")
+	if r.URL.Query().Get("accept") != "message/rfc822" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	body, ok := s.blobs[parts[0]]
+	s.mu.Unlock()
+
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, _ = io.WriteString(w, body)
+}
+
+func (s *stubServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("types") != "Email" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ch := make(chan struct{}, 1)
+	s.mu.Lock()
+	s.listeners = append(s.listeners, ch)
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ch:
+			_, _ = io.WriteString(w, "event: state\ndata: {}\n\n")
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// changed bumps the state, notifying any listeners. s.mu must be held.
+func (s *stubServer) changed() {
+	s.state++
+	for _, ch := range s.listeners {
+		notify(ch)
+	}
+}
+
+// AddEmail adds an email to a mailbox, returning its ID.
+func (s *stubServer) AddEmail(body string, mailboxID string, keywords map[string]bool, receivedAt time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	blobID := fmt.Sprintf("blob%d", len(s.blobs))
+	s.blobs[blobID] = body
+
+	e := &stubEmail{
+		ID:         fmt.Sprintf("e%d", len(s.emails)),
+		BlobID:     blobID,
+		MailboxIDs: map[string]bool{mailboxID: true},
+		Keywords:   keywords,
+		ReceivedAt: receivedAt,
+		created:    s.state + 1,
+	}
+	s.emails = append(s.emails, e)
+	s.changed()
+	return e.ID
+}
+
+// Emails returns the mailboxes of each email still present.
+func (s *stubServer) Emails() map[string]map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	emails := map[string]map[string]bool{}
+	for _, e := range s.emails {
+		emails[e.ID] = e.MailboxIDs
+	}
+	return emails
+}
+
+func (s *stubServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	id := fmt.Sprintf("blob%d", len(s.blobs))
+	s.blobs[id] = string(body)
+	s.mu.Unlock()
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"accountId": "acc1", "blobId": id, "size": len(body)})
+}
+
+func (s *stubServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+	req := apiRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	resp := apiResponse{SessionState: "s1"}
+	for _, call := range req.MethodCalls {
+		s.mu.Lock()
+		s.calls[call.Name]++
+		s.mu.Unlock()
+
+		var result interface{}
+		switch call.Name {
+		case "Mailbox/get":
+			result = map[string]interface{}{"accountId": "acc1", "list": s.mailboxes}
+		case "Email/import":
+			result = s.emailImport(call.Args)
+		case "Email/get":
+			result = s.emailGet(call.Args)
+		case "Email/query":
+			result = s.emailQuery(call.Args)
+		case "Email/changes":
+			result = s.emailChanges(call.Args)
+		case "Email/set":
+			result = s.emailSet(call.Args)
+		default:
+			call.Name = "error"
+			result = map[string]string{"type": "unknownMethod"}
+		}
+
+		args, _ := json.Marshal(result)
+		resp.MethodResponses = append(resp.MethodResponses, invocation{Name: call.Name, Args: args, CallID: call.CallID})
+	}
+
+	_ = json.NewEncoder(w).Encode(&resp)
+}
+
+func (s *stubServer) emailImport(rawArgs json.RawMessage) interface{} {
+	args := struct {
+		Emails map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+			ReceivedAt string          `json:"receivedAt"`
+		} `json:"emails"`
+	}{}
+	_ = json.Unmarshal(rawArgs, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches = append(s.batches, len(args.Emails))
+
+	created := map[string]interface{}{}
+	notCreated := map[string]interface{}{}
+	for key, e := range args.Emails {
+		body := s.blobs[e.BlobID]
+		if strings.Contains(body, "REJECT") {
+			notCreated[key] = map[string]string{"type": "invalidEmail"}
+			continue
+		}
+
+		s.imports = append(s.imports, stubImport{
+			Body:       body,
+			MailboxIDs: e.MailboxIDs,
+			Keywords:   e.Keywords,
+			ReceivedAt: e.ReceivedAt,
+		})
+		created[key] = map[string]string{"id": fmt.Sprintf("email%d", len(s.imports))}
+	}
+
+	return map[string]interface{}{"accountId": "acc1", "created": created, "notCreated": notCreated}
+}
+
+func (s *stubServer) emailGet(rawArgs json.RawMessage) interface{} {
+	args := struct {
+		IDs []string `json:"ids"`
+	}{}
+	_ = json.Unmarshal(rawArgs, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []map[string]interface{}{}
+	for _, id := range args.IDs {
+		for _, e := range s.emails {
+			if e.ID == id {
+				list = append(list, map[string]interface{}{
+					"id":         e.ID,
+					"blobId":     e.BlobID,
+					"keywords":   e.Keywords,
+					"receivedAt": e.ReceivedAt,
+				})
+			}
+		}
+	}
+
+	return map[string]interface{}{"accountId": "acc1", "state": fmt.Sprint(s.state), "list": list}
+}
+
+func (s *stubServer) emailQuery(rawArgs json.RawMessage) interface{} {
+	args := struct {
+		Filter struct {
+			InMailbox string `json:"inMailbox"`
+		} `json:"filter"`
+		Limit int `json:"limit"`
+	}{}
+	_ = json.Unmarshal(rawArgs, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var matches []*stubEmail
+	for _, e := range s.emails {
+		if e.MailboxIDs[args.Filter.InMailbox] {
+			matches = append(matches, e)
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].ReceivedAt.Before(matches[j].ReceivedAt) })
+
+	ids := []string{}
+	for _, e := range matches {
+		if args.Limit > 0 && len(ids) == args.Limit {
+			break
+		}
+		ids = append(ids, e.ID)
+	}
+
+	return map[string]interface{}{"accountId": "acc1", "ids": ids}
+}
+
+func (s *stubServer) emailChanges(rawArgs json.RawMessage) interface{} {
+	args := struct {
+		SinceState string `json:"sinceState"`
+	}{}
+	_ = json.Unmarshal(rawArgs, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := 0
+	_, _ = fmt.Sscan(args.SinceState, &since)
+
+	created := []string{}
+	for _, e := range s.emails {
+		if e.created > since {
+			created = append(created, e.ID)
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId":      "acc1",
+		"oldState":       args.SinceState,
+		"newState":       fmt.Sprint(s.state),
+		"hasMoreChanges": false,
+		"created":        created,
+		"updated":        []string{},
+		"destroyed":      []string{},
+	}
+}
+
+func (s *stubServer) emailSet(rawArgs json.RawMessage) interface{} {
+	args := struct {
+		Update  map[string]map[string]interface{} `json:"update"`
+		Destroy []string                          `json:"destroy"`
+	}{}
+	_ = json.Unmarshal(rawArgs, &args)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updated := map[string]interface{}{}
+	for id, patch := range args.Update {
+		for _, e := range s.emails {
+			if e.ID != id {
+				continue
+			}
+
+			for path, v := range patch {
+				mailboxID := strings.TrimPrefix(path, "mailboxIds/")
+				if v == nil {
+					delete(e.MailboxIDs, mailboxID)
+				} else {
+					e.MailboxIDs[mailboxID] = true
+				}
+			}
+			updated[id] = nil
+		}
+	}
+
+	destroyed := []string{}
+	for _, id := range args.Destroy {
+		for i, e := range s.emails {
+			if e.ID == id {
+				s.emails = append(s.emails[:i], s.emails[i+1:]...)
+				destroyed = append(destroyed, id)
+				break
+			}
+		}
+	}
+
+	s.changed()
+	return map[string]interface{}{"accountId": "acc1", "updated": updated, "destroyed": destroyed}
+}
+
+func (s *stubServer) Imports() []stubImport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]stubImport(nil), s.imports...)
+}
+
+func (s *stubServer) Config() *Config {
+	return &Config{
+		SessionURL: s.URL + "/.well-known/jmap",
+		Username:   "user",
+		Password:   "pass",
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package jmap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"git.vs49688.net/zane/mailpump/delivery"
+)
+
+const (
+	CapabilityCore = "urn:ietf:params:jmap:core"
+	CapabilityMail = "urn:ietf:params:jmap:mail"
+)
+
+var (
+	ErrNoMailAccount      = errors.New("server has no mail account")
+	ErrMailboxNotFound    = errors.New("mailbox not found")
+	ErrUnexpectedResponse = errors.New("unexpected method response")
+)
+
+type Config struct {
+	// SessionURL is the URL of the JMAP session resource, usually
+	// https://host/.well-known/jmap.
+	SessionURL string
+
+	// Username and Password are used for Basic authentication, unless
+	// TokenSource is set.
+	Username string
+	Password string
+
+	// TokenSource, if set, provides a Bearer token for each request.
+	TokenSource oauth2.TokenSource
+
+	// Timeout is the timeout for each HTTP request.
+	Timeout time.Duration
+}
+
+// ReceiverFactory creates receivers for a JMAP account. Acknowledged
+// messages are destroyed, unless MoveTo is set.
+type ReceiverFactory struct {
+	Config
+
+	// MoveTo, if set, is the mailbox acknowledged messages are moved to,
+	// instead of being destroyed.
+	MoveTo string
+}
+
+// session is the JMAP session resource, as defined in RFC 8620 2.
+type session struct {
+	APIURL          string            `json:"apiUrl"`
+	DownloadURL     string            `json:"downloadUrl"`
+	UploadURL       string            `json:"uploadUrl"`
+	EventSourceURL  string            `json:"eventSourceUrl"`
+	PrimaryAccounts map[string]string `json:"primaryAccounts"`
+	State           string            `json:"state"`
+}
+
+// invocation is a method call or response, as defined in RFC 8620 3.2.
+type invocation struct {
+	Name   string
+	Args   json.RawMessage
+	CallID string
+}
+
+func (inv *invocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{inv.Name, inv.Args, inv.CallID})
+}
+
+func (inv *invocation) UnmarshalJSON(b []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	if len(raw) != 3 {
+		return ErrUnexpectedResponse
+	}
+
+	if err := json.Unmarshal(raw[0], &inv.Name); err != nil {
+		return err
+	}
+
+	inv.Args = raw[1]
+	return json.Unmarshal(raw[2], &inv.CallID)
+}
+
+type apiRequest struct {
+	Using       []string     `json:"using"`
+	MethodCalls []invocation `json:"methodCalls"`
+}
+
+type apiResponse struct {
+	MethodResponses []invocation `json:"methodResponses"`
+	SessionState    string       `json:"sessionState"`
+}
+
+// MethodError is a method-level error, as defined in RFC 8620 3.6.2.
+type MethodError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *MethodError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("jmap method error: %v", e.Type)
+	}
+	return fmt.Sprintf("jmap method error: %v: %v", e.Type, e.Description)
+}
+
+// SetError is the error for a single object in a /set or /import call,
+// as defined in RFC 8620 5.3.
+type SetError struct {
+	Type        string `json:"type"`
+	Description string `json:"description,omitempty"`
+}
+
+func (e *SetError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("jmap error: %v", e.Type)
+	}
+	return fmt.Sprintf("jmap error: %v: %v", e.Type, e.Description)
+}
+
+// Temporary checks if the operation may succeed if retried.
+func (e *SetError) Temporary() bool {
+	switch e.Type {
+	case "invalidEmail", "invalidProperties", "tooLarge", "forbidden":
+		return false
+	}
+	return true
+}
+
+// StatusError is returned when the server replies with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("jmap request failed: %v", e.Status)
+}
+
+type mailbox struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	Role     string `json:"role"`
+}
+
+type client struct {
+	cfg  Config
+	http *http.Client
+	push *http.Client
+
+	mu        sync.Mutex
+	session   *session
+	accountID string
+}
+
+// mailboxCache resolves mailbox names to their IDs.
+type mailboxCache struct {
+	client *client
+
+	// mailboxes maps mailbox paths to their IDs.
+	mailboxes map[string]string
+	// roles maps mailbox roles to their IDs.
+	roles map[string]string
+}
+
+type sink struct {
+	client    *client
+	mailboxes *mailboxCache
+}
+
+type ackRequest struct {
+	UID   uint32
+	Error error
+}
+
+// email is a message that has been passed on to the pump. JMAP has no
+// UIDs, so each is given one for the lifetime of the receiver.
+type email struct {
+	UID uint32
+	ID  string
+
+	Acked bool
+	// Rejected is set if the message should be moved to
+	// the reject mailbox instead.
+	Rejected bool
+	// Failed is set if the message wasn't delivered, and is being left be.
+	Failed bool
+}
+
+type mailReceiver struct {
+	client    *client
+	mailboxes *mailboxCache
+	logger    *log.Entry
+
+	// external -> receiver, incoming acks
+	ackChannel chan ackRequest
+
+	// external -> receiver, destination health updates
+	healthChannel chan delivery.Health
+
+	// receiver -> external, message notifications
+	outChannel chan<- *imap.Message
+
+	mailbox              string
+	moveTo               string
+	rejectMailbox        string
+	batchSize            uint
+	idleFallbackInterval time.Duration
+	fetchBufferSize      uint
+	fetchMaxInterval     time.Duration
+	disableDeletions     bool
+
+	messages map[uint32]*email
+	ids      map[string]uint32
+	nextUID  uint32
+
+	// state is the Email state string as of the last fetch. Changes since
+	// then are what trigger the next one.
+	state string
+	// more is set if the last fetch didn't get everything in the mailbox.
+	more bool
+
+	// pushing is set while the event source is connected.
+	pushing atomic.Bool
+
+	cancel   context.CancelFunc
+	hasQuit  chan struct{}
+	wantQuit chan struct{}
+}
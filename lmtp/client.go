@@ -0,0 +1,271 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package lmtp
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newClient(cfg *Config) *client {
+	c := &client{cfg: *cfg}
+
+	if c.cfg.Network == "" {
+		c.cfg.Network = "tcp"
+	}
+
+	if c.cfg.Timeout == 0 {
+		c.cfg.Timeout = 5 * time.Minute
+	}
+
+	if c.cfg.LHLOName == "" {
+		c.cfg.LHLOName = "localhost"
+	}
+
+	return c
+}
+
+func (c *client) close() {
+	if c.conn == nil {
+		return
+	}
+
+	_ = c.conn.Close()
+	c.conn = nil
+	c.netConn = nil
+}
+
+func (c *client) extendDeadline() {
+	_ = c.netConn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+}
+
+func (c *client) connect() error {
+	netConn, err := net.DialTimeout(c.cfg.Network, c.cfg.Address, c.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+
+	c.netConn = netConn
+	c.conn = textproto.NewConn(netConn)
+	c.extendDeadline()
+
+	if _, _, err := c.conn.ReadResponse(220); err != nil {
+		c.close()
+		return err
+	}
+
+	id, err := c.conn.Cmd("LHLO %s", c.cfg.LHLOName)
+	if err != nil {
+		c.close()
+		return err
+	}
+
+	c.conn.StartResponse(id)
+	_, msg, err := c.conn.ReadResponse(250)
+	c.conn.EndResponse(id)
+	if err != nil {
+		c.close()
+		return err
+	}
+
+	c.pipelining = false
+	for _, ext := range strings.Split(msg, "\n") {
+		if strings.EqualFold(strings.TrimSpace(ext), "PIPELINING") {
+			c.pipelining = true
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"address":    c.cfg.Address,
+		"pipelining": c.pipelining,
+	}).Trace("lmtp_connected")
+	return nil
+}
+
+// reset makes sure the connection is ready for a new transaction,
+// reconnecting if needed.
+func (c *client) reset() error {
+	if c.conn != nil {
+		c.extendDeadline()
+		if _, _, err := c.cmd(250, "RSET"); err == nil {
+			return nil
+		}
+
+		// The server probably timed us out
+		c.close()
+	}
+
+	return c.connect()
+}
+
+func (c *client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+	return c.conn.ReadResponse(expectCode)
+}
+
+// response reads a response, separating protocol errors from I/O errors.
+func (c *client) response(expectCode int) (int, string, error) {
+	code, msg, err := c.conn.ReadResponse(expectCode)
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code, tpErr.Msg, nil
+	}
+
+	return code, msg, err
+}
+
+// send delivers a message to each recipient. The recipients that failed are returned,
+// with any other error indicating the whole transaction failed.
+func (c *client) send(from string, rcpts []string, body []byte) ([]*RecipientError, error) {
+	if err := c.reset(); err != nil {
+		return nil, err
+	}
+
+	errs, accepted, err := c.envelope(from, rcpts)
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if len(accepted) == 0 {
+		return errs, nil
+	}
+
+	if _, _, err := c.cmd(354, "DATA"); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	w := c.conn.DotWriter()
+	if _, err := w.Write(body); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	// LMTP gives a response for each accepted recipient
+	for _, rcpt := range accepted {
+		code, msg, err := c.response(250)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+
+		if code != 250 {
+			errs = append(errs, &RecipientError{Recipient: rcpt, Code: code, Message: msg})
+		}
+	}
+
+	return errs, nil
+}
+
+// envelope sends MAIL FROM, and a RCPT TO for each recipient, pipelining them if
+// the server allows it.
+func (c *client) envelope(from string, rcpts []string) ([]*RecipientError, []string, error) {
+	cmds := []string{"MAIL FROM:<" + from + ">"}
+	for _, rcpt := range rcpts {
+		cmds = append(cmds, "RCPT TO:<"+rcpt+">")
+	}
+
+	type result struct {
+		code int
+		msg  string
+	}
+
+	results := make([]result, 0, len(cmds))
+	if c.pipelining {
+		for _, cmd := range cmds {
+			if err := c.conn.PrintfLine("%s", cmd); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		for range cmds {
+			code, msg, err := c.response(250)
+			if err != nil {
+				return nil, nil, err
+			}
+			results = append(results, result{code: code, msg: msg})
+		}
+	} else {
+		for _, cmd := range cmds {
+			if err := c.conn.PrintfLine("%s", cmd); err != nil {
+				return nil, nil, err
+			}
+
+			code, msg, err := c.response(250)
+			if err != nil {
+				return nil, nil, err
+			}
+			results = append(results, result{code: code, msg: msg})
+
+			// No point continuing
+			if len(results) == 1 && code != 250 {
+				break
+			}
+		}
+	}
+
+	// If MAIL FROM failed, every recipient did
+	if mail := results[0]; mail.code != 250 {
+		errs := make([]*RecipientError, 0, len(rcpts))
+		for _, rcpt := range rcpts {
+			errs = append(errs, &RecipientError{Recipient: rcpt, Code: mail.code, Message: mail.msg})
+		}
+		return errs, nil, nil
+	}
+
+	var errs []*RecipientError
+	var accepted []string
+	for i, rcpt := range rcpts {
+		if r := results[i+1]; r.code != 250 {
+			errs = append(errs, &RecipientError{Recipient: rcpt, Code: r.code, Message: r.msg})
+		} else {
+			accepted = append(accepted, rcpt)
+		}
+	}
+
+	return errs, accepted, nil
+}
+
+func (c *client) quit() {
+	if c.conn == nil {
+		return
+	}
+
+	c.extendDeadline()
+	_, _, _ = c.cmd(221, "QUIT")
+	c.close()
+}
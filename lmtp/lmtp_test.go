@@ -0,0 +1,300 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+const testMessage = "Return-Path: <sender@example.com>\r\n" +
+	"From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	".Hello\r\n"
+
+type fakeMessage struct {
+	From       string
+	Recipients []string
+	Body       string
+}
+
+// fakeServer is a minimal LMTP server. Recipients are rejected with the
+// code in rcptCodes, and failed after DATA with the code in dataCodes.
+type fakeServer struct {
+	listener   net.Listener
+	pipelining bool
+	rcptCodes  map[string]int
+	dataCodes  map[string]int
+
+	mu       sync.Mutex
+	messages []fakeMessage
+	commands []string
+}
+
+func newFakeServer(t *testing.T, network, address string) *fakeServer {
+	l, err := net.Listen(network, address)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s := &fakeServer{
+		listener:  l,
+		rcptCodes: map[string]int{},
+		dataCodes: map[string]int{},
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(textproto.NewConn(conn))
+	}
+}
+
+func (s *fakeServer) handle(conn *textproto.Conn) {
+	defer conn.Close()
+
+	_ = conn.PrintfLine("220 localhost LMTP ready")
+
+	var msg fakeMessage
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			if s.pipelining {
+				_ = conn.PrintfLine("250-localhost")
+				_ = conn.PrintfLine("250 PIPELINING")
+			} else {
+				_ = conn.PrintfLine("250 localhost")
+			}
+		case "MAIL":
+			msg = fakeMessage{From: strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")}
+			_ = conn.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if code, ok := s.rcptCodes[rcpt]; ok {
+				_ = conn.PrintfLine("%d rejected", code)
+				continue
+			}
+			msg.Recipients = append(msg.Recipients, rcpt)
+			_ = conn.PrintfLine("250 OK")
+		case "DATA":
+			_ = conn.PrintfLine("354 Go ahead")
+			body, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Body = string(body)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+
+			for _, rcpt := range msg.Recipients {
+				if code, ok := s.dataCodes[rcpt]; ok {
+					_ = conn.PrintfLine("%d failed", code)
+				} else {
+					_ = conn.PrintfLine("250 <%v> delivered", rcpt)
+				}
+			}
+		case "RSET":
+			msg = fakeMessage{}
+			_ = conn.PrintfLine("250 OK")
+		case "QUIT":
+			_ = conn.PrintfLine("221 Bye")
+			return
+		default:
+			_ = conn.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+func (s *fakeServer) Messages() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func newTestSink(t *testing.T, cfg *Config) ingest.Sink {
+	cfg.Timeout = 5 * time.Second
+	sink, err := NewSink(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = sink.Close() })
+	return sink
+}
+
+func TestDeliver(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		t.Run(fmt.Sprintf("pipelining=%v", pipelining), func(t *testing.T) {
+			s := newFakeServer(t, "tcp", "127.0.0.1:0")
+			s.pipelining = pipelining
+
+			sink := newTestSink(t, &Config{Address: s.listener.Addr().String()})
+
+			assert.NoError(t, sink.Deliver("user1@example.com", nil, time.Time{}, []byte(testMessage)))
+			assert.NoError(t, sink.Deliver("user2@example.com", nil, time.Time{}, []byte(testMessage)))
+
+			msgs := s.Messages()
+			if assert.Len(t, msgs, 2) {
+				assert.Equal(t, "sender@example.com", msgs[0].From)
+				assert.Equal(t, []string{"user1@example.com"}, msgs[0].Recipients)
+				assert.Equal(t, strings.ReplaceAll(testMessage, "\r\n", "\n"), msgs[0].Body)
+				assert.Equal(t, []string{"user2@example.com"}, msgs[1].Recipients)
+			}
+		})
+	}
+}
+
+func TestRecipientStatus(t *testing.T) {
+	s := newFakeServer(t, "tcp", "127.0.0.1:0")
+	s.pipelining = true
+	s.rcptCodes["unknown@example.com"] = 550
+	s.dataCodes["full@example.com"] = 452
+	s.dataCodes["broken@example.com"] = 554
+
+	t.Run("permanent", func(t *testing.T) {
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			Recipients: []string{"user@example.com", "unknown@example.com", "broken@example.com"},
+		})
+
+		err := sink.Deliver("", nil, time.Time{}, []byte(testMessage))
+
+		var perr *delivery.PermanentError
+		assert.ErrorAs(t, err, &perr)
+
+		var derr *DeliveryError
+		if assert.ErrorAs(t, err, &derr) {
+			assert.Equal(t, 1, derr.Delivered)
+			assert.Equal(t, []*RecipientError{
+				{Recipient: "unknown@example.com", Code: 550, Message: "rejected"},
+				{Recipient: "broken@example.com", Code: 554, Message: "failed"},
+			}, derr.Errors)
+		}
+	})
+
+	t.Run("temporary", func(t *testing.T) {
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			Recipients: []string{"unknown@example.com", "full@example.com"},
+		})
+
+		err := sink.Deliver("", nil, time.Time{}, []byte(testMessage))
+
+		var perr *delivery.PermanentError
+		assert.False(t, errors.As(err, &perr))
+
+		var derr *DeliveryError
+		if assert.ErrorAs(t, err, &derr) {
+			assert.True(t, derr.Temporary())
+			assert.Equal(t, 0, derr.Delivered)
+		}
+	})
+
+	t.Run("partial_temporary", func(t *testing.T) {
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			Recipients: []string{"user@example.com", "full@example.com"},
+		})
+
+		err := sink.Deliver("", nil, time.Time{}, []byte(testMessage))
+
+		// Retrying would deliver it to user@example.com twice
+		var perr *delivery.PermanentError
+		assert.ErrorAs(t, err, &perr)
+
+		var derr *DeliveryError
+		if assert.ErrorAs(t, err, &derr) {
+			assert.True(t, derr.Temporary())
+			assert.Equal(t, 1, derr.Delivered)
+		}
+	})
+
+	t.Run("all_rejected", func(t *testing.T) {
+		sink := newTestSink(t, &Config{Address: s.listener.Addr().String()})
+
+		n := len(s.Messages())
+		err := sink.Deliver("unknown@example.com", nil, time.Time{}, []byte(testMessage))
+
+		var perr *delivery.PermanentError
+		assert.ErrorAs(t, err, &perr)
+		assert.Len(t, s.Messages(), n)
+	})
+}
+
+func TestNoRecipients(t *testing.T) {
+	sink := newTestSink(t, &Config{Address: "127.0.0.1:1"})
+
+	err := sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+	assert.ErrorIs(t, err, ErrNoRecipients)
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets not supported")
+	}
+
+	path := filepath.Join(t.TempDir(), "lmtp")
+	s := newFakeServer(t, "unix", path)
+
+	sink := newTestSink(t, &Config{
+		Network: "unix",
+		Address: path,
+		From:    "override@example.com",
+	})
+
+	assert.NoError(t, sink.Deliver("user@example.com", nil, time.Time{}, []byte(testMessage)))
+
+	msgs := s.Messages()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "override@example.com", msgs[0].From)
+	}
+}
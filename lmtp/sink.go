@@ -0,0 +1,110 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package lmtp
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewSink creates an ingest.Sink that delivers over LMTP. The connection is
+// made lazily, and kept open between messages.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	c := *cfg
+	if c.LHLOName == "" {
+		if name, err := os.Hostname(); err == nil {
+			c.LHLOName = name
+		}
+	}
+
+	return &sink{client: newClient(&c)}, nil
+}
+
+func (s *sink) recipients(mailbox string) []string {
+	if len(s.client.cfg.Recipients) > 0 {
+		return s.client.cfg.Recipients
+	}
+
+	if mailbox == "" || strings.EqualFold(mailbox, "INBOX") {
+		return nil
+	}
+
+	return []string{mailbox}
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	rcpts := s.recipients(mailbox)
+	if len(rcpts) == 0 {
+		return &delivery.PermanentError{Err: ErrNoRecipients}
+	}
+
+	from := s.client.cfg.From
+	if from == "" {
+		from = ingest.ReturnPath(body)
+	}
+
+	errs, err := s.client.send(from, rcpts, body)
+	if err != nil {
+		return err
+	}
+
+	if len(errs) == 0 {
+		log.WithFields(log.Fields{
+			"mailbox":    mailbox,
+			"recipients": rcpts,
+		}).Trace("lmtp_delivered")
+		return nil
+	}
+
+	derr := &DeliveryError{Errors: errs, Delivered: len(rcpts) - len(errs)}
+	for _, re := range errs {
+		log.WithFields(log.Fields{
+			"mailbox":   mailbox,
+			"recipient": re.Recipient,
+			"code":      re.Code,
+			"message":   re.Message,
+		}).Warn("lmtp_recipient_failed")
+	}
+
+	// Only retry if nobody has it yet, otherwise those that do would get
+	// it again.
+	if derr.Delivered == 0 && derr.Temporary() {
+		return derr
+	}
+
+	if derr.Delivered > 0 {
+		log.WithFields(log.Fields{
+			"mailbox":   mailbox,
+			"delivered": derr.Delivered,
+			"failed":    len(errs),
+		}).Warn("lmtp_partial_delivery")
+	}
+
+	return &delivery.PermanentError{Err: derr}
+}
+
+func (s *sink) Close() error {
+	s.client.quit()
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package lmtp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNoRecipients = errors.New("no recipients")
+)
+
+type Config struct {
+	// Network is either "tcp" or "unix".
+	Network string
+
+	// Address is the HOST:PORT, or socket path, of the server.
+	Address string
+
+	// Recipients are the addresses to deliver to. If empty, the target
+	// mailbox is used as the recipient.
+	Recipients []string
+
+	// From is the envelope sender. If empty, it is taken from the message's
+	// Return-Path header, or is null.
+	From string
+
+	// LHLOName is the name to greet the server with. Defaults to the hostname.
+	LHLOName string
+
+	// Timeout is the timeout for each network operation.
+	Timeout time.Duration
+}
+
+// RecipientError is the failure of a single recipient.
+type RecipientError struct {
+	Recipient string
+	Code      int
+	Message   string
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("<%v>: %d %v", e.Recipient, e.Code, e.Message)
+}
+
+// Temporary checks if the failure was temporary, i.e. a 4xx code.
+func (e *RecipientError) Temporary() bool {
+	return e.Code/100 == 4
+}
+
+// DeliveryError is returned when delivery fails for one or more recipients.
+// It's only retryable if no recipient succeeded.
+type DeliveryError struct {
+	Errors []*RecipientError
+
+	// Delivered is the number of recipients that succeeded.
+	Delivered int
+}
+
+func (e *DeliveryError) Error() string {
+	errs := make([]string, 0, len(e.Errors))
+	for _, re := range e.Errors {
+		errs = append(errs, re.Error())
+	}
+
+	return fmt.Sprintf("delivery failed for %d recipient(s): %v", len(e.Errors), strings.Join(errs, ", "))
+}
+
+// Temporary checks if delivery should be retried, i.e. any recipient failed temporarily.
+func (e *DeliveryError) Temporary() bool {
+	for _, re := range e.Errors {
+		if re.Temporary() {
+			return true
+		}
+	}
+	return false
+}
+
+type client struct {
+	cfg        Config
+	netConn    net.Conn
+	conn       *textproto.Conn
+	pipelining bool
+}
+
+type sink struct {
+	client *client
+}
@@ -0,0 +1,213 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+)
+
+// keywordsFile is where Dovecot keeps the mapping of keywords to letters.
+const keywordsFile = "dovecot-keywords"
+
+// maxKeywords is the number of letters available for keywords, a-z.
+const maxKeywords = 26
+
+var systemFlags = map[string]byte{
+	imap.DraftFlag:    'D',
+	imap.FlaggedFlag:  'F',
+	"$Forwarded":      'P',
+	imap.AnsweredFlag: 'R',
+	imap.SeenFlag:     'S',
+	imap.DeletedFlag:  'T',
+}
+
+// loadKeywords reads the keyword file of a folder. The index of each keyword
+// is its letter, i.e. 0 is 'a'.
+func (f *Folder) loadKeywords() ([]string, error) {
+	file, err := os.Open(filepath.Join(f.path, keywordsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keywords := make([]string, maxKeywords)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		idx, kw, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+
+		i, err := strconv.Atoi(idx)
+		if err != nil || i < 0 || i >= maxKeywords {
+			continue
+		}
+
+		keywords[i] = kw
+	}
+
+	return keywords, scanner.Err()
+}
+
+func (f *Folder) saveKeywords(keywords []string) error {
+	path := filepath.Join(f.path, keywordsFile)
+	tmpPath := path + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for i, kw := range keywords {
+		if kw != "" {
+			_, _ = fmt.Fprintf(w, "%d %s\n", i, kw)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// keywordLetters maps keywords to their letters, allocating new ones as needed.
+// Keywords that can't be allocated a letter are dropped.
+func (f *Folder) keywordLetters(kws []string) ([]byte, error) {
+	if len(kws) == 0 {
+		return nil, nil
+	}
+
+	keywords, err := f.loadKeywords()
+	if err != nil {
+		return nil, err
+	}
+
+	if keywords == nil {
+		keywords = make([]string, maxKeywords)
+	}
+
+	var letters []byte
+	changed := false
+outer:
+	for _, kw := range kws {
+		free := -1
+		for i, existing := range keywords {
+			if existing == kw {
+				letters = append(letters, byte('a'+i))
+				continue outer
+			}
+
+			if existing == "" && free < 0 {
+				free = i
+			}
+		}
+
+		if free < 0 {
+			log.WithFields(log.Fields{"folder": f.path, "keyword": kw}).Warn("maildir_keyword_dropped")
+			continue
+		}
+
+		keywords[free] = kw
+		letters = append(letters, byte('a'+free))
+		changed = true
+	}
+
+	if changed {
+		if err := f.saveKeywords(keywords); err != nil {
+			return nil, err
+		}
+	}
+
+	return letters, nil
+}
+
+// infoFlags builds the flags of the info suffix of a message.
+func (f *Folder) infoFlags(flags []string) (string, error) {
+	var letters []byte
+	var keywords []string
+
+	for _, flag := range flags {
+		if c, ok := systemFlags[flag]; ok {
+			letters = append(letters, c)
+		} else if !strings.HasPrefix(flag, "\\") {
+			keywords = append(keywords, flag)
+		}
+	}
+
+	kwLetters, err := f.keywordLetters(keywords)
+	if err != nil {
+		return "", err
+	}
+	letters = append(letters, kwLetters...)
+
+	// Flags must be unique, and in ASCII order
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	letters = slices.Compact(letters)
+	return string(letters), nil
+}
+
+// ParseInfoFlags converts the flags of a message's info, e.g. the "2,FRa" of
+// "1234.M1P2.host:2,FRa", to IMAP flags. keywords are the folder's keywords,
+// indexed by their letters. Unknown letters are dropped.
+func ParseInfoFlags(info string, keywords []string) []string {
+	letters, ok := strings.CutPrefix(info, "2,")
+	if !ok {
+		return nil
+	}
+
+	var flags []string
+	for i := 0; i < len(letters); i++ {
+		c := letters[i]
+		if c >= 'a' && c <= 'z' {
+			if idx := int(c - 'a'); idx < len(keywords) && keywords[idx] != "" {
+				flags = append(flags, keywords[idx])
+			}
+			continue
+		}
+
+		for flag, fc := range systemFlags {
+			if fc == c {
+				flags = append(flags, flag)
+				break
+			}
+		}
+	}
+
+	return flags
+}
@@ -0,0 +1,187 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap/utf7"
+)
+
+// infoSeparator separates the unique part of a filename from its info.
+// Windows doesn't allow ':' in filenames, so use ';' like other clients.
+var infoSeparator = func() string {
+	if runtime.GOOS == "windows" {
+		return ";"
+	}
+	return ":"
+}()
+
+var deliveryCounter uint64
+
+// Open opens the Maildir at path, creating it if needed.
+func Open(path string) (*Maildir, error) {
+	md := &Maildir{path: path}
+	if err := initFolder(path); err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+func initFolder(path string) error {
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(path, d), 0700); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FolderPath returns the path of a Maildir++ folder, relative to the root.
+// INBOX, or an empty name, is the root itself. Hierarchy delimiters ("/" or ".")
+// are converted to ".", and names are encoded in modified UTF-7, as Dovecot does.
+func FolderPath(name string) (string, error) {
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return "", nil
+	}
+
+	var parts []string
+	for _, p := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '.' }) {
+		enc, err := utf7.Encoding.NewEncoder().String(p)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, enc)
+	}
+
+	if len(parts) == 0 {
+		return "", ErrInvalidFolder
+	}
+
+	return "." + strings.Join(parts, "."), nil
+}
+
+// Folder opens a folder, creating it if needed.
+func (md *Maildir) Folder(name string) (*Folder, error) {
+	rel, err := FolderPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rel == "" {
+		return &Folder{path: md.path}, nil
+	}
+
+	path := filepath.Join(md.path, rel)
+	if err := initFolder(path); err != nil {
+		return nil, err
+	}
+
+	// Maildir++ subfolders are marked as such
+	f, err := os.OpenFile(filepath.Join(path, "maildirfolder"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+
+	return &Folder{path: path}, nil
+}
+
+// Path returns the path of the folder.
+func (f *Folder) Path() string {
+	return f.path
+}
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	host = strings.ReplaceAll(host, "/", "\\057")
+	return strings.ReplaceAll(host, ":", "\\072")
+}
+
+// uniqueName generates a unique filename, as described at https://cr.yp.to/proto/maildir.html
+func uniqueName(size int) string {
+	now := time.Now()
+	n := atomic.AddUint64(&deliveryCounter, 1)
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(), n, hostname(), size)
+}
+
+// Deliver writes a message to the folder. It is written to tmp/ first, then
+// moved into new/, or cur/ if it has any flags. If date isn't zero, it is used
+// as the modification time. The path of the message is returned.
+func (f *Folder) Deliver(body []byte, flags []string, date time.Time) (string, error) {
+	info, err := f.infoFlags(flags)
+	if err != nil {
+		return "", err
+	}
+
+	name := uniqueName(len(body))
+	tmpPath := filepath.Join(f.path, "tmp", name)
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.Write(body); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := file.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	if !date.IsZero() {
+		_ = os.Chtimes(tmpPath, date, date)
+	}
+
+	var finalPath string
+	if info == "" {
+		finalPath = filepath.Join(f.path, "new", name)
+	} else {
+		finalPath = filepath.Join(f.path, "cur", name+infoSeparator+"2,"+info)
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+
+	return finalPath, nil
+}
@@ -0,0 +1,276 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/delivery"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+const testMessage = "From: from@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+
+func TestFolderPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "", expected: ""},
+		{name: "INBOX", expected: ""},
+		{name: "inbox", expected: ""},
+		{name: "Archive", expected: ".Archive"},
+		{name: "Lists/Go", expected: ".Lists.Go"},
+		{name: "Lists.Go", expected: ".Lists.Go"},
+		{name: "Entwürfe", expected: ".Entw&APw-rfe"},
+	}
+
+	for _, tt := range tests {
+		path, err := FolderPath(tt.name)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, path)
+	}
+
+	_, err := FolderPath("/")
+	assert.ErrorIs(t, err, ErrInvalidFolder)
+}
+
+func TestDeliver(t *testing.T) {
+	md, err := Open(t.TempDir())
+	assert.NoError(t, err)
+
+	folder, err := md.Folder("INBOX")
+	assert.NoError(t, err)
+
+	t.Run("new", func(t *testing.T) {
+		date := time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+		path, err := folder.Deliver([]byte(testMessage), nil, date)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(folder.Path(), "new"), filepath.Dir(path))
+
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, testMessage, string(data))
+
+		st, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.True(t, date.Equal(st.ModTime()))
+	})
+
+	t.Run("cur", func(t *testing.T) {
+		flags := []string{imap.SeenFlag, imap.FlaggedFlag, imap.RecentFlag, "$Label1", "Important", "$Label1"}
+		path, err := folder.Deliver([]byte(testMessage), flags, time.Time{})
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(folder.Path(), "cur"), filepath.Dir(path))
+		assert.True(t, strings.HasSuffix(path, infoSeparator+"2,FSab"))
+
+		keywords, err := os.ReadFile(filepath.Join(folder.Path(), keywordsFile))
+		assert.NoError(t, err)
+		assert.Equal(t, "0 $Label1\n1 Important\n", string(keywords))
+
+		// Existing keywords should be reused
+		path, err = folder.Deliver([]byte(testMessage), []string{"Important"}, time.Time{})
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(path, infoSeparator+"2,b"))
+	})
+
+	entries, err := os.ReadDir(filepath.Join(folder.Path(), "tmp"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestSink(t *testing.T) {
+	root := t.TempDir()
+
+	sink, err := NewSink(&Config{Path: root})
+	assert.NoError(t, err)
+
+	ing, err := ingest.NewClient(&ingest.Config{Sink: sink})
+	assert.NoError(t, err)
+	defer ing.Close()
+
+	rfc822Section, _ := imap.ParseBodySectionName(imap.FetchRFC822)
+	msg := imap.NewMessage(1, []imap.FetchItem{imap.FetchRFC822})
+	msg.Uid = 1
+	msg.Body[rfc822Section] = imap.Literal(strings.NewReader(testMessage))
+
+	assert.NoError(t, ingest.IngestMessageSync("Lists/Go", ing, msg))
+
+	entries, err := os.ReadDir(filepath.Join(root, ".Lists.Go", "new"))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	data, err := os.ReadFile(filepath.Join(root, ".Lists.Go", "new", entries[0].Name()))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.ReplaceAll(testMessage, "\r\n", "\n"), string(data))
+
+	_, err = os.Stat(filepath.Join(root, ".Lists.Go", "maildirfolder"))
+	assert.NoError(t, err)
+}
+
+func TestParseInfoFlags(t *testing.T) {
+	keywords := []string{"$Label1", "", "Important"}
+
+	assert.ElementsMatch(t, []string{imap.FlaggedFlag, imap.SeenFlag, "$Forwarded", "$Label1", "Important"},
+		ParseInfoFlags("2,FPSabc", keywords))
+	assert.Empty(t, ParseInfoFlags("2,", keywords))
+	assert.Empty(t, ParseInfoFlags("1,S", keywords))
+	assert.Empty(t, ParseInfoFlags("", nil))
+}
+
+func TestWatcher(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching is only supported on Linux")
+	}
+
+	dir := t.TempDir()
+	w, err := newWatcher(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer w.Close()
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "message"), nil, 0600))
+
+	select {
+	case <-w.Events():
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	root := t.TempDir()
+	md, err := Open(root)
+	assert.NoError(t, err)
+
+	folder, err := md.Folder("INBOX")
+	assert.NoError(t, err)
+
+	lfMessage := strings.ReplaceAll(testMessage, "\r\n", "\n")
+	date := time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+
+	path1, err := folder.Deliver([]byte(lfMessage), []string{imap.SeenFlag, "Important"}, date)
+	assert.NoError(t, err)
+	path2, err := folder.Deliver([]byte(lfMessage), nil, time.Time{})
+	assert.NoError(t, err)
+
+	ch := make(chan *imap.Message, 10)
+	recv, err := receiver.NewReceiver(&receiver.Config{
+		ConnectionConfig:     imap2.ConnectionConfig{Mailbox: "INBOX"},
+		Receiver:             &ReceiverFactory{Path: root},
+		Channel:              ch,
+		RejectMailbox:        "Junk",
+		IDLEFallbackInterval: 10 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	msg1 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, testMessage, internal.MessageBody(t, msg1))
+	assert.ElementsMatch(t, []string{imap.SeenFlag, "Important"}, msg1.Flags)
+	assert.True(t, date.Equal(msg1.InternalDate))
+
+	msg2 := internal.ReceiveMessage(t, ch)
+	assert.Empty(t, msg2.Flags)
+
+	// Should be noticed while running
+	path3, err := folder.Deliver([]byte(lfMessage), nil, time.Time{})
+	assert.NoError(t, err)
+	msg3 := internal.ReceiveMessage(t, ch)
+
+	// Another client has seen it since
+	moved := filepath.Join(folder.Path(), "cur", filepath.Base(path2)+infoSeparator+"2,S")
+	assert.NoError(t, os.Rename(path2, moved))
+
+	recv.Ack(msg1.Uid, nil)
+	recv.Ack(msg2.Uid, &delivery.PermanentError{Err: errors.New("rejected")})
+	recv.Ack(msg3.Uid, errors.New("try again later"))
+	recv.Close()
+
+	_, err = os.Stat(path1)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = os.Stat(filepath.Join(root, ".Junk", "cur", filepath.Base(moved)))
+	assert.NoError(t, err)
+
+	_, err = os.Stat(path3)
+	assert.NoError(t, err)
+
+	assert.Empty(t, ch)
+}
+
+func TestReader(t *testing.T) {
+	root := t.TempDir()
+	md, err := Open(root)
+	assert.NoError(t, err)
+
+	folder, err := md.Folder("Archive")
+	assert.NoError(t, err)
+
+	date := time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+	first, err := folder.Deliver([]byte(testMessage), nil, date)
+	assert.NoError(t, err)
+	second, err := folder.Deliver([]byte(testMessage), []string{imap.SeenFlag, "Important"}, date)
+	assert.NoError(t, err)
+
+	_, err = NewReader(root, "Missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	r, err := NewReader(root, "Archive")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer r.Close()
+
+	// Names aren't guaranteed to sort in delivery order within a second
+	msgs := map[string]*archive.Message{}
+	for i := 0; i < 2; i++ {
+		msg, err := r.Next()
+		if assert.NoError(t, err) {
+			msgs[msg.Key] = msg
+		}
+	}
+
+	if msg, ok := msgs[filepath.Base(first)]; assert.True(t, ok) {
+		assert.True(t, date.Equal(msg.Date))
+		assert.Empty(t, msg.Flags)
+		assert.Equal(t, testMessage, string(msg.Body))
+	}
+
+	key, _, _ := strings.Cut(filepath.Base(second), infoSeparator)
+	if msg, ok := msgs[key]; assert.True(t, ok) {
+		assert.ElementsMatch(t, []string{imap.SeenFlag, "Important"}, msg.Flags)
+	}
+
+	_, err = r.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
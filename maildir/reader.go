@@ -0,0 +1,87 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"git.vs49688.net/zane/mailpump/archive"
+)
+
+// NewReader reads the messages in a folder of an existing Maildir, in the
+// order they arrived. Each message is keyed by the unique part of its name,
+// and dated by its modification time. Nothing is changed.
+func NewReader(path string, folder string) (archive.Reader, error) {
+	rel, err := FolderPath(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Folder{path: filepath.Join(path, rel)}
+	for _, d := range []string{"new", "cur"} {
+		if _, err := os.Stat(filepath.Join(f.path, d)); err != nil {
+			return nil, err
+		}
+	}
+
+	keywords, err := f.loadKeywords()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := f.listMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reader{folder: f, keywords: keywords, entries: entries}, nil
+}
+
+func (r *reader) Next() (*archive.Message, error) {
+	for r.next < len(r.entries) {
+		e := r.entries[r.next]
+		r.next++
+
+		body, date, err := readMessage(filepath.Join(r.folder.path, e.Dir, e.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			// Moved or deleted since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		key, info, _ := strings.Cut(e.Name, infoSeparator)
+		return &archive.Message{
+			Key:   key,
+			Flags: ParseInfoFlags(info, r.keywords),
+			Date:  date,
+			Body:  body,
+		}, nil
+	}
+
+	return nil, io.EOF
+}
+
+func (r *reader) Close() error {
+	return nil
+}
@@ -0,0 +1,433 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/archive"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+// NewReceiver creates a receiver.Client for the folder in cfg.ConnectionConfig. New
+// messages are noticed with inotify where available, otherwise the folder is polled.
+func (f *ReceiverFactory) NewReceiver(cfg *receiver.Config) (receiver.Client, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	md, err := Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err := md.Folder(cfg.Mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var moveTo, reject *Folder
+	if f.MoveTo != "" {
+		if moveTo, err = md.Folder(f.MoveTo); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.RejectMailbox != "" {
+		if reject, err = md.Folder(cfg.RejectMailbox); err != nil {
+			return nil, err
+		}
+	}
+
+	idleFallbackInterval := cfg.IDLEFallbackInterval
+	if idleFallbackInterval == 0 {
+		idleFallbackInterval = 1 * time.Minute
+	}
+
+	fetchBufferSize := cfg.FetchBufferSize
+	if fetchBufferSize == 0 {
+		fetchBufferSize = 20
+	}
+
+	fetchMaxInterval := cfg.FetchMaxInterval
+	if fetchMaxInterval == 0 {
+		fetchMaxInterval = 5 * time.Minute
+	}
+
+	w, err := newWatcher(filepath.Join(folder.path, "new"), filepath.Join(folder.path, "cur"))
+	if err != nil && !errors.Is(err, errWatchUnsupported) {
+		logger.WithError(err).Warn("maildir_receiver_watch_failed")
+	}
+
+	r := &mailReceiver{
+		folder:        folder,
+		moveTo:        moveTo,
+		reject:        reject,
+		logger:        logger,
+		ackChannel:    make(chan ackRequest, fetchBufferSize),
+		healthChannel: make(chan delivery.Health, 1),
+		outChannel:    cfg.Channel,
+
+		idleFallbackInterval: idleFallbackInterval,
+		fetchBufferSize:      fetchBufferSize,
+		fetchMaxInterval:     fetchMaxInterval,
+		disableDeletions:     cfg.DisableDeletions,
+
+		watcher:  w,
+		messages: map[uint32]*message{},
+		keys:     map[string]uint32{},
+
+		hasQuit:  make(chan struct{}, 1),
+		wantQuit: make(chan struct{}, 1),
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *mailReceiver) Ack(UID uint32, error error) {
+	if UID == 0 {
+		return
+	}
+
+	r.ackChannel <- ackRequest{UID: UID, Error: error}
+}
+
+func (r *mailReceiver) SetDestinationHealth(health delivery.Health) {
+	delivery.SendHealth(r.healthChannel, health)
+}
+
+func withMessage(parent *log.Entry, msg *message) *log.Entry {
+	return parent.WithFields(log.Fields{
+		"uid":  msg.UID,
+		"path": msg.Path,
+	})
+}
+
+type entry struct {
+	Dir  string
+	Name string
+}
+
+// listMessages lists the messages in new/ and cur/, roughly in the order
+// they arrived.
+func (f *Folder) listMessages() ([]entry, error) {
+	var entries []entry
+	for _, dir := range []string{"new", "cur"} {
+		des, err := os.ReadDir(filepath.Join(f.path, dir))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, de := range des {
+			if !de.IsDir() && !strings.HasPrefix(de.Name(), ".") {
+				entries = append(entries, entry{Dir: dir, Name: de.Name()})
+			}
+		}
+	}
+
+	// Names start with the delivery time
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// find looks for a message by the unique part of its name.
+func (f *Folder) find(key string) (string, bool) {
+	entries, err := f.listMessages()
+	if err != nil {
+		return "", false
+	}
+
+	for _, e := range entries {
+		if e.Name == key || strings.HasPrefix(e.Name, key+infoSeparator) {
+			return filepath.Join(f.path, e.Dir, e.Name), true
+		}
+	}
+
+	return "", false
+}
+
+func readMessage(path string) ([]byte, time.Time, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Maildirs usually use LF, but IMAP wants CRLF
+	return archive.CRLF(body), st.ModTime(), nil
+}
+
+// scan passes on messages in the folder that haven't been already, up to
+// the fetch buffer size.
+func (r *mailReceiver) scan() error {
+	keywords, err := r.folder.loadKeywords()
+	if err != nil {
+		return err
+	}
+
+	entries, err := r.folder.listMessages()
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, msg := range r.messages {
+		if !msg.Acked && !msg.Failed {
+			pending++
+		}
+	}
+
+	r.more = false
+	seen := map[string]bool{}
+	for _, e := range entries {
+		path := filepath.Join(r.folder.path, e.Dir, e.Name)
+		key, info, _ := strings.Cut(e.Name, infoSeparator)
+		seen[key] = true
+
+		if uid, ok := r.keys[key]; ok {
+			// The flags may have changed
+			r.messages[uid].Path = path
+			continue
+		}
+
+		flags := ParseInfoFlags(info, keywords)
+		if slices.Contains(flags, imap.DeletedFlag) {
+			// Trashed, and waiting to be expunged
+			continue
+		}
+
+		if uint(pending) >= r.fetchBufferSize {
+			r.more = true
+			continue
+		}
+
+		body, date, err := readMessage(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// Renamed since, it'll be picked up next time
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		r.nextUID++
+		msg := &message{UID: r.nextUID, Key: key, Path: path}
+		r.messages[msg.UID] = msg
+		r.keys[key] = msg.UID
+		pending++
+
+		imsg := imap.NewMessage(msg.UID, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822})
+		imsg.Uid = msg.UID
+		imsg.Flags = flags
+		imsg.InternalDate = date
+		imsg.Body[rfc822Section] = bytes.NewBuffer(body)
+
+		withMessage(r.logger, msg).Info("maildir_receiver_message_fetched")
+		r.outChannel <- imsg
+	}
+
+	// Forget anything left be that's gone now
+	for uid, msg := range r.messages {
+		if msg.Failed && !seen[msg.Key] {
+			delete(r.messages, uid)
+			delete(r.keys, msg.Key)
+		}
+	}
+
+	return nil
+}
+
+func (r *mailReceiver) handleAck(req *ackRequest) {
+	e := r.logger.WithField("uid", req.UID)
+	if req.Error != nil {
+		e.WithError(req.Error).Warn("maildir_receiver_ack")
+	} else {
+		e.Info("maildir_receiver_ack")
+	}
+
+	msg, ok := r.messages[req.UID]
+	if !ok || msg.Acked || msg.Failed {
+		return
+	}
+
+	if req.Error != nil && (r.reject == nil || !delivery.IsPermanent(req.Error)) {
+		msg.Failed = true
+		return
+	}
+
+	if req.Error != nil {
+		e.WithField("reject_folder", r.reject.path).Info("maildir_receiver_message_rejected")
+		msg.Rejected = true
+	}
+
+	msg.Acked = true
+	r.process(msg)
+}
+
+// remove unlinks a message, or moves it to target. It keeps its name, and
+// whether it's in new/ or cur/.
+func remove(msg *message, target *Folder) error {
+	if target == nil {
+		return os.Remove(msg.Path)
+	}
+
+	dest := filepath.Join(target.path, filepath.Base(filepath.Dir(msg.Path)), filepath.Base(msg.Path))
+	return os.Rename(msg.Path, dest)
+}
+
+// process unlinks or moves an acknowledged message.
+func (r *mailReceiver) process(msg *message) {
+	if r.disableDeletions {
+		return
+	}
+
+	target := r.moveTo
+	if msg.Rejected {
+		target = r.reject
+	}
+
+	err := remove(msg, target)
+	if errors.Is(err, os.ErrNotExist) {
+		// It may have been renamed, e.g. from new/ to cur/
+		if path, ok := r.folder.find(msg.Key); ok {
+			msg.Path = path
+			err = remove(msg, target)
+		} else {
+			err = nil
+		}
+	}
+
+	if err != nil && msg.Rejected {
+		// Couldn't reject the message, leave it be
+		withMessage(r.logger, msg).WithError(err).Warn("maildir_receiver_message_rejection_failed")
+		msg.Acked = false
+		msg.Rejected = false
+		msg.Failed = true
+		return
+	} else if err != nil {
+		// Try again next time
+		withMessage(r.logger, msg).WithError(err).Info("maildir_receiver_message_deletion_failed")
+		return
+	}
+
+	withMessage(r.logger, msg).Info("maildir_receiver_message_deleted")
+	delete(r.messages, msg.UID)
+	delete(r.keys, msg.Key)
+}
+
+func (r *mailReceiver) run() {
+	var events <-chan struct{}
+	if r.watcher != nil {
+		events = r.watcher.Events()
+	}
+
+	pollInterval := func() time.Duration {
+		if events != nil {
+			return r.fetchMaxInterval
+		}
+		return r.idleFallbackInterval
+	}
+
+	fetchPaused := false
+	wantScan := true
+	nextPoll := time.Now().Add(pollInterval())
+
+	for {
+		if wantScan && !fetchPaused {
+			if err := r.scan(); err != nil {
+				r.logger.WithError(err).Warn("maildir_receiver_scan_failed")
+			} else {
+				wantScan = false
+			}
+		}
+
+		select {
+		case <-r.wantQuit:
+			goto done
+		case _, ok := <-events:
+			if !ok {
+				r.logger.Warn("maildir_receiver_watch_failed")
+				events = nil
+				nextPoll = time.Now().Add(pollInterval())
+			}
+			wantScan = true
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+			wantScan = wantScan || r.more
+		case health := <-r.healthChannel:
+			paused := health != delivery.HealthConnected
+			if paused != fetchPaused {
+				r.logger.WithField("health", health).Info("maildir_receiver_destination_health_changed")
+			}
+
+			// Catch up on anything we missed
+			wantScan = wantScan || (fetchPaused && !paused)
+			fetchPaused = paused
+		case <-time.After(time.Until(nextPoll)):
+			nextPoll = time.Now().Add(pollInterval())
+			wantScan = true
+
+			for _, msg := range r.messages {
+				if msg.Acked {
+					r.process(msg)
+				}
+			}
+		}
+	}
+
+done:
+	// Process any outstanding acks before leaving
+	for {
+		select {
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+			continue
+		default:
+		}
+		break
+	}
+
+	if r.watcher != nil {
+		_ = r.watcher.Close()
+	}
+
+	r.hasQuit <- struct{}{}
+}
+
+func (r *mailReceiver) Close() {
+	r.wantQuit <- struct{}{}
+	<-r.hasQuit
+}
@@ -0,0 +1,67 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewSink creates an ingest.Sink that delivers to a Maildir.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	md, err := Open(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sink{maildir: md, crlf: cfg.CRLF}, nil
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	folder, err := s.maildir.Folder(mailbox)
+	if errors.Is(err, ErrInvalidFolder) {
+		return &delivery.PermanentError{Err: err}
+	} else if err != nil {
+		return err
+	}
+
+	if !s.crlf {
+		body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	}
+
+	path, err := folder.Deliver(body, flags, date)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"mailbox": mailbox,
+		"path":    path,
+	}).Trace("maildir_delivered")
+	return nil
+}
+
+func (s *sink) Close() error {
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package maildir
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+)
+
+var (
+	ErrInvalidFolder = errors.New("invalid maildir folder")
+
+	errWatchUnsupported = errors.New("watching is unsupported on this platform")
+)
+
+type Config struct {
+	// Path is the root of the Maildir. It is created if it doesn't exist.
+	Path string
+
+	// CRLF, if set, keeps CRLF line endings in delivered messages.
+	// By default, they are converted to LF.
+	CRLF bool
+}
+
+// Maildir is a Maildir++ directory.
+type Maildir struct {
+	path string
+}
+
+// Folder is a single folder within a Maildir.
+type Folder struct {
+	path string
+}
+
+// ReceiverFactory creates receivers for a folder of a Maildir. Acknowledged
+// messages are unlinked, unless MoveTo is set.
+type ReceiverFactory struct {
+	// Path is the root of the Maildir.
+	Path string
+
+	// MoveTo, if set, is the folder acknowledged messages are moved to,
+	// instead of being unlinked.
+	MoveTo string
+}
+
+type sink struct {
+	maildir *Maildir
+	crlf    bool
+}
+
+// watcher notifies of new files in a set of directories.
+type watcher interface {
+	// Events receives a value whenever something changes. It is closed
+	// if the watcher fails.
+	Events() <-chan struct{}
+
+	Close() error
+}
+
+type ackRequest struct {
+	UID   uint32
+	Error error
+}
+
+// message is a message that has been passed on to the pump. It is tracked
+// by the unique part of its name, as the info may change underneath us.
+type message struct {
+	UID  uint32
+	Key  string
+	Path string
+
+	Acked bool
+	// Rejected is set if the message should be moved to
+	// the reject folder instead.
+	Rejected bool
+	// Failed is set if the message wasn't delivered, and is being left be.
+	Failed bool
+}
+
+type mailReceiver struct {
+	folder *Folder
+	moveTo *Folder
+	reject *Folder
+	logger *log.Entry
+
+	// external -> receiver, incoming acks
+	ackChannel chan ackRequest
+
+	// external -> receiver, destination health updates
+	healthChannel chan delivery.Health
+
+	// receiver -> external, message notifications
+	outChannel chan<- *imap.Message
+
+	idleFallbackInterval time.Duration
+	fetchBufferSize      uint
+	fetchMaxInterval     time.Duration
+	disableDeletions     bool
+
+	watcher  watcher
+	messages map[uint32]*message
+	keys     map[string]uint32
+	nextUID  uint32
+
+	// more is set if the last scan didn't get everything in the folder.
+	more bool
+
+	hasQuit  chan struct{}
+	wantQuit chan struct{}
+}
+
+type reader struct {
+	folder   *Folder
+	keywords []string
+	entries  []entry
+	next     int
+}
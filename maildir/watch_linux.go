@@ -0,0 +1,81 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+//go:build linux
+
+package maildir
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type inotifyWatcher struct {
+	file   *os.File
+	events chan struct{}
+}
+
+// newWatcher watches dirs for new files with inotify.
+func newWatcher(dirs ...string) (watcher, error) {
+	// Non-blocking, so the runtime poller is used and Close interrupts Read
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CREATE|unix.IN_MOVED_TO); err != nil {
+			_ = unix.Close(fd)
+			return nil, &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+	}
+
+	w := &inotifyWatcher{
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+	}
+
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) read() {
+	defer close(w.events)
+
+	// What changed doesn't matter, the folder is scanned anyway
+	buf := make([]byte, 4096)
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+
+		select {
+		case w.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (w *inotifyWatcher) Events() <-chan struct{} {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	return w.file.Close()
+}
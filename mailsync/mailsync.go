@@ -0,0 +1,597 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mailsync
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var peekSection = &imap.BodySectionName{Peek: true}
+
+// ParseConflictPolicy parses a conflict policy. An empty string is ConflictKeep.
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(strings.ToLower(s)); p {
+	case "":
+		return ConflictKeep, nil
+	case ConflictKeep, ConflictSource, ConflictDest:
+		return p, nil
+	default:
+		return "", ErrInvalidConflictPolicy
+	}
+}
+
+// highestModSeq returns the HIGHESTMODSEQ of a side's mailbox, or zero if
+// the server doesn't support CONDSTORE.
+func highestModSeq(side *Side) (uint64, error) {
+	caps, err := side.Client.Capability()
+	if err != nil {
+		return 0, err
+	}
+
+	if !caps["CONDSTORE"] {
+		return 0, nil
+	}
+
+	status, err := side.Client.Status(side.Mailbox, []imap.StatusItem{imap2.StatusHighestModSeq})
+	if err != nil {
+		return 0, err
+	}
+
+	modSeq, _ := imap2.HighestModSeq(status)
+	return modSeq, nil
+}
+
+// collectFlags adds the flags of each fetched message to a snapshot.
+func collectFlags(snap *snapshot, fetch func(ch chan *imap.Message) error) error {
+	ch := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() { done <- fetch(ch) }()
+
+	for msg := range ch {
+		snap.flags[msg.Uid] = normaliseFlags(msg.Flags)
+		if msg.Uid > snap.maxUID {
+			snap.maxUID = msg.Uid
+		}
+	}
+
+	return <-done
+}
+
+// takeSnapshot lists the messages in a side's mailbox, with their flags. If
+// the server supports CONDSTORE, and the mailbox hasn't changed since the
+// last sync (at mod-sequence since), only the messages changed since are
+// fetched. The rest are given their flags from known, or nil if they weren't
+// paired.
+func takeSnapshot(side *Side, validity uint32, since uint64, known map[uint32][]string) (*snapshot, error) {
+	// Before the fetch, so anything changed during it is fetched again next time
+	modSeq, err := highestModSeq(side)
+	if err != nil {
+		return nil, err
+	}
+
+	status, err := side.Client.Select(side.Mailbox, false)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{
+		uidValidity: status.UidValidity,
+		flags:       map[uint32][]string{},
+		modSeq:      modSeq,
+	}
+
+	if status.Messages == 0 {
+		return snap, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags}
+
+	// A lower HIGHESTMODSEQ means the mod-sequences were reset
+	if modSeq == 0 || since == 0 || modSeq < since || status.UidValidity != validity {
+		return snap, collectFlags(snap, func(ch chan *imap.Message) error {
+			return side.Client.Fetch(seqset, items, ch)
+		})
+	}
+
+	uids, err := side.Client.UidSearch(imap.NewSearchCriteria())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, uid := range uids {
+		snap.flags[uid] = known[uid]
+		if uid > snap.maxUID {
+			snap.maxUID = uid
+		}
+	}
+
+	if modSeq == since {
+		return snap, nil
+	}
+
+	return snap, collectFlags(snap, func(ch chan *imap.Message) error {
+		return side.Client.UidFetchChangedSince(seqset, items, since, ch)
+	})
+}
+
+// fetchHeaders fetches the flags, envelope, size and date of each message in a set.
+func fetchHeaders(c imap2.Client, seqset *imap.SeqSet) ([]*imap.Message, error) {
+	ch := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchEnvelope, imap.FetchRFC822Size, imap.FetchInternalDate}, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+	return msgs, nil
+}
+
+func messageID(msg *imap.Message) string {
+	if msg.Envelope == nil {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(msg.Envelope.MessageId), "<>")
+}
+
+// isCopy checks if msg is a copy of orig. Without a Message-ID, the size, date
+// and subject must match as well, otherwise any other message without one
+// would do.
+func isCopy(orig *imap.Message, msg *imap.Message) bool {
+	if id := messageID(orig); id != "" {
+		return messageID(msg) == id
+	}
+
+	if messageID(msg) != "" || msg.Size != orig.Size || !msg.InternalDate.Equal(orig.InternalDate) {
+		return false
+	}
+
+	return orig.Envelope != nil && msg.Envelope != nil && msg.Envelope.Subject == orig.Envelope.Subject
+}
+
+func storeFlags(c imap2.Client, uid uint32, from []string, to []string) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	add, remove := diffFlags(from, to)
+	if len(add) > 0 {
+		if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), add, nil); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.RemoveFlags, true), remove, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func deleteMessages(c imap2.Client, uids []uint32) error {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.DeletedFlag}, nil); err != nil {
+		return err
+	}
+
+	return c.Expunge(nil)
+}
+
+// copyMessage copies a message to the other side, and finds the copy by
+// looking for a new message with the same Message-ID, see isCopy. Returns a
+// zero UID if the copy couldn't be found, in which case the next sync will
+// pair them.
+func copyMessage(from *Side, to *Side, uid uint32, maxUID *uint32) (uint32, []string, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+
+	ch := make(chan *imap.Message, 1)
+	if err := from.Client.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchEnvelope, imap.FetchRFC822Size, peekSection.FetchItem()}, ch); err != nil {
+		return 0, nil, err
+	}
+
+	msg := <-ch
+	if msg == nil {
+		// Deleted since the snapshot, the next sync will handle it
+		return 0, nil, nil
+	}
+
+	msg.Flags = normaliseFlags(msg.Flags)
+
+	if err := ingest.IngestMessageSyncTimeout(from.Name, to.Mailbox, to.Ingest, msg, 0); err != nil {
+		return 0, nil, err
+	}
+
+	seqset = new(imap.SeqSet)
+	seqset.AddRange(*maxUID+1, 0)
+
+	msgs, err := fetchHeaders(to.Client, seqset)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var found *imap.Message
+	for _, m := range msgs {
+		// "n:*" always matches the last message, even if its UID is below n
+		if m.Uid <= *maxUID {
+			continue
+		}
+
+		if found == nil && isCopy(msg, m) {
+			found = m
+		}
+	}
+
+	for _, m := range msgs {
+		if m.Uid > *maxUID {
+			*maxUID = m.Uid
+		}
+	}
+
+	if found == nil {
+		return 0, nil, nil
+	}
+
+	return found.Uid, normaliseFlags(found.Flags), nil
+}
+
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sync synchronises the two sides once, updating the state. The state is
+// only ever updated to match what's been done, so it should be saved even
+// if an error is returned.
+func Sync(cfg *Config, state *State) (Stats, error) {
+	var stats Stats
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	policy := cfg.Conflict
+	if policy == "" {
+		policy = ConflictKeep
+	}
+
+	sides := [2]*Side{&cfg.Source, &cfg.Dest}
+	validity := [2]*uint32{&state.SourceUIDValidity, &state.DestUIDValidity}
+	modSeqs := [2]*uint64{&state.SourceModSeq, &state.DestModSeq}
+
+	// Unchanged messages still have the flags they were left with
+	known := [2]map[uint32][]string{{}, {}}
+	for _, p := range state.Pairs {
+		known[0][p.Source] = p.Flags
+		known[1][p.Dest] = p.Flags
+	}
+
+	var snaps [2]*snapshot
+	for i, side := range sides {
+		snap, err := takeSnapshot(side, *validity[i], *modSeqs[i], known[i])
+		if err != nil {
+			return stats, err
+		}
+
+		// Without any pairs, there's nothing to lose by starting again
+		if *validity[i] != 0 && *validity[i] != snap.uidValidity && len(state.Pairs) > 0 {
+			logger.WithFields(log.Fields{
+				"mailbox":          side.Mailbox,
+				"old_uid_validity": *validity[i],
+				"uid_validity":     snap.uidValidity,
+			}).Error("sync_uid_validity_changed")
+			return stats, ErrUIDValidityChanged
+		}
+		snaps[i] = snap
+	}
+
+	if len(state.Pairs) == 0 {
+		*validity[0] = snaps[0].uidValidity
+		*validity[1] = snaps[1].uidValidity
+	}
+
+	// Messages on both sides, or deleted from either
+	paired := [2]map[uint32]bool{{}, {}}
+	var deletes [2][]uint32
+	var kept []Pair
+
+	for _, p := range state.Pairs {
+		uids := [2]uint32{p.Source, p.Dest}
+
+		var flags [2][]string
+		var ok [2]bool
+		for i := range sides {
+			flags[i], ok[i] = snaps[i].flags[uids[i]]
+		}
+
+		if !ok[0] && !ok[1] {
+			continue
+		}
+
+		if ok[0] && ok[1] {
+			merged := mergeFlags(p.Flags, flags[0], flags[1])
+			for i, side := range sides {
+				if equalFlags(flags[i], merged) {
+					continue
+				}
+
+				if err := storeFlags(side.Client, uids[i], flags[i], merged); err != nil {
+					return stats, err
+				}
+				stats.Flagged++
+			}
+
+			p.Flags = merged
+			kept = append(kept, p)
+			paired[0][uids[0]] = true
+			paired[1][uids[1]] = true
+			continue
+		}
+
+		// Deleted from one side. If it was changed on the other, it may be
+		// kept, and is then copied back as if it were new.
+		other := 1
+		if ok[0] {
+			other = 0
+		}
+
+		keep := false
+		if !equalFlags(flags[other], p.Flags) {
+			stats.Conflicts++
+			switch policy {
+			case ConflictKeep:
+				keep = true
+			case ConflictSource:
+				keep = other == 0
+			case ConflictDest:
+				keep = other == 1
+			}
+
+			logger.WithFields(log.Fields{
+				"mailbox": sides[other].Mailbox,
+				"uid":     uids[other],
+				"keep":    keep,
+			}).Warn("sync_conflict")
+		}
+
+		if !keep {
+			deletes[other] = append(deletes[other], uids[other])
+			paired[other][uids[other]] = true
+		}
+	}
+
+	for i, side := range sides {
+		if len(deletes[i]) == 0 {
+			continue
+		}
+
+		if err := deleteMessages(side.Client, deletes[i]); err != nil {
+			return stats, err
+		}
+		stats.Deleted += len(deletes[i])
+	}
+
+	// Only now are the changes to the pairs done
+	state.Pairs = kept
+
+	// New messages on either side
+	var fresh [2][]*imap.Message
+	for i, side := range sides {
+		seqset := new(imap.SeqSet)
+		for uid := range snaps[i].flags {
+			if !paired[i][uid] {
+				seqset.AddNum(uid)
+			}
+		}
+
+		if seqset.Empty() {
+			continue
+		}
+
+		msgs, err := fetchHeaders(side.Client, seqset)
+		if err != nil {
+			return stats, err
+		}
+		fresh[i] = msgs
+	}
+
+	// Pair up new messages already on both sides, e.g. copies from a sync
+	// that was interrupted, or that copyMessage couldn't find. Messages
+	// without a Message-ID are all candidates for each other, see isCopy.
+	byID := map[string][]*imap.Message{}
+	for _, msg := range fresh[1] {
+		id := messageID(msg)
+		byID[id] = append(byID[id], msg)
+	}
+
+	matched := map[uint32]bool{}
+	var unmatched [2][]*imap.Message
+	for _, msg := range fresh[0] {
+		id := messageID(msg)
+		candidates := byID[id]
+
+		match := -1
+		for j, c := range candidates {
+			if isCopy(msg, c) {
+				match = j
+				break
+			}
+		}
+
+		if match < 0 {
+			unmatched[0] = append(unmatched[0], msg)
+			continue
+		}
+
+		dest := candidates[match]
+		byID[id] = append(candidates[:match:match], candidates[match+1:]...)
+		matched[dest.Uid] = true
+
+		msgs := [2]*imap.Message{msg, dest}
+		var flags [2][]string
+		for i := range msgs {
+			flags[i] = normaliseFlags(msgs[i].Flags)
+		}
+
+		// Neither side has a history, so keep every flag
+		merged := normaliseFlags(append(append([]string{}, flags[0]...), flags[1]...))
+		for i, side := range sides {
+			if equalFlags(flags[i], merged) {
+				continue
+			}
+
+			if err := storeFlags(side.Client, msgs[i].Uid, flags[i], merged); err != nil {
+				return stats, err
+			}
+			stats.Flagged++
+		}
+
+		state.Pairs = append(state.Pairs, Pair{Source: msg.Uid, Dest: dest.Uid, Flags: merged})
+		stats.Matched++
+	}
+
+	for _, msg := range fresh[1] {
+		if !matched[msg.Uid] {
+			unmatched[1] = append(unmatched[1], msg)
+		}
+	}
+
+	// Copy the rest
+	for i, side := range sides {
+		other := 1 - i
+
+		for _, msg := range unmatched[i] {
+			if stopped(cfg.Stop) {
+				return stats, ErrStopped
+			}
+
+			uid, flags, err := copyMessage(side, sides[other], msg.Uid, &snaps[other].maxUID)
+			if err != nil {
+				return stats, err
+			}
+			stats.Copied++
+
+			if uid == 0 {
+				logger.WithFields(log.Fields{
+					"mailbox": side.Mailbox,
+					"uid":     msg.Uid,
+				}).Warn("sync_copy_not_found")
+				continue
+			}
+
+			p := Pair{Flags: flags}
+			if i == 0 {
+				p.Source, p.Dest = msg.Uid, uid
+			} else {
+				p.Source, p.Dest = uid, msg.Uid
+			}
+			state.Pairs = append(state.Pairs, p)
+		}
+	}
+
+	// Only once everything's done, otherwise the changes missed would never
+	// be fetched again
+	for i := range sides {
+		*modSeqs[i] = snaps[i].modSeq
+	}
+
+	return stats, nil
+}
+
+// Run synchronises the two sides every Interval, until stopped. The state
+// is saved after each sync. It only returns early if the state can't be
+// saved, or if either side's UIDVALIDITY changes.
+func Run(cfg *Config) error {
+	interval := cfg.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	state, err := LoadState(cfg.State)
+	if err != nil {
+		return err
+	}
+
+	for {
+		start := time.Now()
+		stats, err := Sync(cfg, state)
+
+		if serr := SaveState(cfg.State, state); serr != nil {
+			return serr
+		}
+
+		fields := log.Fields{
+			"copied":    stats.Copied,
+			"matched":   stats.Matched,
+			"flagged":   stats.Flagged,
+			"deleted":   stats.Deleted,
+			"conflicts": stats.Conflicts,
+			"pairs":     len(state.Pairs),
+			"elapsed":   time.Since(start),
+		}
+
+		if errors.Is(err, ErrStopped) {
+			logger.WithFields(fields).Info("sync_stopped")
+			return nil
+		} else if errors.Is(err, ErrUIDValidityChanged) {
+			return err
+		} else if err != nil {
+			logger.WithError(err).WithFields(fields).Error("sync_failed")
+		} else {
+			logger.WithFields(fields).Info("sync_finished")
+		}
+
+		select {
+		case <-cfg.Stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,399 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mailsync
+
+import (
+	"bytes"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/internal/imaptest"
+)
+
+func TestMergeFlags(t *testing.T) {
+	base := []string{"\\Seen", "keep"}
+
+	// Added on one side, removed on the other
+	assert.Equal(t, []string{"\\Flagged", "keep"}, mergeFlags(base, []string{"\\Flagged", "\\Seen", "keep"}, []string{"keep"}))
+
+	// Changed the same way on both
+	assert.Equal(t, []string{"\\Answered", "\\Seen", "keep"}, mergeFlags(base, []string{"\\Answered", "\\Seen", "keep"}, []string{"\\Answered", "\\Seen", "keep"}))
+
+	// Unchanged
+	assert.Equal(t, []string{"\\Seen", "keep"}, mergeFlags(base, base, base))
+
+	assert.Equal(t, []string{"\\Seen"}, normaliseFlags([]string{"\\Recent", "\\Seen", "\\Seen"}))
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	for s, want := range map[string]ConflictPolicy{"": ConflictKeep, "keep": ConflictKeep, "Source": ConflictSource, "dest": ConflictDest} {
+		p, err := ParseConflictPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, p)
+	}
+
+	_, err := ParseConflictPolicy("newest")
+	assert.ErrorIs(t, err, ErrInvalidConflictPolicy)
+}
+
+func newSide(t *testing.T, addr string, name string) Side {
+	c := imaptest.Connect(t, addr)
+
+	ing, err := ingest.NewClient(&ingest.Config{ConnectionConfig: imaptest.ConnectionConfig(addr), Factory: client.Factory{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(ing.Close)
+
+	return Side{Client: c, Mailbox: "INBOX", Ingest: ing, Name: name}
+}
+
+// contents returns the flags of each message, by subject.
+func contents(t *testing.T, c imap2.Client) map[string][]string {
+	status, err := c.Select("INBOX", false)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	out := map[string][]string{}
+	if status.Messages == 0 {
+		return out
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+
+	ch := make(chan *imap.Message, status.Messages)
+	assert.NoError(t, c.Fetch(seqset, []imap.FetchItem{imap.FetchFlags, imap.FetchEnvelope}, ch))
+	for msg := range ch {
+		out[msg.Envelope.Subject] = normaliseFlags(msg.Flags)
+	}
+	return out
+}
+
+func appendMessage(t *testing.T, c imap2.Client, subject string, flags ...string) {
+	body := "Message-ID: <" + strings.ReplaceAll(subject, " ", "-") + "@example.com>\r\nSubject: " + subject + "\r\n\r\nbody\r\n"
+	assert.NoError(t, c.Append("INBOX", flags, time.Now(), bytes.NewBufferString(body)))
+}
+
+func modify(t *testing.T, c imap2.Client, subject string, item imap.FlagsOp, flags ...interface{}) {
+	_, err := c.Select("INBOX", false)
+	assert.NoError(t, err)
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Header.Set("Subject", subject)
+	uids, err := c.UidSearch(criteria)
+	if !assert.NoError(t, err) || !assert.Len(t, uids, 1) {
+		t.FailNow()
+	}
+
+	// Checked first, as UidStore converts the flags
+	expunge := item == imap.AddFlags && len(flags) == 1 && flags[0] == imap.DeletedFlag
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+	assert.NoError(t, c.UidStore(seqset, imap.FormatFlagsOp(item, true), flags, nil))
+
+	if expunge {
+		assert.NoError(t, c.Expunge(nil))
+	}
+}
+
+func TestSync(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	cfg := &Config{
+		Source: newSide(t, srcAddr, "src"),
+		Dest:   newSide(t, dstAddr, "dst"),
+		State:  filepath.Join(t.TempDir(), "state.json"),
+	}
+
+	src := newSide(t, srcAddr, "").Client
+	dst := newSide(t, dstAddr, "").Client
+
+	appendMessage(t, src, "one", imap.SeenFlag)
+	appendMessage(t, src, "two")
+	appendMessage(t, dst, "one", imap.AnsweredFlag)
+	appendMessage(t, dst, "three")
+
+	state := &State{}
+	sync := func(want Stats) {
+		stats, err := Sync(cfg, state)
+		assert.NoError(t, err)
+		assert.Equal(t, want, stats)
+		assert.NoError(t, SaveState(cfg.State, state))
+
+		// Both sides always agree afterwards
+		assert.Equal(t, contents(t, src), contents(t, dst))
+	}
+
+	// The copies of "one" are paired, the rest are copied
+	sync(Stats{Matched: 1, Flagged: 2, Copied: 2})
+	assert.Equal(t, map[string][]string{
+		"one":   {imap.AnsweredFlag, imap.SeenFlag},
+		"two":   {},
+		"three": {},
+	}, contents(t, src))
+
+	sync(Stats{})
+
+	// Flag changes go both ways
+	modify(t, src, "two", imap.AddFlags, imap.FlaggedFlag)
+	modify(t, dst, "one", imap.RemoveFlags, imap.SeenFlag)
+	sync(Stats{Flagged: 2})
+	assert.Equal(t, []string{imap.AnsweredFlag}, contents(t, src)["one"])
+	assert.Equal(t, []string{imap.FlaggedFlag}, contents(t, dst)["two"])
+
+	// So do deletions
+	modify(t, dst, "two", imap.AddFlags, imap.DeletedFlag)
+	sync(Stats{Deleted: 1})
+	assert.NotContains(t, contents(t, src), "two")
+
+	// A message deleted on one side and changed on the other is kept
+	modify(t, src, "three", imap.AddFlags, imap.DeletedFlag)
+	modify(t, dst, "three", imap.AddFlags, imap.SeenFlag)
+	sync(Stats{Conflicts: 1, Copied: 1})
+	assert.Equal(t, []string{imap.SeenFlag}, contents(t, src)["three"])
+
+	// Unless the policy says otherwise
+	cfg.Conflict = ConflictSource
+	modify(t, src, "three", imap.AddFlags, imap.DeletedFlag)
+	modify(t, dst, "three", imap.AddFlags, imap.FlaggedFlag)
+	sync(Stats{Conflicts: 1, Deleted: 1})
+	assert.Equal(t, map[string][]string{"one": {imap.AnsweredFlag}}, contents(t, dst))
+
+	loaded, err := LoadState(cfg.State)
+	assert.NoError(t, err)
+	assert.Equal(t, state, loaded)
+	assert.Len(t, loaded.Pairs, 1)
+}
+
+func TestSyncWithoutMessageID(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	cfg := &Config{
+		Source: newSide(t, srcAddr, "src"),
+		Dest:   newSide(t, dstAddr, "dst"),
+	}
+
+	src := newSide(t, srcAddr, "").Client
+	dst := newSide(t, dstAddr, "").Client
+
+	// What's left when copyMessage can't find the copy: the same message on
+	// both sides, without a pair
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, c := range []imap2.Client{src, dst} {
+		assert.NoError(t, c.Append("INBOX", nil, date, bytes.NewBufferString("Subject: copied\r\n\r\nbody\r\n")))
+	}
+
+	// A different message without a Message-ID isn't a copy
+	assert.NoError(t, dst.Append("INBOX", nil, date, bytes.NewBufferString("Subject: other\r\n\r\nbody\r\n")))
+
+	state := &State{}
+	stats, err := Sync(cfg, state)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{Matched: 1, Copied: 1}, stats)
+	assert.Equal(t, []Pair{{Source: 1, Dest: 1, Flags: []string{}}}, state.Pairs[:1])
+
+	stats, err = Sync(cfg, state)
+	assert.NoError(t, err)
+	assert.Equal(t, Stats{}, stats)
+	assert.Len(t, contents(t, src), 2)
+	assert.Len(t, contents(t, dst), 2)
+}
+
+// modSeqs fakes the mod-sequences of a server's messages, as the memory
+// backend doesn't support CONDSTORE. Only changes made through a
+// condstoreClient are counted.
+type modSeqs struct {
+	highest uint64
+	uids    map[uint32]uint64
+}
+
+// condstoreClient adds CONDSTORE to a client, using the mod-sequences from
+// modSeqs.
+type condstoreClient struct {
+	imap2.Client
+	seqs *modSeqs
+
+	fetches      int
+	changedSince []uint64
+}
+
+func (c *condstoreClient) Capability() (map[string]bool, error) {
+	caps, err := c.Client.Capability()
+	if err != nil {
+		return nil, err
+	}
+
+	caps["CONDSTORE"] = true
+	return caps, nil
+}
+
+func (c *condstoreClient) Status(name string, _ []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status := imap.NewMailboxStatus(name, nil)
+	status.Items[imap2.StatusHighestModSeq] = strconv.FormatUint(c.seqs.highest, 10)
+	return status, nil
+}
+
+func (c *condstoreClient) Fetch(seqset *imap.SeqSet, items []imap.FetchItem, ch chan *imap.Message) error {
+	c.fetches++
+	return c.Client.Fetch(seqset, items, ch)
+}
+
+func (c *condstoreClient) UidStore(seqset *imap.SeqSet, item imap.StoreItem, value interface{}, ch chan *imap.Message) error {
+	if err := c.Client.UidStore(seqset, item, value, ch); err != nil {
+		return err
+	}
+
+	c.seqs.highest++
+	for _, seq := range seqset.Set {
+		for uid := seq.Start; uid <= seq.Stop; uid++ {
+			c.seqs.uids[uid] = c.seqs.highest
+		}
+	}
+	return nil
+}
+
+func (c *condstoreClient) UidFetchChangedSince(_ *imap.SeqSet, items []imap.FetchItem, modSeq uint64, ch chan *imap.Message) error {
+	c.changedSince = append(c.changedSince, modSeq)
+
+	seqset := new(imap.SeqSet)
+	for uid, seq := range c.seqs.uids {
+		if seq > modSeq {
+			seqset.AddNum(uid)
+		}
+	}
+
+	if seqset.Empty() {
+		close(ch)
+		return nil
+	}
+
+	return c.Client.UidFetch(seqset, items, ch)
+}
+
+func TestSyncCondStore(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	srcSeqs := &modSeqs{highest: 1, uids: map[uint32]uint64{}}
+	dstSeqs := &modSeqs{highest: 1, uids: map[uint32]uint64{}}
+
+	cfg := &Config{
+		Source: newSide(t, srcAddr, "src"),
+		Dest:   newSide(t, dstAddr, "dst"),
+		State:  filepath.Join(t.TempDir(), "state.json"),
+	}
+
+	srcSide := &condstoreClient{Client: cfg.Source.Client, seqs: srcSeqs}
+	dstSide := &condstoreClient{Client: cfg.Dest.Client, seqs: dstSeqs}
+	cfg.Source.Client = srcSide
+	cfg.Dest.Client = dstSide
+
+	src := &condstoreClient{Client: newSide(t, srcAddr, "").Client, seqs: srcSeqs}
+	dst := &condstoreClient{Client: newSide(t, dstAddr, "").Client, seqs: dstSeqs}
+
+	appendMessage(t, src, "one", imap.SeenFlag)
+	appendMessage(t, src, "two")
+	appendMessage(t, dst, "three")
+
+	state := &State{}
+	sync := func(want Stats) {
+		stats, err := Sync(cfg, state)
+		assert.NoError(t, err)
+		assert.Equal(t, want, stats)
+		assert.Equal(t, contents(t, src), contents(t, dst))
+	}
+
+	// Nothing to go on yet, so everything's fetched
+	sync(Stats{Copied: 3})
+	assert.Equal(t, 1, srcSide.fetches)
+	assert.Equal(t, 1, dstSide.fetches)
+	assert.Equal(t, uint64(1), state.SourceModSeq)
+	assert.Equal(t, uint64(1), state.DestModSeq)
+
+	// Then only what's changed
+	modify(t, src, "two", imap.AddFlags, imap.FlaggedFlag)
+	modify(t, dst, "one", imap.RemoveFlags, imap.SeenFlag)
+	sync(Stats{Flagged: 2})
+	assert.Equal(t, []string{imap.FlaggedFlag}, contents(t, dst)["two"])
+	assert.Equal(t, []string{}, contents(t, src)["one"])
+	assert.Equal(t, []uint64{1}, srcSide.changedSince)
+	assert.Equal(t, []uint64{1}, dstSide.changedSince)
+
+	// Deletions are still found
+	modify(t, dst, "three", imap.AddFlags, imap.DeletedFlag)
+	sync(Stats{Deleted: 1})
+	assert.NotContains(t, contents(t, src), "three")
+	assert.Equal(t, 1, srcSide.fetches)
+	assert.Equal(t, 1, dstSide.fetches)
+
+	// The last sync's own changes are fetched again, but change nothing
+	sync(Stats{})
+	assert.Equal(t, dstSeqs.highest, state.DestModSeq)
+
+	loaded := state.DestModSeq
+	assert.NoError(t, SaveState(cfg.State, state))
+	saved, err := LoadState(cfg.State)
+	assert.NoError(t, err)
+	assert.Equal(t, loaded, saved.DestModSeq)
+
+	// The mod-sequences going backwards means they were reset
+	dstSeqs.highest = 1
+	sync(Stats{})
+	assert.Equal(t, 2, dstSide.fetches)
+	assert.Equal(t, uint64(1), state.DestModSeq)
+}
+
+func TestCopyMessageWithoutMessageID(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	src := newSide(t, srcAddr, "src")
+	dst := newSide(t, dstAddr, "dst")
+
+	date := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, src.Client.Append("INBOX", nil, date, bytes.NewBufferString("Subject: copied\r\n\r\nbody\r\n")))
+
+	// Another message without a Message-ID, that arrived during the sync
+	assert.NoError(t, dst.Client.Append("INBOX", nil, date, bytes.NewBufferString("Subject: other\r\n\r\nbody\r\n")))
+
+	_, err := src.Client.Select("INBOX", false)
+	assert.NoError(t, err)
+	_, err = dst.Client.Select("INBOX", false)
+	assert.NoError(t, err)
+
+	maxUID := uint32(0)
+	uid, _, err := copyMessage(&src, &dst, 1, &maxUID)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), uid)
+	assert.Equal(t, uint32(2), maxUID)
+}
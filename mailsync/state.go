@@ -0,0 +1,138 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mailsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"git.vs49688.net/zane/mailpump/internal/fsutil"
+)
+
+// LoadState reads the state file. A missing file is an empty state.
+func LoadState(path string) (*State, error) {
+	state := &State{}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// SaveState replaces the state file.
+func SaveState(path string, state *State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fsutil.WriteFileAtomic(path, append(data, '\n'))
+}
+
+// normaliseFlags sorts flags and drops duplicates and \Recent, which can't be
+// set by a client.
+func normaliseFlags(flags []string) []string {
+	seen := map[string]bool{}
+	out := []string{}
+	for _, f := range flags {
+		if strings.EqualFold(f, imap.RecentFlag) || seen[f] {
+			continue
+		}
+		seen[f] = true
+		out = append(out, f)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+func flagSet(flags []string) map[string]bool {
+	set := make(map[string]bool, len(flags))
+	for _, f := range flags {
+		set[f] = true
+	}
+	return set
+}
+
+func equalFlags(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeFlags merges the changes made on each side since the last sync. Each
+// flag is merged separately. If the sides disagree, only one of them
+// changed it, and that change wins.
+func mergeFlags(base []string, a []string, b []string) []string {
+	inBase, inA, inB := flagSet(base), flagSet(a), flagSet(b)
+
+	var merged []string
+	for _, flags := range [][]string{base, a, b} {
+		for _, f := range flags {
+			keep := inA[f]
+			if inA[f] != inB[f] {
+				keep = !inBase[f]
+			}
+
+			if keep {
+				merged = append(merged, f)
+			}
+		}
+	}
+
+	return normaliseFlags(merged)
+}
+
+// diffFlags returns the flags to add and remove to go from one set to another.
+func diffFlags(from []string, to []string) ([]interface{}, []interface{}) {
+	inFrom, inTo := flagSet(from), flagSet(to)
+
+	var add, remove []interface{}
+	for _, f := range to {
+		if !inFrom[f] {
+			add = append(add, f)
+		}
+	}
+	for _, f := range from {
+		if !inTo[f] {
+			remove = append(remove, f)
+		}
+	}
+
+	return add, remove
+}
@@ -0,0 +1,140 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mailsync
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrUIDValidityChanged    = errors.New("uidvalidity changed, the sync state must be reset")
+	ErrInvalidConflictPolicy = errors.New("invalid conflict policy")
+	ErrStopped               = errors.New("stopped")
+)
+
+// ConflictPolicy decides what happens to a message that was deleted on one
+// side, but had its flags changed on the other.
+type ConflictPolicy string
+
+const (
+	// ConflictKeep keeps the changed message, copying it back to the side
+	// it was deleted from. Nothing is ever lost.
+	ConflictKeep ConflictPolicy = "keep"
+
+	// ConflictSource does what the source did.
+	ConflictSource ConflictPolicy = "source"
+
+	// ConflictDest does what the dest did.
+	ConflictDest ConflictPolicy = "dest"
+)
+
+// Side is one of the two mailboxes being synchronised.
+type Side struct {
+	// Client is used to list, flag, and delete messages.
+	Client imap2.Client
+
+	// Mailbox is the mailbox to synchronise. It's opened read-write.
+	Mailbox string
+
+	// Ingest appends the messages copied from the other side.
+	Ingest ingest.Client
+
+	// Name identifies the side. It's passed to the other side as the source
+	// of the messages copied from this one.
+	Name string
+}
+
+type Config struct {
+	Source Side
+	Dest   Side
+
+	// State is the file the state is kept in between syncs.
+	State string
+
+	// Conflict defaults to ConflictKeep.
+	Conflict ConflictPolicy
+
+	// Interval is the time between syncs. Defaults to 1 minute.
+	Interval time.Duration
+
+	// Stop, if closed, stops Run after the current sync.
+	Stop <-chan struct{}
+
+	Logger *log.Entry
+}
+
+// Pair links the copies of a message on each side.
+type Pair struct {
+	Source uint32 `json:"source"`
+	Dest   uint32 `json:"dest"`
+
+	// Flags are the flags of both copies after the last sync. Changes are
+	// found by comparing each side against them.
+	Flags []string `json:"flags"`
+}
+
+// State is what's remembered between syncs.
+type State struct {
+	SourceUIDValidity uint32 `json:"source_uid_validity"`
+	DestUIDValidity   uint32 `json:"dest_uid_validity"`
+
+	// SourceModSeq and DestModSeq are each side's HIGHESTMODSEQ as of the
+	// last sync. If the server supports CONDSTORE, only the messages changed
+	// since are fetched. Zero if it doesn't.
+	SourceModSeq uint64 `json:"source_mod_seq,omitempty"`
+	DestModSeq   uint64 `json:"dest_mod_seq,omitempty"`
+
+	Pairs []Pair `json:"pairs"`
+}
+
+// Stats are the results of a sync.
+type Stats struct {
+	// Copied is the number of messages copied to the other side.
+	Copied int
+
+	// Matched is the number of new messages on both sides that were paired
+	// up, rather than copied.
+	Matched int
+
+	// Flagged is the number of messages whose flags were changed.
+	Flagged int
+
+	// Deleted is the number of messages deleted.
+	Deleted int
+
+	// Conflicts is the number of messages deleted on one side and changed
+	// on the other.
+	Conflicts int
+}
+
+// snapshot is the flags of every message in a mailbox.
+type snapshot struct {
+	uidValidity uint32
+	flags       map[uint32][]string
+	maxUID      uint32
+
+	// modSeq is the HIGHESTMODSEQ before the flags were fetched, or zero
+	// if the mailbox doesn't support CONDSTORE.
+	modSeq uint64
+}
@@ -0,0 +1,76 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const (
+	// dotlockTimeout is how long to wait for a dotlock.
+	dotlockTimeout = 30 * time.Second
+
+	// dotlockStale is the age at which a dotlock is assumed to be
+	// left over from a crash, and is removed.
+	dotlockStale = 5 * time.Minute
+
+	dotlockRetryInterval = 100 * time.Millisecond
+)
+
+func (t LockType) fcntl() bool {
+	return t == LockBoth || t == LockFcntl
+}
+
+func (t LockType) dotlock() bool {
+	return t == LockBoth || t == LockDotlock
+}
+
+// acquireDotlock creates path.lock, waiting for any existing one to be removed.
+func acquireDotlock(path string) error {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(dotlockTimeout)
+
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			return f.Close()
+		}
+
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		if st, err := os.Stat(lockPath); err == nil && time.Since(st.ModTime()) > dotlockStale {
+			_ = os.Remove(lockPath)
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return ErrLockTimeout
+		}
+
+		time.Sleep(dotlockRetryInterval)
+	}
+}
+
+func releaseDotlock(path string) error {
+	return os.Remove(path + ".lock")
+}
@@ -0,0 +1,77 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+)
+
+// fromQuoteRegexp matches lines that need quoting, as per mboxrd.
+var fromQuoteRegexp = regexp.MustCompile(`^>*From `)
+
+// envelopeSender extracts the sender for the "From " line from the
+// Return-Path header.
+func envelopeSender(body []byte) string {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return "MAILER-DAEMON"
+	}
+
+	sender := strings.Trim(strings.TrimSpace(hdr.Get("Return-Path")), "<>")
+	if sender == "" || strings.ContainsAny(sender, " \t") {
+		return "MAILER-DAEMON"
+	}
+
+	return sender
+}
+
+// Format formats a raw message as an mboxrd entry, including the "From " line
+// and trailing blank line. Line endings are converted to LF.
+func Format(body []byte, date time.Time) []byte {
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	out := new(bytes.Buffer)
+	out.WriteString("From ")
+	out.WriteString(envelopeSender(body))
+	out.WriteByte(' ')
+	out.WriteString(date.UTC().Format(time.ANSIC))
+	out.WriteByte('\n')
+
+	body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	body = bytes.TrimSuffix(body, []byte("\n"))
+
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if fromQuoteRegexp.Match(line) {
+			out.WriteByte('>')
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+
+	out.WriteByte('\n')
+	return out.Bytes()
+}
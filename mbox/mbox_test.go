@@ -0,0 +1,222 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/assert"
+)
+
+var testDate = time.Date(2016, 5, 11, 14, 31, 59, 0, time.UTC)
+
+const testMessage = "Return-Path: <sender@example.com>\r\n" +
+	"From: from@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"From the start\r\n" +
+	">From a reply\r\n" +
+	"Not From here\r\n"
+
+const testEntry = "From sender@example.com Wed May 11 14:31:59 2016\n" +
+	"Return-Path: <sender@example.com>\n" +
+	"From: from@example.com\n" +
+	"Subject: Test\n" +
+	"\n" +
+	">From the start\n" +
+	">>From a reply\n" +
+	"Not From here\n" +
+	"\n"
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, testEntry, string(Format([]byte(testMessage), testDate)))
+
+	entry := string(Format([]byte("Subject: Test\r\n\r\nHello"), testDate))
+	assert.Equal(t, "From MAILER-DAEMON Wed May 11 14:31:59 2016\nSubject: Test\n\nHello\n\n", entry)
+}
+
+func TestFileName(t *testing.T) {
+	tests := []struct {
+		mailbox  string
+		expected string
+	}{
+		{mailbox: "", expected: "INBOX"},
+		{mailbox: "inbox", expected: "INBOX"},
+		{mailbox: "Archive", expected: "Archive"},
+		{mailbox: "Lists/Go", expected: "Lists.Go"},
+		{mailbox: "../../etc/passwd", expected: "etc.passwd"},
+	}
+
+	for _, tt := range tests {
+		name, err := FileName(tt.mailbox)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, name)
+	}
+
+	_, err := FileName("/../")
+	assert.ErrorIs(t, err, ErrInvalidMailbox)
+}
+
+func TestSink(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := NewSink(&Config{Path: dir})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Deliver("INBOX", nil, testDate, []byte(testMessage)))
+	assert.NoError(t, s.Deliver("INBOX", nil, testDate, []byte(testMessage)))
+
+	data, err := os.ReadFile(filepath.Join(dir, "INBOX"))
+	assert.NoError(t, err)
+	assert.Equal(t, testEntry+testEntry, string(data))
+
+	_, err = os.Stat(filepath.Join(dir, "INBOX.lock"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Archive")
+
+	t.Run("size", func(t *testing.T) {
+		s, err := NewSink(&Config{Path: dir, RotateSize: int64(len(testEntry)) + 1, Gzip: true})
+		assert.NoError(t, err)
+
+		assert.NoError(t, s.Deliver("Archive", nil, testDate, []byte(testMessage)))
+		assert.NoError(t, s.Deliver("Archive", nil, testDate, []byte(testMessage)))
+
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		assert.Equal(t, testEntry, string(data))
+
+		matches, err := filepath.Glob(path + ".*.gz")
+		assert.NoError(t, err)
+		assert.Len(t, matches, 1)
+
+		f, err := os.Open(matches[0])
+		assert.NoError(t, err)
+		defer f.Close()
+
+		r, err := gzip.NewReader(f)
+		assert.NoError(t, err)
+		data, err = io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, testEntry, string(data))
+	})
+
+	t.Run("monthly", func(t *testing.T) {
+		s, err := NewSink(&Config{Path: dir, RotateMonthly: true})
+		assert.NoError(t, err)
+
+		assert.NoError(t, os.Chtimes(path, testDate, testDate))
+		assert.NoError(t, s.Deliver("Archive", nil, testDate, []byte(testMessage)))
+
+		data, err := os.ReadFile(path + ".2016-05")
+		assert.NoError(t, err)
+		assert.Equal(t, testEntry, string(data))
+	})
+}
+
+func TestInvalidLockType(t *testing.T) {
+	_, err := NewSink(&Config{Path: t.TempDir(), Lock: "invalid"})
+	assert.ErrorIs(t, err, ErrInvalidLockType)
+}
+
+func TestReader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "archive.mbox")
+
+	flagged := "From sender@example.com Thu May 12 09:00:00 2016 +0200\n" +
+		"Subject: Flagged\n" +
+		"Status: RO\n" +
+		"X-Status: AF\n" +
+		"X-Keywords: $Label1, Important\n" +
+		"\n" +
+		"Hello\n" +
+		"\n"
+
+	assert.NoError(t, os.WriteFile(path, []byte("\n"+testEntry+flagged), 0600))
+
+	r, err := NewReader(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer r.Close()
+
+	msg, err := r.Next()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "1", msg.Key)
+		assert.True(t, testDate.Equal(msg.Date))
+		assert.Equal(t, testMessage, string(msg.Body))
+		assert.Empty(t, msg.Flags)
+	}
+
+	msg, err = r.Next()
+	if assert.NoError(t, err) {
+		assert.Equal(t, fmt.Sprint(1+len(testEntry)), msg.Key)
+		assert.True(t, time.Date(2016, 5, 12, 7, 0, 0, 0, time.UTC).Equal(msg.Date))
+		assert.True(t, strings.HasSuffix(string(msg.Body), "\r\n\r\nHello\r\n"))
+		assert.Equal(t, []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, "$Label1", "Important"}, msg.Flags)
+	}
+
+	_, err = r.Next()
+	assert.ErrorIs(t, err, io.EOF)
+
+	t.Run("gzip", func(t *testing.T) {
+		f, err := os.Create(path + ".gz")
+		assert.NoError(t, err)
+		w := gzip.NewWriter(f)
+		_, _ = w.Write([]byte(testEntry))
+		assert.NoError(t, w.Close())
+		assert.NoError(t, f.Close())
+
+		r, err := NewReader(path + ".gz")
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer r.Close()
+
+		msg, err := r.Next()
+		if assert.NoError(t, err) {
+			assert.Equal(t, testMessage, string(msg.Body))
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.NoError(t, os.WriteFile(path, []byte("Subject: Not an mbox\n"), 0600))
+
+		r, err := NewReader(path)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer r.Close()
+
+		_, err = r.Next()
+		assert.ErrorIs(t, err, ErrNotMbox)
+	})
+}
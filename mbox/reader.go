@@ -0,0 +1,219 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"git.vs49688.net/zane/mailpump/archive"
+)
+
+// fromDateLayouts are the date formats seen in "From " lines, after the sender.
+var fromDateLayouts = []string{
+	time.ANSIC,
+	"Mon Jan _2 15:04:05 2006 -0700",
+	"Mon Jan _2 15:04:05 -0700 2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+}
+
+// statusFlags maps the letters of the Status and X-Status headers, as written
+// by mutt and others, to IMAP flags.
+var statusFlags = map[byte]string{
+	'R': imap.SeenFlag,
+	'A': imap.AnsweredFlag,
+	'F': imap.FlaggedFlag,
+	'T': imap.DraftFlag,
+	'D': imap.DeletedFlag,
+}
+
+// NewReader reads the messages from an mbox file, which may be gzipped. Each
+// message is keyed by its offset in the (uncompressed) file, and dated by its
+// "From " line.
+func NewReader(path string) (archive.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{closer: f, r: bufio.NewReader(f)}
+
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		r.r = bufio.NewReader(gz)
+	}
+
+	return r, nil
+}
+
+func (r *reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadBytes('\n')
+	r.offset += int64(len(line))
+	return line, err
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+// start finds the first message, allowing for blank lines before it.
+func (r *reader) start() error {
+	r.started = true
+
+	for {
+		offset := r.offset
+		line, err := r.readLine()
+		if isFromLine(line) {
+			r.from, r.fromOffset = line, offset
+			return nil
+		}
+
+		if len(bytes.TrimSpace(line)) != 0 {
+			return ErrNotMbox
+		}
+
+		if errors.Is(err, io.EOF) {
+			return io.EOF
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (r *reader) Next() (*archive.Message, error) {
+	if !r.started {
+		if err := r.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.from == nil {
+		return nil, io.EOF
+	}
+
+	from, offset := r.from, r.fromOffset
+	r.from = nil
+
+	var body bytes.Buffer
+	for {
+		lineOffset := r.offset
+		line, err := r.readLine()
+		if isFromLine(line) {
+			r.from, r.fromOffset = line, lineOffset
+			break
+		}
+
+		// Undo the mboxrd quoting
+		if fromQuoteRegexp.Match(line) && line[0] == '>' {
+			line = line[1:]
+		}
+		body.Write(line)
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	// The blank line before the next "From " line isn't part of the message
+	data := body.Bytes()
+	if bytes.HasSuffix(data, []byte("\r\n\r\n")) {
+		data = data[:len(data)-2]
+	} else if bytes.HasSuffix(data, []byte("\n\n")) {
+		data = data[:len(data)-1]
+	}
+
+	date := parseFromDate(from)
+	if date.IsZero() {
+		date = archive.HeaderDate(data)
+	}
+
+	return &archive.Message{
+		Key:   strconv.FormatInt(offset, 10),
+		Flags: parseStatusFlags(data),
+		Date:  date,
+		Body:  archive.CRLF(data),
+	}, nil
+}
+
+func (r *reader) Close() error {
+	return r.closer.Close()
+}
+
+// parseFromDate parses the date of a "From " line, e.g.
+// "From sender@example.com Wed May 11 14:31:59 2016". The zero time is
+// returned if it can't be parsed.
+func parseFromDate(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 3 {
+		return time.Time{}
+	}
+
+	date := strings.Join(fields[2:], " ")
+	for _, layout := range fromDateLayouts {
+		if t, err := time.ParseInLocation(layout, date, time.UTC); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// parseStatusFlags reads the flags from the Status, X-Status, and X-Keywords
+// headers.
+func parseStatusFlags(body []byte) []string {
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err != nil {
+		return nil
+	}
+
+	var flags []string
+	seen := map[string]bool{}
+	add := func(flag string) {
+		if flag != "" && !seen[flag] {
+			seen[flag] = true
+			flags = append(flags, flag)
+		}
+	}
+
+	status := hdr.Get("Status") + hdr.Get("X-Status")
+	for i := 0; i < len(status); i++ {
+		add(statusFlags[status[i]])
+	}
+
+	for _, kw := range strings.FieldsFunc(hdr.Get("X-Keywords"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		add(kw)
+	}
+
+	return flags
+}
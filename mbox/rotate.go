@@ -0,0 +1,116 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rotateSuffix checks if a file needs rotating before size bytes are written
+// to it, returning the suffix to rotate it to.
+func (s *sink) rotateSuffix(st os.FileInfo, size int, now time.Time) (string, bool) {
+	if st.Size() == 0 {
+		return "", false
+	}
+
+	if s.rotateMonthly {
+		mtime := st.ModTime()
+		if mtime.Year() != now.Year() || mtime.Month() != now.Month() {
+			return mtime.Format("2006-01"), true
+		}
+	}
+
+	if s.rotateSize > 0 && st.Size()+int64(size) > s.rotateSize {
+		return now.Format("20060102T150405"), true
+	}
+
+	return "", false
+}
+
+// rotate moves a file out of the way, compressing it if needed.
+// The caller must hold the lock on it.
+func (s *sink) rotate(path string, suffix string) error {
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+
+	rotated := path + "." + suffix
+	for i := 1; exists(rotated) || exists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%v.%v.%d", path, suffix, i)
+	}
+
+	if err := os.Rename(path, rotated); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{"path": path, "rotated": rotated}).Info("mbox_rotated")
+
+	if !s.gzip {
+		return nil
+	}
+
+	if err := compressFile(rotated); err != nil {
+		// Not fatal, the file's been rotated anyway
+		log.WithError(err).WithField("path", rotated).Warn("mbox_compress_failed")
+	}
+
+	return nil
+}
+
+// compressFile compresses path to path.gz, removing the original.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	gzPath := path + ".gz"
+	out, err := os.OpenFile(gzPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := gzip.NewWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		_ = out.Close()
+		_ = os.Remove(gzPath)
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(gzPath)
+		return err
+	}
+
+	if err := out.Close(); err != nil {
+		_ = os.Remove(gzPath)
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,186 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewSink creates an ingest.Sink that appends to mbox files in a directory.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	lock := cfg.Lock
+	if lock == "" {
+		lock = LockBoth
+	}
+
+	switch lock {
+	case LockBoth, LockFcntl, LockDotlock, LockNone:
+	default:
+		return nil, ErrInvalidLockType
+	}
+
+	if err := os.MkdirAll(cfg.Path, 0700); err != nil {
+		return nil, err
+	}
+
+	return &sink{
+		path:          cfg.Path,
+		lock:          lock,
+		rotateSize:    cfg.RotateSize,
+		rotateMonthly: cfg.RotateMonthly,
+		gzip:          cfg.Gzip,
+	}, nil
+}
+
+// FileName converts a mailbox name to the name of its mbox file. INBOX, or an
+// empty name, is "INBOX". Hierarchy delimiters are converted to ".", so a
+// mailbox and its children can coexist. Relative components are dropped.
+func FileName(mailbox string) (string, error) {
+	if mailbox == "" || strings.EqualFold(mailbox, "INBOX") {
+		return "INBOX", nil
+	}
+
+	var parts []string
+	for _, p := range strings.FieldsFunc(mailbox, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if p != "." && p != ".." {
+			parts = append(parts, p)
+		}
+	}
+
+	if len(parts) == 0 {
+		return "", ErrInvalidMailbox
+	}
+
+	return strings.Join(parts, "."), nil
+}
+
+// openLocked opens and locks a file, making sure it hasn't been rotated
+// out from under us in the meantime.
+func (s *sink) openLocked(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.lock.fcntl() {
+			if err := fcntlLock(f); err != nil {
+				_ = f.Close()
+				return nil, err
+			}
+		}
+
+		fst, err := f.Stat()
+		if err != nil {
+			s.unlock(f)
+			return nil, err
+		}
+
+		if st, err := os.Stat(path); err == nil && os.SameFile(fst, st) {
+			return f, nil
+		}
+
+		s.unlock(f)
+	}
+}
+
+func (s *sink) unlock(f *os.File) {
+	if s.lock.fcntl() {
+		_ = fcntlUnlock(f)
+	}
+	_ = f.Close()
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	name, err := FileName(mailbox)
+	if err != nil {
+		return &delivery.PermanentError{Err: err}
+	}
+
+	path := filepath.Join(s.path, name)
+	entry := Format(body, date)
+
+	if s.lock.dotlock() {
+		if err := acquireDotlock(path); err != nil {
+			return err
+		}
+
+		defer func() {
+			if err := releaseDotlock(path); err != nil {
+				log.WithError(err).WithField("path", path).Warn("mbox_dotlock_release_failed")
+			}
+		}()
+	}
+
+	f, err := s.openLocked(path)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		s.unlock(f)
+		return err
+	}
+
+	if suffix, ok := s.rotateSuffix(st, len(entry), time.Now()); ok {
+		err := s.rotate(path, suffix)
+		s.unlock(f)
+		if err != nil {
+			return err
+		}
+
+		if f, err = s.openLocked(path); err != nil {
+			return err
+		}
+
+		if st, err = f.Stat(); err != nil {
+			s.unlock(f)
+			return err
+		}
+	}
+	defer s.unlock(f)
+
+	if _, err := f.Write(entry); err != nil {
+		// Don't leave a partial message behind
+		_ = f.Truncate(st.Size())
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"mailbox": mailbox,
+		"path":    path,
+	}).Trace("mbox_delivered")
+	return nil
+}
+
+func (s *sink) Close() error {
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package mbox
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+var (
+	ErrInvalidMailbox  = errors.New("invalid mbox mailbox name")
+	ErrInvalidLockType = errors.New("invalid mbox lock type")
+	ErrLockTimeout     = errors.New("timed out waiting for mbox lock")
+	ErrNotMbox         = errors.New("not an mbox file")
+)
+
+// LockType is the method used to lock an mbox file.
+type LockType string
+
+const (
+	LockBoth    LockType = "both"
+	LockFcntl   LockType = "fcntl"
+	LockDotlock LockType = "dotlock"
+	LockNone    LockType = "none"
+)
+
+type Config struct {
+	// Path is the directory containing the mbox files. It is created
+	// if it doesn't exist.
+	Path string
+
+	// Lock is how files are locked while being written. Defaults to LockBoth.
+	// fcntl locks are ignored on platforms that don't support them.
+	Lock LockType
+
+	// RotateSize, if non-zero, is the size at which a file is rotated.
+	RotateSize int64
+
+	// RotateMonthly, if set, rotates files at the start of each month.
+	RotateMonthly bool
+
+	// Gzip, if set, compresses rotated files.
+	Gzip bool
+}
+
+type sink struct {
+	path          string
+	lock          LockType
+	rotateSize    int64
+	rotateMonthly bool
+	gzip          bool
+}
+
+type reader struct {
+	closer io.Closer
+	r      *bufio.Reader
+	offset int64
+
+	// from is the "From " line of the next message, and fromOffset where it starts.
+	from       []byte
+	fromOffset int64
+	started    bool
+}
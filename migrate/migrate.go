@@ -0,0 +1,324 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package migrate
+
+import (
+	"errors"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/archive"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+)
+
+// listMailboxes lists every mailbox on a server.
+func listMailboxes(client imap2.Client) ([]*imap.MailboxInfo, error) {
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.List("", "*", ch)
+	}()
+
+	var mailboxes []*imap.MailboxInfo
+	for mbox := range ch {
+		mailboxes = append(mailboxes, mbox)
+	}
+
+	return mailboxes, <-done
+}
+
+func hasAttr(info *imap.MailboxInfo, attr string) bool {
+	for _, a := range info.Attributes {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+// MapFolder returns the destination of a folder. An exact mapping wins, then
+// the longest mapping of a parent.
+func MapFolder(folder string, mapping map[string]string) string {
+	if target, ok := mapping[folder]; ok {
+		return target
+	}
+
+	best := ""
+	for from := range mapping {
+		if strings.HasPrefix(folder, from+"/") && len(from) > len(best) {
+			best = from
+		}
+	}
+
+	if best == "" {
+		return folder
+	}
+
+	return mapping[best] + strings.TrimPrefix(folder, best)
+}
+
+func matchFolder(folder string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, folder); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ListFolders lists the folders to migrate, and where they're going, ordered
+// by path.
+func ListFolders(client imap2.Client, patterns []string, mapping map[string]string) ([]Folder, error) {
+	mailboxes, err := listMailboxes(client)
+	if err != nil {
+		return nil, err
+	}
+
+	var folders []Folder
+	for _, info := range mailboxes {
+		if hasAttr(info, imap.NoSelectAttr) || hasAttr(info, "\\NonExistent") {
+			continue
+		}
+
+		p := info.Name
+		if info.Delimiter != "" && info.Delimiter != "/" {
+			p = strings.ReplaceAll(p, info.Delimiter, "/")
+		}
+
+		if !matchFolder(p, patterns) {
+			continue
+		}
+
+		folders = append(folders, Folder{
+			Name:   info.Name,
+			Path:   p,
+			Target: MapFolder(p, mapping),
+		})
+	}
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Path < folders[j].Path })
+	return folders, nil
+}
+
+// createTargets creates any missing mailboxes on an IMAP destination, and
+// converts the targets to use its delimiter.
+func createTargets(dest imap2.Client, folders []Folder, logger *log.Entry) error {
+	mailboxes, err := listMailboxes(dest)
+	if err != nil {
+		return err
+	}
+
+	delimiter := "/"
+	existing := map[string]bool{"INBOX": true}
+	for _, info := range mailboxes {
+		if info.Delimiter != "" {
+			delimiter = info.Delimiter
+		}
+		existing[info.Name] = true
+	}
+
+	for i := range folders {
+		target := strings.ReplaceAll(folders[i].Target, "/", delimiter)
+		folders[i].Target = target
+
+		if existing[target] || strings.EqualFold(target, "INBOX") {
+			continue
+		}
+
+		logger.WithField("mailbox", target).Info("migrate_create_mailbox")
+		if err := dest.Create(target); err != nil {
+			return err
+		}
+		existing[target] = true
+	}
+
+	return nil
+}
+
+// stateKey identifies a folder in the state file. The date range is part of
+// it, as the last UID copied means nothing outside of the range.
+func (cfg *Config) stateKey(folder *Folder) string {
+	key := cfg.SourceName + "/" + folder.Path
+
+	q := url.Values{}
+	if !cfg.Since.IsZero() {
+		q.Set("since", cfg.Since.Format("2006-01-02"))
+	}
+	if !cfg.Before.IsZero() {
+		q.Set("before", cfg.Before.Format("2006-01-02"))
+	}
+
+	if len(q) > 0 {
+		key += "?" + q.Encode()
+	}
+	return key
+}
+
+// Migrate copies each folder on the source to the destination. Folders are
+// shared between the workers, and a failure in one doesn't stop the others.
+// A result is returned for each folder, in the order they were listed.
+func Migrate(cfg *Config) ([]Result, error) {
+	if len(cfg.Clients) == 0 {
+		return nil, ErrNoClients
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	connConfig := cfg.Source
+	connConfig.Mailbox = ""
+
+	client, err := cfg.Factory.NewClient(&imap2.ClientConfig{ConnectionConfig: connConfig})
+	if err != nil {
+		return nil, err
+	}
+
+	folders, err := ListFolders(client, cfg.Folders, cfg.Mapping)
+	_ = client.Logout()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(folders) == 0 {
+		return nil, ErrNoFolders
+	}
+
+	if cfg.Dest != nil {
+		if err := createTargets(cfg.Dest, folders, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.WithField("count", len(folders)).Info("migrate_started")
+
+	results := make([]Result, len(folders))
+	for i, folder := range folders {
+		results[i].Folder = folder
+	}
+
+	queue := make(chan int, len(results))
+	for i := range results {
+		queue <- i
+	}
+	close(queue)
+
+	var stopped bool
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, ing := range cfg.Clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var client imap2.Client
+			defer func() {
+				if client != nil {
+					_ = client.Logout()
+				}
+			}()
+
+			for i := range queue {
+				result := &results[i]
+
+				mu.Lock()
+				if stopped {
+					result.Err = archive.ErrStopped
+					mu.Unlock()
+					continue
+				}
+				mu.Unlock()
+
+				// Reconnect if the last folder lost the connection
+				if client != nil {
+					select {
+					case <-client.LoggedOut():
+						client = nil
+					default:
+					}
+				}
+
+				if client == nil {
+					c, err := cfg.Factory.NewClient(&imap2.ClientConfig{ConnectionConfig: connConfig})
+					if err != nil {
+						result.Err = err
+						logger.WithError(err).WithField("folder", result.Name).Error("migrate_connect_failed")
+						continue
+					}
+					client = c
+				}
+
+				folderLogger := logger.WithFields(log.Fields{
+					"folder": result.Name,
+					"target": result.Target,
+				})
+
+				result.ExportStats, result.Err = archive.Export(&archive.ExportConfig{
+					Client:        client,
+					Mailbox:       result.Name,
+					Ingest:        ing,
+					TargetMailbox: result.Target,
+					Source:        cfg.SourceName + "/" + result.Path,
+					State:         cfg.State,
+					Key:           cfg.stateKey(&result.Folder),
+					Since:         cfg.Since,
+					Before:        cfg.Before,
+					Delete:        cfg.Delete,
+					BatchSize:     cfg.BatchSize,
+					Stop:          cfg.Stop,
+					Logger:        folderLogger,
+				})
+
+				fields := log.Fields{
+					"copied":  result.Exported,
+					"skipped": result.Skipped,
+					"failed":  result.Failed,
+				}
+
+				if errors.Is(result.Err, archive.ErrStopped) {
+					mu.Lock()
+					stopped = true
+					mu.Unlock()
+				} else if result.Err != nil {
+					folderLogger.WithError(result.Err).WithFields(fields).Error("migrate_folder_failed")
+				} else {
+					folderLogger.WithFields(fields).Info("migrate_folder_finished")
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if stopped {
+		return results, archive.ErrStopped
+	}
+	return results, nil
+}
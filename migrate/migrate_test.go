@@ -0,0 +1,166 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package migrate
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/archive"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/internal/imaptest"
+)
+
+func TestMapFolder(t *testing.T) {
+	mapping := map[string]string{
+		"[Gmail]/Sent Mail": "Sent",
+		"Lists":             "Archive/Lists",
+		"Lists/Go":          "Go",
+	}
+
+	assert.Equal(t, "Sent", MapFolder("[Gmail]/Sent Mail", mapping))
+	assert.Equal(t, "Archive/Lists", MapFolder("Lists", mapping))
+	assert.Equal(t, "Archive/Lists/Rust", MapFolder("Lists/Rust", mapping))
+	assert.Equal(t, "Go", MapFolder("Lists/Go", mapping))
+	assert.Equal(t, "Go/Nuts", MapFolder("Lists/Go/Nuts", mapping))
+	assert.Equal(t, "Listserv", MapFolder("Listserv", mapping))
+	assert.Equal(t, "INBOX", MapFolder("INBOX", nil))
+}
+
+func subjects(t *testing.T, c imap2.Client, mailbox string) []string {
+	status, err := c.Select(mailbox, true)
+	if !assert.NoError(t, err) || status.Messages == 0 {
+		return nil
+	}
+
+	seqset := new(imap2.SeqSet)
+	seqset.AddRange(1, 0)
+
+	ch := make(chan *imap2.Message, status.Messages)
+	assert.NoError(t, c.Fetch(seqset, []imap2.FetchItem{"BODY.PEEK[HEADER.FIELDS (SUBJECT)]"}, ch))
+
+	var out []string
+	for msg := range ch {
+		for _, lit := range msg.Body {
+			b := new(bytes.Buffer)
+			_, _ = b.ReadFrom(lit)
+			out = append(out, string(bytes.TrimSpace(bytes.TrimPrefix(b.Bytes(), []byte("Subject: ")))))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestMigrate(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	src := imaptest.Connect(t, srcAddr)
+	dst := imaptest.Connect(t, dstAddr)
+
+	old := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	recent := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, mailbox := range []string{"Lists", "Lists/Go", "Sent"} {
+		assert.NoError(t, src.Create(mailbox))
+	}
+
+	for _, m := range []struct {
+		mailbox string
+		subject string
+		date    time.Time
+	}{
+		{"INBOX", "inbox", recent},
+		{"Lists/Go", "go", recent},
+		{"Lists/Go", "go-old", old},
+		{"Sent", "sent", recent},
+	} {
+		body := "Subject: " + m.subject + "\r\n\r\nbody\r\n"
+		assert.NoError(t, src.Append(m.mailbox, nil, m.date, bytes.NewBufferString(body)))
+	}
+
+	var clients []ingest.Client
+	for i := 0; i < 2; i++ {
+		ing, err := ingest.NewClient(&ingest.Config{ConnectionConfig: imaptest.ConnectionConfig(dstAddr), Factory: client.Factory{}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer ing.Close()
+		clients = append(clients, ing)
+	}
+
+	state, err := archive.OpenStateFile(filepath.Join(t.TempDir(), "state.json"))
+	assert.NoError(t, err)
+
+	cfg := &Config{
+		Source:     imaptest.ConnectionConfig(srcAddr),
+		Factory:    client.Factory{},
+		SourceName: "imap://username@src",
+		Clients:    clients,
+		Dest:       dst,
+		Folders:    []string{"INBOX", "Lists/*"},
+		Mapping:    map[string]string{"Lists": "Archive"},
+		Since:      time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		State:      state,
+	}
+
+	results, err := Migrate(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, []Result{
+		{Folder: Folder{Name: "INBOX", Path: "INBOX", Target: "INBOX"}, ExportStats: archive.ExportStats{Exported: 1}},
+		{Folder: Folder{Name: "Lists/Go", Path: "Lists/Go", Target: "Archive/Go"}, ExportStats: archive.ExportStats{Exported: 1}},
+	}, results)
+
+	assert.Equal(t, []string{"inbox"}, subjects(t, dst, "INBOX"))
+	assert.Equal(t, []string{"go"}, subjects(t, dst, "Archive/Go"))
+
+	// The source is untouched
+	assert.Equal(t, []string{"go", "go-old"}, subjects(t, src, "Lists/Go"))
+
+	// A second run resumes, and can delete what it copies
+	assert.NoError(t, src.Append("Lists/Go", nil, recent, bytes.NewBufferString("Subject: go-new\r\n\r\n")))
+	cfg.Delete = true
+
+	results, err = Migrate(cfg)
+	assert.NoError(t, err)
+	assert.Equal(t, archive.ExportStats{Skipped: 1}, results[0].ExportStats)
+	assert.Equal(t, archive.ExportStats{Exported: 1, Skipped: 1}, results[1].ExportStats)
+
+	assert.Equal(t, []string{"go", "go-new"}, subjects(t, dst, "Archive/Go"))
+	assert.Equal(t, []string{"go", "go-old"}, subjects(t, src, "Lists/Go"))
+}
+
+func TestMigrateNoFolders(t *testing.T) {
+	_, addr, _ := internal.BuildTestIMAPServer(t)
+
+	_, err := Migrate(&Config{
+		Source:  imaptest.ConnectionConfig(addr),
+		Factory: client.Factory{},
+		Clients: []ingest.Client{nil},
+		Folders: []string{"Missing"},
+	})
+	assert.ErrorIs(t, err, ErrNoFolders)
+}
@@ -0,0 +1,101 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package migrate
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/archive"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrNoClients = errors.New("no ingest clients")
+	ErrNoFolders = errors.New("no folders to migrate")
+)
+
+type Config struct {
+	// Source is the account to migrate from. Each worker makes its own
+	// connection with Factory. The mailbox is ignored.
+	Source  imap2.ConnectionConfig
+	Factory imap2.Factory
+
+	// SourceName identifies the source account, without a mailbox. It's
+	// passed to the destination, and keys each folder in the state file.
+	SourceName string
+
+	// Clients are the destination. A worker is started for each.
+	Clients []ingest.Client
+
+	// Dest, if set, is a connection to an IMAP destination. Missing mailboxes
+	// are created on it, and "/" in their names is replaced with its
+	// hierarchy delimiter.
+	Dest imap2.Client
+
+	// Folders are the patterns, as in path.Match, of the folders to migrate.
+	// If empty, all are migrated. Names always use "/" as the delimiter.
+	Folders []string
+
+	// Mapping renames folders on the destination. The subfolders of a
+	// folder follow it. Unmapped folders keep their names.
+	Mapping map[string]string
+
+	// Since and Before, if set, limit the migration to messages received in
+	// that range, by their internal date.
+	Since  time.Time
+	Before time.Time
+
+	// Delete removes messages from the source once they've been copied.
+	Delete bool
+
+	// State, if set, records the progress of each folder, so an
+	// interrupted migration can be resumed.
+	State *archive.StateFile
+
+	// BatchSize is the number of messages fetched at a time.
+	BatchSize int
+
+	// Stop, if closed, stops the migration after the current batch.
+	Stop <-chan struct{}
+
+	Logger *log.Entry
+}
+
+type Folder struct {
+	// Name is the name of the folder on the source.
+	Name string
+
+	// Path is the name, with "/" as the delimiter.
+	Path string
+
+	// Target is the mailbox on the destination.
+	Target string
+}
+
+// Result is the outcome of migrating a single folder.
+type Result struct {
+	Folder
+	archive.ExportStats
+
+	// Err is why the folder couldn't be migrated, or wasn't finished.
+	Err error
+}
@@ -0,0 +1,106 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package multipump
+
+import (
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+)
+
+// admit checks a message against the dedupe index. If false is returned,
+// the message has been dealt with and should not be ingested.
+//
+// Copies of a message that is already in flight are held until the first
+// completes, so a failed ingest never loses the only copy.
+func (pump *multiPump) admit(receiverIndex int, msg *imap.Message) bool {
+	if pump.dedupe == nil {
+		return true
+	}
+
+	e := log.WithFields(log.Fields{"receiver": receiverIndex, "uid": msg.Uid})
+
+	body, err := bufferBody(msg, pump.rfc822Section)
+	if err != nil {
+		e.WithError(err).Warn("pump_dedupe_key_failed")
+		return true
+	}
+
+	key := pump.dedupe.Key(body)
+	e = e.WithField("key", key)
+
+	if pump.dedupe.Contains(key) {
+		e.Info("pump_duplicate_dropped")
+		pump.receivers[receiverIndex].Ack(msg.Uid, nil)
+		return false
+	}
+
+	if held, ok := pump.held[key]; ok {
+		e.Info("pump_duplicate_held")
+		pump.held[key] = append(held, heldMessage{receiver: receiverIndex, msg: msg})
+		return false
+	}
+
+	pump.held[key] = nil
+	pump.inflight[sourceUID{receiver: receiverIndex, uid: msg.Uid}] = key
+	return true
+}
+
+// complete updates the dedupe index after a message has been ingested,
+// releasing any copies held behind it.
+func (pump *multiPump) complete(receiverIndex int, uid uint32, err error) {
+	if pump.dedupe == nil {
+		return
+	}
+
+	su := sourceUID{receiver: receiverIndex, uid: uid}
+	key, ok := pump.inflight[su]
+	if !ok {
+		return
+	}
+	delete(pump.inflight, su)
+
+	held := pump.held[key]
+	delete(pump.held, key)
+
+	if err == nil {
+		if err := pump.dedupe.Add(key); err != nil {
+			log.WithError(err).WithField("key", key).Error("pump_dedupe_add_failed")
+		}
+
+		for _, h := range held {
+			log.WithFields(log.Fields{
+				"receiver": h.receiver,
+				"uid":      h.msg.Uid,
+				"key":      key,
+			}).Info("pump_duplicate_dropped")
+			pump.receivers[h.receiver].Ack(h.msg.Uid, nil)
+		}
+		return
+	}
+
+	if len(held) == 0 {
+		return
+	}
+
+	// The first copy failed, try the next one.
+	next := held[0]
+	pump.held[key] = held[1:]
+	pump.inflight[sourceUID{receiver: next.receiver, uid: next.msg.Uid}] = key
+	pump.ingest(next.receiver, next.msg)
+}
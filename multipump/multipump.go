@@ -24,6 +24,8 @@ import (
 
 	"github.com/emersion/go-imap"
 	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/dedupe"
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/ingest"
 	"git.vs49688.net/zane/mailpump/receiver"
 )
@@ -61,9 +63,14 @@ func NewPump(cfg *Config) (MultiPump, error) {
 		return nil, errors.New("mismatching source configuration/mailbox pairs")
 	}
 
+	if cfg.SourceNames != nil && len(cfg.SourceNames) != len(cfg.Sources) {
+		return nil, errors.New("mismatching source configuration/name pairs")
+	}
+
 	pump := &multiPump{}
 
 	pump.targetMailboxes = cfg.TargetMailboxes
+	pump.sourceNames = cfg.SourceNames
 
 	// Our config comes from the user, don't trust their channels
 	pump.recvChannels = make([]chan *imap.Message, len(cfg.Sources))
@@ -78,8 +85,11 @@ func NewPump(cfg *Config) (MultiPump, error) {
 		pump.ingestChannels[i] = make(chan ingest.Response, 10)
 	}
 
+	pump.healthChannel = make(chan delivery.Health, 1)
+	cfg.Destination.HealthUpdates = pump.healthChannel
+
 	// Build the switch cases
-	pump.cases = make([]reflect.SelectCase, 2*len(cfg.Sources)+1)
+	pump.cases = make([]reflect.SelectCase, 2*len(cfg.Sources)+2)
 
 	pump.recvBaseOffset = 0
 	for i := 0; i < len(cfg.Sources); i++ {
@@ -103,12 +113,33 @@ func NewPump(cfg *Config) (MultiPump, error) {
 		Chan: reflect.ValueOf(cfg.StopChan),
 	}
 
+	pump.healthOffset = pump.exitOffset + 1
+	pump.cases[pump.healthOffset] = reflect.SelectCase{
+		Dir:  reflect.SelectRecv,
+		Chan: reflect.ValueOf(pump.healthChannel),
+	}
+
+	if cfg.Dedupe != nil {
+		if pump.dedupe, err = dedupe.NewStore(cfg.Dedupe); err != nil {
+			return nil, err
+		}
+
+		if pump.rfc822Section, err = imap.ParseBodySectionName(imap.FetchRFC822); err != nil {
+			panic(err)
+		}
+
+		pump.inflight = map[sourceUID]string{}
+		pump.held = map[string][]heldMessage{}
+	}
+
 	if pump.ingestClient, err = ingest.NewClient(&cfg.Destination); err != nil {
+		pump.closeDedupe()
 		return nil, err
 	}
 
 	if pump.receivers, err = makeReceivers(cfg.Sources); err != nil {
 		closeAndWait(pump.ingestClient)
+		pump.closeDedupe()
 		return nil, err
 	}
 
@@ -120,6 +151,29 @@ func NewPump(cfg *Config) (MultiPump, error) {
 func (pump *multiPump) Close() {
 	closeAndWait(pump.receivers...)
 	closeAndWait(pump.ingestClient)
+	pump.closeDedupe()
+}
+
+func (pump *multiPump) closeDedupe() {
+	if pump.dedupe == nil {
+		return
+	}
+
+	if err := pump.dedupe.Close(); err != nil {
+		log.WithError(err).Error("pump_dedupe_close_failed")
+	}
+}
+
+func (pump *multiPump) ingest(receiverIndex int, msg *imap.Message) {
+	source := ""
+	if pump.sourceNames != nil {
+		source = pump.sourceNames[receiverIndex]
+	}
+
+	if err := pump.ingestClient.IngestMessageFrom(source, pump.targetMailboxes[receiverIndex], msg, pump.ingestChannels[receiverIndex]); err != nil {
+		pump.receivers[receiverIndex].Ack(msg.Uid, err)
+		pump.complete(receiverIndex, msg.Uid, err)
+	}
 }
 
 func (pump *multiPump) tick() error {
@@ -134,13 +188,20 @@ func (pump *multiPump) tick() error {
 				"uid":      msg.Uid,
 				"seq":      msg.SeqNum,
 			}).Trace("pump_handle_incoming")
-			if err := pump.ingestClient.IngestMessage(pump.targetMailboxes[receiverIndex], msg, pump.ingestChannels[receiverIndex]); err != nil {
-				pump.receivers[chosen].Ack(msg.Uid, err)
+			if pump.admit(receiverIndex, msg) {
+				pump.ingest(receiverIndex, msg)
 			}
 		} else if chosen >= pump.ingestBaseOffset && chosen < pump.exitOffset {
 			r := val.Interface().(ingest.Response)
 			receiverIndex := chosen - pump.ingestBaseOffset
 			pump.receivers[receiverIndex].Ack(r.UID, r.Error)
+			pump.complete(receiverIndex, r.UID, r.Error)
+		} else if chosen == pump.healthOffset && ok {
+			h := val.Interface().(delivery.Health)
+			log.WithField("health", h).Trace("pump_handle_health")
+			for _, recv := range pump.receivers {
+				recv.SetDestinationHealth(h)
+			}
 		} else if chosen == pump.exitOffset || !ok {
 			log.Trace("exit_requested")
 			break
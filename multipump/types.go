@@ -21,7 +21,9 @@ package multipump
 import (
 	"reflect"
 
-	"git.vs49688.net/zane/mailpump/imap"
+	"github.com/emersion/go-imap"
+	"git.vs49688.net/zane/mailpump/dedupe"
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/ingest"
 	"git.vs49688.net/zane/mailpump/receiver"
 )
@@ -31,6 +33,13 @@ type Config struct {
 	Sources         []receiver.Config
 	TargetMailboxes []string
 
+	// SourceNames, if set, are the names of each source, passed on to the destination.
+	SourceNames []string
+
+	// Dedupe, if set, enables a deduplication index shared between all
+	// sources. Messages already in the index are acked without being ingested.
+	Dedupe *dedupe.Config
+
 	DoneChan chan<- error
 	StopChan <-chan struct{}
 }
@@ -45,10 +54,30 @@ type multiPump struct {
 
 	recvChannels    []chan *imap.Message
 	ingestChannels  []chan ingest.Response
+	healthChannel   chan delivery.Health
 	targetMailboxes []string
+	sourceNames     []string
 
 	cases            []reflect.SelectCase
 	recvBaseOffset   int
 	ingestBaseOffset int
 	exitOffset       int
+	healthOffset     int
+
+	dedupe        dedupe.Store
+	rfc822Section *imap.BodySectionName
+	// inflight maps messages being ingested to their dedupe keys.
+	inflight map[sourceUID]string
+	// held contains the copies of an in-flight key waiting for it to complete.
+	held map[string][]heldMessage
+}
+
+type sourceUID struct {
+	receiver int
+	uid      uint32
+}
+
+type heldMessage struct {
+	receiver int
+	msg      *imap.Message
 }
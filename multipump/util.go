@@ -18,6 +18,15 @@
 
 package multipump
 
+import (
+	"bytes"
+	"errors"
+
+	"github.com/emersion/go-imap"
+)
+
+var errNoBody = errors.New("message has no body")
+
 type closable interface {
 	Close()
 }
@@ -32,3 +41,23 @@ func closeAndWait[T closable](closables ...T) {
 		<-ch
 	}
 }
+
+// bufferBody reads the body section of a message into memory, replacing
+// the literal so it may be read again.
+func bufferBody(msg *imap.Message, section *imap.BodySectionName) ([]byte, error) {
+	for s, lit := range msg.Body {
+		if !section.Equal(s) || lit == nil {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		if _, err := buf.ReadFrom(lit); err != nil {
+			return nil, err
+		}
+
+		msg.Body[s] = bytes.NewReader(buf.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	return nil, errNoBody
+}
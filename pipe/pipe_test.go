@@ -0,0 +1,148 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pipe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+const testMessage = "From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+// TestHelperProcess isn't a real test, it's the command run by the sink.
+// It writes its input and environment to the directory in $PIPE_TEST_OUT,
+// then exits with $PIPE_TEST_EXIT.
+func TestHelperProcess(t *testing.T) {
+	out := os.Getenv("PIPE_TEST_OUT")
+	if out == "" {
+		return
+	}
+
+	body, _ := io.ReadAll(os.Stdin)
+	_ = os.WriteFile(filepath.Join(out, "body"), body, 0600)
+
+	env := ""
+	for _, k := range []string{"MAILPUMP_SOURCE", "MAILPUMP_UID", "MAILPUMP_MAILBOX", "MAILPUMP_FLAGS", "MAILPUMP_DATE"} {
+		env += fmt.Sprintf("%v=%v\n", k, os.Getenv(k))
+	}
+	_ = os.WriteFile(filepath.Join(out, "env"), []byte(env), 0600)
+
+	code, _ := strconv.Atoi(os.Getenv("PIPE_TEST_EXIT"))
+	if code != 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "failed with %d\n", code)
+	}
+	os.Exit(code)
+}
+
+func newHelperSink(t *testing.T, exitCode int, crlf bool) (ingest.MetadataSink, string) {
+	out := t.TempDir()
+	t.Setenv("PIPE_TEST_OUT", out)
+	t.Setenv("PIPE_TEST_EXIT", strconv.Itoa(exitCode))
+
+	sink, err := NewSink(&Config{
+		Command: os.Args[0],
+		Args:    []string{"-test.run=TestHelperProcess"},
+		CRLF:    crlf,
+		Timeout: 30 * time.Second,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	return sink.(ingest.MetadataSink), out
+}
+
+func TestDeliver(t *testing.T) {
+	sink, out := newHelperSink(t, 0, false)
+
+	meta := ingest.Metadata{Source: "work", UID: 42}
+	date := time.Date(2022, 5, 11, 14, 31, 59, 0, time.UTC)
+	assert.NoError(t, sink.DeliverMetadata(meta, "Archive", []string{"\\Seen", "\\Flagged"}, date, []byte(testMessage)))
+
+	body, err := os.ReadFile(filepath.Join(out, "body"))
+	assert.NoError(t, err)
+	assert.Equal(t, "From: sender@example.com\nSubject: Test\n\nHello\n", string(body))
+
+	env, err := os.ReadFile(filepath.Join(out, "env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "MAILPUMP_SOURCE=work\n"+
+		"MAILPUMP_UID=42\n"+
+		"MAILPUMP_MAILBOX=Archive\n"+
+		"MAILPUMP_FLAGS=\\Seen \\Flagged\n"+
+		"MAILPUMP_DATE=2022-05-11T14:31:59Z\n", string(env))
+}
+
+func TestCRLF(t *testing.T) {
+	sink, out := newHelperSink(t, 0, true)
+
+	assert.NoError(t, sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage)))
+
+	body, err := os.ReadFile(filepath.Join(out, "body"))
+	assert.NoError(t, err)
+	assert.Equal(t, testMessage, string(body))
+}
+
+func TestExitCodes(t *testing.T) {
+	t.Run("tempfail", func(t *testing.T) {
+		sink, _ := newHelperSink(t, ExitTempFail, false)
+
+		err := sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+
+		var xerr *ExitError
+		if assert.ErrorAs(t, err, &xerr) {
+			assert.Equal(t, ExitTempFail, xerr.ExitCode)
+			assert.Equal(t, "failed with 75", xerr.Stderr)
+		}
+		assert.False(t, delivery.IsPermanent(err))
+	})
+
+	t.Run("permanent", func(t *testing.T) {
+		// EX_NOUSER
+		sink, _ := newHelperSink(t, 67, false)
+
+		err := sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+		assert.True(t, delivery.IsPermanent(err))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		sink, err := NewSink(&Config{Command: filepath.Join(t.TempDir(), "missing")})
+		assert.NoError(t, err)
+
+		err = sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+		assert.Error(t, err)
+		assert.False(t, delivery.IsPermanent(err))
+	})
+}
+
+func TestNoCommand(t *testing.T) {
+	_, err := NewSink(&Config{})
+	assert.ErrorIs(t, err, ErrNoCommand)
+}
@@ -0,0 +1,143 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pipe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// maxStderr is the most of the command's standard error kept for errors.
+const maxStderr = 1024
+
+// NewSink creates an ingest.Sink that runs a command for each message,
+// with the message on its standard input.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	if cfg.Command == "" {
+		return nil, ErrNoCommand
+	}
+
+	s := &sink{cfg: *cfg}
+	if s.cfg.Timeout == 0 {
+		s.cfg.Timeout = 5 * time.Minute
+	}
+
+	return s, nil
+}
+
+// limitedBuffer is a bytes.Buffer that discards anything past its limit.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+
+	return len(p), nil
+}
+
+func environ(meta ingest.Metadata, mailbox string, flags []string, date time.Time) []string {
+	env := append(os.Environ(),
+		"MAILPUMP_SOURCE="+meta.Source,
+		"MAILPUMP_UID="+strconv.FormatUint(uint64(meta.UID), 10),
+		"MAILPUMP_MAILBOX="+mailbox,
+		"MAILPUMP_FLAGS="+strings.Join(flags, " "),
+	)
+
+	if !date.IsZero() {
+		env = append(env, "MAILPUMP_DATE="+date.Format(time.RFC3339))
+	}
+
+	return env
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	return s.DeliverMetadata(ingest.Metadata{}, mailbox, flags, date, body)
+}
+
+func (s *sink) DeliverMetadata(meta ingest.Metadata, mailbox string, flags []string, date time.Time, body []byte) error {
+	if !s.cfg.CRLF {
+		body = bytes.ReplaceAll(body, []byte("\r\n"), []byte("\n"))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	stderr := &limitedBuffer{limit: maxStderr}
+
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, s.cfg.Command, s.cfg.Args...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = stderr
+	cmd.Env = environ(meta, mailbox, flags, date)
+
+	e := log.WithFields(log.Fields{
+		"source":  meta.Source,
+		"uid":     meta.UID,
+		"mailbox": mailbox,
+		"command": s.cfg.Command,
+	})
+
+	err := cmd.Run()
+	if err == nil {
+		e.Trace("pipe_delivered")
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// Couldn't even start it, try again later
+		e.WithError(err).Error("pipe_command_failed")
+		return err
+	}
+
+	xerr := &ExitError{
+		ExitCode: exitErr.ExitCode(),
+		Stderr:   strings.TrimSpace(stderr.String()),
+	}
+
+	e.WithError(xerr).Warn("pipe_delivery_failed")
+
+	if xerr.Temporary() {
+		return xerr
+	}
+
+	return &delivery.PermanentError{Err: xerr}
+}
+
+func (s *sink) Close() error {
+	return nil
+}
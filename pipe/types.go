@@ -0,0 +1,72 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pipe
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ExitTempFail is EX_TEMPFAIL from sysexits.h. Delivery agents exit with it
+// when the message should be retried later.
+const ExitTempFail = 75
+
+var ErrNoCommand = errors.New("no command given")
+
+type Config struct {
+	// Command is the path to the program to run.
+	Command string
+
+	// Args are passed to the command. No shell is involved.
+	Args []string
+
+	// CRLF keeps CRLF line endings, instead of converting to LF.
+	CRLF bool
+
+	// Timeout is the time the command has to deliver each message before
+	// it is killed.
+	Timeout time.Duration
+}
+
+// ExitError is returned when the command fails.
+type ExitError struct {
+	// ExitCode is the exit code of the command, or -1 if it was killed.
+	ExitCode int
+
+	// Stderr is the start of the command's standard error, if any.
+	Stderr string
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("command exited with code %d", e.ExitCode)
+	}
+	return fmt.Sprintf("command exited with code %d: %v", e.ExitCode, e.Stderr)
+}
+
+// Temporary checks if the message should be retried, i.e. the command
+// exited with EX_TEMPFAIL, or was killed.
+func (e *ExitError) Temporary() bool {
+	return e.ExitCode == ExitTempFail || e.ExitCode < 0
+}
+
+type sink struct {
+	cfg Config
+}
@@ -0,0 +1,341 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pop3
+
+import (
+	"crypto/md5" // #nosec G501 -- APOP is defined with MD5
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// dial connects and authenticates to the server.
+func dial(cfg *Config) (*client, error) {
+	c := &client{cfg: *cfg}
+	if c.cfg.Timeout == 0 {
+		c.cfg.Timeout = time.Minute
+	}
+
+	host, _, err := net.SplitHostPort(c.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	c.host = host
+
+	switch c.cfg.Security {
+	case SecurityStartTLS, SecurityTLS, SecurityNone:
+	default:
+		return nil, ErrInvalidSecurity
+	}
+
+	dialer := &net.Dialer{Timeout: c.cfg.Timeout}
+
+	var conn net.Conn
+	if c.cfg.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.cfg.Address, c.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", c.cfg.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.setConn(conn)
+	c.extendDeadline()
+
+	greeting, err := c.response("greeting")
+	if err != nil {
+		c.close()
+		return nil, err
+	}
+
+	// RFC 1939 7, the timestamp is a msg-id at the end of the greeting
+	if i := strings.LastIndex(greeting, "<"); i >= 0 {
+		if j := strings.Index(greeting[i:], ">"); j >= 0 {
+			c.timestamp = greeting[i : i+j+1]
+		}
+	}
+
+	if c.cfg.Security == SecurityStartTLS {
+		if _, err := c.cmd("STLS"); err != nil {
+			c.close()
+			return nil, fmt.Errorf("%w: %v", ErrStartTLSUnsupported, err)
+		}
+
+		tlsConn := tls.Client(c.netConn, c.tlsConfig())
+		if err := tlsConn.Handshake(); err != nil {
+			c.close()
+			return nil, err
+		}
+		c.setConn(tlsConn)
+	}
+
+	if err := c.auth(); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"address":  c.cfg.Address,
+		"security": c.cfg.Security,
+	}).Trace("pop3_connected")
+	return c, nil
+}
+
+func (c *client) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if c.cfg.TLSConfig != nil {
+		cfg = c.cfg.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = c.host
+	}
+
+	return cfg
+}
+
+func (c *client) setConn(conn net.Conn) {
+	c.netConn = conn
+	c.conn = textproto.NewConn(conn)
+}
+
+func (c *client) extendDeadline() {
+	_ = c.netConn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+}
+
+// close drops the connection. Without a QUIT, the server discards any deletions.
+func (c *client) close() {
+	if c.conn == nil {
+		return
+	}
+
+	_ = c.conn.Close()
+	c.conn = nil
+	c.netConn = nil
+}
+
+func (c *client) response(command string) (string, error) {
+	line, err := c.conn.ReadLine()
+	if err != nil {
+		return "", err
+	}
+
+	return parseResponse(command, line)
+}
+
+func parseResponse(command string, line string) (string, error) {
+	if strings.HasPrefix(line, "+OK") {
+		return strings.TrimSpace(line[3:]), nil
+	} else if strings.HasPrefix(line, "-ERR") {
+		return "", &ResponseError{Command: command, Message: strings.TrimSpace(line[4:])}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnexpectedResponse, line)
+}
+
+func (c *client) cmd(format string, args ...interface{}) (string, error) {
+	c.extendDeadline()
+	if err := c.conn.PrintfLine(format, args...); err != nil {
+		return "", err
+	}
+
+	return c.response(strings.Fields(format)[0])
+}
+
+// lines reads the rest of a multi-line response, undoing the dot-stuffing.
+// Unlike textproto.DotReader, line endings are left alone.
+func (c *client) lines() ([]string, error) {
+	var lines []string
+	for {
+		line, err := c.conn.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if line == "." {
+			return lines, nil
+		}
+
+		lines = append(lines, strings.TrimPrefix(line, "."))
+	}
+}
+
+func (c *client) auth() error {
+	if c.cfg.APOP {
+		if c.timestamp == "" {
+			return ErrAPOPUnsupported
+		}
+
+		// #nosec G401 -- APOP is defined with MD5
+		digest := md5.Sum([]byte(c.timestamp + c.cfg.Password))
+		_, err := c.cmd("APOP %s %s", c.cfg.Username, hex.EncodeToString(digest[:]))
+		return err
+	}
+
+	// Same as smtp.PlainAuth, don't send credentials in the clear.
+	if _, ok := c.netConn.(*tls.Conn); !ok && !isLocalhost(c.host) {
+		return ErrInsecureAuth
+	}
+
+	if c.cfg.Auth != nil {
+		return c.authSASL()
+	}
+
+	if _, err := c.cmd("USER %s", c.cfg.Username); err != nil {
+		return err
+	}
+
+	_, err := c.cmd("PASS %s", c.cfg.Password)
+	return err
+}
+
+// authSASL authenticates with the AUTH command, as per RFC 5034.
+func (c *client) authSASL() error {
+	mech, ir, err := c.cfg.Auth.Start()
+	if err != nil {
+		return err
+	}
+
+	line := "AUTH " + mech
+	if ir != nil {
+		if len(ir) == 0 {
+			line += " ="
+		} else {
+			line += " " + base64.StdEncoding.EncodeToString(ir)
+		}
+	}
+
+	c.extendDeadline()
+	if err := c.conn.PrintfLine("%s", line); err != nil {
+		return err
+	}
+
+	for {
+		line, err := c.conn.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		if !strings.HasPrefix(line, "+ ") && line != "+" {
+			_, err := parseResponse("AUTH", line)
+			return err
+		}
+
+		challenge, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.cfg.Auth.Next(challenge)
+		if err != nil {
+			// Cancel the exchange
+			_ = c.conn.PrintfLine("*")
+			_, _ = c.response("AUTH")
+			return err
+		}
+
+		if err := c.conn.PrintfLine("%s", base64.StdEncoding.EncodeToString(resp)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *client) uidl() ([]listing, error) {
+	if _, err := c.cmd("UIDL"); err != nil {
+		return nil, err
+	}
+
+	lines, err := c.lines()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]listing, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrUnexpectedResponse, line)
+		}
+
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrUnexpectedResponse, line)
+		}
+
+		list = append(list, listing{Number: n, UIDL: fields[1]})
+	}
+
+	return list, nil
+}
+
+// retr fetches a message, with CRLF line endings.
+func (c *client) retr(n int) ([]byte, error) {
+	if _, err := c.cmd("RETR %d", n); err != nil {
+		return nil, err
+	}
+
+	lines, err := c.lines()
+	if err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(line)
+		sb.WriteString("\r\n")
+	}
+
+	return []byte(sb.String()), nil
+}
+
+func (c *client) dele(n int) error {
+	_, err := c.cmd("DELE %d", n)
+	return err
+}
+
+func (c *client) noop() error {
+	_, err := c.cmd("NOOP")
+	return err
+}
+
+// quit ends the session, committing any deletions.
+func (c *client) quit() error {
+	_, err := c.cmd("QUIT")
+	c.close()
+	return err
+}
@@ -0,0 +1,287 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pop3
+
+import (
+	"crypto/md5" // #nosec G501
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+const testTimestamp = "<1896.697170952@dbc.mtview.ca.us>"
+
+type fakeMessage struct {
+	UIDL string
+	Body string
+}
+
+// fakeServer is a minimal POP3 server, accepting user "user" with password "pass".
+type fakeServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	messages []fakeMessage
+	auths    []string
+}
+
+func newFakeServer(t *testing.T, messages ...fakeMessage) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s := &fakeServer{listener: l, messages: messages}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeServer) Messages() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func (s *fakeServer) Auths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.auths...)
+}
+
+func (s *fakeServer) authed(method string) {
+	s.mu.Lock()
+	s.auths = append(s.auths, method)
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+
+	_ = tp.PrintfLine("+OK POP3 server ready %s", testTimestamp)
+
+	s.mu.Lock()
+	messages := append([]fakeMessage(nil), s.messages...)
+	s.mu.Unlock()
+
+	deleted := map[int]bool{}
+	user := ""
+	authed := false
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			_ = tp.PrintfLine("-ERR empty command")
+			continue
+		}
+
+		n := 0
+		if len(fields) > 1 {
+			n, _ = strconv.Atoi(fields[1])
+		}
+
+		cmd := strings.ToUpper(fields[0])
+		if !authed && cmd != "USER" && cmd != "PASS" && cmd != "APOP" && cmd != "AUTH" && cmd != "QUIT" {
+			_ = tp.PrintfLine("-ERR not authenticated")
+			continue
+		}
+
+		switch cmd {
+		case "USER":
+			user = fields[1]
+			_ = tp.PrintfLine("+OK")
+		case "PASS":
+			if user == "user" && len(fields) == 2 && fields[1] == "pass" {
+				authed = true
+				s.authed("USER")
+				_ = tp.PrintfLine("+OK")
+			} else {
+				_ = tp.PrintfLine("-ERR invalid credentials")
+			}
+		case "APOP":
+			digest := md5.Sum([]byte(testTimestamp + "pass")) // #nosec G401
+			if len(fields) == 3 && fields[1] == "user" && fields[2] == hex.EncodeToString(digest[:]) {
+				authed = true
+				s.authed("APOP")
+				_ = tp.PrintfLine("+OK")
+			} else {
+				_ = tp.PrintfLine("-ERR invalid credentials")
+			}
+		case "AUTH":
+			ir := ""
+			if len(fields) == 3 {
+				ir = fields[2]
+			} else {
+				_ = tp.PrintfLine("+ ")
+				if ir, err = tp.ReadLine(); err != nil {
+					return
+				}
+			}
+
+			resp, _ := base64.StdEncoding.DecodeString(ir)
+			if strings.ToUpper(fields[1]) == sasl.Plain && string(resp) == "\x00user\x00pass" {
+				authed = true
+				s.authed(sasl.Plain)
+				_ = tp.PrintfLine("+OK")
+			} else {
+				_ = tp.PrintfLine("-ERR invalid credentials")
+			}
+		case "UIDL":
+			_ = tp.PrintfLine("+OK")
+			w := tp.DotWriter()
+			for i, msg := range messages {
+				if !deleted[i+1] {
+					_, _ = fmt.Fprintf(w, "%d %s\r\n", i+1, msg.UIDL)
+				}
+			}
+			_ = w.Close()
+		case "RETR":
+			if n < 1 || n > len(messages) || deleted[n] {
+				_ = tp.PrintfLine("-ERR no such message")
+				continue
+			}
+
+			_ = tp.PrintfLine("+OK")
+			w := tp.DotWriter()
+			_, _ = io.WriteString(w, messages[n-1].Body)
+			_ = w.Close()
+		case "DELE":
+			deleted[n] = true
+			_ = tp.PrintfLine("+OK")
+		case "NOOP":
+			_ = tp.PrintfLine("+OK")
+		case "QUIT":
+			s.mu.Lock()
+			s.messages = s.messages[:0]
+			for i, msg := range messages {
+				if !deleted[i+1] {
+					s.messages = append(s.messages, msg)
+				}
+			}
+			s.mu.Unlock()
+
+			_ = tp.PrintfLine("+OK")
+			return
+		default:
+			_ = tp.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newFakeServer(t)
+
+	tests := map[string]Config{
+		"USER":     {Username: "user", Password: "pass"},
+		"APOP":     {Username: "user", Password: "pass", APOP: true},
+		sasl.Plain: {Auth: sasl.NewPlainClient("", "user", "pass")},
+	}
+
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg.Address = s.Address()
+			cfg.Security = SecurityNone
+
+			c, err := dial(&cfg)
+			if assert.NoError(t, err) {
+				assert.NoError(t, c.quit())
+			}
+		})
+	}
+
+	assert.ElementsMatch(t, []string{"USER", "APOP", sasl.Plain}, s.Auths())
+
+	_, err := dial(&Config{Address: s.Address(), Security: SecurityNone, Username: "user", Password: "wrong"})
+	var rerr *ResponseError
+	if assert.ErrorAs(t, err, &rerr) {
+		assert.Equal(t, "PASS", rerr.Command)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	s := newFakeServer(t,
+		fakeMessage{UIDL: "a", Body: "Subject: one\r\n\r\nHello\r\n"},
+		fakeMessage{UIDL: "b", Body: "Subject: two\r\n\r\n.dotted\r\n"},
+		fakeMessage{UIDL: "c", Body: "Subject: three\r\n\r\nHello\r\n"},
+	)
+
+	ch := make(chan *imap.Message, 10)
+	recv, err := receiver.NewReceiver(&receiver.Config{
+		Receiver:        &ReceiverFactory{Config: Config{Address: s.Address(), Security: SecurityNone, Username: "user", Password: "pass"}},
+		Channel:         ch,
+		FetchBufferSize: 2,
+	})
+	assert.NoError(t, err)
+
+	msg1 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "Subject: one\r\n\r\nHello\r\n", internal.MessageBody(t, msg1))
+
+	msg2 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "Subject: two\r\n\r\n.dotted\r\n", internal.MessageBody(t, msg2))
+
+	recv.Ack(msg1.Uid, nil)
+	recv.Ack(msg2.Uid, &delivery.PermanentError{Err: errors.New("rejected")})
+
+	// The first session fetches as much as it can, and the next is started
+	// straight away for the rest. The failed message isn't fetched again.
+	msg3 := internal.ReceiveMessage(t, ch)
+	assert.Equal(t, "Subject: three\r\n\r\nHello\r\n", internal.MessageBody(t, msg3))
+	assert.NotEqual(t, msg1.Uid, msg3.Uid)
+
+	recv.Ack(msg3.Uid, nil)
+	recv.Close()
+
+	assert.Equal(t, []fakeMessage{{UIDL: "b", Body: "Subject: two\r\n\r\n.dotted\r\n"}}, s.Messages())
+	assert.Empty(t, ch)
+}
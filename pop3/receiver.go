@@ -0,0 +1,326 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pop3
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/receiver"
+)
+
+// keepaliveInterval is how often to NOOP while waiting for acks.
+const keepaliveInterval = time.Minute
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+// NewReceiver creates a receiver.Client for the maildrop. The maildrop is polled
+// every cfg.IDLEFallbackInterval, and each session waits up to cfg.FetchMaxInterval
+// for the messages it fetched to be acknowledged before deleting them.
+//
+// POP3 has no mailboxes, so cfg.ConnectionConfig and cfg.RejectMailbox are unused.
+// Rejected messages are left on the server.
+func (f *ReceiverFactory) NewReceiver(cfg *receiver.Config) (receiver.Client, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	pollInterval := cfg.IDLEFallbackInterval
+	if pollInterval == 0 {
+		pollInterval = 1 * time.Minute
+	}
+
+	fetchBufferSize := cfg.FetchBufferSize
+	if fetchBufferSize == 0 {
+		fetchBufferSize = 20
+	}
+
+	fetchMaxInterval := cfg.FetchMaxInterval
+	if fetchMaxInterval == 0 {
+		fetchMaxInterval = 5 * time.Minute
+	}
+
+	r := &mailReceiver{
+		cfg:           f.Config,
+		logger:        logger,
+		ackChannel:    make(chan ackRequest, fetchBufferSize),
+		healthChannel: make(chan delivery.Health, 1),
+		outChannel:    cfg.Channel,
+
+		pollInterval:     pollInterval,
+		fetchBufferSize:  fetchBufferSize,
+		fetchMaxInterval: fetchMaxInterval,
+		disableDeletions: cfg.DisableDeletions,
+
+		messages: map[string]*message{},
+		uids:     map[uint32]*message{},
+
+		hasQuit:  make(chan struct{}, 1),
+		wantQuit: make(chan struct{}, 1),
+	}
+
+	go r.run()
+	return r, nil
+}
+
+func (r *mailReceiver) Ack(UID uint32, error error) {
+	if UID == 0 {
+		return
+	}
+
+	r.ackChannel <- ackRequest{UID: UID, Error: error}
+}
+
+func (r *mailReceiver) SetDestinationHealth(health delivery.Health) {
+	delivery.SendHealth(r.healthChannel, health)
+}
+
+func withMessage(parent *log.Entry, msg *message) *log.Entry {
+	return parent.WithFields(log.Fields{
+		"uid":   msg.UID,
+		"uidl":  msg.UIDL,
+		"state": msg.State,
+	})
+}
+
+func (r *mailReceiver) handleAck(req *ackRequest) {
+	msg, ok := r.uids[req.UID]
+	if !ok || msg.State != StatePending {
+		return
+	}
+
+	if req.Error != nil {
+		// Nowhere to move it to, so leave it be
+		msg.State = StateFailed
+		withMessage(r.logger, msg).WithError(req.Error).Warn("pop3_receiver_ack")
+		return
+	}
+
+	msg.State = StateAcked
+	withMessage(r.logger, msg).Info("pop3_receiver_ack")
+}
+
+func (r *mailReceiver) handleHealth(health delivery.Health) {
+	paused := health != delivery.HealthConnected
+	if paused != r.paused {
+		r.logger.WithField("health", health).Info("pop3_receiver_destination_health_changed")
+	}
+	r.paused = paused
+}
+
+// outstanding checks if any messages listed in this session are still
+// waiting to be acked.
+func (r *mailReceiver) outstanding() bool {
+	for _, msg := range r.messages {
+		if msg.Number != 0 && msg.State == StatePending {
+			return true
+		}
+	}
+	return false
+}
+
+// wait handles acks until everything fetched in this session has been
+// acked, or it's time to give up.
+func (r *mailReceiver) wait(c *client) error {
+	deadline := time.After(r.fetchMaxInterval)
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for r.outstanding() {
+		select {
+		case <-r.wantQuit:
+			r.quitting = true
+			return nil
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+		case health := <-r.healthChannel:
+			r.handleHealth(health)
+		case <-keepalive.C:
+			if err := c.noop(); err != nil {
+				return err
+			}
+		case <-deadline:
+			// Delete what we have, the rest will be next time
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// drainAcks handles any acks that have already arrived.
+func (r *mailReceiver) drainAcks() {
+	for {
+		select {
+		case ack := <-r.ackChannel:
+			r.handleAck(&ack)
+		default:
+			return
+		}
+	}
+}
+
+// poll runs a session. Messages not seen before are fetched and passed on,
+// and those that are acked are deleted. It reports whether there were more
+// messages than could be fetched.
+func (r *mailReceiver) poll() (bool, error) {
+	c, err := dial(&r.cfg)
+	if err != nil {
+		return false, err
+	}
+	defer c.close()
+
+	list, err := c.uidl()
+	if err != nil {
+		return false, err
+	}
+
+	pending := 0
+	for _, msg := range r.messages {
+		msg.Number = 0
+		if msg.State == StatePending {
+			pending++
+		}
+	}
+
+	more := false
+	var toFetch []listing
+	for _, l := range list {
+		if msg, ok := r.messages[l.UIDL]; ok {
+			msg.Number = l.Number
+		} else if uint(pending+len(toFetch)) < r.fetchBufferSize {
+			toFetch = append(toFetch, l)
+		} else {
+			more = true
+		}
+	}
+
+	// Forget anything that's gone from the server, unless the pump
+	// still has it
+	for uidl, msg := range r.messages {
+		if msg.Number == 0 && msg.State != StatePending {
+			delete(r.messages, uidl)
+			delete(r.uids, msg.UID)
+		}
+	}
+
+	for _, l := range toFetch {
+		body, err := c.retr(l.Number)
+		if err != nil {
+			return false, err
+		}
+
+		r.nextUID++
+		msg := &message{UID: r.nextUID, UIDL: l.UIDL, State: StatePending, Number: l.Number}
+		r.messages[msg.UIDL] = msg
+		r.uids[msg.UID] = msg
+
+		imsg := imap.NewMessage(msg.UID, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822})
+		imsg.Uid = msg.UID
+		imsg.Body[rfc822Section] = bytes.NewBuffer(body)
+
+		withMessage(r.logger, msg).Info("pop3_receiver_message_fetched")
+		r.outChannel <- imsg
+	}
+
+	if err := r.wait(c); err != nil {
+		return false, err
+	}
+	r.drainAcks()
+
+	var deleted []*message
+	if !r.disableDeletions {
+		for _, msg := range r.messages {
+			if msg.Number != 0 && msg.State == StateAcked {
+				if err := c.dele(msg.Number); err != nil {
+					return false, err
+				}
+				deleted = append(deleted, msg)
+			}
+		}
+	}
+
+	// The deletions only happen once we QUIT
+	if err := c.quit(); err != nil {
+		return false, err
+	}
+
+	for _, msg := range deleted {
+		withMessage(r.logger, msg).Info("pop3_receiver_message_deleted")
+		delete(r.messages, msg.UIDL)
+		delete(r.uids, msg.UID)
+	}
+
+	return more, nil
+}
+
+func (r *mailReceiver) run() {
+	nextPoll := time.Now()
+
+	for {
+		if !r.paused && !time.Now().Before(nextPoll) {
+			more, err := r.poll()
+			if err != nil {
+				r.logger.WithError(err).Warn("pop3_receiver_poll_failed")
+			}
+
+			if r.quitting {
+				break
+			}
+
+			if more && err == nil {
+				continue
+			}
+
+			nextPoll = time.Now().Add(r.pollInterval)
+		}
+
+		// Don't poll at all while paused
+		var pollTimer <-chan time.Time
+		if !r.paused {
+			pollTimer = time.After(time.Until(nextPoll))
+		}
+
+		select {
+		case <-r.wantQuit:
+			r.quitting = true
+		case ack := <-r.ackChannel:
+			// From a session that failed
+			r.handleAck(&ack)
+		case health := <-r.healthChannel:
+			r.handleHealth(health)
+		case <-pollTimer:
+		}
+
+		if r.quitting {
+			break
+		}
+	}
+
+	r.hasQuit <- struct{}{}
+}
+
+func (r *mailReceiver) Close() {
+	r.wantQuit <- struct{}{}
+	<-r.hasQuit
+}
@@ -0,0 +1,175 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package pop3
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-sasl"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+)
+
+var (
+	ErrStartTLSUnsupported = errors.New("server does not support STLS")
+	ErrAPOPUnsupported     = errors.New("server does not support APOP")
+	ErrInsecureAuth        = errors.New("refusing to authenticate over an unencrypted connection")
+	ErrInvalidSecurity     = errors.New("invalid security type")
+	ErrUnexpectedResponse  = errors.New("unexpected response")
+)
+
+type Security string
+
+const (
+	// SecurityStartTLS upgrades the connection with STLS, failing if the
+	// server doesn't support it.
+	SecurityStartTLS Security = "starttls"
+
+	// SecurityTLS connects with implicit TLS.
+	SecurityTLS Security = "tls"
+
+	// SecurityNone never uses TLS.
+	SecurityNone Security = "none"
+)
+
+type Config struct {
+	// Address is the HOST:PORT of the server.
+	Address string
+
+	Security  Security
+	TLSConfig *tls.Config
+
+	Username string
+	Password string
+
+	// APOP, if set, authenticates with APOP instead of USER and PASS.
+	APOP bool
+
+	// Auth, if set, authenticates with SASL instead of USER and PASS.
+	Auth sasl.Client
+
+	// Timeout is the timeout for each command.
+	Timeout time.Duration
+}
+
+// ReceiverFactory creates receivers for a POP3 maildrop. Acknowledged
+// messages are deleted.
+type ReceiverFactory struct {
+	Config
+}
+
+// ResponseError is an -ERR response from the server.
+type ResponseError struct {
+	Command string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("pop3 %v failed: %v", e.Command, e.Message)
+}
+
+type client struct {
+	cfg     Config
+	host    string
+	netConn net.Conn
+	conn    *textproto.Conn
+
+	// timestamp is the APOP timestamp from the greeting, if any.
+	timestamp string
+}
+
+// listing is a line of a UIDL response.
+type listing struct {
+	Number int
+	UIDL   string
+}
+
+type ackRequest struct {
+	UID   uint32
+	Error error
+}
+
+type state int
+
+const (
+	StatePending state = 0
+	StateAcked   state = 1
+	StateFailed  state = 2
+)
+
+func (s state) String() string {
+	switch s {
+	case StatePending:
+		return "StatePending"
+	case StateAcked:
+		return "StateAcked"
+	case StateFailed:
+		return "StateFailed"
+	default:
+		panic("invalid state")
+	}
+}
+
+// message is a message that has been passed on to the pump. POP3 message
+// numbers only last for a session, so each is given a UID for the lifetime
+// of the receiver, and is tracked by its UIDL.
+type message struct {
+	UID   uint32
+	UIDL  string
+	State state
+
+	// Number is the message number in the current session, or 0 if the
+	// message wasn't listed.
+	Number int
+}
+
+type mailReceiver struct {
+	cfg    Config
+	logger *log.Entry
+
+	// external -> receiver, incoming acks
+	ackChannel chan ackRequest
+
+	// external -> receiver, destination health updates
+	healthChannel chan delivery.Health
+
+	// receiver -> external, message notifications
+	outChannel chan<- *imap.Message
+
+	pollInterval     time.Duration
+	fetchBufferSize  uint
+	fetchMaxInterval time.Duration
+	disableDeletions bool
+
+	messages map[string]*message
+	uids     map[uint32]*message
+	nextUID  uint32
+
+	paused   bool
+	quitting bool
+
+	hasQuit  chan struct{}
+	wantQuit chan struct{}
+}
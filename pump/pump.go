@@ -19,8 +19,12 @@
 package pump
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/emersion/go-imap"
 	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/ingest"
 	"git.vs49688.net/zane/mailpump/receiver"
 )
@@ -28,24 +32,38 @@ import (
 func NewMailPump(cfg *Config) (*MailPump, error) {
 	ch := make(chan *imap.Message, 20)
 
+	var drained chan receiver.DrainResult
+	if cfg.Once {
+		drained = make(chan receiver.DrainResult, 1)
+	}
+
 	recv, err := receiver.NewReceiver(&receiver.Config{
 		ConnectionConfig:     cfg.Source,
 		Factory:              cfg.SourceFactory,
+		Receiver:             cfg.SourceReceiver,
 		IDLEFallbackInterval: cfg.IDLEFallbackInterval,
 		BatchSize:            cfg.BatchSize,
 		DisableDeletions:     cfg.DisableDeletions,
 		FetchBufferSize:      cfg.FetchBufferSize,
 		FetchMaxInterval:     cfg.FetchMaxInterval,
+		RejectMailbox:        cfg.RejectMailbox,
 		Channel:              ch,
+		Drained:              drained,
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
+	healthChannel := make(chan delivery.Health, 1)
 	ing, err := ingest.NewClient(&ingest.Config{
 		ConnectionConfig: cfg.Dest,
 		Factory:          cfg.DestFactory,
+		Sink:             cfg.DestSink,
+		CheckDuplicates:  cfg.CheckDuplicates,
+		Normalise:        cfg.Normalise,
+		QuotaThreshold:   cfg.QuotaThreshold,
+		HealthUpdates:    healthChannel,
 	})
 	if err != nil {
 		recv.Close()
@@ -56,8 +74,13 @@ func NewMailPump(cfg *Config) (*MailPump, error) {
 		receiver:      recv,
 		ingest:        ing,
 		destMailbox:   cfg.Dest.Mailbox,
+		sourceName:    cfg.SourceName,
 		incoming:      ch,
 		ingestChannel: make(chan ingest.Response, 10),
+		healthChannel: healthChannel,
+		drained:       drained,
+
+		shutdownTimeout: cfg.ShutdownTimeout,
 	}
 
 	go func() { cfg.DoneChan <- pump.tick(cfg.StopChan) }()
@@ -81,15 +104,92 @@ func (pump *MailPump) tick(ch <-chan struct{}) error {
 				"uid": msg.Uid,
 				"seq": msg.SeqNum,
 			}).Trace("pump_handle_incoming")
-			if err := pump.ingest.IngestMessage(pump.destMailbox, msg, pump.ingestChannel); err != nil {
+			if err := pump.ingest.IngestMessageFrom(pump.sourceName, pump.destMailbox, msg, pump.ingestChannel); err != nil {
 				pump.receiver.Ack(msg.Uid, err)
+			} else {
+				pump.inFlight++
 			}
 
 		case r := <-pump.ingestChannel:
+			pump.inFlight--
 			pump.receiver.Ack(r.UID, r.Error)
+		case h := <-pump.healthChannel:
+			log.WithField("health", h).Trace("pump_handle_health")
+			pump.receiver.SetDestinationHealth(h)
+		case r := <-pump.drained:
+			log.WithFields(log.Fields{
+				"delivered": r.Delivered,
+				"rejected":  r.Rejected,
+				"left":      r.Left,
+			}).Info("pump_drained")
+
+			if r.Err != nil {
+				return r.Err
+			}
+
+			if r.Left > 0 {
+				return fmt.Errorf("%w: %v message(s) left in the source", ErrDrainIncomplete, r.Left)
+			}
+			return nil
 		case <-ch:
 			log.Trace("exit_requested")
+			pump.shutdown()
 			return nil
 		}
 	}
 }
+
+// shutdown stops fetching, and waits up to shutdownTimeout for the messages
+// already being ingested to be delivered, acked, and deleted. Anything
+// fetched but not yet ingested is left where it is.
+func (pump *MailPump) shutdown() {
+	if pump.shutdownTimeout <= 0 {
+		return
+	}
+
+	// Not every receiver can report when it's done, so for those only
+	// wait for the ingests.
+	var drained chan receiver.DrainResult
+	if d, ok := pump.receiver.(receiver.Drainer); ok {
+		drained = make(chan receiver.DrainResult, 1)
+		d.Drain(drained)
+	}
+
+	log.WithFields(log.Fields{
+		"in_flight": pump.inFlight,
+		"timeout":   pump.shutdownTimeout,
+	}).Info("pump_shutdown_started")
+
+	deadline := time.NewTimer(pump.shutdownTimeout)
+	defer deadline.Stop()
+
+	abandoned := 0
+	for drained != nil || pump.inFlight > 0 {
+		select {
+		case msg := <-pump.incoming:
+			abandoned++
+			pump.receiver.Ack(msg.Uid, errShuttingDown)
+		case r := <-pump.ingestChannel:
+			pump.inFlight--
+			pump.receiver.Ack(r.UID, r.Error)
+		case h := <-pump.healthChannel:
+			pump.receiver.SetDestinationHealth(h)
+		case r := <-drained:
+			log.WithFields(log.Fields{
+				"abandoned": abandoned,
+				"left":      r.Left,
+			}).Info("pump_shutdown_finished")
+			return
+		case <-deadline.C:
+			// Anything in flight may have been delivered, but won't
+			// have been deleted.
+			log.WithFields(log.Fields{
+				"abandoned": abandoned,
+				"in_flight": pump.inFlight,
+			}).Warn("pump_shutdown_timeout")
+			return
+		}
+	}
+
+	log.WithField("abandoned", abandoned).Info("pump_shutdown_finished")
+}
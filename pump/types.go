@@ -19,8 +19,10 @@
 package pump
 
 import (
+	"errors"
 	"time"
 
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/imap"
 	"git.vs49688.net/zane/mailpump/ingest"
 	"git.vs49688.net/zane/mailpump/receiver"
@@ -33,20 +35,54 @@ type Config struct {
 	SourceFactory imap.Factory
 	DestFactory   imap.Factory
 
+	// SourceReceiver, if set, creates the receiver instead of an IMAP one.
+	SourceReceiver receiver.Factory
+
+	// DestSink, if set, is used instead of an IMAP destination.
+	DestSink ingest.Sink
+
+	// SourceName is the name of the source, passed on to the destination.
+	SourceName string
+
 	IDLEFallbackInterval time.Duration
 	BatchSize            uint
 	DisableDeletions     bool
 	FetchBufferSize      uint
 	FetchMaxInterval     time.Duration
+	CheckDuplicates      bool
+	Normalise            bool
+	QuotaThreshold       float64
+	RejectMailbox        string
+
+	// Once, if set, drains the source and then stops, instead of waiting
+	// for new mail. DoneChan is sent an error if anything was left behind.
+	Once bool
+
+	// ShutdownTimeout is how long to wait once stopped for the messages
+	// already fetched to be delivered and deleted. If 0, it stops at once.
+	ShutdownTimeout time.Duration
 
 	DoneChan chan<- error
 	StopChan <-chan struct{}
 }
 
+var (
+	ErrDrainIncomplete = errors.New("drain incomplete")
+	errShuttingDown    = errors.New("shutting down")
+)
+
 type MailPump struct {
 	receiver      receiver.Client
 	ingest        ingest.Client
 	destMailbox   string
+	sourceName    string
 	incoming      chan *imap.Message
 	ingestChannel chan ingest.Response
+	healthChannel chan delivery.Health
+	drained       chan receiver.DrainResult
+
+	shutdownTimeout time.Duration
+
+	// inFlight is the number of messages being ingested
+	inFlight int
 }
@@ -54,13 +54,15 @@ func buildSeqSet(existing imap.SeqSet, mbStatus *imap.MailboxStatus, maxSize uin
 	return seq
 }
 
-func doFetch(client imap2.Client, existing imap.SeqSet, maxSize uint, result chan<- interface{}, logger *log.Entry) bool {
+// doFetch fetches messages not already in existing. It only fails if the
+// mailbox couldn't be read, not if there's nothing to fetch.
+func doFetch(client imap2.Client, existing imap.SeqSet, maxSize uint, result chan<- interface{}, logger *log.Entry) error {
 	logger.Trace("receiver_fetching_messages")
 
 	mbStatus := client.Mailbox()
 	if mbStatus == nil {
 		logger.Warn("receiver_no_mailbox")
-		return false
+		return errNoMailbox
 	}
 
 	logger.WithFields(log.Fields{
@@ -72,13 +74,13 @@ func doFetch(client imap2.Client, existing imap.SeqSet, maxSize uint, result cha
 	}).Trace("receiver_mailbox_status")
 
 	if mbStatus.Messages == 0 {
-		return false
+		return nil
 	}
 
 	seqset := buildSeqSet(existing, mbStatus, maxSize)
 	logger.WithField("set", seqset).Trace("receiver_fetch_set")
 	if seqset.Empty() {
-		return false
+		return nil
 	}
 
 	ch := make(chan *imap.Message)
@@ -90,7 +92,8 @@ func doFetch(client imap2.Client, existing imap.SeqSet, maxSize uint, result cha
 
 	uids, messages := readMessages(ch)
 
-	if err := <-done; err != nil {
+	err := <-done
+	if err != nil {
 		logger.WithError(err).Warn("receiver_fetch_failed")
 	} else {
 		logger.WithFields(log.Fields{"uids": uids}).Trace("receiver_fetch_succeeded")
@@ -101,16 +104,45 @@ func doFetch(client imap2.Client, existing imap.SeqSet, maxSize uint, result cha
 		logger.WithFields(log.Fields{"uids": uids}).Trace("receiver_fetch_succeeded_chanwrite")
 	}
 
-	return false
+	return err
 }
 
-func doDelete(client imap2.Client, result chan<- interface{}, toProcess map[uint32]*messageState, logger *log.Entry) interface{} {
+// doReject copies rejected messages to the reject mailbox. Returns false if
+// the copy failed, in which case the messages must not be deleted.
+func doReject(client imap2.Client, toProcess map[uint32]*messageState, rejectMailbox string, logger *log.Entry) bool {
+	rejectSet := new(imap.SeqSet)
+	for uid, msg := range toProcess {
+		if msg.State == StateAcked && msg.Rejected {
+			rejectSet.AddNum(uid)
+		}
+	}
+
+	if rejectSet.Empty() {
+		return true
+	}
+
+	if err := client.UidCopy(rejectSet, rejectMailbox); err != nil {
+		logger.WithError(err).WithFields(log.Fields{
+			"set":            rejectSet,
+			"reject_mailbox": rejectMailbox,
+		}).Warn("receiver_reject_failed")
+		return false
+	}
+
+	return true
+}
+
+func doDelete(client imap2.Client, result chan<- interface{}, toProcess map[uint32]*messageState, rejectMailbox string, logger *log.Entry) interface{} {
 	toDelete := map[uint32]*imap.Message{}
 
 	deleteSet := new(imap.SeqSet)
 
+	rejectOK := doReject(client, toProcess, rejectMailbox, logger)
+
 	for uid, msg := range toProcess {
-		if msg.State == StateAcked {
+		if msg.State == StateAcked && msg.Rejected && !rejectOK {
+			result <- deleteResult{UID: msg.UID, State: StateUnacked}
+		} else if msg.State == StateAcked {
 			toDelete[uid] = msg.Message
 			deleteSet.AddNum(uid)
 		} else if msg.State == StateDeleted {
@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	delivery "git.vs49688.net/zane/mailpump/delivery"
 )
 
 // MockClient is a mock of Client interface.
@@ -56,3 +57,15 @@ func (mr *MockClientMockRecorder) Close() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockClient)(nil).Close))
 }
+
+// SetDestinationHealth mocks base method.
+func (m *MockClient) SetDestinationHealth(health delivery.Health) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "SetDestinationHealth", health)
+}
+
+// SetDestinationHealth indicates an expected call of SetDestinationHealth.
+func (mr *MockClientMockRecorder) SetDestinationHealth(health interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetDestinationHealth", reflect.TypeOf((*MockClient)(nil).SetDestinationHealth), health)
+}
@@ -23,10 +23,18 @@ import (
 
 	client2 "github.com/emersion/go-imap/client"
 	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 )
 
 func NewReceiver(cfg *Config) (Client, error) {
+	if cfg.Receiver != nil {
+		if cfg.Drained != nil {
+			return nil, ErrDrainUnsupported
+		}
+		return cfg.Receiver.NewReceiver(cfg)
+	}
+
 	logger := cfg.Logger
 	if logger == nil {
 		logger = log.NewEntry(log.StandardLogger())
@@ -68,6 +76,8 @@ func NewReceiver(cfg *Config) (Client, error) {
 		updates:       updateChannel,
 		imapChannel:   make(chan interface{}),
 		ackChannel:    make(chan ackRequest, fetchBufferSize),
+		healthChannel: make(chan delivery.Health, 1),
+		drainChannel:  make(chan chan<- DrainResult, 1),
 		updateChannel: make(chan *messageState, 10),
 		outChannel:    cfg.Channel,
 
@@ -78,6 +88,9 @@ func NewReceiver(cfg *Config) (Client, error) {
 		fetchBufferSize:      fetchBufferSize,
 		fetchMaxInterval:     fetchMaxInterval,
 		disableDeletions:     cfg.DisableDeletions,
+		rejectMailbox:        cfg.RejectMailbox,
+
+		drained: cfg.Drained,
 
 		hasQuit:  make(chan struct{}, 1),
 		wantQuit: make(chan struct{}, 1),
@@ -102,6 +115,16 @@ func (mr *mailReceiver) Ack(UID uint32, error error) {
 	mr.logger.WithField("uid", UID).Trace("receiver_ack_return")
 }
 
+func (mr *mailReceiver) SetDestinationHealth(health delivery.Health) {
+	mr.logger.WithField("health", health).Trace("receiver_set_destination_health_called")
+	delivery.SendHealth(mr.healthChannel, health)
+}
+
+func (mr *mailReceiver) Drain(ch chan<- DrainResult) {
+	mr.logger.Trace("receiver_drain_called")
+	mr.drainChannel <- ch
+}
+
 func withMessageState(parent *log.Entry, mstate *messageState) *log.Entry {
 	return parent.WithFields(log.Fields{
 		"uid":   mstate.UID,
@@ -118,7 +141,10 @@ func (mr *mailReceiver) handleFetch(r *fetchResult) uint {
 	var num uint = 0
 	mr.logger.WithField("uids", r.UIDs).Trace("receiver_got_fetch_result")
 	for uid, msg := range r.Messages {
-		if _, ok := mr.messages[uid]; !ok {
+		if mstate, ok := mr.messages[uid]; ok {
+			// Expunges may have moved it
+			mstate.SeqNum = msg.SeqNum
+		} else {
 			mstate := &messageState{
 				UID:     uid,
 				SeqNum:  msg.SeqNum,
@@ -143,10 +169,30 @@ func (mr *mailReceiver) handleDelete(r *deleteResult) *messageState {
 		return nil
 	}
 
+	if msg, ok := mr.messages[r.UID]; ok && r.State == StateUnacked {
+		// Couldn't reject the message, leave it be
+		e.Warn("receiver_message_rejection_failed")
+		msg.State = r.State
+		msg.Rejected = false
+		msg.Failed = true
+		mr.drainResult.Rejected--
+		logMessageState(mr.logger, msg)
+		return nil
+	}
+
 	if msg, ok := mr.messages[r.UID]; ok {
+		msg.State = r.State
+
+		// When draining, give up rather than retrying forever
+		if mr.drained != nil {
+			e.Warn("receiver_message_deletion_failed")
+			msg.Failed = true
+			logMessageState(mr.logger, msg)
+			return nil
+		}
+
 		// Delete failed, try again
 		e.Info("receiver_message_deletion_failed")
-		msg.State = r.State
 		logMessageState(mr.logger, msg)
 		return msg
 	}
@@ -163,12 +209,27 @@ func (mr *mailReceiver) handleAck(r *ackRequest) *messageState {
 		mr.logger.WithField("uid", r.UID).Info("receiver_ack")
 	}
 
-	if r.Error != nil {
+	if r.Error != nil && (mr.rejectMailbox == "" || !delivery.IsPermanent(r.Error)) {
+		// Left where it is, it won't be fetched again
+		if msg, ok := mr.messages[r.UID]; ok && msg.State == StateUnacked {
+			msg.Failed = true
+		}
 		return nil
 	}
 
 	if msg, ok := mr.messages[r.UID]; ok {
 		if msg.State == StateUnacked {
+			if r.Error != nil {
+				mr.logger.WithFields(log.Fields{
+					"uid":            r.UID,
+					"reject_mailbox": mr.rejectMailbox,
+				}).Info("receiver_message_rejected")
+				msg.Rejected = true
+				mr.drainResult.Rejected++
+			} else {
+				mr.drainResult.Delivered++
+			}
+
 			msg.State = StateAcked
 			logMessageState(mr.logger, msg)
 			return msg
@@ -178,6 +239,42 @@ func (mr *mailReceiver) handleAck(r *ackRequest) *messageState {
 	return nil
 }
 
+// pending counts the messages that have been passed on, but not yet acked.
+func (mr *mailReceiver) pending() int {
+	n := 0
+	for _, msg := range mr.messages {
+		if msg.State == StateUnacked && !msg.Failed {
+			n++
+		}
+	}
+	return n
+}
+
+// finishDrain sends the drain summary. Anything still known is still in
+// the mailbox.
+func (mr *mailReceiver) finishDrain(err error) {
+	result := mr.drainResult
+	result.Err = err
+	for _, msg := range mr.messages {
+		// Acked messages are meant to be left behind with deletions disabled
+		if msg.Failed || !mr.disableDeletions {
+			result.Left++
+		}
+	}
+
+	e := mr.logger.WithFields(log.Fields{
+		"delivered": result.Delivered,
+		"rejected":  result.Rejected,
+		"left":      result.Left,
+	})
+	if err != nil {
+		e = e.WithError(err)
+	}
+	e.Info("receiver_drained")
+
+	mr.drained <- result
+}
+
 func (mr *mailReceiver) handleMessageUpdate(upd client2.Update) bool {
 	switch vv := upd.(type) {
 	case *client2.StatusUpdate:
@@ -213,6 +310,20 @@ func (mr *mailReceiver) run() {
 	wantFetch := NewCounter()  // Do we need to fetch again
 	wantDelete := NewCounter() // Do we need to delete
 
+	// Is the destination unhealthy? If so, don't fetch anything new.
+	fetchPaused := false
+
+	// When draining, have we fetched everything, and are we done?
+	drainFetched := false
+	drainDone := false
+	var drainErr error
+
+	// Has Drain been called? If so, nothing more is fetched.
+	stopping := false
+
+	// How many messages the current fetch has returned
+	var fetchSeen uint
+
 	setState := func(s sstate) {
 		mr.logger.WithFields(log.Fields{
 			"old": state,
@@ -221,6 +332,27 @@ func (mr *mailReceiver) run() {
 		state = s
 	}
 
+	startFetch := func() {
+		mr.logger.Trace("receiver_fetch_start")
+		wantFetch.Reset()
+		setState(StateInFetch)
+		fetchSeen = 0
+
+		existing := mr.buildCurrentSequence()
+		go func() {
+			op := OperationFetchFinish
+			if err := doFetch(mr.client, existing, mr.fetchBufferSize, mr.imapChannel, mr.logger); err != nil {
+				op = OperationFetchFailed
+			}
+			opChan <- op
+		}()
+	}
+
+	// Nothing prompts the first fetch when draining
+	if mr.drained != nil {
+		opChan <- OperationNone
+	}
+
 	for {
 		mr.logger.WithFields(log.Fields{
 			"state":          state,
@@ -228,6 +360,7 @@ func (mr *mailReceiver) run() {
 			"want_fetch":     wantFetch.IsFlagged(),
 			"want_delete":    wantDelete.IsFlagged(),
 			"want_stop_idle": wantStopIdle.IsFlagged(),
+			"fetch_paused":   fetchPaused,
 		}).Trace("receiver_loop_start")
 
 		op := OperationNone
@@ -248,13 +381,14 @@ func (mr *mailReceiver) run() {
 				}
 
 				// If we're quitting, just discard all new fetches
-				if wantQuit.IsFlagged() {
+				if wantQuit.IsFlagged() || stopping {
 					mr.logger.WithField("uids", r.UIDs).Trace("receiver_ignoring_fetch_quitting")
 					break
 				}
 
 				// Only sends messages out
 				_ = mr.handleFetch(&r)
+				fetchSeen += uint(len(r.Messages))
 			case deleteResult:
 				if state != StateInDelete {
 					mr.logger.WithField("state", state).Panic("receiver_delete_outside_delete")
@@ -274,6 +408,23 @@ func (mr *mailReceiver) run() {
 				nextToProcess[msg.UID] = msg
 				wantDelete.FlagIf(!mr.disableDeletions)
 			}
+		case ch := <-mr.drainChannel:
+			mr.logger.Info("receiver_stopping")
+			mr.drained = ch
+			stopping = true
+			drainFetched = true
+			drainDone = false
+		case health := <-mr.healthChannel:
+			paused := health != delivery.HealthConnected
+			if paused != fetchPaused {
+				mr.logger.WithField("health", health).Info("receiver_destination_health_changed")
+			}
+
+			// Catch up on anything we missed
+			if fetchPaused && !paused {
+				wantFetch.Flag()
+			}
+			fetchPaused = paused
 		case <-time.After(mr.fetchMaxInterval):
 			op = OperationTimeout
 		case op = <-opChan:
@@ -325,6 +476,11 @@ func (mr *mailReceiver) run() {
 				wantDelete.FlagIf(!mr.disableDeletions)
 			}
 
+			// Once there's nothing left to fetch or ack, delete the rest
+			if drainFetched && mr.pending() == 0 {
+				wantDelete.FlagIf(!mr.disableDeletions)
+			}
+
 			if wantDelete.IsFlagged() {
 				wantDelete.Reset()
 
@@ -332,7 +488,7 @@ func (mr *mailReceiver) run() {
 					mr.logger.Trace("receiver_delete_start")
 					setState(StateInDelete)
 					go func(toProcess map[uint32]*messageState) {
-						_ = doDelete(mr.client, mr.imapChannel, toProcess, mr.logger)
+						_ = doDelete(mr.client, mr.imapChannel, toProcess, mr.rejectMailbox, mr.logger)
 						opChan <- OperationDeleteFinish
 					}(nextToProcess)
 					nextToProcess = map[uint32]*messageState{}
@@ -340,16 +496,36 @@ func (mr *mailReceiver) run() {
 				}
 			}
 
-			if wantFetch.IsFlagged() {
-				mr.logger.Trace("receiver_fetch_start")
+			// When draining, only fetch once everything's been acked,
+			// and never IDLE.
+			if mr.drained != nil && !wantQuit.IsFlagged() {
 				wantFetch.Reset()
-				setState(StateInFetch)
 
-				existing := mr.buildCurrentSequence()
-				go func() {
-					_ = doFetch(mr.client, existing, mr.fetchBufferSize, mr.imapChannel, mr.logger)
-					opChan <- OperationFetchFinish
-				}()
+				if drainDone || mr.pending() > 0 {
+					continue
+				}
+
+				if !drainFetched {
+					if fetchPaused {
+						mr.logger.Trace("receiver_fetch_paused")
+					} else {
+						startFetch()
+					}
+					continue
+				}
+
+				// Everything's been fetched, acked, and deleted
+				drainDone = true
+				mr.finishDrain(drainErr)
+				continue
+			}
+
+			if wantFetch.IsFlagged() && fetchPaused && !wantQuit.IsFlagged() {
+				mr.logger.Trace("receiver_fetch_paused")
+			}
+
+			if wantFetch.IsFlagged() && !fetchPaused {
+				startFetch()
 			} else if !wantQuit.IsFlagged() {
 				mr.logger.Trace("receiver_idle_start")
 				setState(StateInIDLE)
@@ -388,8 +564,22 @@ func (mr *mailReceiver) run() {
 			switch op {
 			case OperationNone:
 				break
-			case OperationFetchFinish:
+			case OperationFetchFinish, OperationFetchFailed:
 				mr.logger.Trace("receiver_fetch_finish")
+
+				// A fetch that only found messages we already knew about
+				// means their sequence numbers were out of date, so it's
+				// not done until a fetch finds nothing. If stopping, it
+				// doesn't matter.
+				if mr.drained != nil && !stopping {
+					if op == OperationFetchFailed {
+						drainErr = ErrFetchFailed
+						drainFetched = true
+					} else if fetchSeen == 0 {
+						drainFetched = true
+					}
+				}
+
 				setState(StateNone)
 				opChan <- OperationNone
 			case OperationTimeout:
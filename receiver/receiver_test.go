@@ -21,11 +21,14 @@ package receiver
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"strings"
 	"testing"
 	"time"
 
+	"git.vs49688.net/zane/mailpump/delivery"
 	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/internal/imaptest"
 
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 
@@ -226,3 +229,265 @@ func TestSequenceGeneration(t *testing.T) {
 	toFetch = buildSeqSet(existing, &mbStatus, mr.fetchBufferSize)
 	assert.Equal(t, expected, toFetch)
 }
+
+// mailboxUIDs lists the UIDs in a mailbox. The memory backend isn't safe to
+// read while the server is running, so this goes through IMAP.
+func mailboxUIDs(t *testing.T, addr string, mailbox string) []uint32 {
+	c, err := client.Factory{}.NewClient(&imap2.ClientConfig{ConnectionConfig: imaptest.ConnectionConfig(addr)})
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer func() { _ = c.Logout() }()
+
+	status, err := c.Select(mailbox, true)
+	if !assert.NoError(t, err) || status.Messages == 0 {
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+
+	ch := make(chan *imap.Message, status.Messages)
+	assert.NoError(t, c.Fetch(seqset, []imap.FetchItem{imap.FetchUid}, ch))
+
+	var uids []uint32
+	for msg := range ch {
+		uids = append(uids, msg.Uid)
+	}
+	return uids
+}
+
+func TestRejectMailbox(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	s, addr, _ := internal.BuildTestIMAPServer(t)
+
+	user, err := s.Backend.Login(nil, "username", "password")
+	assert.NoError(t, err)
+	assert.NoError(t, user.CreateMailbox("Rejected"))
+
+	ing, err := ingest.NewClient(&ingest.Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory: client.Factory{},
+	})
+	assert.NoError(t, err)
+	defer ing.Close()
+
+	testMsg, _ := makeTestMessage(t, "<01@localhost>")
+	testMsg.Uid = 1
+	err = ingest.IngestMessageSync("INBOX", ing, testMsg)
+	assert.NoError(t, err)
+
+	ch := make(chan *imap.Message, 1)
+	receiver, err := NewReceiver(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+			Mailbox:  "INBOX",
+		},
+		Factory:              persistentclient.Factory{},
+		Channel:              ch,
+		IDLEFallbackInterval: 1 * time.Second,
+		FetchMaxInterval:     5 * time.Second,
+		RejectMailbox:        "Rejected",
+	})
+	assert.NoError(t, err)
+	defer receiver.Close()
+
+	msg := <-ch
+	receiver.Ack(msg.Uid, &delivery.PermanentError{Err: ingest.ErrMessageTooLarge})
+
+	assert.Eventually(t, func() bool {
+		return len(mailboxUIDs(t, addr, "Rejected")) == 1 && len(mailboxUIDs(t, addr, "INBOX")) == 0
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestDestinationHealthPausesFetch(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	_, addr, _ := internal.BuildTestIMAPServer(t)
+
+	ing, err := ingest.NewClient(&ingest.Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory: client.Factory{},
+	})
+	assert.NoError(t, err)
+	defer ing.Close()
+
+	ch := make(chan *imap.Message, 1)
+	receiver, err := NewReceiver(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+			Mailbox:  "INBOX",
+		},
+		Factory:              persistentclient.Factory{},
+		Channel:              ch,
+		IDLEFallbackInterval: 1 * time.Second,
+		FetchMaxInterval:     1 * time.Second,
+	})
+	assert.NoError(t, err)
+	defer receiver.Close()
+
+	receiver.SetDestinationHealth(delivery.HealthDown)
+
+	testMsg, _ := makeTestMessage(t, "<01@localhost>")
+	testMsg.Uid = 1
+	err = ingest.IngestMessageSync("INBOX", ing, testMsg)
+	assert.NoError(t, err)
+
+	select {
+	case <-ch:
+		assert.Fail(t, "fetched while paused")
+	case <-time.After(3 * time.Second):
+	}
+
+	receiver.SetDestinationHealth(delivery.HealthConnected)
+
+	select {
+	case msg := <-ch:
+		assert.Equal(t, uint32(1), msg.Uid)
+		receiver.Ack(msg.Uid, nil)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "not fetched after resuming")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	_, addr, _ := internal.BuildTestIMAPServer(t)
+
+	ing, err := ingest.NewClient(&ingest.Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory: client.Factory{},
+	})
+	assert.NoError(t, err)
+	defer ing.Close()
+
+	for i, id := range []string{"<01@localhost>", "<02@localhost>", "<03@localhost>"} {
+		testMsg, _ := makeTestMessage(t, id)
+		testMsg.Uid = uint32(i + 1)
+		assert.NoError(t, ingest.IngestMessageSync("INBOX", ing, testMsg))
+	}
+
+	ch := make(chan *imap.Message, 1)
+	drained := make(chan DrainResult, 1)
+	receiver, err := NewReceiver(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+			Mailbox:  "INBOX",
+		},
+		Factory: persistentclient.Factory{},
+		Channel: ch,
+
+		// Make it take more than one fetch
+		FetchBufferSize: 2,
+		Drained:         drained,
+	})
+	assert.NoError(t, err)
+	defer receiver.Close()
+
+	var result DrainResult
+	for done := false; !done; {
+		select {
+		case msg := <-ch:
+			if msg.Uid == 2 {
+				receiver.Ack(msg.Uid, errors.New("temporary failure"))
+			} else {
+				receiver.Ack(msg.Uid, nil)
+			}
+		case result = <-drained:
+			done = true
+		case <-time.After(10 * time.Second):
+			assert.FailNow(t, "not drained")
+		}
+	}
+
+	assert.Equal(t, DrainResult{Delivered: 2, Left: 1}, result)
+	assert.Equal(t, []uint32{2}, mailboxUIDs(t, addr, "INBOX"))
+}
+
+func TestDrainUnsupported(t *testing.T) {
+	_, err := NewReceiver(&Config{
+		Receiver: unsupportedFactory{},
+		Drained:  make(chan DrainResult),
+	})
+	assert.ErrorIs(t, err, ErrDrainUnsupported)
+}
+
+type unsupportedFactory struct{}
+
+func (unsupportedFactory) NewReceiver(*Config) (Client, error) {
+	return nil, nil
+}
+
+func TestDrainOnStop(t *testing.T) {
+	log.SetLevel(log.TraceLevel)
+
+	_, addr, _ := internal.BuildTestIMAPServer(t)
+
+	ing, err := ingest.NewClient(&ingest.Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+		},
+		Factory: client.Factory{},
+	})
+	assert.NoError(t, err)
+	defer ing.Close()
+
+	for i, id := range []string{"<01@localhost>", "<02@localhost>", "<03@localhost>"} {
+		testMsg, _ := makeTestMessage(t, id)
+		testMsg.Uid = uint32(i + 1)
+		assert.NoError(t, ingest.IngestMessageSync("INBOX", ing, testMsg))
+	}
+
+	ch := make(chan *imap.Message, 1)
+	recv, err := NewReceiver(&Config{
+		ConnectionConfig: imap2.ConnectionConfig{
+			HostPort: addr,
+			Auth:     imap2.NewNormalAuthenticator("username", "password"),
+			Mailbox:  "INBOX",
+		},
+		Factory:              persistentclient.Factory{},
+		Channel:              ch,
+		IDLEFallbackInterval: 1 * time.Second,
+		FetchMaxInterval:     5 * time.Second,
+	})
+	assert.NoError(t, err)
+	defer recv.Close()
+
+	// The first is delivered before stopping, the second while stopping,
+	// and the third never is. The acked ones are still waiting for a batch
+	// to fill when it's stopped.
+	first := <-ch
+	recv.Ack(first.Uid, nil)
+
+	drained := make(chan DrainResult, 1)
+	recv.(Drainer).Drain(drained)
+
+	second := <-ch
+	third := <-ch
+	recv.Ack(second.Uid, nil)
+	recv.Ack(third.Uid, errors.New("shutting down"))
+
+	select {
+	case result := <-drained:
+		assert.Equal(t, DrainResult{Delivered: 2, Left: 1}, result)
+	case <-time.After(10 * time.Second):
+		assert.FailNow(t, "not drained")
+	}
+
+	assert.Equal(t, []uint32{third.Uid}, mailboxUIDs(t, addr, "INBOX"))
+}
@@ -19,12 +19,14 @@
 package receiver
 
 import (
+	"errors"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"git.vs49688.net/zane/mailpump/delivery"
 	imap2 "git.vs49688.net/zane/mailpump/imap"
 )
 
@@ -32,6 +34,11 @@ type Config struct {
 	imap2.ConnectionConfig
 	Factory imap2.Factory
 
+	// Receiver, if set, creates the receiver instead of an IMAP one,
+	// e.g. for a non-IMAP source. ConnectionConfig.Mailbox is still
+	// the mailbox to receive from.
+	Receiver Factory
+
 	Logger *log.Entry
 
 	IDLEFallbackInterval time.Duration
@@ -44,6 +51,39 @@ type Config struct {
 	// This is intended solely as a data-loss prevention measure when debugging
 	// against live accounts.
 	DisableDeletions bool
+
+	// RejectMailbox, if set, is the source mailbox that messages permanently
+	// rejected by the destination are moved to. Otherwise, they are left
+	// where they are.
+	RejectMailbox string
+
+	// Drained, if set, puts the receiver in drain mode. Instead of waiting
+	// for new mail, it fetches until there's nothing left, waits for
+	// everything it fetched to be acked and deleted, and then sends a
+	// summary. Only IMAP sources support this.
+	Drained chan<- DrainResult
+}
+
+var (
+	ErrDrainUnsupported = errors.New("source can't be drained")
+	ErrFetchFailed      = errors.New("fetch failed, the mailbox may not be empty")
+	errNoMailbox        = errors.New("no mailbox selected")
+)
+
+// DrainResult summarises a drain.
+type DrainResult struct {
+	// Delivered is the number of messages acked by the destination.
+	Delivered uint
+
+	// Rejected is the number of messages moved to the reject mailbox.
+	Rejected uint
+
+	// Left is the number of messages that were fetched, but are still in
+	// the mailbox because they couldn't be delivered, moved, or deleted.
+	Left uint
+
+	// Err is set if the mailbox couldn't be read to the end.
+	Err error
 }
 
 type Client interface {
@@ -51,9 +91,28 @@ type Client interface {
 	// the message has fully processed and persisted, and thus is EXPUNGE'd from the server.
 	Ack(UID uint32, error error)
 
+	// SetDestinationHealth informs the receiver of the health of the destination.
+	// While it is anything but delivery.HealthConnected, no new messages are fetched,
+	// but the mailbox is still IDLE'd upon.
+	SetDestinationHealth(health delivery.Health)
+
 	Close()
 }
 
+// Drainer is implemented by receivers that can finish what they've started
+// before being closed.
+type Drainer interface {
+	// Drain stops fetching new messages. Once everything that's been passed
+	// on has been acked, and the acked messages deleted, a summary is sent
+	// on ch.
+	Drain(ch chan<- DrainResult)
+}
+
+// Factory creates receivers for a source.
+type Factory interface {
+	NewReceiver(cfg *Config) (Client, error)
+}
+
 type ackRequest struct {
 	UID   uint32
 	Error error
@@ -88,6 +147,7 @@ const (
 	OperationFetchFinish  operation = 2
 	OperationDeleteFinish operation = 3
 	OperationTimeout      operation = 4
+	OperationFetchFailed  operation = 5
 )
 
 func (op operation) String() string {
@@ -102,6 +162,8 @@ func (op operation) String() string {
 		return "delete_finish"
 	case OperationTimeout:
 		return "timeout"
+	case OperationFetchFailed:
+		return "fetch_failed"
 	default:
 		panic("invalid state")
 	}
@@ -112,6 +174,14 @@ type messageState struct {
 	SeqNum  uint32
 	Message *imap.Message
 	State   state
+
+	// Rejected is set if the message should be moved to
+	// the reject mailbox before deletion.
+	Rejected bool
+
+	// Failed is set if the message won't be acked or deleted,
+	// and so is left in the mailbox.
+	Failed bool
 }
 
 type fetchResult struct {
@@ -162,6 +232,12 @@ type mailReceiver struct {
 	// external -> receiver, incoming acks
 	ackChannel chan ackRequest
 
+	// external -> receiver, destination health updates
+	healthChannel chan delivery.Health
+
+	// external -> receiver, drain requests
+	drainChannel chan chan<- DrainResult
+
 	// receiver -> imap handler, message state updates
 	updateChannel chan *messageState
 
@@ -174,6 +250,10 @@ type mailReceiver struct {
 	fetchBufferSize      uint
 	fetchMaxInterval     time.Duration
 	disableDeletions     bool
+	rejectMailbox        string
+
+	drained     chan<- DrainResult
+	drainResult DrainResult
 
 	hasQuit  chan struct{}
 	wantQuit chan struct{}
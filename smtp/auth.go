@@ -0,0 +1,50 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtp
+
+import (
+	"net"
+	smtp2 "net/smtp"
+)
+
+func isLocalhost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *saslAuth) Start(server *smtp2.ServerInfo) (string, []byte, error) {
+	// Same as smtp.PlainAuth, don't send credentials in the clear.
+	if !server.TLS && !isLocalhost(a.host) {
+		return "", nil, ErrInsecureAuth
+	}
+
+	return a.client.Start()
+}
+
+func (a *saslAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	return a.client.Next(fromServer)
+}
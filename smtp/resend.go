@@ -0,0 +1,47 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+func generateMessageID(domain string) string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+// resend prepends a Resent-* block to a message, as per RFC 5322 3.6.6.
+// The original headers are left untouched.
+func resend(body []byte, from string, to []string, date time.Time, messageID string) []byte {
+	out := new(bytes.Buffer)
+	out.WriteString("Resent-Date: " + date.Format(time.RFC1123Z) + "\r\n")
+	if from != "" {
+		out.WriteString("Resent-From: <" + from + ">\r\n")
+	}
+	out.WriteString("Resent-To: <" + strings.Join(to, ">, <") + ">\r\n")
+	out.WriteString("Resent-Message-ID: " + messageID + "\r\n")
+	out.Write(body)
+	return out.Bytes()
+}
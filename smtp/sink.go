@@ -0,0 +1,279 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	smtp2 "net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewSink creates an ingest.Sink that forwards messages over SMTP. The connection
+// is made lazily, and kept open between messages.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	s := &sink{cfg: *cfg}
+
+	switch s.cfg.Security {
+	case "":
+		s.cfg.Security = SecurityStartTLS
+	case SecurityStartTLS, SecurityTLS, SecurityNone:
+	default:
+		return nil, ErrInvalidSecurity
+	}
+
+	switch s.cfg.Mode {
+	case "":
+		s.cfg.Mode = ModeReinject
+	case ModeReinject, ModeResend:
+	default:
+		return nil, ErrInvalidMode
+	}
+
+	host, _, err := net.SplitHostPort(s.cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	s.host = host
+
+	if s.cfg.HELOName == "" {
+		s.cfg.HELOName = "localhost"
+		if name, err := os.Hostname(); err == nil {
+			s.cfg.HELOName = name
+		}
+	}
+
+	if s.cfg.Timeout == 0 {
+		s.cfg.Timeout = 5 * time.Minute
+	}
+
+	if s.cfg.ResentFrom == "" {
+		s.cfg.ResentFrom = s.cfg.From
+	}
+
+	return s, nil
+}
+
+func (s *sink) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if s.cfg.TLSConfig != nil {
+		cfg = s.cfg.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = s.host
+	}
+
+	return cfg
+}
+
+func (s *sink) extendDeadline() {
+	_ = s.conn.SetDeadline(time.Now().Add(s.cfg.Timeout))
+}
+
+func (s *sink) close() {
+	if s.client == nil {
+		return
+	}
+
+	_ = s.client.Close()
+	s.client = nil
+	s.conn = nil
+}
+
+func (s *sink) connect() error {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+
+	var conn net.Conn
+	var err error
+	if s.cfg.Security == SecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.cfg.Address, s.tlsConfig())
+	} else {
+		conn, err = dialer.Dial("tcp", s.cfg.Address)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.extendDeadline()
+
+	c, err := smtp2.NewClient(conn, s.host)
+	if err != nil {
+		_ = conn.Close()
+		s.conn = nil
+		return err
+	}
+	s.client = c
+
+	if err := c.Hello(s.cfg.HELOName); err != nil {
+		s.close()
+		return err
+	}
+
+	if s.cfg.Security == SecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			s.close()
+			return ErrStartTLSUnsupported
+		}
+
+		if err := c.StartTLS(s.tlsConfig()); err != nil {
+			s.close()
+			return err
+		}
+	}
+
+	if s.cfg.Auth != nil {
+		if err := c.Auth(&saslAuth{client: s.cfg.Auth, host: s.host}); err != nil {
+			s.close()
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"address":  s.cfg.Address,
+		"security": s.cfg.Security,
+	}).Trace("smtp_connected")
+	return nil
+}
+
+// reset makes sure the connection is ready for a new transaction,
+// reconnecting if needed.
+func (s *sink) reset() error {
+	if s.client != nil {
+		s.extendDeadline()
+		if err := s.client.Reset(); err == nil {
+			return nil
+		}
+
+		// The server probably timed us out
+		s.close()
+	}
+
+	return s.connect()
+}
+
+func (s *sink) recipients(mailbox string) []string {
+	if len(s.cfg.Recipients) > 0 {
+		return s.cfg.Recipients
+	}
+
+	if mailbox == "" || strings.EqualFold(mailbox, "INBOX") {
+		return nil
+	}
+
+	return []string{mailbox}
+}
+
+func (s *sink) send(from string, rcpts []string, body []byte) error {
+	if err := s.client.Mail(from); err != nil {
+		return err
+	}
+
+	for _, rcpt := range rcpts {
+		if err := s.client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := s.client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(body); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	rcpts := s.recipients(mailbox)
+	if len(rcpts) == 0 {
+		return &delivery.PermanentError{Err: ErrNoRecipients}
+	}
+
+	from := s.cfg.From
+	if from == "" {
+		from = ingest.ReturnPath(body)
+	}
+
+	if s.cfg.Mode == ModeResend {
+		body = resend(body, s.cfg.ResentFrom, rcpts, time.Now(), generateMessageID(s.cfg.HELOName))
+	}
+
+	if err := s.reset(); err != nil {
+		return err
+	}
+
+	err := s.send(from, rcpts, body)
+	if err == nil {
+		log.WithFields(log.Fields{
+			"mailbox":    mailbox,
+			"recipients": rcpts,
+		}).Trace("smtp_forwarded")
+		return nil
+	}
+
+	// A reply from the server means the connection is still fine,
+	// anything else and we can't trust it.
+	var tpErr *textproto.Error
+	if !errors.As(err, &tpErr) {
+		s.close()
+		return err
+	}
+
+	log.WithError(err).WithFields(log.Fields{
+		"mailbox": mailbox,
+		"code":    tpErr.Code,
+	}).Warn("smtp_rejected")
+
+	if tpErr.Code/100 == 5 {
+		return &delivery.PermanentError{Err: err}
+	}
+
+	return err
+}
+
+func (s *sink) Close() error {
+	if s.client == nil {
+		return nil
+	}
+
+	s.extendDeadline()
+	err := s.client.Quit()
+	if err != nil {
+		_ = s.client.Close()
+	}
+	s.client = nil
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,321 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+)
+
+const testMessage = "Return-Path: <sender@example.com>\r\n" +
+	"From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+type fakeMessage struct {
+	From       string
+	Recipients []string
+	Body       string
+	User       string
+	TLS        bool
+}
+
+// fakeServer is a minimal SMTP server. Recipients are rejected with the
+// code in rcptCodes.
+type fakeServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+	implicit  bool
+	rcptCodes map[string]int
+
+	mu       sync.Mutex
+	messages []fakeMessage
+}
+
+func newFakeServer(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	s := &fakeServer{
+		listener:  l,
+		tlsConfig: tlsConfig,
+		implicit:  implicit,
+		rcptCodes: map[string]int{},
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		if s.implicit {
+			conn = tls.Server(conn, s.tlsConfig)
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeServer) handle(netConn net.Conn) {
+	conn := textproto.NewConn(netConn)
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.PrintfLine("220 localhost ESMTP ready")
+
+	msg := fakeMessage{TLS: s.implicit}
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			_ = conn.PrintfLine("250-localhost")
+			if s.tlsConfig != nil && !s.implicit && !msg.TLS {
+				_ = conn.PrintfLine("250-STARTTLS")
+			}
+			_ = conn.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			_ = conn.PrintfLine("220 Go ahead")
+			tlsConn := tls.Server(netConn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			netConn = tlsConn
+			conn = textproto.NewConn(tlsConn)
+			msg.TLS = true
+		case "AUTH":
+			mech, ir, _ := strings.Cut(arg, " ")
+			user := ""
+			switch mech {
+			case "PLAIN":
+				b, _ := base64.StdEncoding.DecodeString(ir)
+				user = strings.Split(string(b), "\x00")[1]
+			case "LOGIN":
+				b, _ := base64.StdEncoding.DecodeString(ir)
+				user = string(b)
+				_ = conn.PrintfLine("334 %v", base64.StdEncoding.EncodeToString([]byte("Password:")))
+				if _, err := conn.ReadLine(); err != nil {
+					return
+				}
+			}
+			msg.User = user
+			_ = conn.PrintfLine("235 Authenticated")
+		case "MAIL":
+			msg.From = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			_ = conn.PrintfLine("250 OK")
+		case "RCPT":
+			rcpt := strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			if code, ok := s.rcptCodes[rcpt]; ok {
+				_ = conn.PrintfLine("%d rejected", code)
+				continue
+			}
+			msg.Recipients = append(msg.Recipients, rcpt)
+			_ = conn.PrintfLine("250 OK")
+		case "DATA":
+			_ = conn.PrintfLine("354 Go ahead")
+			body, err := conn.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.Body = string(body)
+
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+
+			_ = conn.PrintfLine("250 Queued")
+		case "RSET":
+			msg = fakeMessage{User: msg.User, TLS: msg.TLS}
+			_ = conn.PrintfLine("250 OK")
+		case "QUIT":
+			_ = conn.PrintfLine("221 Bye")
+			return
+		default:
+			_ = conn.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+func (s *fakeServer) Messages() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+func newTestSink(t *testing.T, cfg *Config) ingest.Sink {
+	cfg.Timeout = 5 * time.Second
+	sink, err := NewSink(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = sink.Close() })
+	return sink
+}
+
+func TestForward(t *testing.T) {
+	s := newFakeServer(t, nil, false)
+
+	sink := newTestSink(t, &Config{
+		Address:    s.listener.Addr().String(),
+		Security:   SecurityNone,
+		Auth:       sasl.NewPlainClient("", "user", "pass"),
+		Recipients: []string{"forward@example.com"},
+	})
+
+	assert.NoError(t, sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage)))
+	assert.NoError(t, sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage)))
+
+	msgs := s.Messages()
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, "sender@example.com", msgs[0].From)
+		assert.Equal(t, []string{"forward@example.com"}, msgs[0].Recipients)
+		assert.Equal(t, "user", msgs[0].User)
+		assert.Equal(t, strings.ReplaceAll(testMessage, "\r\n", "\n"), msgs[0].Body)
+	}
+}
+
+func TestResend(t *testing.T) {
+	s := newFakeServer(t, nil, false)
+
+	sink := newTestSink(t, &Config{
+		Address:  s.listener.Addr().String(),
+		Security: SecurityNone,
+		From:     "pump@example.com",
+		Mode:     ModeResend,
+	})
+
+	assert.NoError(t, sink.Deliver("forward@example.com", nil, time.Time{}, []byte(testMessage)))
+
+	msgs := s.Messages()
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, "pump@example.com", msgs[0].From)
+		assert.Equal(t, []string{"forward@example.com"}, msgs[0].Recipients)
+
+		lines := strings.Split(msgs[0].Body, "\n")
+		assert.True(t, strings.HasPrefix(lines[0], "Resent-Date: "))
+		assert.Equal(t, "Resent-From: <pump@example.com>", lines[1])
+		assert.Equal(t, "Resent-To: <forward@example.com>", lines[2])
+		assert.True(t, strings.HasPrefix(lines[3], "Resent-Message-ID: <"))
+		assert.Equal(t, strings.ReplaceAll(testMessage, "\r\n", "\n"), strings.Join(lines[4:], "\n"))
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tlsConfig := internal.BuildTestTLSConfig(t)
+
+	t.Run("starttls", func(t *testing.T) {
+		s := newFakeServer(t, tlsConfig, false)
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			TLSConfig:  &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+			Auth:       sasl.NewLoginClient("user", "pass"),
+			Recipients: []string{"forward@example.com"},
+		})
+
+		assert.NoError(t, sink.Deliver("", nil, time.Time{}, []byte(testMessage)))
+		msgs := s.Messages()
+		if assert.Len(t, msgs, 1) {
+			assert.True(t, msgs[0].TLS)
+			assert.Equal(t, "user", msgs[0].User)
+		}
+	})
+
+	t.Run("implicit", func(t *testing.T) {
+		s := newFakeServer(t, tlsConfig, true)
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			Security:   SecurityTLS,
+			TLSConfig:  &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+			Recipients: []string{"forward@example.com"},
+		})
+
+		assert.NoError(t, sink.Deliver("", nil, time.Time{}, []byte(testMessage)))
+		msgs := s.Messages()
+		if assert.Len(t, msgs, 1) {
+			assert.True(t, msgs[0].TLS)
+		}
+	})
+
+	t.Run("starttls_unsupported", func(t *testing.T) {
+		s := newFakeServer(t, nil, false)
+		sink := newTestSink(t, &Config{
+			Address:    s.listener.Addr().String(),
+			Recipients: []string{"forward@example.com"},
+		})
+
+		err := sink.Deliver("", nil, time.Time{}, []byte(testMessage))
+		assert.ErrorIs(t, err, ErrStartTLSUnsupported)
+
+		var perr *delivery.PermanentError
+		assert.False(t, errors.As(err, &perr))
+	})
+}
+
+func TestRejected(t *testing.T) {
+	s := newFakeServer(t, nil, false)
+	s.rcptCodes["unknown@example.com"] = 550
+	s.rcptCodes["busy@example.com"] = 451
+
+	sink := newTestSink(t, &Config{
+		Address:  s.listener.Addr().String(),
+		Security: SecurityNone,
+	})
+
+	var perr *delivery.PermanentError
+
+	err := sink.Deliver("unknown@example.com", nil, time.Time{}, []byte(testMessage))
+	assert.ErrorAs(t, err, &perr)
+
+	err = sink.Deliver("busy@example.com", nil, time.Time{}, []byte(testMessage))
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &perr))
+
+	// The connection should still be usable
+	assert.NoError(t, sink.Deliver("user@example.com", nil, time.Time{}, []byte(testMessage)))
+	assert.Len(t, s.Messages(), 1)
+
+	err = sink.Deliver("INBOX", nil, time.Time{}, []byte(testMessage))
+	assert.ErrorIs(t, err, ErrNoRecipients)
+}
@@ -0,0 +1,104 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	smtp2 "net/smtp"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+var (
+	ErrNoRecipients        = errors.New("no recipients")
+	ErrStartTLSUnsupported = errors.New("server does not support STARTTLS")
+	ErrInsecureAuth        = errors.New("refusing to authenticate over an unencrypted connection")
+	ErrInvalidSecurity     = errors.New("invalid security type")
+	ErrInvalidMode         = errors.New("invalid forwarding mode")
+)
+
+type Security string
+
+const (
+	// SecurityStartTLS upgrades the connection with STARTTLS, failing if the
+	// server doesn't support it.
+	SecurityStartTLS Security = "starttls"
+
+	// SecurityTLS connects with implicit TLS.
+	SecurityTLS Security = "tls"
+
+	// SecurityNone never uses TLS.
+	SecurityNone Security = "none"
+)
+
+type Mode string
+
+const (
+	// ModeReinject sends the message untouched.
+	ModeReinject Mode = "reinject"
+
+	// ModeResend prepends Resent-* headers to the message.
+	ModeResend Mode = "resend"
+)
+
+type Config struct {
+	// Address is the HOST:PORT of the server.
+	Address string
+
+	Security  Security
+	TLSConfig *tls.Config
+
+	// Auth, if set, is used to authenticate after connecting.
+	Auth sasl.Client
+
+	// Recipients are the addresses to forward to. If empty, the target
+	// mailbox is used as the recipient.
+	Recipients []string
+
+	// From is the envelope sender. If empty, it is taken from the message's
+	// Return-Path header, or is null.
+	From string
+
+	Mode Mode
+
+	// ResentFrom is the address used in the Resent-From header. Defaults to From.
+	ResentFrom string
+
+	// HELOName is the name to greet the server with. Defaults to the hostname.
+	HELOName string
+
+	// Timeout is the timeout for each message.
+	Timeout time.Duration
+}
+
+// saslAuth adapts a sasl.Client into a smtp.Auth.
+type saslAuth struct {
+	client sasl.Client
+	host   string
+}
+
+type sink struct {
+	cfg    Config
+	host   string
+	conn   net.Conn
+	client *smtp2.Client
+}
@@ -0,0 +1,213 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtpd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var rfc822Section, _ = imap.ParseBodySectionName(imap.FetchRFC822)
+
+func NewServer(cfg *Config) (Server, error) {
+	s := &server{
+		cfg:       *cfg,
+		routes:    map[string]string{},
+		listeners: map[net.Listener]struct{}{},
+		sessions:  map[*session]struct{}{},
+	}
+
+	if s.cfg.Ingest == nil {
+		return nil, ErrNoIngest
+	}
+
+	switch s.cfg.Protocol {
+	case "":
+		s.cfg.Protocol = ProtocolSMTP
+	case ProtocolSMTP, ProtocolLMTP:
+	default:
+		return nil, ErrInvalidProtocol
+	}
+
+	if s.cfg.Hostname == "" {
+		s.cfg.Hostname, _ = os.Hostname()
+		if s.cfg.Hostname == "" {
+			s.cfg.Hostname = "localhost"
+		}
+	}
+
+	if s.cfg.Source == "" {
+		s.cfg.Source = string(s.cfg.Protocol)
+	}
+
+	if s.cfg.MaxRecipients == 0 {
+		s.cfg.MaxRecipients = 100
+	}
+
+	if s.cfg.Timeout == 0 {
+		s.cfg.Timeout = 5 * time.Minute
+	}
+
+	if s.cfg.Logger == nil {
+		s.cfg.Logger = log.NewEntry(log.StandardLogger())
+	}
+
+	for k, v := range s.cfg.Routes {
+		s.routes[strings.ToLower(k)] = v
+	}
+
+	return s, nil
+}
+
+func (s *server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	s.cfg.Logger.WithField("address", l.Addr().String()).Info("smtpd_listening")
+
+	var tempDelay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closed.Load() {
+				return ErrServerClosed
+			}
+
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else if tempDelay *= 2; tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+
+				s.cfg.Logger.WithError(err).Warn("smtpd_accept_failed")
+				time.Sleep(tempDelay)
+				continue
+			}
+
+			s.mu.Lock()
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			return err
+		}
+		tempDelay = 0
+
+		sess := newSession(s, conn)
+
+		s.mu.Lock()
+		if s.closed.Load() {
+			s.mu.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		s.sessions[sess] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			sess.serve()
+
+			s.mu.Lock()
+			delete(s.sessions, sess)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+func (s *server) Close() error {
+	s.mu.Lock()
+	if s.closed.Load() {
+		s.mu.Unlock()
+		s.wg.Wait()
+		return nil
+	}
+	s.closed.Store(true)
+
+	for l := range s.listeners {
+		_ = l.Close()
+	}
+
+	// Wake up any sessions waiting for a command, the rest will notice
+	// once their transaction is done.
+	for sess := range s.sessions {
+		sess.interrupt()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+// route finds the mailbox for a recipient, trying the full address, then the
+// local part, then the domain.
+func (s *server) route(address string) (string, bool) {
+	address = strings.ToLower(address)
+
+	if mailbox, ok := s.routes[address]; ok {
+		return mailbox, true
+	}
+
+	if at := strings.LastIndexByte(address, '@'); at >= 0 {
+		if mailbox, ok := s.routes[address[:at]]; ok {
+			return mailbox, true
+		}
+
+		if mailbox, ok := s.routes[address[at:]]; ok {
+			return mailbox, true
+		}
+	}
+
+	if s.cfg.RejectUnknown {
+		return "", false
+	}
+
+	return s.cfg.DefaultMailbox, true
+}
+
+// deliver ingests a message into a mailbox, waiting for the result.
+func (s *server) deliver(mailbox string, body []byte) error {
+	uid := atomic.AddUint32(&s.uid, 1)
+	if uid == 0 {
+		uid = atomic.AddUint32(&s.uid, 1)
+	}
+
+	msg := imap.NewMessage(uid, []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822})
+	msg.Uid = uid
+	msg.InternalDate = time.Now()
+	msg.Body[rfc822Section] = bytes.NewBuffer(body)
+
+	// Don't keep the client waiting forever if the destination is down, it'll retry.
+	return ingest.IngestMessageSyncTimeout(s.cfg.Source, mailbox, s.cfg.Ingest, msg, s.cfg.Timeout)
+}
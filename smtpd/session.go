@@ -0,0 +1,685 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// maxLineLength is the longest line read from a client. RFC 5321 only allows
+// 1000, but plenty of mail has longer lines.
+const maxLineLength = 64 * 1024
+
+var (
+	errQuit            = errors.New("quit")
+	errLineTooLong     = errors.New("line too long")
+	errMessageTooLarge = errors.New("message too large")
+)
+
+func newSession(s *server, conn net.Conn) *session {
+	return &session{
+		server:  s,
+		netConn: conn,
+		conn:    textproto.NewConn(conn),
+		logger:  s.cfg.Logger.WithField("remote", conn.RemoteAddr().String()),
+	}
+}
+
+func (s *session) lmtp() bool {
+	return s.server.cfg.Protocol == ProtocolLMTP
+}
+
+// interrupt wakes the session up if it's waiting for a command.
+func (s *session) interrupt() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.idle {
+		_ = s.netConn.SetReadDeadline(time.Now())
+	}
+}
+
+func (s *session) reply(code int, format string, args ...interface{}) error {
+	_ = s.netConn.SetWriteDeadline(time.Now().Add(s.server.cfg.Timeout))
+	return s.conn.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *session) replyLines(code int, lines []string) error {
+	_ = s.netConn.SetWriteDeadline(time.Now().Add(s.server.cfg.Timeout))
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+
+		if err := s.conn.PrintfLine("%d%s%s", code, sep, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readLine reads a line from the client, within the timeout.
+func (s *session) readLine() (string, error) {
+	_ = s.netConn.SetReadDeadline(time.Now().Add(s.server.cfg.Timeout))
+	return s.readLimitedLine()
+}
+
+// readLimitedLine reads a line like textproto.Reader.ReadLine, but discards
+// any line longer than maxLineLength, returning errLineTooLong, so a client
+// can't make it grow without bound.
+func (s *session) readLimitedLine() (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := s.conn.R.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxLineLength {
+			tooLong = true
+			line = nil
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	if tooLong {
+		return "", errLineTooLong
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// readCommand waits for the next command. It can be interrupted by the
+// server closing.
+func (s *session) readCommand() (string, error) {
+	s.mu.Lock()
+	if s.server.closed.Load() {
+		s.mu.Unlock()
+		return "", ErrServerClosed
+	}
+	_ = s.netConn.SetReadDeadline(time.Now().Add(s.server.cfg.Timeout))
+	s.idle = true
+	s.mu.Unlock()
+
+	line, err := s.readLimitedLine()
+
+	s.mu.Lock()
+	s.idle = false
+	s.mu.Unlock()
+
+	if err != nil && s.server.closed.Load() {
+		return "", ErrServerClosed
+	}
+	return line, err
+}
+
+func (s *session) serve() {
+	defer func() { _ = s.conn.Close() }()
+
+	s.logger.Debug("smtpd_session_started")
+
+	greeting := "ESMTP"
+	if s.lmtp() {
+		greeting = "LMTP"
+	}
+
+	if err := s.reply(220, "%v %v mailpump ready", s.server.cfg.Hostname, greeting); err != nil {
+		return
+	}
+
+	for {
+		line, err := s.readCommand()
+		if errors.Is(err, ErrServerClosed) {
+			_ = s.reply(421, "%v Service shutting down", s.server.cfg.Hostname)
+			s.logger.Debug("smtpd_session_closed")
+			return
+		} else if errors.Is(err, errLineTooLong) {
+			if err := s.reply(500, "Line too long"); err != nil {
+				return
+			}
+			continue
+		} else if err != nil {
+			s.logger.WithError(err).Debug("smtpd_session_ended")
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		if err := s.handle(strings.ToUpper(verb), strings.TrimSpace(arg)); errors.Is(err, errQuit) {
+			s.logger.Debug("smtpd_session_ended")
+			return
+		} else if err != nil {
+			s.logger.WithError(err).Debug("smtpd_session_ended")
+			return
+		}
+	}
+}
+
+func (s *session) handle(verb string, arg string) error {
+	switch verb {
+	case "HELO", "EHLO":
+		if s.lmtp() {
+			return s.reply(500, "This is an LMTP server, use LHLO")
+		}
+		return s.hello(arg, verb == "EHLO")
+	case "LHLO":
+		if !s.lmtp() {
+			return s.reply(500, "Command not recognized")
+		}
+		return s.hello(arg, true)
+	case "STARTTLS":
+		return s.startTLS(arg)
+	case "AUTH":
+		return s.auth(arg)
+	case "MAIL":
+		return s.mail(arg)
+	case "RCPT":
+		return s.rcpt(arg)
+	case "DATA":
+		return s.data(arg)
+	case "RSET":
+		s.reset()
+		return s.reply(250, "OK")
+	case "NOOP":
+		return s.reply(250, "OK")
+	case "VRFY":
+		return s.reply(252, "Cannot VRFY user")
+	case "QUIT":
+		_ = s.reply(221, "%v Bye", s.server.cfg.Hostname)
+		return errQuit
+	default:
+		return s.reply(500, "Command not recognized")
+	}
+}
+
+func (s *session) reset() {
+	s.from = ""
+	s.hasFrom = false
+	s.recipients = nil
+}
+
+func (s *session) canAuth() bool {
+	return len(s.server.cfg.Users) > 0 && (s.server.cfg.TLSConfig == nil || s.tls)
+}
+
+func (s *session) hello(arg string, extended bool) error {
+	if arg == "" {
+		return s.reply(501, "Domain required")
+	}
+
+	s.reset()
+	s.helo = arg
+	s.extended = extended
+
+	if !extended {
+		return s.reply(250, "%v", s.server.cfg.Hostname)
+	}
+
+	lines := []string{s.server.cfg.Hostname, "PIPELINING", "8BITMIME"}
+
+	if s.server.cfg.MaxMessageSize > 0 {
+		lines = append(lines, fmt.Sprintf("SIZE %d", s.server.cfg.MaxMessageSize))
+	} else {
+		lines = append(lines, "SIZE")
+	}
+
+	if s.server.cfg.TLSConfig != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+
+	if s.canAuth() {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+
+	return s.replyLines(250, lines)
+}
+
+func (s *session) startTLS(arg string) error {
+	if s.server.cfg.TLSConfig == nil {
+		return s.reply(502, "Command not implemented")
+	} else if s.tls {
+		return s.reply(503, "Already running TLS")
+	} else if arg != "" {
+		return s.reply(501, "Syntax error")
+	}
+
+	if err := s.reply(220, "Ready to start TLS"); err != nil {
+		return err
+	}
+
+	// Anything sent before the handshake can't be trusted.
+	if s.conn.R.Buffered() > 0 {
+		return errors.New("data sent before tls handshake")
+	}
+
+	tlsConn := tls.Server(s.netConn, s.server.cfg.TLSConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(s.server.cfg.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.netConn = tlsConn
+	s.conn = textproto.NewConn(tlsConn)
+	s.mu.Unlock()
+
+	s.tls = true
+	s.helo = ""
+	s.extended = false
+	s.authenticated = false
+	s.reset()
+	return nil
+}
+
+// readAuthResponse sends a challenge and decodes the response.
+func (s *session) readAuthResponse(challenge string) ([]byte, bool, error) {
+	if err := s.reply(334, "%v", challenge); err != nil {
+		return nil, false, err
+	}
+
+	line, err := s.readLine()
+	if errors.Is(err, errLineTooLong) {
+		return nil, false, s.reply(500, "Line too long")
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if line == "*" {
+		return nil, false, s.reply(501, "Authentication cancelled")
+	}
+
+	resp, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		return nil, false, s.reply(501, "Invalid base64 data")
+	}
+
+	return resp, true, nil
+}
+
+func (s *session) auth(arg string) error {
+	if len(s.server.cfg.Users) == 0 {
+		return s.reply(502, "Command not implemented")
+	} else if !s.canAuth() {
+		return s.reply(538, "Encryption required for requested authentication mechanism")
+	} else if s.helo == "" || !s.extended {
+		return s.reply(503, "Send EHLO first")
+	} else if s.authenticated {
+		return s.reply(503, "Already authenticated")
+	} else if s.hasFrom {
+		return s.reply(503, "Not permitted during a mail transaction")
+	}
+
+	mech, ir, hasIR := strings.Cut(arg, " ")
+
+	var username, password string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		var resp []byte
+		if hasIR && ir != "=" {
+			var err error
+			if resp, err = base64.StdEncoding.DecodeString(ir); err != nil {
+				return s.reply(501, "Invalid base64 data")
+			}
+		} else if !hasIR {
+			var ok bool
+			var err error
+			if resp, ok, err = s.readAuthResponse(""); !ok {
+				return err
+			}
+		}
+
+		parts := strings.Split(string(resp), "\x00")
+		if len(parts) != 3 {
+			return s.reply(501, "Invalid PLAIN response")
+		}
+
+		// The authorization identity, if given, must be the user.
+		if parts[0] != "" && parts[0] != parts[1] {
+			return s.reply(535, "Authentication credentials invalid")
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		if hasIR {
+			user, err := base64.StdEncoding.DecodeString(ir)
+			if err != nil {
+				return s.reply(501, "Invalid base64 data")
+			}
+			username = string(user)
+		} else {
+			user, ok, err := s.readAuthResponse(base64.StdEncoding.EncodeToString([]byte("Username:")))
+			if !ok {
+				return err
+			}
+			username = string(user)
+		}
+
+		pass, ok, err := s.readAuthResponse(base64.StdEncoding.EncodeToString([]byte("Password:")))
+		if !ok {
+			return err
+		}
+		password = string(pass)
+	default:
+		return s.reply(504, "Unrecognized authentication type")
+	}
+
+	expected, exists := s.server.cfg.Users[username]
+	if !exists || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+		s.logger.WithField("username", username).Warn("smtpd_auth_failed")
+		return s.reply(535, "Authentication credentials invalid")
+	}
+
+	s.authenticated = true
+	s.logger = s.logger.WithField("username", username)
+	s.logger.Debug("smtpd_auth_succeeded")
+	return s.reply(235, "Authentication succeeded")
+}
+
+// parsePath parses the argument to MAIL or RCPT, e.g. "FROM:<user@example.com> SIZE=123".
+func parsePath(arg string, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	arg = strings.TrimLeft(arg[len(prefix):], " ")
+
+	var path string
+	if strings.HasPrefix(arg, "<") {
+		end := strings.IndexByte(arg, '>')
+		if end < 0 {
+			return "", nil, false
+		}
+		path, arg = arg[1:end], arg[end+1:]
+	} else {
+		path, arg, _ = strings.Cut(arg, " ")
+	}
+
+	// Drop any source route, e.g. "@a,@b:user@example.com".
+	if strings.HasPrefix(path, "@") {
+		if _, after, ok := strings.Cut(path, ":"); ok {
+			path = after
+		}
+	}
+
+	return path, strings.Fields(arg), true
+}
+
+func (s *session) mail(arg string) error {
+	if s.helo == "" {
+		return s.reply(503, "Send HELO/EHLO first")
+	} else if len(s.server.cfg.Users) > 0 && !s.authenticated {
+		return s.reply(530, "Authentication required")
+	} else if s.hasFrom {
+		return s.reply(503, "Nested MAIL command")
+	}
+
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		return s.reply(501, "Syntax: MAIL FROM:<address>")
+	}
+
+	for _, param := range params {
+		key, value, _ := strings.Cut(param, "=")
+		switch strings.ToUpper(key) {
+		case "SIZE":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return s.reply(501, "Invalid SIZE parameter")
+			}
+
+			if s.server.cfg.MaxMessageSize > 0 && size > s.server.cfg.MaxMessageSize {
+				return s.reply(552, "Message size exceeds fixed maximum message size")
+			}
+		case "BODY":
+			if !strings.EqualFold(value, "7BIT") && !strings.EqualFold(value, "8BITMIME") {
+				return s.reply(501, "Invalid BODY parameter")
+			}
+		default:
+			return s.reply(555, "Unsupported parameter %v", key)
+		}
+	}
+
+	s.from = from
+	s.hasFrom = true
+	return s.reply(250, "OK")
+}
+
+func (s *session) rcpt(arg string) error {
+	if !s.hasFrom {
+		return s.reply(503, "Need MAIL command")
+	} else if len(s.recipients) >= s.server.cfg.MaxRecipients {
+		return s.reply(452, "Too many recipients")
+	}
+
+	to, params, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		return s.reply(501, "Syntax: RCPT TO:<address>")
+	} else if len(params) > 0 {
+		return s.reply(555, "Unsupported parameter %v", params[0])
+	}
+
+	mailbox, ok := s.server.route(to)
+	if !ok {
+		s.logger.WithField("recipient", to).Info("smtpd_recipient_rejected")
+		return s.reply(550, "No such user here")
+	}
+
+	s.recipients = append(s.recipients, recipient{Address: to, Mailbox: mailbox})
+	return s.reply(250, "OK")
+}
+
+// readData reads the message up to the terminating ".", converting line
+// endings to CRLF. If the message is too large, or has a line that's too long,
+// the rest of it is discarded and errMessageTooLarge or errLineTooLong is
+// returned.
+func (s *session) readData() ([]byte, error) {
+	var buf bytes.Buffer
+	var reject error
+	max := s.server.cfg.MaxMessageSize
+
+	for {
+		line, err := s.readLine()
+		if errors.Is(err, errLineTooLong) {
+			reject = err
+			buf.Reset()
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if line == "." {
+			return buf.Bytes(), reject
+		}
+
+		if reject != nil {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, ".")
+		if max > 0 && int64(buf.Len()+len(line)+2) > max {
+			reject = errMessageTooLarge
+			buf.Reset()
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteString("\r\n")
+	}
+}
+
+// trace builds the Return-Path and Received headers for the message.
+func (s *session) trace() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Return-Path: <%v>\r\n", s.from)
+
+	with := "SMTP"
+	if s.lmtp() {
+		with = "LMTP"
+	} else if s.extended {
+		with = "ESMTP"
+	}
+
+	if s.tls {
+		with += "S"
+	}
+
+	if s.authenticated {
+		with += "A"
+	}
+
+	fmt.Fprintf(&b, "Received: from %v", s.helo)
+	if host, _, err := net.SplitHostPort(s.netConn.RemoteAddr().String()); err == nil && host != "" {
+		fmt.Fprintf(&b, " ([%v])", host)
+	}
+	fmt.Fprintf(&b, "\r\n\tby %v with %v", s.server.cfg.Hostname, with)
+
+	if len(s.recipients) == 1 {
+		fmt.Fprintf(&b, "\r\n\tfor <%v>", s.recipients[0].Address)
+	}
+	fmt.Fprintf(&b, "; %v\r\n", time.Now().Format(time.RFC1123Z))
+
+	return b.String()
+}
+
+// replyFor picks the reply for a delivery error.
+func replyFor(err error) (int, string) {
+	if err == nil {
+		return 250, "OK"
+	} else if errors.Is(err, ingest.ErrMessageTooLarge) {
+		return 552, "Message size exceeds destination limit"
+	} else if errors.Is(err, ingest.ErrTimeout) {
+		return 451, "Timed out waiting for the destination, try again later"
+	} else if delivery.IsPermanent(err) {
+		return 554, "Delivery failed"
+	} else {
+		return 451, "Temporary delivery failure, try again later"
+	}
+}
+
+func (s *session) data(arg string) error {
+	if !s.hasFrom {
+		return s.reply(503, "Need MAIL command")
+	} else if len(s.recipients) == 0 {
+		return s.reply(503, "Need RCPT command")
+	} else if arg != "" {
+		return s.reply(501, "Syntax error")
+	}
+
+	if err := s.reply(354, "Start mail input; end with <CRLF>.<CRLF>"); err != nil {
+		return err
+	}
+
+	data, err := s.readData()
+	if err != nil && !errors.Is(err, errMessageTooLarge) && !errors.Is(err, errLineTooLong) {
+		return err
+	}
+
+	recipients := s.recipients
+	defer s.reset()
+
+	if errors.Is(err, errMessageTooLarge) {
+		s.logger.WithField("max_size", s.server.cfg.MaxMessageSize).Info("smtpd_message_too_large")
+		return s.replyAll(recipients, func(recipient) (int, string) {
+			return 552, "Message size exceeds fixed maximum message size"
+		})
+	} else if errors.Is(err, errLineTooLong) {
+		s.logger.WithField("max_length", maxLineLength).Info("smtpd_line_too_long")
+		return s.replyAll(recipients, func(recipient) (int, string) {
+			return 500, "Line too long"
+		})
+	}
+
+	body := append([]byte(s.trace()), data...)
+
+	// Deliver once to each mailbox, no matter how many recipients route there.
+	results := map[string]error{}
+	for _, rcpt := range recipients {
+		if _, ok := results[rcpt.Mailbox]; ok {
+			continue
+		}
+
+		err := s.server.deliver(rcpt.Mailbox, body)
+		results[rcpt.Mailbox] = err
+
+		logger := s.logger.WithFields(log.Fields{
+			"from":    s.from,
+			"mailbox": rcpt.Mailbox,
+			"size":    len(body),
+		})
+		if err != nil {
+			logger.WithError(err).Error("smtpd_delivery_failed")
+		} else {
+			logger.Info("smtpd_message_delivered")
+		}
+	}
+
+	if s.lmtp() {
+		return s.replyAll(recipients, func(rcpt recipient) (int, string) {
+			return replyFor(results[rcpt.Mailbox])
+		})
+	}
+
+	// SMTP only has one reply. If anything failed temporarily, have the client
+	// retry the lot, even if it means a duplicate in the other mailboxes.
+	var failed error
+	for _, err := range results {
+		if err != nil && (failed == nil || !delivery.IsPermanent(err)) {
+			failed = err
+		}
+	}
+
+	code, msg := replyFor(failed)
+	return s.reply(code, "%v", msg)
+}
+
+// replyAll sends an LMTP reply for each recipient, or a single SMTP reply.
+func (s *session) replyAll(recipients []recipient, fn func(rcpt recipient) (int, string)) error {
+	if !s.lmtp() {
+		code, msg := fn(recipient{})
+		return s.reply(code, "%v", msg)
+	}
+
+	for _, rcpt := range recipients {
+		code, msg := fn(rcpt)
+		if err := s.reply(code, "<%v> %v", rcpt.Address, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
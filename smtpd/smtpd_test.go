@@ -0,0 +1,354 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/smtp"
+)
+
+const testMessage = "From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	".Hello\r\n"
+
+type testDelivery struct {
+	Mailbox string
+	Body    string
+}
+
+// testSink records deliveries, failing those to mailboxes in errors.
+type testSink struct {
+	mu         sync.Mutex
+	errors     map[string]error
+	deliveries []testDelivery
+}
+
+func (s *testSink) Deliver(mailbox string, _ []string, _ time.Time, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err, ok := s.errors[mailbox]; ok {
+		return err
+	}
+
+	s.deliveries = append(s.deliveries, testDelivery{Mailbox: mailbox, Body: string(body)})
+	return nil
+}
+
+func (s *testSink) Close() error {
+	return nil
+}
+
+func (s *testSink) Deliveries() []testDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testDelivery(nil), s.deliveries...)
+}
+
+// newTestServer starts a server, returning its address.
+func newTestServer(t *testing.T, cfg *Config, sink *testSink) (Server, string) {
+	ing, err := ingest.NewClient(&ingest.Config{Sink: sink})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(ing.Close)
+
+	cfg.Ingest = ing
+	cfg.Hostname = "mx.example.com"
+	cfg.Timeout = 5 * time.Second
+
+	s, err := NewServer(cfg)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		assert.ErrorIs(t, <-done, ErrServerClosed)
+	})
+	return s, l.Addr().String()
+}
+
+func dial(t *testing.T, address string) *textproto.Conn {
+	conn, err := textproto.Dial("tcp", address)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	_, _, err = conn.ReadResponse(220)
+	assert.NoError(t, err)
+	return conn
+}
+
+// cmd sends a command, returning the code of the reply.
+func cmd(t *testing.T, conn *textproto.Conn, format string, args ...interface{}) int {
+	assert.NoError(t, conn.PrintfLine(format, args...))
+	return readCode(t, conn)
+}
+
+func readCode(t *testing.T, conn *textproto.Conn) int {
+	code, _, err := conn.ReadResponse(0)
+
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code
+	}
+
+	assert.NoError(t, err)
+	return code
+}
+
+func TestRoute(t *testing.T) {
+	s, err := NewServer(&Config{
+		Ingest: &testIngest{},
+		Routes: map[string]string{
+			"Alice@Example.com": "Alice",
+			"bob":               "Bob",
+			"@example.org":      "Org",
+		},
+		RejectUnknown: true,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	srv := s.(*server)
+
+	tests := []struct {
+		address string
+		mailbox string
+		ok      bool
+	}{
+		{"alice@example.com", "Alice", true},
+		{"alice@example.org", "Org", true},
+		{"bob@example.net", "Bob", true},
+		{"BOB@example.org", "Bob", true},
+		{"carol@example.com", "", false},
+	}
+
+	for _, test := range tests {
+		mailbox, ok := srv.route(test.address)
+		assert.Equal(t, test.ok, ok, test.address)
+		assert.Equal(t, test.mailbox, mailbox, test.address)
+	}
+
+	srv.cfg.DefaultMailbox = "INBOX"
+	srv.cfg.RejectUnknown = false
+	mailbox, ok := srv.route("carol@example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "INBOX", mailbox)
+}
+
+// testIngest is never used, it just satisfies NewServer.
+type testIngest struct {
+	ingest.Client
+}
+
+func TestSMTP(t *testing.T) {
+	sink := &testSink{}
+	_, address := newTestServer(t, &Config{
+		DefaultMailbox: "Inbox",
+		TLSConfig:      internal.BuildTestTLSConfig(t),
+		Users:          map[string]string{"user": "pass"},
+	}, sink)
+
+	client, err := smtp.NewSink(&smtp.Config{
+		Address:    address,
+		TLSConfig:  &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+		Auth:       sasl.NewPlainClient("", "user", "pass"),
+		From:       "sender@example.com",
+		Recipients: []string{"user@example.com"},
+		HELOName:   "client.example.com",
+		Timeout:    5 * time.Second,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer client.Close()
+
+	assert.NoError(t, client.Deliver("", nil, time.Time{}, []byte(testMessage)))
+
+	deliveries := sink.Deliveries()
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, "Inbox", deliveries[0].Mailbox)
+		assert.True(t, strings.HasPrefix(deliveries[0].Body, "Return-Path: <sender@example.com>\r\nReceived: from client.example.com ([127.0.0.1])\r\n"))
+		assert.Contains(t, deliveries[0].Body, "\tby mx.example.com with ESMTPSA\r\n\tfor <user@example.com>; ")
+		assert.True(t, strings.HasSuffix(deliveries[0].Body, testMessage))
+	}
+}
+
+func TestSMTPAuth(t *testing.T) {
+	_, address := newTestServer(t, &Config{
+		DefaultMailbox: "INBOX",
+		Users:          map[string]string{"user": "pass"},
+	}, &testSink{})
+
+	conn := dial(t, address)
+	assert.Equal(t, 250, cmd(t, conn, "EHLO client.example.com"))
+	assert.Equal(t, 530, cmd(t, conn, "MAIL FROM:<sender@example.com>"))
+	assert.Equal(t, 535, cmd(t, conn, "AUTH PLAIN AHVzZXIAd3Jvbmc="))
+	assert.Equal(t, 334, cmd(t, conn, "AUTH LOGIN"))
+	assert.Equal(t, 334, cmd(t, conn, "dXNlcg=="))
+	assert.Equal(t, 235, cmd(t, conn, "cGFzcw=="))
+	assert.Equal(t, 250, cmd(t, conn, "MAIL FROM:<sender@example.com>"))
+}
+
+func TestSMTPFailures(t *testing.T) {
+	sink := &testSink{errors: map[string]error{
+		"Busy":   errors.New("try again"),
+		"Broken": &delivery.PermanentError{Err: errors.New("no")},
+	}}
+	_, address := newTestServer(t, &Config{
+		Routes: map[string]string{
+			"user":   "Inbox",
+			"busy":   "Busy",
+			"broken": "Broken",
+		},
+		RejectUnknown:  true,
+		MaxMessageSize: 1024,
+	}, sink)
+
+	send := func(conn *textproto.Conn, body string, recipients ...string) int {
+		assert.Equal(t, 250, cmd(t, conn, "MAIL FROM:<sender@example.com>"))
+		for _, rcpt := range recipients {
+			assert.Equal(t, 250, cmd(t, conn, "RCPT TO:<%v>", rcpt))
+		}
+		assert.Equal(t, 354, cmd(t, conn, "DATA"))
+
+		w := conn.DotWriter()
+		_, _ = w.Write([]byte(body))
+		assert.NoError(t, w.Close())
+		return readCode(t, conn)
+	}
+
+	conn := dial(t, address)
+	assert.Equal(t, 503, cmd(t, conn, "MAIL FROM:<sender@example.com>"))
+	assert.Equal(t, 250, cmd(t, conn, "EHLO client.example.com"))
+	assert.Equal(t, 552, cmd(t, conn, "MAIL FROM:<sender@example.com> SIZE=2048"))
+
+	assert.Equal(t, 250, cmd(t, conn, "MAIL FROM:<sender@example.com>"))
+	assert.Equal(t, 550, cmd(t, conn, "RCPT TO:<unknown@example.com>"))
+	assert.Equal(t, 503, cmd(t, conn, "DATA"))
+	assert.Equal(t, 250, cmd(t, conn, "RSET"))
+
+	assert.Equal(t, 250, send(conn, testMessage, "user@example.com", "user@example.org"))
+	assert.Equal(t, 552, send(conn, strings.Repeat("x", 2048), "user@example.com"))
+	assert.Equal(t, 500, send(conn, strings.Repeat("x", maxLineLength+1), "user@example.com"))
+	assert.Equal(t, 500, cmd(t, conn, "NOOP %v", strings.Repeat("x", maxLineLength)))
+	assert.Equal(t, 250, cmd(t, conn, "NOOP"))
+	assert.Equal(t, 554, send(conn, testMessage, "broken@example.com"))
+	assert.Equal(t, 451, send(conn, testMessage, "broken@example.com", "busy@example.com"))
+	assert.Equal(t, 221, cmd(t, conn, "QUIT"))
+
+	// Both recipients route to the same mailbox, so it's only delivered once.
+	deliveries := sink.Deliveries()
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, "Inbox", deliveries[0].Mailbox)
+		assert.NotContains(t, deliveries[0].Body, "\tfor <")
+	}
+}
+
+func TestReplyFor(t *testing.T) {
+	codes := []struct {
+		err  error
+		code int
+	}{
+		{nil, 250},
+		{ingest.ErrTimeout, 451},
+		{errors.New("try again"), 451},
+		{&delivery.PermanentError{Err: ingest.ErrMessageTooLarge}, 552},
+		{&delivery.PermanentError{Err: errors.New("no")}, 554},
+	}
+
+	for _, c := range codes {
+		code, _ := replyFor(c.err)
+		assert.Equal(t, c.code, code, "%v", c.err)
+	}
+}
+
+func TestLMTP(t *testing.T) {
+	sink := &testSink{errors: map[string]error{
+		"Busy": errors.New("try again"),
+	}}
+	_, address := newTestServer(t, &Config{
+		Protocol: ProtocolLMTP,
+		Routes: map[string]string{
+			"alice": "Alice",
+			"bob":   "Bob",
+			"busy":  "Busy",
+		},
+	}, sink)
+
+	conn := dial(t, address)
+	assert.Equal(t, 500, cmd(t, conn, "EHLO client.example.com"))
+	assert.Equal(t, 250, cmd(t, conn, "LHLO client.example.com"))
+	assert.Equal(t, 250, cmd(t, conn, "MAIL FROM:<>"))
+	assert.Equal(t, 250, cmd(t, conn, "RCPT TO:<alice@example.com>"))
+	assert.Equal(t, 250, cmd(t, conn, "RCPT TO:<busy@example.com>"))
+	assert.Equal(t, 250, cmd(t, conn, "RCPT TO:<bob@example.com>"))
+	assert.Equal(t, 354, cmd(t, conn, "DATA"))
+
+	w := conn.DotWriter()
+	_, _ = w.Write([]byte(testMessage))
+	assert.NoError(t, w.Close())
+
+	assert.Equal(t, 250, readCode(t, conn))
+	assert.Equal(t, 451, readCode(t, conn))
+	assert.Equal(t, 250, readCode(t, conn))
+
+	deliveries := sink.Deliveries()
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, "Alice", deliveries[0].Mailbox)
+		assert.Equal(t, "Bob", deliveries[1].Mailbox)
+		assert.True(t, strings.HasPrefix(deliveries[0].Body, "Return-Path: <>\r\n"))
+		assert.Contains(t, deliveries[0].Body, "\tby mx.example.com with LMTP; ")
+	}
+}
+
+func TestClose(t *testing.T) {
+	s, address := newTestServer(t, &Config{DefaultMailbox: "INBOX"}, &testSink{})
+
+	conn := dial(t, address)
+	assert.Equal(t, 250, cmd(t, conn, "EHLO client.example.com"))
+
+	assert.NoError(t, s.Close())
+	assert.Equal(t, 421, readCode(t, conn))
+}
@@ -0,0 +1,142 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package smtpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+var (
+	ErrInvalidProtocol = errors.New("invalid protocol")
+	ErrNoIngest        = errors.New("no ingest client")
+	ErrServerClosed    = errors.New("server closed")
+)
+
+type Protocol string
+
+const (
+	ProtocolSMTP Protocol = "smtp"
+	ProtocolLMTP Protocol = "lmtp"
+)
+
+type Config struct {
+	// Protocol is either "smtp" or "lmtp". Defaults to "smtp".
+	Protocol Protocol
+
+	// Hostname is the name to greet clients with. Defaults to the hostname.
+	Hostname string
+
+	// Ingest is where accepted messages are delivered.
+	Ingest ingest.Client
+
+	// Source is the name passed to the destination as the source of each
+	// message. Defaults to the protocol.
+	Source string
+
+	// Routes maps recipients to mailboxes. Keys are a full address, a local
+	// part ("user"), or a domain ("@example.com"), and are matched
+	// case-insensitively in that order.
+	Routes map[string]string
+
+	// DefaultMailbox is the mailbox for recipients without a route. If empty,
+	// the destination's default is used.
+	DefaultMailbox string
+
+	// RejectUnknown, if set, rejects recipients without a route instead.
+	RejectUnknown bool
+
+	// TLSConfig, if set, enables STARTTLS. AUTH is then only offered once
+	// the connection is encrypted.
+	TLSConfig *tls.Config
+
+	// Users, if set, maps usernames to passwords. Clients must then AUTH
+	// before sending mail.
+	Users map[string]string
+
+	// MaxMessageSize is the largest message accepted, in bytes. 0 for no limit.
+	MaxMessageSize int64
+
+	// MaxRecipients is the most recipients accepted per message. Defaults to 100.
+	MaxRecipients int
+
+	// Timeout is how long to wait for each command from the client.
+	// Defaults to 5 minutes.
+	Timeout time.Duration
+
+	Logger *log.Entry
+}
+
+// Server accepts mail over SMTP or LMTP and ingests it. A message is only
+// accepted once it's been delivered to every mailbox it's routed to.
+type Server interface {
+	// Serve accepts connections on l until Close is called.
+	Serve(l net.Listener) error
+
+	// Close stops accepting connections, waiting for any transactions in
+	// progress to finish.
+	Close() error
+}
+
+type server struct {
+	cfg    Config
+	uid    uint32
+	routes map[string]string
+
+	// closed is only set with mu held, but may be read without it.
+	closed atomic.Bool
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	sessions  map[*session]struct{}
+	wg        sync.WaitGroup
+}
+
+type recipient struct {
+	Address string
+	Mailbox string
+}
+
+type session struct {
+	server  *server
+	netConn net.Conn
+	conn    *textproto.Conn
+	logger  *log.Entry
+
+	helo          string
+	extended      bool
+	tls           bool
+	authenticated bool
+
+	from       string
+	hasFrom    bool
+	recipients []recipient
+
+	// mu guards idle, which is set while waiting for a command.
+	mu   sync.Mutex
+	idle bool
+}
@@ -0,0 +1,92 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package verify
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// Entry describes a single message in a mailbox.
+type Entry struct {
+	UID uint32 `json:"uid"`
+
+	// MessageID is the Message-ID, without the angle brackets. Messages
+	// without one are matched by their date and subject instead.
+	MessageID string `json:"message_id"`
+	Size      uint32 `json:"size"`
+
+	// Date is from the Date header, or the internal date if there isn't one.
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+}
+
+// Mismatch is a message on both sides with different sizes.
+type Mismatch struct {
+	MessageID  string `json:"message_id"`
+	SourceUID  uint32 `json:"source_uid"`
+	SourceSize uint32 `json:"source_size"`
+	DestUID    uint32 `json:"dest_uid"`
+	DestSize   uint32 `json:"dest_size"`
+}
+
+// Report is the result of comparing two mailboxes.
+type Report struct {
+	Source      string `json:"source"`
+	Dest        string `json:"dest"`
+	SourceCount int    `json:"source_count"`
+	DestCount   int    `json:"dest_count"`
+
+	// MissingFromDest are the source messages without a copy in the dest.
+	MissingFromDest []Entry `json:"missing_from_dest"`
+
+	// MissingFromSource are the dest messages without a copy in the source.
+	MissingFromSource []Entry `json:"missing_from_source"`
+
+	SizeMismatches []Mismatch `json:"size_mismatches"`
+
+	// Repumped is the number of messages missing from the dest that were
+	// copied again.
+	Repumped int `json:"repumped"`
+}
+
+type RepumpConfig struct {
+	// Client is connected to the source.
+	Client imap2.Client
+
+	// Mailbox is the source mailbox. It's opened read-only.
+	Mailbox string
+
+	// UIDs are the messages to copy.
+	UIDs []uint32
+
+	// Ingest is the destination.
+	Ingest ingest.Client
+
+	// TargetMailbox is the mailbox to write to.
+	TargetMailbox string
+
+	// Source is passed to the destination as the source of each message.
+	Source string
+
+	Logger *log.Entry
+}
@@ -0,0 +1,226 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package verify
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	log "github.com/sirupsen/logrus"
+	imap2 "git.vs49688.net/zane/mailpump/imap"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// List describes every message in a mailbox, ordered by UID. The mailbox is
+// opened read-only.
+func List(client imap2.Client, mailbox string) ([]Entry, error) {
+	msgs, err := Messages(client, mailbox)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for _, msg := range msgs {
+		entries = append(entries, NewEntry(msg))
+	}
+
+	return entries, nil
+}
+
+// Messages fetches the UID, size, internal date and envelope of every message
+// in a mailbox, ordered by UID. The mailbox is opened read-only.
+func Messages(client imap2.Client, mailbox string) ([]*imap.Message, error) {
+	status, err := client.Select(mailbox, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if status.Messages == 0 {
+		return nil, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+
+	ch := make(chan *imap.Message, 100)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Fetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchRFC822Size, imap.FetchInternalDate, imap.FetchEnvelope}, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+	return msgs, nil
+}
+
+// NewEntry describes a message fetched by Messages.
+func NewEntry(msg *imap.Message) Entry {
+	entry := Entry{
+		UID:  msg.Uid,
+		Size: msg.Size,
+		Date: msg.InternalDate,
+	}
+
+	if msg.Envelope != nil {
+		entry.MessageID = strings.Trim(strings.TrimSpace(msg.Envelope.MessageId), "<>")
+		entry.Subject = msg.Envelope.Subject
+		if !msg.Envelope.Date.IsZero() {
+			entry.Date = msg.Envelope.Date
+		}
+	}
+
+	return entry
+}
+
+// key is what's used to match messages.
+func (e *Entry) key() string {
+	if e.MessageID != "" {
+		return e.MessageID
+	}
+
+	return "\x00" + e.Date.UTC().Format(time.RFC3339) + "\x00" + e.Subject
+}
+
+// Compare matches the messages in two mailboxes by their Message-ID. A
+// Message-ID seen more than once is matched as many times as it's on both
+// sides, and the rest are missing.
+func Compare(source []Entry, dest []Entry) *Report {
+	report := &Report{
+		SourceCount:       len(source),
+		DestCount:         len(dest),
+		MissingFromDest:   []Entry{},
+		MissingFromSource: []Entry{},
+		SizeMismatches:    []Mismatch{},
+	}
+
+	unmatched := map[string][]Entry{}
+	for _, e := range dest {
+		unmatched[e.key()] = append(unmatched[e.key()], e)
+	}
+
+	for _, e := range source {
+		k := e.key()
+		candidates := unmatched[k]
+		if len(candidates) == 0 {
+			report.MissingFromDest = append(report.MissingFromDest, e)
+			continue
+		}
+
+		// Prefer a copy of the same size, so duplicates don't cause mismatches
+		match := 0
+		for i, c := range candidates {
+			if c.Size == e.Size {
+				match = i
+				break
+			}
+		}
+
+		d := candidates[match]
+		unmatched[k] = append(candidates[:match:match], candidates[match+1:]...)
+
+		if d.Size != e.Size {
+			report.SizeMismatches = append(report.SizeMismatches, Mismatch{
+				MessageID:  e.MessageID,
+				SourceUID:  e.UID,
+				SourceSize: e.Size,
+				DestUID:    d.UID,
+				DestSize:   d.Size,
+			})
+		}
+	}
+
+	for _, e := range dest {
+		for _, u := range unmatched[e.key()] {
+			if u.UID == e.UID {
+				report.MissingFromSource = append(report.MissingFromSource, e)
+				break
+			}
+		}
+	}
+
+	return report
+}
+
+// Differences is the number of messages that don't agree.
+func (r *Report) Differences() int {
+	return len(r.MissingFromDest) - r.Repumped + len(r.MissingFromSource) + len(r.SizeMismatches)
+}
+
+// Repump copies messages from the source to the destination, returning the
+// number copied. It stops at the first failure.
+func Repump(cfg *RepumpConfig) (int, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.NewEntry(log.StandardLogger())
+	}
+
+	if len(cfg.UIDs) == 0 {
+		return 0, nil
+	}
+
+	if _, err := cfg.Client.Select(cfg.Mailbox, true); err != nil {
+		return 0, err
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(cfg.UIDs...)
+
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, section.FetchItem()}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- cfg.Client.UidFetch(seqset, items, ch)
+	}()
+
+	var msgs []*imap.Message
+	for msg := range ch {
+		msgs = append(msgs, msg)
+	}
+
+	if err := <-done; err != nil {
+		return 0, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+
+	repumped := 0
+	for _, msg := range msgs {
+		if err := ingest.IngestCopySync(cfg.Source, cfg.TargetMailbox, cfg.Ingest, msg, 0); err != nil {
+			logger.WithError(err).WithField("uid", msg.Uid).Error("repump_failed")
+			return repumped, err
+		}
+
+		logger.WithField("uid", msg.Uid).Info("repumped")
+		repumped++
+	}
+
+	return repumped, nil
+}
@@ -0,0 +1,134 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package verify
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/imap/client"
+	"git.vs49688.net/zane/mailpump/ingest"
+	"git.vs49688.net/zane/mailpump/internal"
+	"git.vs49688.net/zane/mailpump/internal/imaptest"
+)
+
+func TestCompare(t *testing.T) {
+	date := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	source := []Entry{
+		{UID: 1, MessageID: "a@example.com", Size: 100},
+		{UID: 2, MessageID: "b@example.com", Size: 200},
+		{UID: 3, MessageID: "c@example.com", Size: 300},
+		{UID: 4, MessageID: "dup@example.com", Size: 400},
+		{UID: 5, MessageID: "dup@example.com", Size: 400},
+		{UID: 6, Subject: "no id", Date: date, Size: 600},
+	}
+
+	dest := []Entry{
+		{UID: 10, MessageID: "a@example.com", Size: 100},
+		{UID: 11, MessageID: "c@example.com", Size: 310},
+		{UID: 12, MessageID: "dup@example.com", Size: 400},
+		{UID: 13, MessageID: "d@example.com", Size: 500},
+		{UID: 14, Subject: "no id", Date: date, Size: 600},
+		{UID: 15, Subject: "no id", Date: date.Add(time.Hour), Size: 600},
+	}
+
+	report := Compare(source, dest)
+	assert.Equal(t, 6, report.SourceCount)
+	assert.Equal(t, 6, report.DestCount)
+	assert.Equal(t, []Entry{source[1], source[4]}, report.MissingFromDest)
+	assert.Equal(t, []Entry{dest[3], dest[5]}, report.MissingFromSource)
+	assert.Equal(t, []Mismatch{{
+		MessageID:  "c@example.com",
+		SourceUID:  3,
+		SourceSize: 300,
+		DestUID:    11,
+		DestSize:   310,
+	}}, report.SizeMismatches)
+	assert.Equal(t, 5, report.Differences())
+
+	report = Compare(source, source)
+	assert.Equal(t, 0, report.Differences())
+}
+
+func TestRepump(t *testing.T) {
+	_, srcAddr, _ := internal.BuildTestIMAPServer(t)
+	_, dstAddr, _ := internal.BuildTestIMAPServer(t)
+
+	src := imaptest.Connect(t, srcAddr)
+	dst := imaptest.Connect(t, dstAddr)
+
+	date := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, id := range []string{"one", "two", "three"} {
+		body := "Message-ID: <" + id + "@example.com>\r\nSubject: " + id + "\r\n\r\nbody\r\n"
+		assert.NoError(t, src.Append("INBOX", []string{"\\Seen"}, date, bytes.NewBufferString(body)))
+		if id != "two" {
+			assert.NoError(t, dst.Append("INBOX", nil, date, bytes.NewBufferString(body)))
+		}
+	}
+
+	source, err := List(src, "INBOX")
+	assert.NoError(t, err)
+	if assert.Len(t, source, 3) {
+		assert.Equal(t, Entry{UID: 1, MessageID: "one@example.com", Size: source[0].Size, Date: source[0].Date, Subject: "one"}, source[0])
+	}
+
+	dest, err := List(dst, "INBOX")
+	assert.NoError(t, err)
+
+	report := Compare(source, dest)
+	if !assert.Len(t, report.MissingFromDest, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, "two@example.com", report.MissingFromDest[0].MessageID)
+
+	ing, err := ingest.NewClient(&ingest.Config{ConnectionConfig: imaptest.ConnectionConfig(dstAddr), Factory: client.Factory{}})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer ing.Close()
+
+	n, err := Repump(&RepumpConfig{
+		Client:        src,
+		Mailbox:       "INBOX",
+		UIDs:          []uint32{report.MissingFromDest[0].UID},
+		Ingest:        ing,
+		TargetMailbox: "INBOX",
+		Source:        "test",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	dest, err = List(dst, "INBOX")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, Compare(source, dest).Differences())
+}
+
+func TestListEmpty(t *testing.T) {
+	_, addr, _ := internal.BuildTestIMAPServer(t)
+
+	entries, err := List(imaptest.Connect(t, addr), "INBOX")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = List(imaptest.Connect(t, addr), "Missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,169 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package webhook
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	log "github.com/sirupsen/logrus"
+	"git.vs49688.net/zane/mailpump/delivery"
+	"git.vs49688.net/zane/mailpump/ingest"
+)
+
+// NewSink creates an ingest.Sink that POSTs each message to a URL.
+func NewSink(cfg *Config) (ingest.Sink, error) {
+	s := &sink{cfg: *cfg}
+
+	switch s.cfg.Format {
+	case "":
+		s.cfg.Format = FormatRaw
+	case FormatRaw, FormatJSON:
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	if s.cfg.Timeout == 0 {
+		s.cfg.Timeout = 30 * time.Second
+	}
+
+	s.client = &http.Client{Timeout: s.cfg.Timeout}
+	return s, nil
+}
+
+// Sign calculates the signature of a request body.
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEnvelope(mailbox string, flags []string, date time.Time, body []byte) *Envelope {
+	env := &Envelope{
+		Mailbox: mailbox,
+		Flags:   flags,
+		Date:    date,
+		Size:    len(body),
+		Message: body,
+	}
+
+	if env.Flags == nil {
+		env.Flags = []string{}
+	}
+
+	hdr, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(body)))
+	if err == nil {
+		env.MessageID = strings.Trim(strings.TrimSpace(hdr.Get("Message-Id")), "<>")
+		env.From = hdr.Get("From")
+		env.Subject = hdr.Get("Subject")
+	}
+
+	return env
+}
+
+func (s *sink) newRequest(mailbox string, flags []string, date time.Time, body []byte) (*http.Request, error) {
+	var payload []byte
+	var contentType string
+
+	if s.cfg.Format == FormatJSON {
+		var err error
+		if payload, err = json.Marshal(newEnvelope(mailbox, flags, date, body)); err != nil {
+			return nil, err
+		}
+		contentType = "application/json"
+	} else {
+		payload = body
+		contentType = "message/rfc822"
+	}
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, s.cfg.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range s.cfg.Headers {
+		req.Header[k] = v
+	}
+
+	req.Header.Set("Content-Type", contentType)
+
+	if s.cfg.Format == FormatRaw {
+		req.Header.Set(HeaderMailbox, mailbox)
+		req.Header.Set(HeaderFlags, strings.Join(flags, " "))
+		if !date.IsZero() {
+			req.Header.Set(HeaderDate, date.Format(time.RFC3339))
+		}
+	}
+
+	if len(s.cfg.Secret) > 0 {
+		req.Header.Set(HeaderSignature, Sign(s.cfg.Secret, payload))
+	}
+
+	return req, nil
+}
+
+func (s *sink) Deliver(mailbox string, flags []string, date time.Time, body []byte) error {
+	req, err := s.newRequest(mailbox, flags, date, body)
+	if err != nil {
+		return &delivery.PermanentError{Err: err}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// Drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+
+	e := log.WithFields(log.Fields{
+		"mailbox": mailbox,
+		"status":  resp.StatusCode,
+	})
+
+	if resp.StatusCode/100 == 2 {
+		e.Trace("webhook_delivered")
+		return nil
+	}
+
+	serr := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	e.Warn("webhook_rejected")
+
+	if serr.Temporary() {
+		return serr
+	}
+
+	return &delivery.PermanentError{Err: serr}
+}
+
+func (s *sink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var ErrInvalidFormat = errors.New("invalid webhook format")
+
+type Format string
+
+const (
+	// FormatRaw posts the raw RFC822 message, with the metadata in headers.
+	FormatRaw Format = "raw"
+
+	// FormatJSON posts a JSON envelope, with the message base64-encoded.
+	FormatJSON Format = "json"
+)
+
+const (
+	HeaderMailbox   = "X-Mailpump-Mailbox"
+	HeaderFlags     = "X-Mailpump-Flags"
+	HeaderDate      = "X-Mailpump-Date"
+	HeaderSignature = "X-Mailpump-Signature"
+)
+
+type Config struct {
+	URL    string
+	Format Format
+
+	// Secret, if set, is used to sign each request with HMAC-SHA256. The signature
+	// is sent in the X-Mailpump-Signature header, as "sha256=<hex>".
+	Secret []byte
+
+	// Headers are added to each request.
+	Headers http.Header
+
+	// Timeout is the timeout for each request.
+	Timeout time.Duration
+}
+
+// Envelope is the request body when using FormatJSON.
+type Envelope struct {
+	Mailbox   string    `json:"mailbox"`
+	Flags     []string  `json:"flags"`
+	Date      time.Time `json:"date"`
+	Size      int       `json:"size"`
+	MessageID string    `json:"message_id,omitempty"`
+	From      string    `json:"from,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+
+	// Message is the raw message. It is base64-encoded when marshalled.
+	Message []byte `json:"message"`
+}
+
+// StatusError is returned when the server replies with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("webhook failed: %v", e.Status)
+}
+
+// Temporary checks if the request should be retried.
+func (e *StatusError) Temporary() bool {
+	switch {
+	case e.StatusCode == http.StatusRequestTimeout:
+		return true
+	case e.StatusCode == http.StatusTooManyRequests:
+		return true
+	case e.StatusCode >= 500:
+		return true
+	}
+	return false
+}
+
+type sink struct {
+	cfg    Config
+	client *http.Client
+}
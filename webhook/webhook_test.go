@@ -0,0 +1,140 @@
+/*
+ * MailPump - Copyright (C) 2022 Zane van Iperen.
+ *    Contact: zane@zanevaniperen.com
+ *
+ * This program is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 2, and only
+ * version 2 as published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 59 Temple Place, Suite 330, Boston, MA  02111-1307  USA
+ */
+
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"git.vs49688.net/zane/mailpump/delivery"
+)
+
+const testMessage = "Message-ID: <01@example.com>\r\n" +
+	"From: sender@example.com\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello\r\n"
+
+var testDate = time.Date(2022, 5, 11, 14, 31, 59, 0, time.UTC)
+
+type capturedRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+func newTestServer(t *testing.T, status int) (*httptest.Server, chan capturedRequest) {
+	ch := make(chan capturedRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ch <- capturedRequest{Header: r.Header, Body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, ch
+}
+
+func TestRaw(t *testing.T) {
+	srv, ch := newTestServer(t, http.StatusNoContent)
+
+	sink, err := NewSink(&Config{
+		URL:     srv.URL,
+		Secret:  []byte("secret"),
+		Headers: http.Header{"Authorization": {"Bearer token"}},
+	})
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	assert.NoError(t, sink.Deliver("INBOX", []string{"\\Seen", "$Label1"}, testDate, []byte(testMessage)))
+
+	req := <-ch
+	assert.Equal(t, testMessage, string(req.Body))
+	assert.Equal(t, "message/rfc822", req.Header.Get("Content-Type"))
+	assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	assert.Equal(t, "INBOX", req.Header.Get(HeaderMailbox))
+	assert.Equal(t, "\\Seen $Label1", req.Header.Get(HeaderFlags))
+	assert.Equal(t, "2022-05-11T14:31:59Z", req.Header.Get(HeaderDate))
+	assert.Equal(t, Sign([]byte("secret"), []byte(testMessage)), req.Header.Get(HeaderSignature))
+}
+
+func TestJSON(t *testing.T) {
+	srv, ch := newTestServer(t, http.StatusOK)
+
+	sink, err := NewSink(&Config{URL: srv.URL, Format: FormatJSON})
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	assert.NoError(t, sink.Deliver("Archive", nil, testDate, []byte(testMessage)))
+
+	req := <-ch
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Empty(t, req.Header.Get(HeaderSignature))
+
+	var env Envelope
+	assert.NoError(t, json.Unmarshal(req.Body, &env))
+	assert.Equal(t, Envelope{
+		Mailbox:   "Archive",
+		Flags:     []string{},
+		Date:      testDate,
+		Size:      len(testMessage),
+		MessageID: "01@example.com",
+		From:      "sender@example.com",
+		Subject:   "Test",
+		Message:   []byte(testMessage),
+	}, env)
+}
+
+func TestStatus(t *testing.T) {
+	tests := map[int]bool{
+		http.StatusBadRequest:          true,
+		http.StatusForbidden:           true,
+		http.StatusRequestTimeout:      false,
+		http.StatusTooManyRequests:     false,
+		http.StatusInternalServerError: false,
+		http.StatusServiceUnavailable:  false,
+	}
+
+	for status, permanent := range tests {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			srv, ch := newTestServer(t, status)
+
+			sink, err := NewSink(&Config{URL: srv.URL})
+			assert.NoError(t, err)
+			defer sink.Close()
+
+			err = sink.Deliver("INBOX", nil, testDate, []byte(testMessage))
+			<-ch
+
+			var serr *StatusError
+			if assert.ErrorAs(t, err, &serr) {
+				assert.Equal(t, status, serr.StatusCode)
+			}
+			assert.Equal(t, permanent, delivery.IsPermanent(err))
+		})
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	_, err := NewSink(&Config{URL: "http://localhost", Format: "xml"})
+	assert.ErrorIs(t, err, ErrInvalidFormat)
+}